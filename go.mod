@@ -3,6 +3,8 @@ module trollibox
 require (
 	github.com/fhs/gompd/v2 v2.3.0
 	github.com/go-chi/chi/v5 v5.2.2
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/gorilla/websocket v1.5.3
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,131 @@
+// Package composed implements a filter that combines other filters that are
+// stored in a filter.DB by referring to them by name.
+package composed
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"trollibox/src/filter"
+	"trollibox/src/library"
+)
+
+func init() {
+	filter.RegisterFactory(func() filter.Filter {
+		return &ComposedFilter{}
+	})
+}
+
+// A ComposedFilter passes tracks that pass all included filters and none of
+// the excluded filters. If no filters are included, all tracks that are not
+// excluded pass. The weight of a track is the product of its weights in the
+// included filters.
+//
+// The filter must be resolved before use, see filter.ReferencingFilter.
+type ComposedFilter struct {
+	// Names of the filters that tracks must pass.
+	Include []string
+	// Names of the filters that tracks must not pass.
+	Exclude []string
+
+	lock     sync.RWMutex
+	include  []filter.Filter
+	exclude  []filter.Filter
+	resolved bool
+}
+
+// References implements the filter.ReferencingFilter interface.
+func (ft *ComposedFilter) References() []string {
+	refs := make([]string, 0, len(ft.Include)+len(ft.Exclude))
+	refs = append(refs, ft.Include...)
+	return append(refs, ft.Exclude...)
+}
+
+// Resolve implements the filter.ReferencingFilter interface.
+func (ft *ComposedFilter) Resolve(db *filter.DB) error {
+	lookup := func(names []string) ([]filter.Filter, error) {
+		filters := make([]filter.Filter, len(names))
+		for i, name := range names {
+			f, err := db.Get(name)
+			if err != nil {
+				return nil, fmt.Errorf("could not resolve filter %q: %w", name, err)
+			}
+			filters[i] = f
+		}
+		return filters, nil
+	}
+	include, err := lookup(ft.Include)
+	if err != nil {
+		return err
+	}
+	exclude, err := lookup(ft.Exclude)
+	if err != nil {
+		return err
+	}
+
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.include, ft.exclude, ft.resolved = include, exclude, true
+	return nil
+}
+
+// Filter implements the filter.Filter interface.
+func (ft *ComposedFilter) Filter(track library.Track) (filter.SearchResult, bool) {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	if !ft.resolved {
+		return filter.SearchResult{}, false
+	}
+
+	for _, f := range ft.exclude {
+		if _, ok := f.Filter(track); ok {
+			return filter.SearchResult{}, false
+		}
+	}
+	result := filter.SearchResult{Track: track, Weight: 1}
+	for _, f := range ft.include {
+		res, ok := f.Filter(track)
+		if !ok {
+			return filter.SearchResult{}, false
+		}
+		result.Weight *= res.RandomWeight()
+		for property, matches := range res.Matches {
+			result.AddMatches(property, matches...)
+		}
+	}
+	return result, true
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (ft *ComposedFilter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Include []string `json:"include"`
+		Exclude []string `json:"exclude"`
+		Type    string   `json:"type"`
+	}{
+		Include: nonNil(ft.Include),
+		Exclude: nonNil(ft.Exclude),
+		Type:    "composed",
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (ft *ComposedFilter) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Include []string `json:"include"`
+		Exclude []string `json:"exclude"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	ft.Include, ft.Exclude = raw.Include, raw.Exclude
+	return nil
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package composed
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"trollibox/src/filter"
+	"trollibox/src/filter/ruled"
+	"trollibox/src/library"
+)
+
+func TestComposedFilter(t *testing.T) {
+	db, err := filter.NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(name string, rules ...ruled.Rule) {
+		t.Helper()
+		ft, err := ruled.BuildFilter(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set(name, ft); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("long", ruled.Rule{Attribute: "duration", Operation: ruled.Greater, Value: 60.0})
+	set("christmas", ruled.Rule{Attribute: "genre", Operation: ruled.Equals, Value: "christmas"})
+	set("jazz", ruled.Rule{Attribute: "genre", Operation: ruled.Contains, Value: "jazz"})
+
+	ft := &ComposedFilter{Include: []string{"long"}, Exclude: []string{"christmas"}}
+	if _, ok := ft.Filter(library.Track{Duration: time.Minute * 3}); ok {
+		t.Fatalf("An unresolved filter should not pass tracks")
+	}
+	if err := db.Set("base", ft); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("base-jazz", &ComposedFilter{Include: []string{"base", "jazz"}}); err != nil {
+		t.Fatal(err)
+	}
+	baseJazz, err := db.Get("base-jazz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		track  library.Track
+		base   bool
+		jazz   bool
+		reason string
+	}{
+		{library.Track{Genre: "Jazz", Duration: time.Minute * 5}, true, true, "long jazz"},
+		{library.Track{Genre: "Rock", Duration: time.Minute * 5}, true, false, "long rock"},
+		{library.Track{Genre: "Jazz", Duration: time.Second * 30}, false, false, "short jazz"},
+		{library.Track{Genre: "Christmas", Duration: time.Minute * 5}, false, false, "christmas"},
+	}
+	for _, tc := range tt {
+		if _, ok := ft.Filter(tc.track); ok != tc.base {
+			t.Fatalf("Unexpected result of base for %s: exp %v, got %v", tc.reason, tc.base, ok)
+		}
+		if _, ok := baseJazz.Filter(tc.track); ok != tc.jazz {
+			t.Fatalf("Unexpected result of base-jazz for %s: exp %v, got %v", tc.reason, tc.jazz, ok)
+		}
+	}
+
+	// Updating a referenced filter should be reflected.
+	set("long", ruled.Rule{Attribute: "duration", Operation: ruled.Greater, Value: 10.0})
+	if _, ok := ft.Filter(library.Track{Genre: "Jazz", Duration: time.Second * 30}); !ok {
+		t.Fatalf("The updated referenced filter was not used")
+	}
+
+	// The weights of the included filters are multiplied.
+	set("jazz", ruled.Rule{Attribute: "genre", Operation: ruled.Contains, Value: "jazz", Boost: 3})
+	set("long", ruled.Rule{Attribute: "duration", Operation: ruled.Greater, Value: 10.0, Boost: 2})
+	if res, _ := baseJazz.Filter(library.Track{Genre: "Jazz", Duration: time.Minute}); res.Weight != 6 {
+		t.Fatalf("Unexpected weight: %v", res.Weight)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	ft := &ComposedFilter{Include: []string{"foo"}}
+	data, err := json.Marshal(ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"include":["foo"],"exclude":[],"type":"composed"}` {
+		t.Fatalf("Unexpected JSON: %s", data)
+	}
+	loaded, err := filter.UnmarshalJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := loaded.(*ComposedFilter).References(); len(refs) != 1 || refs[0] != "foo" {
+		t.Fatalf("Unexpected references: %v", refs)
+	}
+}
@@ -14,7 +14,17 @@ import (
 	"trollibox/src/util"
 )
 
-var ErrNotFound = errors.New("filter not found")
+var (
+	ErrNotFound = errors.New("filter not found")
+
+	// ErrReferenceCycle is returned when storing a filter that would refer to
+	// itself through other filters.
+	ErrReferenceCycle = errors.New("filter reference cycle")
+
+	// ErrReferenced is returned when removing a filter that is referenced by
+	// another filter.
+	ErrReferenced = errors.New("filter is referenced by another filter")
+)
 
 // A ListEvent is emitted when a filter is removed or added.
 type ListEvent struct {
@@ -27,6 +37,20 @@ type UpdateEvent struct {
 	Filter Filter
 }
 
+// A ReferencingFilter is a Filter that is composed of other filters which are
+// stored in a DB.
+type ReferencingFilter interface {
+	Filter
+
+	// References returns the names of the filters that are referred to.
+	References() []string
+
+	// Resolve looks up the referenced filters in the database. It is called
+	// by the database before the filter is returned or stored and when any of
+	// the referenced filters is updated.
+	Resolve(db *DB) error
+}
+
 var factories = map[string]func() Filter{}
 
 // RegisterFactory registers a factory function that enables DB to deserialize
@@ -111,6 +135,23 @@ outer:
 // An error is returned if the database is not able to instantiate the filter,
 // which could be caused by a missing factory.
 func (db *DB) Get(name string) (Filter, error) {
+	filter, err := db.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if rf, ok := filter.(ReferencingFilter); ok {
+		if err := db.checkReferences(name, rf); err != nil {
+			return nil, err
+		}
+		if err := rf.Resolve(db); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// load retrieves a filter without resolving its references.
+func (db *DB) load(name string) (Filter, error) {
 	if f, ok := db.cache.Load(name); ok {
 		return f.(Filter), nil
 	}
@@ -126,43 +167,65 @@ func (db *DB) Get(name string) (Filter, error) {
 
 // Set stores the specified filter under the specified name overwriting any
 // pre-existing filter with the same name.
+//
+// Filters that refer to other filters must not refer to themselves, not even
+// through other filters. Filters referring to the stored filter are resolved
+// again and an UpdateEvent is emitted for each of them.
 func (db *DB) Set(name string, filter Filter) error {
 	if name == "" || strings.Contains(name, "/") {
 		return fmt.Errorf("invalid filter name: %q", name)
 	}
-
-	db.cache.Store(name, filter)
-
-	filename := db.filterFile(name)
-	// Emit a ListEvent if the target file does not exist yet.
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		names, err := db.Names()
-		if err != nil {
-			db.cache.Delete(name)
+	if rf, ok := filter.(ReferencingFilter); ok {
+		if err := db.checkReferences(name, rf); err != nil {
+			return err
+		}
+		if err := rf.Resolve(db); err != nil {
 			return err
 		}
-		defer db.Emit(ListEvent{Names: names})
 	}
 
-	defer db.Emit(UpdateEvent{Name: name, Filter: filter})
+	filename := db.filterFile(name)
+	// Emit a ListEvent if the target file does not exist yet.
+	_, err := os.Stat(filename)
+	isNew := os.IsNotExist(err)
 
+	// Until the filter is written, the previous version remains in effect.
 	fd, err := os.Create(filename)
 	if err != nil {
-		slog.Error("Could not create filter db file", "error", err, "path", filename)
-		return nil
+		return fmt.Errorf("could not create filter db file: %w", err)
 	}
 	defer fd.Close()
 	if err := json.NewEncoder(fd).Encode(filter); err != nil {
-		slog.Error("Could not read filter db", "error", err)
-		return nil
+		db.cache.Delete(name)
+		return fmt.Errorf("could not write filter db file: %w", err)
+	}
+	db.cache.Store(name, filter)
+
+	db.Emit(UpdateEvent{Name: name, Filter: filter})
+	if isNew {
+		names, err := db.Names()
+		if err != nil {
+			return err
+		}
+		db.Emit(ListEvent{Names: names})
 	}
+	db.updateDependents(name)
 	return nil
 }
 
 // Remove removes the named filter from the database.
 //
-// Removing a non-existent filter is a no-op.
+// Removing a non-existent filter is a no-op. Filters that are referenced by
+// other filters can not be removed.
 func (db *DB) Remove(name string) error {
+	dependents, err := db.dependents(name)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("%w: %q is used by %s", ErrReferenced, name, strings.Join(dependents, ", "))
+	}
+
 	db.cache.Delete(name)
 	if err := os.Remove(db.filterFile(name)); os.IsNotExist(err) {
 		return fmt.Errorf("%w, no filter with name %q", ErrNotFound, name)
@@ -186,6 +249,95 @@ func (db *DB) Events() *util.Emitter {
 	return &db.Emitter
 }
 
+// checkReferences returns an error if the filter stored under the name would
+// be part of a reference cycle or refers to a filter that does not exist.
+func (db *DB) checkReferences(name string, filter ReferencingFilter) error {
+	var visit func(rf ReferencingFilter, path []string) error
+	visit = func(rf ReferencingFilter, path []string) error {
+		for _, ref := range rf.References() {
+			refPath := append(path[:len(path):len(path)], ref)
+			for _, p := range path {
+				if p == ref {
+					return fmt.Errorf("%w: %s", ErrReferenceCycle, strings.Join(refPath, " -> "))
+				}
+			}
+			var refFilter Filter
+			if ref == name {
+				refFilter = filter
+			} else {
+				var err error
+				if refFilter, err = db.load(ref); err != nil {
+					return err
+				}
+			}
+			if next, ok := refFilter.(ReferencingFilter); ok {
+				if err := visit(next, refPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return visit(filter, []string{name})
+}
+
+// dependents returns the names of the filters that refer to the named filter,
+// either directly or through other filters.
+func (db *DB) dependents(name string) ([]string, error) {
+	names, err := db.Names()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string][]string{}
+	for _, n := range names {
+		f, err := db.load(n)
+		if err != nil {
+			// Broken filters can not be resolved anyway.
+			continue
+		}
+		if rf, ok := f.(ReferencingFilter); ok {
+			refs[n] = rf.References()
+		}
+	}
+
+	var dependents []string
+	found := map[string]bool{name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, n := range names {
+			if found[n] {
+				continue
+			}
+			for _, ref := range refs[n] {
+				if found[ref] {
+					found[n], changed = true, true
+					dependents = append(dependents, n)
+					break
+				}
+			}
+		}
+	}
+	return dependents, nil
+}
+
+// updateDependents resolves the filters that refer to the named filter again
+// and emits an UpdateEvent for each of them.
+func (db *DB) updateDependents(name string) {
+	dependents, err := db.dependents(name)
+	if err != nil {
+		slog.Error("Could not find dependent filters", "error", err, "name", name)
+		return
+	}
+	for _, n := range dependents {
+		filter, err := db.Get(n)
+		if err != nil {
+			slog.Error("Could not resolve dependent filter", "error", err, "name", n)
+			continue
+		}
+		db.Emit(UpdateEvent{Name: n, Filter: filter})
+	}
+}
+
 func (db *DB) filterFile(name string) string {
 	return path.Join(db.directory, name+".json")
 }
@@ -1,11 +1,13 @@
 package filter
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"trollibox/src/library"
 	"trollibox/src/util"
@@ -15,6 +17,9 @@ func init() {
 	RegisterFactory(func() Filter {
 		return &dummyFilter{}
 	})
+	RegisterFactory(func() Filter {
+		return &dummyRefFilter{}
+	})
 }
 
 type dummyFilter struct {
@@ -34,6 +39,39 @@ func (d *dummyFilter) MarshalJSON() ([]byte, error) {
 	})
 }
 
+type dummyRefFilter struct {
+	Refs []string `json:"refs"`
+
+	resolved []Filter
+}
+
+func (*dummyRefFilter) Filter(library.Track) (SearchResult, bool) {
+	return SearchResult{}, true
+}
+
+func (d *dummyRefFilter) References() []string {
+	return d.Refs
+}
+
+func (d *dummyRefFilter) Resolve(db *DB) error {
+	d.resolved = nil
+	for _, ref := range d.Refs {
+		f, err := db.Get(ref)
+		if err != nil {
+			return err
+		}
+		d.resolved = append(d.resolved, f)
+	}
+	return nil
+}
+
+func (d *dummyRefFilter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"refs": d.Refs,
+		"type": "dummyref",
+	})
+}
+
 func TestDBGetSetRemove(t *testing.T) {
 	db, err := NewDB(path.Join(os.TempDir(), "filter-db-test-getsetremove"))
 	if err != nil {
@@ -168,3 +206,128 @@ func TestDBEvents(t *testing.T) {
 		}
 	})
 }
+
+func TestDBReferences(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := &dummyFilter{Foo: "base"}
+	if err := db.Set("base", base); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("a", &dummyRefFilter{Refs: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", &dummyRefFilter{Refs: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := b.(*dummyRefFilter).resolved[0].(*dummyRefFilter)
+	if a.resolved[0] != Filter(base) {
+		t.Fatalf("References were not resolved: %#v", a)
+	}
+
+	if err := db.Set("missing", &dummyRefFilter{Refs: []string{"nope"}}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Unexpected %v", err)
+	}
+	if err := db.Set("self", &dummyRefFilter{Refs: []string{"self"}}); !errors.Is(err, ErrReferenceCycle) {
+		t.Fatalf("Unexpected %v", err)
+	}
+	if err := db.Set("a", &dummyRefFilter{Refs: []string{"b"}}); !errors.Is(err, ErrReferenceCycle) {
+		t.Fatalf("Unexpected %v", err)
+	}
+	if err := db.Remove("a"); !errors.Is(err, ErrReferenced) {
+		t.Fatalf("Unexpected %v", err)
+	}
+	if err := db.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBReferenceUpdateEvents(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Set("base", &dummyFilter{Foo: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("a", &dummyRefFilter{Refs: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", &dummyRefFilter{Refs: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := &dummyFilter{Foo: "bar"}
+	for _, name := range []string{"a", "b"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		l := db.Events().Listen(ctx)
+		if err := db.Set("base", updated); err != nil {
+			t.Fatal(err)
+		}
+	outer:
+		for {
+			select {
+			case msg := <-l:
+				if ev, ok := msg.(UpdateEvent); ok && ev.Name == name {
+					f := ev.Filter.(*dummyRefFilter)
+					for f.resolved[0] != Filter(updated) {
+						f = f.resolved[0].(*dummyRefFilter)
+					}
+					break outer
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("No update event was emitted for %q", name)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestDBSetWriteError(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := &dummyFilter{Foo: "foo"}
+	if err := db.Set("base", original); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("a", &dummyRefFilter{Refs: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing fails if a directory is in the way of the file.
+	if err := os.Remove(path.Join(dir, "base.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "base.json"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := db.Events().Listen(ctx)
+	if err := db.Set("base", &dummyFilter{Foo: "bar"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	select {
+	case msg := <-l:
+		t.Fatalf("unexpected event: %#v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if f, err := db.Get("base"); err != nil || f != Filter(original) {
+		t.Fatalf("the original filter was replaced: %v, %v", f, err)
+	}
+}
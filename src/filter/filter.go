@@ -14,6 +14,17 @@ type Filter interface {
 	Filter(track library.Track) (SearchResult, bool)
 }
 
+// An IndexedFilter is a Filter that is able to use an index of tracks to
+// narrow down which tracks it could pass.
+type IndexedFilter interface {
+	Filter
+
+	// Candidates returns the sorted positions of the indexed tracks that may
+	// pass the filter. False is returned if the index can not be used, in
+	// which case all tracks should be considered.
+	Candidates(index *library.Index) ([]int, bool)
+}
+
 // Func adds an implementation of the Filter interface to a function with a
 // similar signature.
 type Func func(library.Track) (SearchResult, bool)
@@ -35,6 +46,22 @@ type SearchMatch struct {
 type SearchResult struct {
 	library.Track
 	Matches map[string][]SearchMatch
+	// The relevance of the result, only set by filters that rank their
+	// results. Higher is more relevant.
+	Score float64
+	// How likely the track is to be picked relative to other results when
+	// drawing tracks at random. Zero is the same as 1, the weight of tracks
+	// of filters that do not weigh their results.
+	Weight float64
+}
+
+// RandomWeight returns the weight of the result, substituting 1 if the weight
+// is not set.
+func (sr SearchResult) RandomWeight() float64 {
+	if sr.Weight <= 0 {
+		return 1
+	}
+	return sr.Weight
 }
 
 // AddMatch marks a portion of the named property value as matched.
@@ -69,6 +96,20 @@ func (l ByNumMatches) Len() int           { return len(l) }
 func (l ByNumMatches) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
 func (l ByNumMatches) Less(a, b int) bool { return l[a].NumMatches() > l[b].NumMatches() }
 
+// ByScore implements the sort.Interface to sort a list of search results by
+// their score in descending order. Results with equal scores are ordered by
+// the number of matches.
+type ByScore []SearchResult
+
+func (l ByScore) Len() int      { return len(l) }
+func (l ByScore) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l ByScore) Less(a, b int) bool {
+	if l[a].Score != l[b].Score {
+		return l[a].Score > l[b].Score
+	}
+	return l[a].NumMatches() > l[b].NumMatches()
+}
+
 // Tracks filters a list of tracks by applying the specified filter to all
 // tracks.
 //
@@ -116,3 +157,33 @@ func Tracks(ctx context.Context, filter Filter, tracks []library.Track) ([]Searc
 		}
 	}
 }
+
+// LibraryTracks filters all tracks in the library.
+//
+// If both the library and the filter support indexing, only the tracks that
+// the index yields as candidates are considered.
+func LibraryTracks(ctx context.Context, filter Filter, lib library.Library) ([]SearchResult, error) {
+	indexedFilter, filterOk := filter.(IndexedFilter)
+	indexedLib, libOk := lib.(library.IndexedLibrary)
+	if !filterOk || !libOk {
+		tracks, err := lib.Tracks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return Tracks(ctx, filter, tracks)
+	}
+
+	index, err := indexedLib.TrackIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tracks := index.Tracks()
+	if positions, ok := indexedFilter.Candidates(index); ok {
+		candidates := make([]library.Track, len(positions))
+		for i, p := range positions {
+			candidates[i] = tracks[p]
+		}
+		tracks = candidates
+	}
+	return Tracks(ctx, filter, tracks)
+}
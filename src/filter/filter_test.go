@@ -108,3 +108,64 @@ func TestMatchSorting(t *testing.T) {
 		t.Fatalf("Wrong sort order: %q at index %v", results[0].URI, 2)
 	}
 }
+
+func TestScoreSorting(t *testing.T) {
+	results := []SearchResult{
+		{Track: library.Track{URI: "bar"}, Score: 1.5},
+		{Track: library.Track{URI: "baz"}, Score: 0.5},
+		{
+			Track: library.Track{URI: "qux"},
+			Matches: map[string][]SearchMatch{
+				"artist": {{0, 1}},
+			},
+			Score: 1.5,
+		},
+		{Track: library.Track{URI: "foo"}, Score: 3},
+	}
+	sort.Sort(ByScore(results))
+	for i, uri := range []string{"foo", "qux", "bar", "baz"} {
+		if results[i].URI != uri {
+			t.Fatalf("Wrong sort order: %q at index %v", results[i].URI, i)
+		}
+	}
+}
+
+type indexedDummyLibrary struct {
+	library.DummyLibrary
+}
+
+func (lib *indexedDummyLibrary) TrackIndex(ctx context.Context) (*library.Index, error) {
+	return library.NewIndex(lib.DummyLibrary), nil
+}
+
+type candidateFilter []int
+
+func (ft candidateFilter) Filter(track library.Track) (SearchResult, bool) {
+	return SearchResult{Track: track}, true
+}
+
+func (ft candidateFilter) Candidates(index *library.Index) ([]int, bool) {
+	return ft, true
+}
+
+func TestLibraryTracks(t *testing.T) {
+	tracks := []library.Track{{URI: "foo"}, {URI: "bar"}, {URI: "baz"}}
+
+	dummy := library.DummyLibrary(tracks)
+	results, err := LibraryTracks(context.Background(), candidateFilter{1}, &dummy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected all tracks without an index, got %d", len(results))
+	}
+
+	results, err = LibraryTracks(context.Background(), candidateFilter{0, 2}, &indexedDummyLibrary{dummy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].URI < results[j].URI })
+	if len(results) != 2 || results[0].URI != "baz" || results[1].URI != "foo" {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+}
@@ -0,0 +1,238 @@
+// Package fuzzy implements a search that ranks tracks by their relevance to a
+// query and tolerates spelling mistakes.
+package fuzzy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"trollibox/src/filter"
+	"trollibox/src/library"
+)
+
+// ErrInvalidQuery is returned when a query can not be compiled.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// DefaultWeights are the weights of the attributes that are searched if no
+// weight is specified. Attributes that are not listed here have a weight of 1.
+var DefaultWeights = map[string]float64{
+	"title":       3,
+	"artist":      2.5,
+	"albumartist": 2,
+	"album":       1.5,
+	"genre":       1,
+	"uri":         0.25,
+}
+
+const (
+	// The scores of a single query term matching a word.
+	scoreExact     = 1.0
+	scorePrefix    = 0.75
+	scoreSubstring = 0.5
+	scoreTypo      = 0.5
+
+	// The bonuses awarded per attribute if the whole query is equal to or a
+	// prefix of its value.
+	bonusExact  = 2.0
+	bonusPrefix = 1.0
+)
+
+// A Query is a compiled fuzzy search query.
+type Query struct {
+	Query   string
+	Weights map[string]float64
+
+	terms  []string
+	phrase string
+}
+
+// CompileQuery compiles a query that matches tracks containing all words of
+// the query in any of the specified attributes. Matches are scored using the
+// weights of DefaultWeights.
+//
+// A word matches if it is equal to a word of an attribute value, is a prefix or
+// a part of it or is within a small edit distance of it. Closer matches,
+// matches in more important attributes and values that are equal to the whole
+// query are scored higher.
+func CompileQuery(query string, fields []string) (*Query, error) {
+	weights := map[string]float64{}
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+		if w, ok := DefaultWeights[field]; ok {
+			weights[field] = w
+		} else {
+			weights[field] = 1
+		}
+	}
+	return CompileWeightedQuery(query, weights)
+}
+
+// CompileWeightedQuery is like CompileQuery, but allows the weight of each
+// searched attribute to be specified.
+func CompileWeightedQuery(query string, weights map[string]float64) (*Query, error) {
+	if len(weights) == 0 {
+		return nil, fmt.Errorf("%w: at least one field is required", ErrInvalidQuery)
+	}
+	for field, w := range weights {
+		if _, ok := (&library.Track{}).Attr(field).(string); !ok {
+			return nil, fmt.Errorf("%w: unable to search field %q", ErrInvalidQuery, field)
+		}
+		if w <= 0 {
+			return nil, fmt.Errorf("%w: weight of %q must be positive", ErrInvalidQuery, field)
+		}
+	}
+
+	var terms []string
+	for _, w := range words(query) {
+		terms = append(terms, strings.ToLower(query[w.Start:w.End]))
+	}
+	return &Query{
+		Query:   query,
+		Weights: weights,
+		terms:   terms,
+		phrase:  strings.Join(terms, " "),
+	}, nil
+}
+
+// Filter implements the filter.Filter interface.
+func (q *Query) Filter(track library.Track) (filter.SearchResult, bool) {
+	if q == nil || len(q.terms) == 0 {
+		return filter.SearchResult{}, false
+	}
+
+	type field struct {
+		name   string
+		value  string
+		words  []filter.SearchMatch
+		lower  []string
+		weight float64
+	}
+	fields := make([]field, 0, len(q.Weights))
+	for name, weight := range q.Weights {
+		value, _ := track.Attr(name).(string)
+		f := field{name: name, value: value, words: words(value), weight: weight}
+		f.lower = make([]string, len(f.words))
+		for i, w := range f.words {
+			f.lower[i] = strings.ToLower(value[w.Start:w.End])
+		}
+		fields = append(fields, f)
+	}
+
+	result := filter.SearchResult{Track: track}
+	for _, term := range q.terms {
+		var best float64
+		for _, f := range fields {
+			for i, word := range f.lower {
+				s := matchWord(term, word)
+				if s == 0 {
+					continue
+				}
+				result.AddMatches(f.name, f.words[i])
+				if s*f.weight > best {
+					best = s * f.weight
+				}
+			}
+		}
+		if best == 0 {
+			return filter.SearchResult{}, false
+		}
+		result.Score += best
+	}
+
+	for _, f := range fields {
+		phrase := strings.Join(f.lower, " ")
+		if phrase == q.phrase {
+			result.Score += bonusExact * f.weight
+		} else if strings.HasPrefix(phrase, q.phrase) {
+			result.Score += bonusPrefix * f.weight
+		}
+	}
+	return result, true
+}
+
+// matchWord scores how well the query term matches a word. Both should be
+// lower case. Zero is returned if the term does not match.
+func matchWord(term, word string) float64 {
+	switch {
+	case term == word:
+		return scoreExact
+	case strings.HasPrefix(word, term):
+		return scorePrefix
+	case strings.Contains(word, term):
+		return scoreSubstring
+	}
+	n := utf8.RuneCountInString(term)
+	if d := editDistance(term, word); d <= maxTypos(n) {
+		return scoreTypo * (1 - float64(d)/float64(n+1))
+	}
+	return 0
+}
+
+// maxTypos returns the number of edits that are tolerated for a term of the
+// specified length.
+func maxTypos(length int) int {
+	switch {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// words returns the offsets of all sequences of letters and digits in s.
+func words(s string) []filter.SearchMatch {
+	var ww []filter.SearchMatch
+	start := -1
+	for i, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			ww = append(ww, filter.SearchMatch{Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ww = append(ww, filter.SearchMatch{Start: start, End: len(s)})
+	}
+	return ww
+}
@@ -0,0 +1,131 @@
+package fuzzy
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"trollibox/src/filter"
+	"trollibox/src/library"
+)
+
+func TestEditDistance(t *testing.T) {
+	testcases := []struct {
+		a, b string
+		d    int
+	}{
+		{"", "", 0},
+		{"beatles", "beatles", 0},
+		{"beetles", "beatles", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+		{"ünïcode", "unicode", 2},
+	}
+	for _, tt := range testcases {
+		if d := editDistance(tt.a, tt.b); d != tt.d {
+			t.Fatalf("Unexpected distance between %q and %q: exp %d, got %d", tt.a, tt.b, tt.d, d)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tracks := []library.Track{
+		{URI: "a", Artist: "The Beatles", Title: "Help!"},
+		{URI: "b", Artist: "The Rolling Stones", Title: "Paint It Black"},
+		{URI: "c", Artist: "Queen", Title: "Bohemian Rhapsody"},
+	}
+	testcases := []struct {
+		query  string
+		expect []string
+	}{
+		{"beatles", []string{"a"}},
+		{"beetles", []string{"a"}},
+		{"BEATLES help", []string{"a"}},
+		{"roll", []string{"b"}},
+		{"the", []string{"a", "b"}},
+		{"bohemain rhapsody", []string{"c"}},
+		{"the queen", nil},
+		{"qeen", []string{"c"}},
+		{"qen", nil},
+		{"", nil},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := CompileQuery(tt.query, []string{"artist", "title"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := filter.Tracks(context.Background(), query, tracks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(tt.expect) {
+				t.Fatalf("Unexpected number of results: exp %d, got %d", len(tt.expect), len(results))
+			}
+			sort.Slice(results, func(i, j int) bool { return results[i].URI < results[j].URI })
+			for i, uri := range tt.expect {
+				if results[i].URI != uri {
+					t.Fatalf("Unexpected result at %d: exp %q, got %q", i, uri, results[i].URI)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterRanking(t *testing.T) {
+	tracks := []library.Track{
+		{URI: "file:///music/yesterday.mp3", Artist: "Someone", Title: "Something Else"},
+		{URI: "file:///music/01.mp3", Artist: "Some Band", Title: "Yesterday Once More"},
+		{URI: "file:///music/02.mp3", Artist: "The Beatles", Title: "Yesterday"},
+		{URI: "file:///music/03.mp3", Artist: "Yesterdays", Title: "Today"},
+	}
+	query, err := CompileQuery("yesterday", []string{"uri", "artist", "title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := filter.Tracks(context.Background(), query, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(filter.ByScore(results))
+	expect := []string{
+		"file:///music/02.mp3",
+		"file:///music/01.mp3",
+		"file:///music/03.mp3",
+		"file:///music/yesterday.mp3",
+	}
+	if len(results) != len(expect) {
+		t.Fatalf("Unexpected number of results: %d", len(results))
+	}
+	for i, uri := range expect {
+		if results[i].URI != uri {
+			t.Fatalf("Unexpected result at %d: exp %q, got %q (%v)", i, uri, results[i].URI, results[i].Score)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	query, err := CompileQuery("beetles", []string{"artist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := query.Filter(library.Track{Artist: "The Beatles"})
+	if !ok {
+		t.Fatalf("Expected a match")
+	}
+	if m := result.Matches["artist"]; len(m) != 1 || m[0] != (filter.SearchMatch{Start: 4, End: 11}) {
+		t.Fatalf("Unexpected matches: %v", result.Matches)
+	}
+	if result.Score <= 0 {
+		t.Fatalf("Expected a positive score, got %v", result.Score)
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	if _, err := CompileQuery("foo", nil); err == nil {
+		t.Fatalf("Expected an error for missing fields")
+	}
+	if _, err := CompileQuery("foo", []string{"duration"}); err == nil {
+		t.Fatalf("Expected an error for a non-string field")
+	}
+}
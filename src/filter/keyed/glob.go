@@ -0,0 +1,109 @@
+package keyed
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A glob is a case insensitive pattern in which an asterisk matches any
+// sequence of characters and a question mark matches a single character.
+//
+// Wildcard characters and backslashes are made literal by escaping them with a
+// backslash.
+type glob string
+
+// index returns the byte offsets of the leftmost and shortest match of the
+// pattern in s. The start is -1 if the pattern does not match.
+func (g glob) index(s string) (start, end int) {
+	for i := 0; ; {
+		if n := g.matchPrefix(s[i:], false); n >= 0 {
+			return i, i + n
+		}
+		if i == len(s) {
+			return -1, -1
+		}
+		_, w := utf8.DecodeRuneInString(s[i:])
+		i += w
+	}
+}
+
+// matches reports whether the pattern matches the whole of s.
+func (g glob) matches(s string) bool {
+	return g.matchPrefix(s, true) == len(s)
+}
+
+// matchPrefix returns the length of the shortest prefix of s that is matched
+// by the pattern or -1 if there is no such prefix. If full is set, only s as a
+// whole is considered.
+func (g glob) matchPrefix(s string, full bool) int {
+	pattern, offset := string(g), 0
+	for len(pattern) > 0 {
+		p, n := utf8.DecodeRuneInString(pattern)
+		pattern = pattern[n:]
+
+		switch p {
+		case '*':
+			for i := offset; ; {
+				if m := glob(pattern).matchPrefix(s[i:], full); m >= 0 {
+					return i + m
+				}
+				if i == len(s) {
+					return -1
+				}
+				_, w := utf8.DecodeRuneInString(s[i:])
+				i += w
+			}
+		case '?':
+			if offset == len(s) {
+				return -1
+			}
+			_, w := utf8.DecodeRuneInString(s[offset:])
+			offset += w
+			continue
+		case '\\':
+			if len(pattern) > 0 {
+				p, n = utf8.DecodeRuneInString(pattern)
+				pattern = pattern[n:]
+			}
+		}
+
+		if offset == len(s) {
+			return -1
+		}
+		r, w := utf8.DecodeRuneInString(s[offset:])
+		if !equalFold(p, r) {
+			return -1
+		}
+		offset += w
+	}
+	if full && offset != len(s) {
+		return -1
+	}
+	return offset
+}
+
+// equalFold reports whether both runes are equal under Unicode case folding.
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for r := unicode.SimpleFold(a); r != a; r = unicode.SimpleFold(r) {
+		if r == b {
+			return true
+		}
+	}
+	return false
+}
+
+// literal returns the pattern with wildcards being regular characters.
+func (g glob) literal() string {
+	var b strings.Builder
+	for i := 0; i < len(g); i++ {
+		if g[i] == '\\' && i+1 < len(g) {
+			i++
+		}
+		b.WriteByte(g[i])
+	}
+	return b.String()
+}
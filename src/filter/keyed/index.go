@@ -0,0 +1,130 @@
+package keyed
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"trollibox/src/library"
+)
+
+// Candidates implements the filter.IndexedFilter interface.
+func (sq *Query) Candidates(index *library.Index) ([]int, bool) {
+	if sq == nil || sq.rule == nil {
+		return nil, true
+	}
+	return ruleCandidates(sq.rule, index)
+}
+
+// ruleCandidates returns the positions of the tracks in the index that could
+// match the rule. False is returned if the rule does not narrow down the
+// tracks using the index.
+func ruleCandidates(r rule, index *library.Index) ([]int, bool) {
+	switch t := r.(type) {
+	case andRule:
+		var lists [][]int
+		for _, r := range t.rules {
+			if c, ok := ruleCandidates(r, index); ok {
+				lists = append(lists, c)
+			}
+		}
+		if len(lists) == 0 {
+			return nil, false
+		}
+		return library.IntersectPositions(lists...), true
+	case orRule:
+		lists := make([][]int, 0, len(t.rules))
+		for _, r := range t.rules {
+			c, ok := ruleCandidates(r, index)
+			if !ok {
+				return nil, false
+			}
+			lists = append(lists, c)
+		}
+		return library.UnionPositions(lists...), true
+	case stringContainsRule:
+		return t.needle.candidates(index, t.property)
+	case stringEqualsRule:
+		// A value that is equal to the needle also contains it.
+		return t.needle.candidates(index, t.property)
+	case unkeyedRule:
+		lists := make([][]int, 0, len(t.properties))
+		for _, property := range t.properties {
+			c, ok := t.needle.candidates(index, property)
+			if !ok {
+				return nil, false
+			}
+			lists = append(lists, c)
+		}
+		return library.UnionPositions(lists...), true
+	}
+	return nil, false
+}
+
+// candidates returns the positions of the tracks that contain all words of
+// the pattern's literal parts in the named attribute.
+//
+// Words at the edges of a literal part may be only a part of a word in the
+// attribute value. So "e bea" requires a word ending in "e" and a word starting
+// with "bea".
+func (g glob) candidates(index *library.Index, property string) ([]int, bool) {
+	if !index.Indexed(property) {
+		return nil, false
+	}
+	var lists [][]int
+	for _, segment := range g.segments() {
+		folded := library.FoldString(segment)
+		words := library.IndexWords(folded)
+		first, _ := utf8.DecodeRuneInString(folded)
+		last, _ := utf8.DecodeLastRuneInString(folded)
+		for i, word := range words {
+			openStart := i == 0 && library.IsWordRune(first)
+			openEnd := i == len(words)-1 && library.IsWordRune(last)
+			var c []int
+			switch {
+			case openStart && openEnd:
+				c = index.LookupFunc(property, func(s string) bool { return strings.Contains(s, word) })
+			case openStart:
+				c = index.LookupFunc(property, func(s string) bool { return strings.HasSuffix(s, word) })
+			case openEnd:
+				c = index.LookupFunc(property, func(s string) bool { return strings.HasPrefix(s, word) })
+			default:
+				c = index.Lookup(property, word)
+			}
+			lists = append(lists, c)
+		}
+	}
+	if len(lists) == 0 {
+		return nil, false
+	}
+	return library.IntersectPositions(lists...), true
+}
+
+// segments returns the parts of the pattern in between wildcards with escape
+// characters removed.
+func (g glob) segments() []string {
+	var segments []string
+	var b strings.Builder
+	pattern := string(g)
+	for len(pattern) > 0 {
+		r, n := utf8.DecodeRuneInString(pattern)
+		pattern = pattern[n:]
+		switch r {
+		case '*', '?':
+			if b.Len() > 0 {
+				segments = append(segments, b.String())
+				b.Reset()
+			}
+			continue
+		case '\\':
+			if len(pattern) > 0 {
+				r, n = utf8.DecodeRuneInString(pattern)
+				pattern = pattern[n:]
+			}
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() > 0 {
+		segments = append(segments, b.String())
+	}
+	return segments
+}
@@ -3,9 +3,13 @@ package keyed
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"trollibox/src/filter"
 	"trollibox/src/library"
@@ -14,78 +18,344 @@ import (
 // parser returns the grammar of the query as a parser combinator.
 // The grammar is curried with so some arguments required by mapping functions
 // can be compiled in.
-func parser(untaggedFields []string) ParseFunc {
+//
+// Failures of the parsers for the most relevant tokens are recorded in ff if
+// it is not nil.
+func parser(untaggedFields []string, ff *furthestFailure) ParseFunc {
 	digit := pAny(pLiterals("0", "1", "2", "3", "4", "5", "6", "7", "8", "9")...)
+	number := ff.expect("number", pApply(pAtLeastOne(digit), gJoinStrings))
+
+	var strKeys, ordKeys []string
+	for _, attr := range library.TrackAttrs {
+		switch (&library.Track{}).Attr(attr).(type) {
+		case string:
+			strKeys = append(strKeys, attr)
+		case int64:
+			ordKeys = append(ordKeys, attr)
+		}
+	}
+	strKey := pKeyOf(strKeys)
+	ordKey := pKeyOf(ordKeys)
+	anyKey := pKeyOf(library.TrackAttrs)
+	// Timestamps can be compared by how long ago they were.
+	timeKey := pKeyOf([]string{"modtime"})
+
+	equality := pAny(pLiterals("!=", "=", ":")...)
+	comparison := pLast(pOptional(pLit(":")), pAny(pLiterals("<=", ">=", "<", ">")...))
+
+	strMatchValue := pAny(
+		pApply(pApply(pAll(pLit(`"`), pMany(pAny(pQuotedLit(), pEscapedLit())), ff.expect(`'"'`, pLit(`"`))), gPick(1)), gJoinStrings),
+		pApply(pAtLeastOne(pAny(pValueLit(), pEscapedLit())), gJoinStrings),
+	)
+	// Regular expressions retain their backslashes, only quotes are
+	// unescaped.
+	regexValue := pAny(
+		pApply(pApply(pAll(pLit(`"`), pMany(pAny(pLast(pLit("\\"), pLit(`"`)), pRuneExcept(`"`))), ff.expect(`'"'`, pLit(`"`))), gPick(1)), gJoinStrings),
+		pApply(pAtLeastOne(pAny(pValueLit(), pApply(pAll(pLit("\\"), pRuneExcept("")), gJoinStrings))), gJoinStrings),
+	)
+	rangeValue := pAll(pOptional(number), pLit(".."), pOptional(number))
+	ageUnit := ff.expect("unit", pAny(pLiterals("h", "d", "w", "y")...))
+
+	keyedMatch := pLocateErrors(pAny(
+		pApply(pAll(anyKey, pLit(":"), rangeValue, pNot(pValueLit())), gMapRangeRule),
+		pApply(pAll(timeKey, comparison, number, ageUnit, pNot(pValueLit())), gMapAgeRule),
+		pApply(pAll(anyKey, comparison, number, pNot(pValueLit())), gMapOrdRule),
+		pApply(pAll(strKey, comparison, strMatchValue), gMapStringCompareRule),
+		pApply(pAll(strKey, pLit("~"), regexValue), gMapRegexRule),
+		pApply(pAll(strKey, equality, strMatchValue), gMapStringRule),
+		pApply(pAll(ordKey, equality, number, pNot(pValueLit())), gMapOrdRule),
+		// Anything else that looks like a keyed match is either an unknown key
+		// or an invalid combination of key, operation and value.
+		pApply(pAll(pKeyName(), pAny(pLiterals("!=", "<=", ">=", "=", "<", ">", "~", ":")...), pOptional(strMatchValue)), gMapInvalidRule),
+	))
+
+	unkeyedMatch := pApply(ff.expect("value", strMatchValue), gMapUnkeyedRule(untaggedFields))
 
-	strKey := pAny(pLiterals("uri", "artist", "title", "album")...)
-	strOperation := pAny(pLiterals("=", ":")...)
-	strMatchValue := pApply(pAtLeastOne(pAny(pWordLit(), pLast(pLiterals("\\", " ")...))), gJoinStrings)
-
-	ordKey := pLit("duration")
-	ordOperation := pAny(pLiterals("=", "<", ">")...)
-	ordMatchValue := pApply(pAtLeastOne(digit), gJoinStrings)
+	condition := pAny(keyedMatch, unkeyedMatch)
 
-	keyedMatch := pAny(
-		pApply(pAll(strKey, strOperation, strMatchValue), gMapStringRule),
-		pApply(pAll(ordKey, ordOperation, ordMatchValue), gMapOrdRule),
+	ws := pAtLeastOne(pLit(" "))
+	optWs := pMany(pLit(" "))
+	negation := pAny(pAll(ff.expect("NOT", pKeyword("NOT")), optWs), ff.expect("'-'", pLit("-")))
+	disjunction := pAll(optWs, ff.expect("OR", pKeyword("OR")), optWs)
+
+	var expression, unary ParseFunc
+	group := pApply(pAll(ff.expect("'('", pLit("(")), optWs, pRef(&expression), optWs, ff.expect("')'", pLit(")"))), gPick(2))
+	unary = pAny(
+		pApply(pLast(negation, pRef(&unary)), gMapNotRule),
+		group,
+		condition,
 	)
+	conjunction := pApply(pAll(unary, pMany(pLast(ws, pNot(pKeyword("OR")), unary))), gMapAndRule)
+	expression = pApply(pAll(conjunction, pMany(pLast(disjunction, conjunction))), gMapOrRule)
 
-	unkeyedMatch := pApply(strMatchValue, gMapUnkeyedRule(untaggedFields))
+	query := pApply(pAll(optWs, expression, optWs), gPick(1))
 
-	condition := pAny(keyedMatch, unkeyedMatch)
-	//	query := pApply(pAtLeastOne(condition), gMapRuleSet) // TODO: repetition
+	return query
+}
 
-	query := pApply(pAtLeastOne(pAny(condition, pLit(" "))), gMapRuleSet)
+// pKeyword matches a reserved word that is not directly followed by another
+// value character.
+func pKeyword(keyword string) ParseFunc {
+	return pApply(pAll(pLit(keyword), pNot(pValueLit())), gPick(0))
+}
 
-	return query
+// pLocateErrors records the location of error rules produced by the parser.
+func pLocateErrors(parser ParseFunc) ParseFunc {
+	return func(source string) (interface{}, int) {
+		v, r := parser(source)
+		if er, ok := v.(errorRule); ok && r >= 0 {
+			er.remaining, er.length = len(source), r
+			v = er
+		}
+		return v, r
+	}
 }
 
-func pWordLit() ParseFunc {
-	re := regexp.MustCompile(`\w`)
+// pKeyName matches a word that could be the name of an attribute.
+func pKeyName() ParseFunc {
 	return func(source string) (interface{}, int) {
-		if len(source) > 0 && re.MatchString(source[:1]) {
-			return source[:1], 1
+		i := 0
+		for i < len(source) && ('a' <= source[i] && source[i] <= 'z' || 'A' <= source[i] && source[i] <= 'Z') {
+			i++
+		}
+		if i == 0 {
+			return nil, -1
+		}
+		return source[:i], i
+	}
+}
+
+// pKeyOf matches the name of one of the specified attributes.
+func pKeyOf(keys []string) ParseFunc {
+	name := pKeyName()
+	return func(source string) (interface{}, int) {
+		v, r := name(source)
+		if r < 0 {
+			return nil, -1
+		}
+		for _, key := range keys {
+			if v == key {
+				return v, r
+			}
 		}
 		return nil, -1
 	}
 }
 
+// pRuneExcept matches any single character that is not in the specified set.
+func pRuneExcept(chars string) ParseFunc {
+	return func(source string) (interface{}, int) {
+		r, n := utf8.DecodeRuneInString(source)
+		if n == 0 || r == utf8.RuneError || strings.ContainsRune(chars, r) {
+			return nil, -1
+		}
+		return source[:n], n
+	}
+}
+
+// pValueLit matches a single character of an unquoted value. Wildcards are
+// passed through as-is.
+func pValueLit() ParseFunc {
+	return func(source string) (interface{}, int) {
+		r, n := utf8.DecodeRuneInString(source)
+		if n == 0 || r == utf8.RuneError || unicode.IsSpace(r) || strings.ContainsRune(`()":\`, r) {
+			return nil, -1
+		}
+		return source[:n], n
+	}
+}
+
+// pQuotedLit matches a single character between double quotes. Wildcards are
+// escaped so they are matched literally.
+func pQuotedLit() ParseFunc {
+	return func(source string) (interface{}, int) {
+		r, n := utf8.DecodeRuneInString(source)
+		if n == 0 || r == utf8.RuneError || r == '"' || r == '\\' {
+			return nil, -1
+		}
+		if r == '*' || r == '?' {
+			return "\\" + source[:n], n
+		}
+		return source[:n], n
+	}
+}
+
+// pEscapedLit matches any character that is preceded by a backslash. The
+// backslash is retained for characters that have a special meaning in a glob.
+func pEscapedLit() ParseFunc {
+	return func(source string) (interface{}, int) {
+		if !strings.HasPrefix(source, "\\") {
+			return nil, -1
+		}
+		r, n := utf8.DecodeRuneInString(source[1:])
+		if n == 0 || r == utf8.RuneError {
+			return nil, -1
+		}
+		if r == '*' || r == '?' || r == '\\' {
+			return source[:1+n], 1 + n
+		}
+		return source[1 : 1+n], 1 + n
+	}
+}
+
+// A rule is a node in the tree of a compiled query. Match reports whether the
+// object satisfies the rule along with the parts of its attributes that were
+// matched.
 type rule interface {
-	Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch
+	Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool)
+}
+
+type andRule struct {
+	rules []rule
+}
+
+func (rule andRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	m := map[string][]filter.SearchMatch{}
+	for _, r := range rule.rules {
+		matches, ok := r.Match(obj)
+		if !ok {
+			return nil, false
+		}
+		for property, mm := range matches {
+			m[property] = append(m[property], mm...)
+		}
+	}
+	return m, true
+}
+
+type orRule struct {
+	rules []rule
+}
+
+func (rule orRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	// All branches are evaluated so the highlighting reflects every branch
+	// that matched.
+	m, matched := map[string][]filter.SearchMatch{}, false
+	for _, r := range rule.rules {
+		matches, ok := r.Match(obj)
+		if !ok {
+			continue
+		}
+		matched = true
+		for property, mm := range matches {
+			m[property] = append(m[property], mm...)
+		}
+	}
+	if !matched {
+		return nil, false
+	}
+	return m, true
+}
+
+type notRule struct {
+	rule rule
+}
+
+func (rule notRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	// Whatever the inverted rule matched is exactly what is not wanted, so
+	// there is nothing to highlight.
+	_, ok := rule.rule.Match(obj)
+	return nil, !ok
 }
 
 type stringContainsRule struct {
 	property string
-	needle   string
+	needle   glob
 }
 
-func (rule stringContainsRule) Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch {
+func (rule stringContainsRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
 	s, ok := obj.Attr(rule.property).(string)
 	if !ok {
-		return nil
+		return nil, false
 	}
-	i := strings.Index(strings.ToLower(s), rule.needle)
-	if i == -1 {
-		return nil
+	start, end := rule.needle.index(s)
+	if start == -1 {
+		return nil, false
 	}
 	return map[string][]filter.SearchMatch{
-		rule.property: {filter.SearchMatch{Start: i, End: i + len(rule.needle)}},
-	}
+		rule.property: {filter.SearchMatch{Start: start, End: end}},
+	}, true
 }
 
 type stringEqualsRule struct {
 	property string
-	needle   string
+	needle   glob
 }
 
-func (rule stringEqualsRule) Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch {
+func (rule stringEqualsRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
 	s, ok := obj.Attr(rule.property).(string)
-	if !ok || strings.ToLower(s) != rule.needle {
-		return nil
+	if !ok || !rule.needle.matches(s) {
+		return nil, false
 	}
 	return map[string][]filter.SearchMatch{
-		rule.property: {filter.SearchMatch{Start: 0, End: len(rule.needle)}},
+		rule.property: {filter.SearchMatch{Start: 0, End: len(s)}},
+	}, true
+}
+
+type stringCompareRule struct {
+	property  string
+	operation string
+	ref       string
+}
+
+func (rule stringCompareRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	s, ok := obj.Attr(rule.property).(string)
+	if !ok {
+		return nil, false
+	}
+	c := strings.Compare(strings.ToLower(s), rule.ref)
+	switch rule.operation {
+	case "<":
+		ok = c < 0
+	case "<=":
+		ok = c <= 0
+	case ">":
+		ok = c > 0
+	case ">=":
+		ok = c >= 0
+	}
+	return nil, ok
+}
+
+type regexRule struct {
+	property string
+	pattern  *regexp.Regexp
+}
+
+func (rule regexRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	s, ok := obj.Attr(rule.property).(string)
+	if !ok {
+		return nil, false
+	}
+	indices := rule.pattern.FindAllStringIndex(s, -1)
+	if indices == nil {
+		return nil, false
+	}
+	matches := make([]filter.SearchMatch, len(indices))
+	for i, ix := range indices {
+		matches[i] = filter.SearchMatch{Start: ix[0], End: ix[1]}
 	}
+	return map[string][]filter.SearchMatch{rule.property: matches}, true
+}
+
+// ordAttr retrieves an attribute as an integer. String attributes are
+// interpreted by their leading digits, so an album track of "3/12" yields 3.
+func ordAttr(obj interface{ Attr(string) interface{} }, property string) (int64, filter.SearchMatch, bool) {
+	switch v := obj.Attr(property).(type) {
+	case int64:
+		return v, filter.SearchMatch{Start: 0, End: 1}, true
+	case string:
+		n := 0
+		for n < len(v) && '0' <= v[n] && v[n] <= '9' {
+			n++
+		}
+		i, err := strconv.ParseInt(v[:n], 10, 64)
+		if err != nil {
+			return 0, filter.SearchMatch{}, false
+		}
+		return i, filter.SearchMatch{Start: 0, End: n}, true
+	}
+	return 0, filter.SearchMatch{}, false
 }
 
 type ordEqualsRule struct {
@@ -93,14 +363,12 @@ type ordEqualsRule struct {
 	ref      int64
 }
 
-func (rule ordEqualsRule) Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch {
-	i, ok := obj.Attr(rule.property).(int64)
+func (rule ordEqualsRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	i, m, ok := ordAttr(obj, rule.property)
 	if !ok || i != rule.ref {
-		return nil
-	}
-	return map[string][]filter.SearchMatch{
-		rule.property: {filter.SearchMatch{Start: 0, End: 1}},
+		return nil, false
 	}
+	return map[string][]filter.SearchMatch{rule.property: {m}}, true
 }
 
 type ordLessThanRule struct {
@@ -108,14 +376,12 @@ type ordLessThanRule struct {
 	ref      int64
 }
 
-func (rule ordLessThanRule) Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch {
-	i, ok := obj.Attr(rule.property).(int64)
+func (rule ordLessThanRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	i, m, ok := ordAttr(obj, rule.property)
 	if !ok || i >= rule.ref {
-		return nil
-	}
-	return map[string][]filter.SearchMatch{
-		rule.property: {filter.SearchMatch{Start: 0, End: 1}},
+		return nil, false
 	}
+	return map[string][]filter.SearchMatch{rule.property: {m}}, true
 }
 
 type ordGreaterThanRule struct {
@@ -123,34 +389,88 @@ type ordGreaterThanRule struct {
 	ref      int64
 }
 
-func (rule ordGreaterThanRule) Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch {
-	i, ok := obj.Attr(rule.property).(int64)
+func (rule ordGreaterThanRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	i, m, ok := ordAttr(obj, rule.property)
 	if !ok || i <= rule.ref {
-		return nil
+		return nil, false
 	}
-	return map[string][]filter.SearchMatch{
-		rule.property: {filter.SearchMatch{Start: 0, End: 1}},
+	return map[string][]filter.SearchMatch{rule.property: {m}}, true
+}
+
+// An ordRangeRule matches if the attribute lies within the inclusive range.
+type ordRangeRule struct {
+	property string
+	min, max int64
+}
+
+func (rule ordRangeRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	i, m, ok := ordAttr(obj, rule.property)
+	if !ok || i < rule.min || i > rule.max {
+		return nil, false
+	}
+	return map[string][]filter.SearchMatch{rule.property: {m}}, true
+}
+
+// An ageRule compares the time that has passed since a timestamp attribute.
+// Unknown timestamps, which are zero, never match.
+type ageRule struct {
+	property  string
+	operation string
+	age       time.Duration
+}
+
+func (rule ageRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	ts, ok := obj.Attr(rule.property).(int64)
+	if !ok || ts == 0 {
+		return nil, false
+	}
+	age := time.Since(time.Unix(ts, 0))
+	switch rule.operation {
+	case "<":
+		ok = age < rule.age
+	case "<=":
+		ok = age <= rule.age
+	case ">":
+		ok = age > rule.age
+	case ">=":
+		ok = age >= rule.age
+	}
+	if !ok {
+		return nil, false
 	}
+	return map[string][]filter.SearchMatch{rule.property: {{Start: 0, End: 1}}}, true
+}
+
+// An errorRule is produced for conditions that are syntactically valid, but
+// can not be evaluated. Queries containing it will not compile.
+type errorRule struct {
+	err      error
+	expected []string
+	// The location of the condition, see pLocateErrors.
+	remaining, length int
+}
+
+func (rule errorRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
+	return nil, false
 }
 
 type unkeyedRule struct {
 	properties []string
-	needle     string
+	needle     glob
 }
 
-func (rule unkeyedRule) Match(obj interface{ Attr(string) interface{} }) map[string][]filter.SearchMatch {
+func (rule unkeyedRule) Match(obj interface{ Attr(string) interface{} }) (map[string][]filter.SearchMatch, bool) {
 	m := map[string][]filter.SearchMatch{}
 	for _, prop := range rule.properties {
 		s, ok := obj.Attr(prop).(string)
 		if !ok {
 			continue
 		}
-		i := strings.Index(strings.ToLower(s), rule.needle)
-		if i >= 0 {
-			m[prop] = append(m[prop], filter.SearchMatch{Start: i, End: i + len(rule.needle)})
+		if start, end := rule.needle.index(s); start >= 0 {
+			m[prop] = append(m[prop], filter.SearchMatch{Start: start, End: end})
 		}
 	}
-	return m
+	return m, len(m) > 0
 }
 
 func gJoinStrings(v interface{}) interface{} {
@@ -165,7 +485,7 @@ func gMapUnkeyedRule(untaggedFields []string) ApplyFunc {
 	return func(v interface{}) interface{} {
 		return unkeyedRule{
 			properties: untaggedFields,
-			needle:     strings.ToLower(v.(string)),
+			needle:     glob(v.(string)),
 		}
 	}
 }
@@ -176,37 +496,158 @@ func gMapStringRule(v interface{}) interface{} {
 	argument := v.([]interface{})[2].(string)
 	switch operation {
 	case ":":
-		return stringContainsRule{property: property, needle: strings.ToLower(argument)}
+		return stringContainsRule{property: property, needle: glob(argument)}
 	case "=":
-		return stringEqualsRule{property: property, needle: strings.ToLower(argument)}
+		return stringEqualsRule{property: property, needle: glob(argument)}
+	case "!=":
+		return notRule{rule: stringEqualsRule{property: property, needle: glob(argument)}}
 	}
 	panic("unreachable")
 }
 
+func gMapStringCompareRule(v interface{}) interface{} {
+	property := v.([]interface{})[0].(string)
+	operation := v.([]interface{})[1].(string)
+	argument := v.([]interface{})[2].(string)
+	return stringCompareRule{
+		property:  property,
+		operation: operation,
+		ref:       strings.ToLower(glob(argument).literal()),
+	}
+}
+
+func gMapRegexRule(v interface{}) interface{} {
+	property := v.([]interface{})[0].(string)
+	argument := v.([]interface{})[2].(string)
+	pattern, err := regexp.Compile("(?i)" + argument)
+	if err != nil {
+		return errorRule{err: fmt.Errorf("invalid regular expression for %s: %v", property, err)}
+	}
+	return regexRule{property: property, pattern: pattern}
+}
+
 func gMapOrdRule(v interface{}) interface{} {
 	property := v.([]interface{})[0].(string)
 	operation := v.([]interface{})[1].(string)
-	argument, _ := strconv.ParseInt(v.([]interface{})[2].(string), 10, 64)
+	argument, err := strconv.ParseInt(v.([]interface{})[2].(string), 10, 64)
+	if err != nil {
+		return errorRule{err: fmt.Errorf("invalid value for %s: %v", property, err)}
+	}
 	switch operation {
-	case "=":
+	case "=", ":":
 		return ordEqualsRule{property: property, ref: argument}
+	case "!=":
+		return notRule{rule: ordEqualsRule{property: property, ref: argument}}
 	case "<":
 		return ordLessThanRule{property: property, ref: argument}
 	case ">":
 		return ordGreaterThanRule{property: property, ref: argument}
+	case "<=":
+		return ordRangeRule{property: property, min: math.MinInt64, max: argument}
+	case ">=":
+		return ordRangeRule{property: property, min: argument, max: math.MaxInt64}
 	}
 	panic("unreachable")
 }
 
-func gMapRuleSet(vv interface{}) interface{} {
-	rules := []rule{}
-	for _, v := range vv.([]interface{}) {
-		rule, ok := v.(rule)
-		if ok {
-			rules = append(rules, rule)
+var ageUnits = map[string]time.Duration{
+	"h": time.Hour,
+	"d": time.Hour * 24,
+	"w": time.Hour * 24 * 7,
+	"y": time.Hour * 24 * 365,
+}
+
+func gMapAgeRule(v interface{}) interface{} {
+	property := v.([]interface{})[0].(string)
+	operation := v.([]interface{})[1].(string)
+	n, err := strconv.ParseInt(v.([]interface{})[2].(string), 10, 32)
+	if err != nil {
+		return errorRule{err: fmt.Errorf("invalid age for %s: %v", property, err)}
+	}
+	unit := ageUnits[v.([]interface{})[3].(string)]
+	return ageRule{property: property, operation: operation, age: time.Duration(n) * unit}
+}
+
+func gMapRangeRule(v interface{}) interface{} {
+	property := v.([]interface{})[0].(string)
+	bounds := v.([]interface{})[2].([]interface{})
+	if bounds[0] == nil && bounds[2] == nil {
+		return errorRule{err: fmt.Errorf("invalid range for %s: no bounds", property)}
+	}
+	rule := ordRangeRule{property: property, min: math.MinInt64, max: math.MaxInt64}
+	for i, bound := range []*int64{&rule.min, &rule.max} {
+		if s, ok := bounds[i*2].(string); ok {
+			var err error
+			if *bound, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return errorRule{err: fmt.Errorf("invalid range for %s: %v", property, err)}
+			}
 		}
 	}
-	return rules
+	if rule.min > rule.max {
+		return errorRule{err: fmt.Errorf("invalid range for %s: %d > %d", property, rule.min, rule.max)}
+	}
+	return rule
+}
+
+func gMapInvalidRule(v interface{}) interface{} {
+	property := v.([]interface{})[0].(string)
+	operation := v.([]interface{})[1].(string)
+	argument, _ := v.([]interface{})[2].(string)
+	if (&library.Track{}).Attr(property) == nil {
+		return errorRule{err: fmt.Errorf("unknown key: %q", property), expected: library.TrackAttrs}
+	}
+	return errorRule{err: fmt.Errorf("invalid condition for %s: %s%s%s", property, property, operation, argument)}
+}
+
+func gMapNotRule(v interface{}) interface{} {
+	return notRule{rule: v.(rule)}
+}
+
+func gMapAndRule(v interface{}) interface{} {
+	first, rest := v.([]interface{})[0].(rule), v.([]interface{})[1].([]interface{})
+	if len(rest) == 0 {
+		return first
+	}
+	rules := []rule{first}
+	for _, r := range rest {
+		rules = append(rules, r.(rule))
+	}
+	return andRule{rules: rules}
+}
+
+func gMapOrRule(v interface{}) interface{} {
+	first, rest := v.([]interface{})[0].(rule), v.([]interface{})[1].([]interface{})
+	if len(rest) == 0 {
+		return first
+	}
+	rules := []rule{first}
+	for _, r := range rest {
+		rules = append(rules, r.(rule))
+	}
+	return orRule{rules: rules}
+}
+
+func gPick(index int) ApplyFunc {
+	return func(v interface{}) interface{} {
+		return v.([]interface{})[index]
+	}
+}
+
+// walkRules calls fn for the specified rule and all rules nested in it.
+func walkRules(r rule, fn func(rule)) {
+	fn(r)
+	switch t := r.(type) {
+	case andRule:
+		for _, r := range t.rules {
+			walkRules(r, fn)
+		}
+	case orRule:
+		for _, r := range t.rules {
+			walkRules(r, fn)
+		}
+	case notRule:
+		walkRules(t.rule, fn)
+	}
 }
 
 func init() {
@@ -222,7 +663,7 @@ type (
 		Query    string   `json:"query"`
 		Untagged []string `json:"untagged"`
 
-		rules []rule
+		rule rule
 	}
 )
 
@@ -236,31 +677,64 @@ type (
 // A track should contain all the keywords to pass selection. If no property is
 // set, the value is searched for in the fields specified by untaggedFields.
 //
-// It is possible to use asterisks as wildcards.
-// A literal whitespace character may be specified by a leading backslash.
+// It is possible to use asterisks and question marks as wildcards. Values may
+// be put in double quotes to search for phrases, wildcards in quoted values are
+// matched literally. Any character may be escaped by a leading backslash.
+// Matching is case insensitive.
+//
+// Keywords may be combined with the OR operator and be negated by prefixing
+// them with NOT or a dash. Parentheses can be used for grouping. Negation binds
+// the strongest, followed by the implicit AND between keywords and finally OR.
+//
+// The modification time may be compared to an age in hours, days, weeks or
+// years, so modtime<30d matches tracks that were modified in the last 30 days.
 //
 // The query could look something like this:
 //
-//	foo bar baz title:something album:one\ two artist:foo*ar
+//	foo bar baz title:something album:one\ two artist:foo*ar title:"don't stop"
+//	(artist:beatles OR artist:stones) -genre:christmas
+//
+// A *ParseError is returned if the query is malformed.
 func CompileQuery(query string, untaggedFields []string) (*Query, error) {
-	v, r := parser(untaggedFields)(query)
-	if r < 0 {
-		return nil, fmt.Errorf("parse error")
+	var ff furthestFailure
+	v, r := parser(untaggedFields, &ff)(query)
+	if r < 0 || r != len(query) {
+		return nil, ff.parseError(query, r)
+	}
+	compiled := v.(rule)
+
+	var ruleErr error
+	walkRules(compiled, func(r rule) {
+		if er, ok := r.(errorRule); ok && ruleErr == nil {
+			offset := len(query) - er.remaining
+			ruleErr = &ParseError{
+				Offset:   offset,
+				Fragment: query[offset : offset+er.length],
+				Expected: er.expected,
+				Reason:   er.err.Error(),
+			}
+		}
+	})
+	if ruleErr != nil {
+		return nil, ruleErr
 	}
-	rules := v.([]rule)
 
 	if len(untaggedFields) == 0 {
-		for _, rule := range rules {
-			if _, ok := rule.(unkeyedRule); ok {
-				return nil, fmt.Errorf("untaggedFields is required for unkeyed rules")
+		var hasUnkeyed bool
+		walkRules(compiled, func(r rule) {
+			if _, ok := r.(unkeyedRule); ok {
+				hasUnkeyed = true
 			}
+		})
+		if hasUnkeyed {
+			return nil, fmt.Errorf("untaggedFields is required for unkeyed rules")
 		}
 	}
 
 	return &Query{
 		Query:    query,
 		Untagged: untaggedFields,
-		rules:    rules,
+		rule:     compiled,
 	}, nil
 }
 
@@ -287,22 +761,20 @@ func (sq *Query) UnmarshalJSON(data []byte) error {
 
 // Filter implements the filter.Filter interface.
 func (sq *Query) Filter(track library.Track) (filter.SearchResult, bool) {
-	if sq == nil || len(sq.rules) == 0 {
+	if sq == nil || sq.rule == nil {
 		return filter.SearchResult{}, false
 	}
 
+	matches, ok := sq.rule.Match(&track)
+	if !ok {
+		return filter.SearchResult{}, false
+	}
 	result := filter.SearchResult{
 		Track:   track,
 		Matches: map[string][]filter.SearchMatch{},
 	}
-	for _, rule := range sq.rules {
-		matches := rule.Match(&track)
-		if len(matches) == 0 {
-			return filter.SearchResult{}, false
-		}
-		for property, m := range matches {
-			result.AddMatches(property, m...)
-		}
+	for property, m := range matches {
+		result.AddMatches(property, m...)
 	}
-	return result, len(result.Matches) > 0
+	return result, true
 }
@@ -2,8 +2,12 @@ package keyed
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"trollibox/src/library"
 )
@@ -11,69 +15,214 @@ import (
 func TestParser(t *testing.T) {
 	testcases := []struct {
 		query  string
-		expect []rule
+		expect rule
 	}{
 		{
 			"artist:foo",
-			[]rule{stringContainsRule{property: "artist", needle: "foo"}},
+			stringContainsRule{property: "artist", needle: "foo"},
 		},
 		{
 			"title=foo",
-			[]rule{stringEqualsRule{property: "title", needle: "foo"}},
+			stringEqualsRule{property: "title", needle: "foo"},
 		},
 		{
 			"duration=42",
-			[]rule{ordEqualsRule{property: "duration", ref: 42}},
+			ordEqualsRule{property: "duration", ref: 42},
 		},
 		{
 			"duration<1",
-			[]rule{ordLessThanRule{property: "duration", ref: 1}},
+			ordLessThanRule{property: "duration", ref: 1},
 		},
 		{
 			"duration>1337",
-			[]rule{ordGreaterThanRule{property: "duration", ref: 1337}},
+			ordGreaterThanRule{property: "duration", ref: 1337},
 		},
 		{
 			"foo",
-			[]rule{unkeyedRule{properties: []string{"property"}, needle: "foo"}},
+			unkeyedRule{properties: []string{"property"}, needle: "foo"},
 		},
 		{
 			"foo\\ bar",
-			[]rule{unkeyedRule{properties: []string{"property"}, needle: "foo bar"}},
+			unkeyedRule{properties: []string{"property"}, needle: "foo bar"},
 		},
 		{
 			"artist:foo\\ bar",
-			[]rule{stringContainsRule{property: "artist", needle: "foo bar"}},
+			stringContainsRule{property: "artist", needle: "foo bar"},
 		},
 		{
 			"foo bar",
-			[]rule{
+			andRule{rules: []rule{
 				unkeyedRule{properties: []string{"property"}, needle: "foo"},
 				unkeyedRule{properties: []string{"property"}, needle: "bar"},
-			},
+			}},
 		},
 		{
 			"foo artist:bar",
-			[]rule{
+			andRule{rules: []rule{
 				unkeyedRule{properties: []string{"property"}, needle: "foo"},
 				stringContainsRule{property: "artist", needle: "bar"},
-			},
+			}},
 		},
+		{
+			" foo  bar ",
+			andRule{rules: []rule{
+				unkeyedRule{properties: []string{"property"}, needle: "foo"},
+				unkeyedRule{properties: []string{"property"}, needle: "bar"},
+			}},
+		},
+		{
+			"artist:foo OR artist:bar",
+			orRule{rules: []rule{
+				stringContainsRule{property: "artist", needle: "foo"},
+				stringContainsRule{property: "artist", needle: "bar"},
+			}},
+		},
+		{
+			"foo bar OR baz",
+			orRule{rules: []rule{
+				andRule{rules: []rule{
+					unkeyedRule{properties: []string{"property"}, needle: "foo"},
+					unkeyedRule{properties: []string{"property"}, needle: "bar"},
+				}},
+				unkeyedRule{properties: []string{"property"}, needle: "baz"},
+			}},
+		},
+		{
+			"foo (bar OR baz)",
+			andRule{rules: []rule{
+				unkeyedRule{properties: []string{"property"}, needle: "foo"},
+				orRule{rules: []rule{
+					unkeyedRule{properties: []string{"property"}, needle: "bar"},
+					unkeyedRule{properties: []string{"property"}, needle: "baz"},
+				}},
+			}},
+		},
+		{
+			"-foo",
+			notRule{rule: unkeyedRule{properties: []string{"property"}, needle: "foo"}},
+		},
+		{
+			"NOT foo",
+			notRule{rule: unkeyedRule{properties: []string{"property"}, needle: "foo"}},
+		},
+		{
+			"NOT (foo OR bar)",
+			notRule{rule: orRule{rules: []rule{
+				unkeyedRule{properties: []string{"property"}, needle: "foo"},
+				unkeyedRule{properties: []string{"property"}, needle: "bar"},
+			}}},
+		},
+		{
+			"orchestra",
+			unkeyedRule{properties: []string{"property"}, needle: "orchestra"},
+		},
+		{
+			"ORCHESTRA",
+			unkeyedRule{properties: []string{"property"}, needle: "ORCHESTRA"},
+		},
+		{
+			"artist:foo*ar",
+			stringContainsRule{property: "artist", needle: "foo*ar"},
+		},
+		{
+			`title:"don't stop"`,
+			stringContainsRule{property: "title", needle: "don't stop"},
+		},
+		{
+			`title:"foo*bar \"baz\" \\"`,
+			stringContainsRule{property: "title", needle: `foo\*bar "baz" \\`},
+		},
+		{
+			`foo\*bar`,
+			unkeyedRule{properties: []string{"property"}, needle: `foo\*bar`},
+		},
+		{
+			"jean-michel",
+			unkeyedRule{properties: []string{"property"}, needle: "jean-michel"},
+		},
+		{
+			"artist:björk title:jóga",
+			andRule{rules: []rule{
+				stringContainsRule{property: "artist", needle: "björk"},
+				stringContainsRule{property: "title", needle: "jóga"},
+			}},
+		},
+		{
+			`title=""`,
+			stringEqualsRule{property: "title", needle: ""},
+		},
+		{
+			"genre:jazz albumartist=foo",
+			andRule{rules: []rule{
+				stringContainsRule{property: "genre", needle: "jazz"},
+				stringEqualsRule{property: "albumartist", needle: "foo"},
+			}},
+		},
+		{
+			"artist!=foo",
+			notRule{rule: stringEqualsRule{property: "artist", needle: "foo"}},
+		},
+		{
+			"duration!=42",
+			notRule{rule: ordEqualsRule{property: "duration", ref: 42}},
+		},
+		{
+			"duration:42",
+			ordEqualsRule{property: "duration", ref: 42},
+		},
+		{
+			"duration:120..300",
+			ordRangeRule{property: "duration", min: 120, max: 300},
+		},
+		{
+			"duration:120..",
+			ordRangeRule{property: "duration", min: 120, max: math.MaxInt64},
+		},
+		{
+			"albumtrack:..3",
+			ordRangeRule{property: "albumtrack", min: math.MinInt64, max: 3},
+		},
+		{
+			"albumtrack:<5",
+			ordLessThanRule{property: "albumtrack", ref: 5},
+		},
+		{
+			"albumdisc>=2",
+			ordRangeRule{property: "albumdisc", min: 2, max: math.MaxInt64},
+		},
+		{
+			"artist:<m",
+			stringCompareRule{property: "artist", operation: "<", ref: "m"},
+		},
+		{
+			"title:...",
+			stringContainsRule{property: "title", needle: "..."},
+		},
+		{"", nil},
+		{`title:"foo`, nil},
+		{"foo OR", nil},
+		{"(foo", nil},
+		{"foo)", nil},
+		{"()", nil},
 	}
-	p := parser([]string{"property"})
+	p := parser([]string{"property"}, nil)
 	for _, tt := range testcases {
 		t.Run(tt.query, func(t *testing.T) {
-			vv, r := p(tt.query)
+			v, r := p(tt.query)
+			if r != len(tt.query) {
+				r = -1
+			}
 			if r < 0 && tt.expect != nil {
 				t.Fatalf("Expected a match")
 			} else if r >= 0 && tt.expect == nil {
 				t.Fatalf("Expected no match")
+			} else if r < 0 {
+				return
 			}
-			rules := vv.([]rule)
-			if !reflect.DeepEqual(rules, tt.expect) {
+			if !reflect.DeepEqual(v, tt.expect) {
 				t.Logf("exp %#v", tt.expect)
-				t.Logf("got %#v", rules)
-				t.Fatalf("Unexpected rules")
+				t.Logf("got %#v", v)
+				t.Fatalf("Unexpected rule")
 			}
 		})
 	}
@@ -84,7 +233,7 @@ func TestCompileQuery(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("%#v", query.rules)
+	t.Logf("%#v", query.rule)
 	if !reflect.DeepEqual(query.Untagged, []string{"artist", "title"}) {
 		t.Fatalf("Unexpected untagged: %#v", query.Untagged)
 	} else if query.Query != "foo bar baz" {
@@ -117,7 +266,7 @@ func TestFilter(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("%#v", query.rules)
+	t.Logf("%#v", query.rule)
 	result, ok := query.Filter(library.Track{
 		Artist: "asdffootest123",
 	})
@@ -140,7 +289,7 @@ func TestFilter(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("%#v", query.rules)
+	t.Logf("%#v", query.rule)
 	result, ok = query.Filter(library.Track{
 		Artist: "foo bar baz",
 	})
@@ -156,7 +305,7 @@ func TestJSON(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("%#v", query.rules)
+	t.Logf("%#v", query.rule)
 
 	encoded, err := json.Marshal(query)
 	if err != nil {
@@ -184,3 +333,343 @@ func TestJSON(t *testing.T) {
 		t.Fatalf("Unexpected number of matches: %v", n)
 	}
 }
+
+func TestFilterBoolean(t *testing.T) {
+	tracks := []library.Track{
+		{Artist: "The Beatles", Title: "Yesterday", Genre: "Rock"},
+		{Artist: "The Rolling Stones", Title: "Angie", Genre: "Rock"},
+		{Artist: "Mariah Carey", Title: "All I Want for Christmas Is You", Genre: "Christmas"},
+	}
+	testcases := []struct {
+		query  string
+		expect []string
+	}{
+		{"artist:beatles OR artist:stones", []string{"The Beatles", "The Rolling Stones"}},
+		{"-genre:christmas", []string{"The Beatles", "The Rolling Stones"}},
+		{"NOT genre:christmas", []string{"The Beatles", "The Rolling Stones"}},
+		{"(artist:beatles OR artist:carey) -genre:christmas", []string{"The Beatles"}},
+		{"artist:the -(title:angie OR title:yesterday)", []string{}},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := CompileQuery(tt.query, []string{"artist", "title"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			matched := []string{}
+			for _, track := range tracks {
+				if _, ok := query.Filter(track); ok {
+					matched = append(matched, track.Artist)
+				}
+			}
+			if !reflect.DeepEqual(matched, tt.expect) {
+				t.Fatalf("Unexpected matches: %q", matched)
+			}
+		})
+	}
+}
+
+func TestFilterBooleanMatches(t *testing.T) {
+	query, err := CompileQuery("artist:foo OR title:bar OR album:baz", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := query.Filter(library.Track{
+		Artist: "foo",
+		Title:  "qux",
+		Album:  "baz",
+	})
+	if !ok {
+		t.Fatalf("No match while a match was expected")
+	}
+	if _, ok := result.Matches["title"]; ok {
+		t.Fatalf("Branches that did not match should not be highlighted")
+	}
+	if n := result.NumMatches(); n != 2 {
+		t.Fatalf("Unexpected number of matches: %v", n)
+	}
+
+	query, err = CompileQuery("artist:foo -title:bar", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok = query.Filter(library.Track{
+		Artist: "foo",
+		Title:  "qux",
+	})
+	if !ok {
+		t.Fatalf("No match while a match was expected")
+	} else if n := result.NumMatches(); n != 1 {
+		t.Fatalf("Unexpected number of matches: %v", n)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	testcases := []struct {
+		pattern    glob
+		subject    string
+		start, end int
+		full       bool
+	}{
+		{"foo", "foo", 0, 3, true},
+		{"foo", "xfoox", 1, 4, false},
+		{"FOO", "xfoox", 1, 4, false},
+		{"foo", "bar", -1, -1, false},
+		{"foo*ar", "the foobar", 4, 10, false},
+		{"foo*ar", "foo bar baz", 0, 7, false},
+		{"foo*", "foobar", 0, 3, true},
+		{"*", "foobar", 0, 0, true},
+		{"f?o", "xfoo", 1, 4, false},
+		{"f?o", "fo", -1, -1, false},
+		{`foo\*`, "foobar", -1, -1, false},
+		{`foo\*`, "foo*", 0, 4, true},
+		{`a\\b`, `a\b`, 0, 3, true},
+		{"björk", "BJÖRK", 0, 6, true},
+		{"σίσυφος", "ΣΊΣΥΦΟΣ", 0, 14, true},
+		{"straße", "Die Straße", 4, 11, false},
+		{"", "foo", 0, 0, false},
+	}
+	for _, tt := range testcases {
+		t.Run(string(tt.pattern)+"_"+tt.subject, func(t *testing.T) {
+			if start, end := tt.pattern.index(tt.subject); start != tt.start || end != tt.end {
+				t.Fatalf("Unexpected index: exp (%d, %d), got (%d, %d)", tt.start, tt.end, start, end)
+			}
+			if full := tt.pattern.matches(tt.subject); full != tt.full {
+				t.Fatalf("Unexpected full match: exp %v, got %v", tt.full, full)
+			}
+		})
+	}
+}
+
+func TestFilterWildcardAndPhrase(t *testing.T) {
+	query, err := CompileQuery(`title:"don't stop" artist=*queen`, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := query.Filter(library.Track{
+		Artist: "Queen",
+		Title:  "Don't Stop Me Now",
+	})
+	if !ok {
+		t.Fatalf("No match while a match was expected")
+	} else if m := result.Matches["title"][0]; m.Start != 0 || m.End != 10 {
+		t.Fatalf("Unexpected match indices: %#v", m)
+	} else if m := result.Matches["artist"][0]; m.Start != 0 || m.End != 5 {
+		t.Fatalf("Unexpected match indices: %#v", m)
+	}
+
+	if _, ok := query.Filter(library.Track{Artist: "Queens of the Stone Age", Title: "Don't Stop"}); ok {
+		t.Fatalf("Equality should match the whole attribute")
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	testcases := []struct {
+		query string
+		err   string
+	}{
+		{"genr:foo", `unknown key: "genr"`},
+		{"artist:foo Year>1990", `unknown key: "Year"`},
+		{"duration:abc", "invalid condition for duration"},
+		{"duration~foo", "invalid condition for duration"},
+		{"duration:300..120", "invalid range for duration"},
+		{"duration:..", "invalid range for duration"},
+		{`title~"(foo"`, "invalid regular expression for title"},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := CompileQuery(tt.query, []string{"artist"})
+			if err == nil {
+				t.Fatalf("Expected an error")
+			} else if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompileQueryParseError(t *testing.T) {
+	testcases := []struct {
+		query    string
+		offset   int
+		fragment string
+		expected string
+	}{
+		{`title:"foo`, 10, "", `'"'`},
+		{"foo OR", 6, "", "value"},
+		{"(foo", 4, "", "')'"},
+		{"foo  bar )", 9, ")", "'('"},
+		{"artist:foo genr:bar", 11, "genr:bar", "genre"},
+		{"artist:foo duration:..", 11, "duration:..", ""},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := CompileQuery(tt.query, []string{"artist"})
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a parse error, got %v", err)
+			}
+			if parseErr.Offset != tt.offset {
+				t.Fatalf("Unexpected offset: exp %d, got %d", tt.offset, parseErr.Offset)
+			}
+			if parseErr.Fragment != tt.fragment {
+				t.Fatalf("Unexpected fragment: exp %q, got %q", tt.fragment, parseErr.Fragment)
+			}
+			if tt.expected == "" {
+				return
+			}
+			for _, e := range parseErr.Expected {
+				if e == tt.expected {
+					return
+				}
+			}
+			t.Fatalf("Expected %q in %q", tt.expected, parseErr.Expected)
+		})
+	}
+}
+
+func TestFilterOperators(t *testing.T) {
+	tracks := []library.Track{
+		{Artist: "ABBA", Title: "Waterloo", AlbumTrack: "1/12", Duration: 170 * time.Second},
+		{Artist: "Bananarama", Title: "Venus", AlbumTrack: "4", Duration: 220 * time.Second},
+		{Artist: "Cher", Title: "Believe", AlbumTrack: "7/10", Duration: 240 * time.Second},
+	}
+	testcases := []struct {
+		query  string
+		expect []string
+	}{
+		{"albumtrack:<5", []string{"ABBA", "Bananarama"}},
+		{"albumtrack:4..7", []string{"Bananarama", "Cher"}},
+		{"duration:200..300", []string{"Bananarama", "Cher"}},
+		{"duration<=220", []string{"ABBA", "Bananarama"}},
+		{"artist!=cher", []string{"ABBA", "Bananarama"}},
+		{`title~"^(venus|believe)$"`, []string{"Bananarama", "Cher"}},
+		{"artist>=b", []string{"Bananarama", "Cher"}},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := CompileQuery(tt.query, []string{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			matched := []string{}
+			for _, track := range tracks {
+				if _, ok := query.Filter(track); ok {
+					matched = append(matched, track.Artist)
+				}
+			}
+			if !reflect.DeepEqual(matched, tt.expect) {
+				t.Fatalf("Unexpected matches: %q", matched)
+			}
+		})
+	}
+}
+
+func TestFilterDates(t *testing.T) {
+	now := time.Now()
+	tracks := []library.Track{
+		{Artist: "ABBA", Date: "1974-03-04", ModTime: now.Add(-time.Hour * 24 * 400)},
+		{Artist: "Bananarama", Date: "1986", ModTime: now.Add(-time.Hour * 24 * 10)},
+		{Artist: "Cher", Date: "1998-10-22", ModTime: now.Add(-time.Hour * 5)},
+		{Artist: "Unknown"},
+	}
+	testcases := []struct {
+		query  string
+		expect []string
+	}{
+		{"year:1980..1989", []string{"Bananarama"}},
+		{"year>=1980", []string{"Bananarama", "Cher"}},
+		{"date:1998", []string{"Cher"}},
+		{"modtime<30d", []string{"Bananarama", "Cher"}},
+		{"modtime:<=1w", []string{"Cher"}},
+		{"modtime<12h", []string{"Cher"}},
+		{"modtime>1y", []string{"ABBA"}},
+		{"-modtime<30d", []string{"ABBA", "Unknown"}},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := CompileQuery(tt.query, []string{"artist"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			matched := []string{}
+			for _, track := range tracks {
+				if _, ok := query.Filter(track); ok {
+					matched = append(matched, track.Artist)
+				}
+			}
+			if !reflect.DeepEqual(matched, tt.expect) {
+				t.Fatalf("Unexpected matches: %q", matched)
+			}
+		})
+	}
+
+	if _, err := CompileQuery("duration<30d", nil); err == nil {
+		t.Fatalf("Expected an error for an age of a non-timestamp")
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	tracks := []library.Track{
+		{Artist: "The Beatles", Title: "Help!", Album: "Help!"},
+		{Artist: "The Rolling Stones", Title: "Paint It Black", Album: "Aftermath"},
+		{Artist: "Beat Happening", Title: "Indian Summer", Album: "Jamboree"},
+		{Artist: "Sigur Rós", Title: "Hoppípolla", Album: "Takk..."},
+		{Artist: "AC/DC", Title: "T.N.T.", Album: "T.N.T.", Duration: 214 * time.Second},
+	}
+	index := library.NewIndex(tracks)
+
+	testcases := []struct {
+		query  string
+		expect []int // nil if the index can not be used.
+	}{
+		{"beat", []int{0, 2}},
+		{"e bea", []int{0, 2}},
+		{"artist:the", []int{0, 1}},
+		{"artist=the*", []int{0, 1}},
+		{"artist:\"the beatles\"", []int{0}},
+		{"artist:RÓS", []int{3}},
+		{"help OR summer", []int{0, 2}},
+		{"the -help", []int{0, 1}},
+		{"title:t.n.t", []int{4}},
+		{"ac/dc", []int{4}},
+		{"artist:*", nil},
+		{"duration>200", nil},
+		{"help OR duration>200", nil},
+		{"-help", nil},
+		{"artist~beat", nil},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := CompileQuery(tt.query, []string{"artist", "title", "album"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates, ok := query.Candidates(index)
+			if !ok {
+				if tt.expect != nil {
+					t.Fatalf("Expected the index to be used")
+				}
+				return
+			}
+			if tt.expect == nil {
+				t.Fatalf("Expected the index not to be used, got %v", candidates)
+			}
+			if !reflect.DeepEqual(candidates, tt.expect) {
+				t.Fatalf("Unexpected candidates: exp %v, got %v", tt.expect, candidates)
+			}
+			for i, track := range tracks {
+				if _, ok := query.Filter(track); !ok {
+					continue
+				}
+				found := false
+				for _, c := range candidates {
+					found = found || c == i
+				}
+				if !found {
+					t.Fatalf("Matching track %d is not a candidate", i)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,94 @@
 package keyed
 
 import (
+	"fmt"
 	"strings"
 )
 
+// A ParseError is returned when a query could not be compiled. It points at
+// the part of the query that is in error.
+type ParseError struct {
+	// The byte offset into the query at which the error was detected.
+	Offset int `json:"offset"`
+	// The part of the query that is in error.
+	Fragment string `json:"fragment"`
+	// The tokens that would have been valid at the offset, if known.
+	Expected []string `json:"expected,omitempty"`
+	// A description of the error for errors that are not caused by the
+	// query's syntax.
+	Reason string `json:"reason,omitempty"`
+}
+
+func (err *ParseError) Error() string {
+	if err.Reason != "" {
+		return fmt.Sprintf("parse error at offset %d (%q): %s", err.Offset, err.Fragment, err.Reason)
+	}
+	return fmt.Sprintf("parse error at offset %d (%q): expected one of %s", err.Offset, err.Fragment, strings.Join(err.Expected, ", "))
+}
+
+// furthestFailure keeps track of the failure that occurred the furthest into
+// the source, which is most likely the location of the actual error.
+type furthestFailure struct {
+	failed    bool
+	remaining int
+	expected  []string
+}
+
+// expect records a failure of the named parser. A nil receiver is valid and
+// does not record anything.
+func (ff *furthestFailure) expect(name string, parser ParseFunc) ParseFunc {
+	if ff == nil {
+		return parser
+	}
+	return func(source string) (interface{}, int) {
+		v, r := parser(source)
+		if r >= 0 {
+			return v, r
+		}
+		if !ff.failed || len(source) < ff.remaining {
+			ff.failed, ff.remaining, ff.expected = true, len(source), []string{name}
+		} else if len(source) == ff.remaining {
+			for _, e := range ff.expected {
+				if e == name {
+					return nil, -1
+				}
+			}
+			ff.expected = append(ff.expected, name)
+		}
+		return nil, -1
+	}
+}
+
+// parseError builds a ParseError for the query from the recorded failure. The
+// consumed argument is used as the location if no failure was recorded.
+func (ff *furthestFailure) parseError(query string, consumed int) *ParseError {
+	offset := consumed
+	if ff.failed {
+		offset = len(query) - ff.remaining
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	expected := ff.expected
+	if !ff.failed {
+		expected = []string{"end of query"}
+	}
+	return &ParseError{
+		Offset:   offset,
+		Fragment: fragmentAt(query, offset),
+		Expected: expected,
+	}
+}
+
+// fragmentAt returns the word that starts at the offset into the query.
+func fragmentAt(query string, offset int) string {
+	fragment := query[offset:]
+	if i := strings.IndexByte(fragment, ' '); i >= 0 {
+		fragment = fragment[:i]
+	}
+	return fragment
+}
+
 type (
 	// ParseFunc is an internal parser combinator primitive.
 	ParseFunc func(source string) (value interface{}, remainderIndex int)
@@ -99,3 +184,45 @@ func pApply(p ParseFunc, fn ApplyFunc) ParseFunc {
 		return fn(v), r
 	}
 }
+
+func pMany(parser ParseFunc) ParseFunc {
+	return func(source string) (interface{}, int) {
+		vv, rr := []interface{}{}, 0
+		for {
+			v, r := parser(source[rr:])
+			if r <= 0 {
+				break
+			}
+			rr += r
+			vv = append(vv, v)
+		}
+		return vv, rr
+	}
+}
+
+// pNot is a negative lookahead. It succeeds without consuming any input if
+// the specified parser fails.
+func pNot(parser ParseFunc) ParseFunc {
+	return func(source string) (interface{}, int) {
+		if _, r := parser(source); r >= 0 {
+			return nil, -1
+		}
+		return nil, 0
+	}
+}
+
+// pRef dereferences the parser lazily so recursive grammars can be expressed.
+func pRef(parser *ParseFunc) ParseFunc {
+	return func(source string) (interface{}, int) {
+		return (*parser)(source)
+	}
+}
+
+func pOptional(parser ParseFunc) ParseFunc {
+	return func(source string) (interface{}, int) {
+		if v, r := parser(source); r >= 0 {
+			return v, r
+		}
+		return nil, 0
+	}
+}
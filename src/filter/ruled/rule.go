@@ -20,6 +20,12 @@ const (
 	Greater  Op = "greater"
 	Less     Op = "less"
 	Matches  Op = "matches"
+	// Within matches timestamps that are at most Value seconds ago.
+	Within Op = "within"
+
+	// Operations for groups of rules.
+	All Op = "all"
+	Any Op = "any"
 )
 
 func init() {
@@ -30,6 +36,9 @@ func init() {
 
 // A Rule represents an expression that compares some Track's attribute
 // according to an operation with a reference value.
+//
+// If the operation is All or Any, the rule is a group that matches if
+// respectively all or any of the nested rules match. Groups may be nested.
 type Rule struct {
 	// Name of the track attribute to match.
 	Attribute string `json:"attribute"`
@@ -42,10 +51,144 @@ type Rule struct {
 
 	// The value to use with the operation.
 	Value interface{} `json:"value"`
+
+	// The nested rules of a group.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// The factor by which the weight of a track is multiplied if it passes
+	// this rule, see filter.SearchResult. Zero leaves the weight unchanged.
+	Boost float64 `json:"boost,omitempty"`
+}
+
+// IsGroup reports whether the rule is a group of rules.
+func (rule Rule) IsGroup() bool {
+	return rule.Operation == All || rule.Operation == Any
+}
+
+// A ruleFunc matches a track and returns the matches for highlighting along
+// with the weight of the track.
+type ruleFunc func(library.Track) (map[string][]filter.SearchMatch, float64, bool)
+
+func (rule Rule) weight() float64 {
+	if rule.Boost == 0 {
+		return 1
+	}
+	return rule.Boost
+}
+
+// compile creates a function that matches a track against the rule or group
+// of rules. The path is the location of the rule which is used to report
+// errors.
+func (rule Rule) compile(path []int) (ruleFunc, error) {
+	if rule.Boost < 0 {
+		return nil, &RuleError{
+			OrigErr: fmt.Errorf("rule's Boost can not be negative (%v)", rule),
+			Rule:    rule,
+			Index:   path[0],
+			Path:    path,
+		}
+	}
+	if !rule.IsGroup() {
+		if len(rule.Rules) > 0 {
+			return nil, &RuleError{
+				OrigErr: fmt.Errorf("rule's Operation must be %q or %q for groups (%v)", All, Any, rule),
+				Rule:    rule,
+				Index:   path[0],
+				Path:    path,
+			}
+		}
+		match, err := rule.MatchFunc()
+		if err != nil {
+			return nil, &RuleError{OrigErr: err, Rule: rule, Index: path[0], Path: path}
+		}
+		return func(track library.Track) (map[string][]filter.SearchMatch, float64, bool) {
+			matches, ok := match(track)
+			if !ok {
+				return nil, 0, false
+			}
+			return map[string][]filter.SearchMatch{rule.Attribute: matches}, rule.weight(), true
+		}, nil
+	}
+
+	if rule.Attribute != "" || rule.Value != nil {
+		return nil, &RuleError{
+			OrigErr: fmt.Errorf("rule's Attribute and Value must be unset for groups (%v)", rule),
+			Rule:    rule,
+			Index:   path[0],
+			Path:    path,
+		}
+	}
+	funcs, err := compileFuncs(rule.Rules, path)
+	if err != nil {
+		return nil, err
+	}
+	var match ruleFunc
+	if rule.Operation == All {
+		match = matchAll(funcs)
+	} else {
+		match = matchAny(funcs)
+	}
+	if rule.Invert {
+		return func(track library.Track) (map[string][]filter.SearchMatch, float64, bool) {
+			// Whatever the group matched is exactly what is not wanted, so
+			// there is nothing to highlight.
+			_, _, ok := match(track)
+			return nil, rule.weight(), !ok
+		}, nil
+	}
+	return func(track library.Track) (map[string][]filter.SearchMatch, float64, bool) {
+		matches, weight, ok := match(track)
+		return matches, weight * rule.weight(), ok
+	}, nil
+}
+
+func matchAll(funcs []ruleFunc) ruleFunc {
+	return func(track library.Track) (map[string][]filter.SearchMatch, float64, bool) {
+		m, weight := map[string][]filter.SearchMatch{}, 1.0
+		for _, fn := range funcs {
+			matches, w, ok := fn(track)
+			if !ok {
+				return nil, 0, false
+			}
+			weight *= w
+			for attr, mm := range matches {
+				m[attr] = append(m[attr], mm...)
+			}
+		}
+		return m, weight, true
+	}
+}
+
+func matchAny(funcs []ruleFunc) ruleFunc {
+	return func(track library.Track) (map[string][]filter.SearchMatch, float64, bool) {
+		// All rules are evaluated so the highlighting and weight reflect every
+		// rule that matched.
+		m, weight, matched := map[string][]filter.SearchMatch{}, 1.0, false
+		for _, fn := range funcs {
+			matches, w, ok := fn(track)
+			if !ok {
+				continue
+			}
+			matched = true
+			weight *= w
+			for attr, mm := range matches {
+				m[attr] = append(m[attr], mm...)
+			}
+		}
+		if !matched {
+			return nil, 0, false
+		}
+		return m, weight, true
+	}
 }
 
 // MatchFunc Creates a function that matches a track based on this rules criteria.
+//
+// Groups of rules are not supported.
 func (rule Rule) MatchFunc() (func(library.Track) ([]filter.SearchMatch, bool), error) {
+	if rule.IsGroup() {
+		return nil, fmt.Errorf("rule is a group (%v)", rule)
+	}
 	if rule.Attribute == "" {
 		return nil, fmt.Errorf("rule's Attribute is unset (%v)", rule)
 	}
@@ -71,8 +214,24 @@ func (rule Rule) MatchFunc() (func(library.Track) ([]filter.SearchMatch, bool),
 		return nil, fmt.Errorf("value and attribute types do not match (%v, %v)", typeVal, typeTrack)
 	}
 
-	// The duration is currently the only integer attribute.
-	if rule.Attribute == "duration" {
+	var intVal int64
+	if v, ok := rule.Value.(float64); ok {
+		intVal = int64(v)
+	} else if v, ok := rule.Value.(int64); ok {
+		intVal = v
+	}
+
+	if rule.Operation == Within {
+		if rule.Attribute != "modtime" {
+			return nil, fmt.Errorf("the %q operation can only be used with timestamps (%v)", Within, rule)
+		}
+		age := time.Duration(intVal) * time.Second
+		return func(track library.Track) ([]filter.SearchMatch, bool) {
+			ts := track.Attr(rule.Attribute).(int64)
+			return nil, inv(ts != 0 && time.Since(time.Unix(ts, 0)) <= age)
+		}, nil
+
+	} else if rule.Attribute == "duration" {
 		var durVal time.Duration
 		if v, ok := rule.Value.(float64); ok {
 			durVal = time.Duration(v) * time.Second
@@ -94,6 +253,22 @@ func (rule Rule) MatchFunc() (func(library.Track) ([]filter.SearchMatch, bool),
 			}, nil
 		}
 
+	} else if typeTrack == reflect.Int64 {
+		switch rule.Operation {
+		case Equals:
+			return func(track library.Track) ([]filter.SearchMatch, bool) {
+				return nil, inv(track.Attr(rule.Attribute).(int64) == intVal)
+			}, nil
+		case Greater:
+			return func(track library.Track) ([]filter.SearchMatch, bool) {
+				return nil, inv(track.Attr(rule.Attribute).(int64) > intVal)
+			}, nil
+		case Less:
+			return func(track library.Track) ([]filter.SearchMatch, bool) {
+				return nil, inv(track.Attr(rule.Attribute).(int64) < intVal)
+			}, nil
+		}
+
 	} else if strVal, ok := rule.Value.(string); ok {
 		switch rule.Operation {
 		case Contains:
@@ -157,6 +332,13 @@ func (rule *Rule) String() string {
 	if rule.Invert {
 		invStr = " not"
 	}
+	if rule.IsGroup() {
+		strs := make([]string, len(rule.Rules))
+		for i := range rule.Rules {
+			strs[i] = rule.Rules[i].String()
+		}
+		return fmt.Sprintf("if%s %s (%s)", invStr, rule.Operation, strings.Join(strs, ", "))
+	}
 	return fmt.Sprintf("if%s %s %s %q", invStr, rule.Attribute, rule.Operation, rule.Value)
 }
 
@@ -164,8 +346,13 @@ func (rule *Rule) String() string {
 // filter.
 type RuleError struct {
 	OrigErr error `json:"-"`
-	Rule    Rule  `json:"rule"`
-	Index   int   `json:"index"`
+	// The rule that is in error, which may be nested in a group.
+	Rule Rule `json:"rule"`
+	// The index of the top level rule that is or contains the rule in error.
+	Index int `json:"index"`
+	// The indices of the rule in error and the groups containing it,
+	// starting at the top level.
+	Path []int `json:"path"`
 }
 
 func (err RuleError) Error() string {
@@ -178,7 +365,7 @@ type (
 	rawRuleFilter struct {
 		Rules []Rule `json:"rules"`
 
-		funcs []func(library.Track) ([]filter.SearchMatch, bool)
+		funcs []ruleFunc
 	}
 )
 
@@ -188,7 +375,7 @@ func BuildFilter(rules []Rule) (filter.Filter, error) {
 		Rules: rules,
 	}
 	var err error
-	ft.funcs, err = compileFuncs(rules)
+	ft.funcs, err = compileFuncs(rules, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -201,13 +388,16 @@ func (ft RuleFilter) Filter(track library.Track) (filter.SearchResult, bool) {
 		// No rules, match everything.
 		return filter.SearchResult{Track: track}, true
 	}
-	result := filter.SearchResult{Track: track}
-	for i, rule := range ft.funcs {
-		matches, ok := rule(track)
+	result := filter.SearchResult{Track: track, Weight: 1}
+	for _, rule := range ft.funcs {
+		matches, weight, ok := rule(track)
 		if !ok {
 			return filter.SearchResult{}, false
 		}
-		result.AddMatches(ft.Rules[i].Attribute, matches...)
+		result.Weight *= weight
+		for attr, mm := range matches {
+			result.AddMatches(attr, mm...)
+		}
 	}
 	return result, true
 }
@@ -226,16 +416,19 @@ func (ft *RuleFilter) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	ft.funcs, err = compileFuncs(ft.Rules)
+	ft.funcs, err = compileFuncs(ft.Rules, nil)
 	return err
 }
 
-func compileFuncs(rules []Rule) ([]func(library.Track) ([]filter.SearchMatch, bool), error) {
-	funcs := make([]func(library.Track) ([]filter.SearchMatch, bool), len(rules))
+// compileFuncs compiles a list of rules located at the path, which is nil for
+// the top level.
+func compileFuncs(rules []Rule, path []int) ([]ruleFunc, error) {
+	funcs := make([]ruleFunc, len(rules))
 	for i, rule := range rules {
+		rulePath := append(append([]int{}, path...), i)
 		var err error
-		if funcs[i], err = rule.MatchFunc(); err != nil {
-			return nil, &RuleError{OrigErr: err, Rule: rule, Index: i}
+		if funcs[i], err = rule.compile(rulePath); err != nil {
+			return nil, err
 		}
 	}
 	return funcs, nil
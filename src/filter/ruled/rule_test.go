@@ -1,6 +1,9 @@
 package ruled
 
 import (
+	"encoding/json"
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -287,6 +290,192 @@ func TestMatchesError(t *testing.T) {
 	}
 }
 
+func TestMatchGroups(t *testing.T) {
+	jazzOrBlues := Rule{
+		Operation: Any,
+		Rules: []Rule{
+			{Attribute: "genre", Operation: Equals, Value: "jazz"},
+			{Attribute: "genre", Operation: Equals, Value: "blues"},
+		},
+	}
+	notLive := Rule{Attribute: "title", Operation: Contains, Value: "live", Invert: true}
+
+	tt := []struct {
+		track       library.Track
+		shouldMatch bool
+		rules       rules
+	}{
+		{
+			track:       library.Track{Genre: "Jazz", Title: "So What"},
+			shouldMatch: true,
+			rules:       []Rule{jazzOrBlues, notLive},
+		},
+		{
+			track:       library.Track{Genre: "Blues", Title: "The Thrill Is Gone"},
+			shouldMatch: true,
+			rules:       []Rule{jazzOrBlues, notLive},
+		},
+		{
+			track:       library.Track{Genre: "Blues", Title: "Sweet Home Chicago (Live)"},
+			shouldMatch: false,
+			rules:       []Rule{jazzOrBlues, notLive},
+		},
+		{
+			track:       library.Track{Genre: "Rock", Title: "Paint It Black"},
+			shouldMatch: false,
+			rules:       []Rule{jazzOrBlues, notLive},
+		},
+		{
+			track:       library.Track{Genre: "Rock", Title: "Paint It Black"},
+			shouldMatch: true,
+			rules: []Rule{{
+				Operation: Any,
+				Invert:    true,
+				Rules:     jazzOrBlues.Rules,
+			}},
+		},
+		{
+			track:       library.Track{Genre: "Rock", Artist: "Cream", Title: "Crossroads (Live)"},
+			shouldMatch: true,
+			rules: []Rule{{
+				Operation: Any,
+				Rules: []Rule{
+					jazzOrBlues,
+					{
+						Operation: All,
+						Rules: []Rule{
+							{Attribute: "artist", Operation: Equals, Value: "cream"},
+							{Attribute: "title", Operation: Contains, Value: "live"},
+						},
+					},
+				},
+			}},
+		},
+		{
+			track:       library.Track{Genre: "Jazz"},
+			shouldMatch: false,
+			rules:       []Rule{{Operation: Any}},
+		},
+		{
+			track:       library.Track{Genre: "Jazz"},
+			shouldMatch: true,
+			rules:       []Rule{{Operation: All}},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.rules.String(), func(t *testing.T) {
+			f, err := BuildFilter(tc.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, matched := f.Filter(tc.track); matched != tc.shouldMatch {
+				t.Fatalf("unexpected result: exp %v, got %v", tc.shouldMatch, matched)
+			}
+		})
+	}
+}
+
+func TestGroupMatches(t *testing.T) {
+	f, err := BuildFilter([]Rule{{
+		Operation: Any,
+		Rules: []Rule{
+			{Attribute: "artist", Operation: Contains, Value: "foo"},
+			{Attribute: "title", Operation: Contains, Value: "bar"},
+			{Attribute: "album", Operation: Contains, Value: "baz"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := f.Filter(library.Track{Artist: "Foo", Title: "Bar"})
+	if !ok {
+		t.Fatalf("expected a match")
+	}
+	if len(result.Matches["artist"]) != 1 || len(result.Matches["title"]) != 1 || len(result.Matches["album"]) != 0 {
+		t.Fatalf("unexpected matches: %v", result.Matches)
+	}
+}
+
+func TestJSONCompatibility(t *testing.T) {
+	var ft RuleFilter
+	legacy := `{"rules":[{"attribute":"artist","operation":"contains","invert":false,"value":"foo"}],"type":"ruled"}`
+	if err := json.Unmarshal([]byte(legacy), &ft); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ft.Filter(library.Track{Artist: "Foo"}); !ok {
+		t.Fatalf("expected a match")
+	}
+	data, err := json.Marshal(&ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != legacy {
+		t.Fatalf("unexpected JSON: %s", data)
+	}
+
+	grouped := `{"rules":[{"attribute":"","operation":"any","invert":true,"value":null,"rules":[{"attribute":"genre","operation":"equals","invert":false,"value":"jazz"}]}],"type":"ruled"}`
+	ft = RuleFilter{}
+	if err := json.Unmarshal([]byte(grouped), &ft); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ft.Filter(library.Track{Genre: "Jazz"}); ok {
+		t.Fatalf("expected no match")
+	}
+	data, err = json.Marshal(&ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != grouped {
+		t.Fatalf("unexpected JSON: %s", data)
+	}
+}
+
+func TestRuleErrorPath(t *testing.T) {
+	invalid := Rule{Attribute: "artist", Operation: Matches, Value: "{1}"}
+	_, err := BuildFilter([]Rule{
+		{Attribute: "artist", Operation: Contains, Value: "foo"},
+		{
+			Operation: All,
+			Rules: []Rule{
+				{Attribute: "title", Operation: Contains, Value: "bar"},
+				{Operation: Any, Rules: []Rule{invalid}},
+			},
+		},
+	})
+	var ruleErr *RuleError
+	if !errors.As(err, &ruleErr) {
+		t.Fatalf("expected a RuleError, got %v", err)
+	}
+	if ruleErr.Index != 1 {
+		t.Fatalf("unexpected index: %v", ruleErr.Index)
+	}
+	if !reflect.DeepEqual(ruleErr.Path, []int{1, 1, 0}) {
+		t.Fatalf("unexpected path: %v", ruleErr.Path)
+	}
+	if !reflect.DeepEqual(ruleErr.Rule, invalid) {
+		t.Fatalf("unexpected rule: %v", ruleErr.Rule)
+	}
+}
+
+func TestGroupWithAttribute(t *testing.T) {
+	for _, group := range []Rule{
+		{Operation: All, Attribute: "artist", Rules: []Rule{{Attribute: "title", Operation: Contains, Value: "bar"}}},
+		{Operation: Any, Value: "foo", Rules: []Rule{{Attribute: "title", Operation: Contains, Value: "bar"}}},
+	} {
+		_, err := BuildFilter([]Rule{
+			{Attribute: "artist", Operation: Contains, Value: "foo"},
+			{Operation: All, Rules: []Rule{group}},
+		})
+		var ruleErr *RuleError
+		if !errors.As(err, &ruleErr) {
+			t.Fatalf("expected a RuleError for %v, got %v", group, err)
+		}
+		if !reflect.DeepEqual(ruleErr.Path, []int{1, 0}) {
+			t.Fatalf("unexpected path: %v", ruleErr.Path)
+		}
+	}
+}
+
 type rules []Rule
 
 func (rr rules) String() string {
@@ -296,3 +485,108 @@ func (rr rules) String() string {
 	}
 	return strings.Join(strs, ",")
 }
+
+func TestMatchIntegers(t *testing.T) {
+	now := time.Now()
+	tt := []struct {
+		track       library.Track
+		shouldMatch bool
+		rules       rules
+	}{
+		{
+			track:       library.Track{Date: "1984-05-01"},
+			shouldMatch: true,
+			rules: []Rule{
+				{Attribute: "year", Operation: Greater, Value: 1979.0},
+				{Attribute: "year", Operation: Less, Value: 1990.0},
+			},
+		},
+		{
+			track:       library.Track{Date: "1994"},
+			shouldMatch: false,
+			rules: []Rule{
+				{Attribute: "year", Operation: Greater, Value: 1979.0},
+				{Attribute: "year", Operation: Less, Value: 1990.0},
+			},
+		},
+		{
+			track:       library.Track{Date: "1994"},
+			shouldMatch: true,
+			rules:       []Rule{{Attribute: "year", Operation: Equals, Value: int64(1994)}},
+		},
+		{
+			track:       library.Track{ModTime: now.Add(-time.Hour * 24 * 3)},
+			shouldMatch: true,
+			rules:       []Rule{{Attribute: "modtime", Operation: Within, Value: float64(30 * 24 * 3600)}},
+		},
+		{
+			track:       library.Track{ModTime: now.Add(-time.Hour * 24 * 60)},
+			shouldMatch: false,
+			rules:       []Rule{{Attribute: "modtime", Operation: Within, Value: float64(30 * 24 * 3600)}},
+		},
+		{
+			track:       library.Track{ModTime: now.Add(-time.Hour * 24 * 60)},
+			shouldMatch: true,
+			rules:       []Rule{{Attribute: "modtime", Operation: Within, Value: float64(30 * 24 * 3600), Invert: true}},
+		},
+		{
+			track:       library.Track{},
+			shouldMatch: false,
+			rules:       []Rule{{Attribute: "modtime", Operation: Within, Value: float64(30 * 24 * 3600)}},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.rules.String(), func(t *testing.T) {
+			f, err := BuildFilter(tc.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, matched := f.Filter(tc.track); matched != tc.shouldMatch {
+				t.Fatalf("unexpected result: exp %v, got %v", tc.shouldMatch, matched)
+			}
+		})
+	}
+}
+
+func TestWithinError(t *testing.T) {
+	_, err := BuildFilter([]Rule{{Attribute: "duration", Operation: Within, Value: 60.0}})
+	if err == nil {
+		t.Fatalf("expected an error for a non-timestamp attribute")
+	}
+}
+
+func TestRuleWeights(t *testing.T) {
+	jazzOrBlues := Rule{
+		Operation: Any,
+		Rules: []Rule{
+			{Attribute: "genre", Operation: Equals, Value: "jazz", Boost: 4},
+			{Attribute: "genre", Operation: Contains, Value: "blues"},
+		},
+	}
+	notLive := Rule{Attribute: "title", Operation: Contains, Value: "live", Invert: true, Boost: 0.5}
+	ft, err := BuildFilter([]Rule{jazzOrBlues, notLive})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		track  library.Track
+		weight float64
+	}{
+		{library.Track{Genre: "Jazz", Title: "So What"}, 2},
+		{library.Track{Genre: "Blues", Title: "The Thrill Is Gone"}, 0.5},
+	}
+	for _, tc := range tt {
+		res, ok := ft.Filter(tc.track)
+		if !ok {
+			t.Fatalf("%v did not pass", tc.track)
+		}
+		if res.Weight != tc.weight {
+			t.Fatalf("Unexpected weight for %v: exp %v, got %v", tc.track, tc.weight, res.Weight)
+		}
+	}
+
+	if _, err := BuildFilter([]Rule{{Attribute: "genre", Operation: Equals, Value: "jazz", Boost: -1}}); err == nil {
+		t.Fatalf("expected an error for a negative boost")
+	}
+}
@@ -6,17 +6,27 @@ import (
 	"errors"
 	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 
 	"trollibox/src/filter"
+	"trollibox/src/filter/fuzzy"
+	"trollibox/src/filter/keyed"
+	"trollibox/src/filter/ruled"
+	"trollibox/src/identity"
 	"trollibox/src/jukebox"
+	"trollibox/src/snapcast"
 )
 
 // InitRouter attaches all API routes to the specified router.
-func InitRouter(r chi.Router, jukebox *jukebox.Jukebox) {
-	api := API{jukebox: jukebox}
+func InitRouter(r chi.Router, jukebox *jukebox.Jukebox, accounts identity.Accounts) {
+	api := API{jukebox: jukebox, accounts: accounts}
 	r.Use(jsonCtx)
+	r.Use(accounts.Middleware)
+	r.Get("/identity", api.identityGet)
+	r.Put("/identity", api.identitySet)
+	r.Delete("/identity", api.identityRemove)
 	r.Route("/player/{playerName}", func(r chi.Router) {
 		r.Route("/playlist", func(r chi.Router) {
 			r.Get("/", api.playlistContents)
@@ -35,7 +45,20 @@ func InitRouter(r chi.Router, jukebox *jukebox.Jukebox) {
 		r.Get("/tracks", api.playerTracks)
 		r.Get("/tracks/search", api.playerTrackSearch)
 		r.Get("/tracks/art", api.playerTrackArt)
+		r.Post("/tracks/preview", api.playerFilterPreview)
 		r.Post("/autoqueuer", api.playerSetAutoQueuer)
+		r.Get("/autoqueuer/status", api.playerGetAutoQueuerStatus)
+		r.Get("/autoqueuer/repeat", api.playerGetAutoQueuerRepeat)
+		r.Post("/autoqueuer/repeat", api.playerSetAutoQueuerRepeat)
+		r.Get("/autoqueuer/lookahead", api.playerGetAutoQueuerLookahead)
+		r.Post("/autoqueuer/lookahead", api.playerSetAutoQueuerLookahead)
+		r.Get("/autoqueuer/schedule", api.playerGetAutoQueuerSchedule)
+		r.Put("/autoqueuer/schedule", api.playerSetAutoQueuerSchedule)
+		r.Delete("/autoqueuer/schedule", api.playerRemoveAutoQueuerSchedule)
+		r.Get("/history", api.playerHistory)
+		r.Get("/snapcast", api.playerGetSnapcast)
+		r.Post("/snapcast/clients/{clientID}/volume", api.playerSetSnapcastClientVolume)
+		r.Post("/snapcast/clients/{clientID}/stream", api.playerSetSnapcastClientStream)
 		r.Get("/events", api.playerEvents)
 	})
 
@@ -66,8 +89,25 @@ func (api *API) mapError(w http.ResponseWriter, r *http.Request, err error) bool
 	}
 
 	status := http.StatusInternalServerError
-	if errors.Is(err, filter.ErrNotFound) {
+	var parseErr *keyed.ParseError
+	var ruleErr *ruled.RuleError
+	var quotaErr *jukebox.QuotaError
+	if errors.As(err, &quotaErr) {
+		status = http.StatusTooManyRequests
+		if quotaErr.Reason == jukebox.QuotaDuplicate {
+			status = http.StatusConflict
+		}
+		if quotaErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(quotaErr.RetryAfter))
+		}
+	} else if errors.Is(err, filter.ErrNotFound) || errors.Is(err, jukebox.ErrPlayerNotFound) || errors.Is(err, jukebox.ErrSnapcastNotConfigured) || errors.Is(err, snapcast.ErrClientNotFound) || errors.Is(err, snapcast.ErrStreamNotFound) {
 		status = http.StatusNotFound
+	} else if errors.As(err, &parseErr) || errors.As(err, &ruleErr) || errors.Is(err, fuzzy.ErrInvalidQuery) || errors.Is(err, filter.ErrReferenceCycle) || errors.Is(err, jukebox.ErrInvalidArgument) || errors.Is(err, identity.ErrInvalidName) {
+		status = http.StatusBadRequest
+	} else if errors.Is(err, filter.ErrReferenced) {
+		status = http.StatusConflict
+	} else if errors.Is(err, jukebox.ErrSkipVoteRequired) {
+		status = http.StatusForbidden
 	}
 
 	respondError(w, r, status, err)
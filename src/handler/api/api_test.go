@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"trollibox/src/filter"
+	"trollibox/src/history"
+	"trollibox/src/identity"
+	"trollibox/src/jukebox"
+	"trollibox/src/library"
+	"trollibox/src/library/stream"
+	"trollibox/src/player"
+	"trollibox/src/player/virtual"
+)
+
+// newTestAPI creates an API that controls a single virtual player named
+// "demo".
+func newTestAPI(t *testing.T, skipVoting jukebox.SkipVoting, quota jukebox.Quota, accounts identity.Accounts) (http.Handler, *virtual.Player) {
+	t.Helper()
+	dir := t.TempDir()
+	filterdb, err := filter.NewDB(filepath.Join(dir, "filters"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamdb, err := stream.NewDB(filepath.Join(dir, "streams"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	historydb, err := history.NewDB(filepath.Join(dir, "history"), history.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := virtual.New(virtual.NewLibrary(
+		library.Track{URI: "virtual://a.mp3", Artist: "Foo", Title: "Track A", Duration: time.Minute},
+		library.Track{URI: "virtual://b.mp3", Artist: "Bar", Title: "Track B", Duration: time.Minute},
+		library.Track{URI: "virtual://c.mp3", Artist: "Foo", Title: "Track C", Duration: time.Minute},
+		library.Track{URI: "virtual://d.mp3", Artist: "Baz", Title: "Track D", Duration: time.Minute},
+	))
+	jb := jukebox.NewJukebox(
+		player.SimpleList{"demo": pl},
+		filterdb,
+		streamdb,
+		"",
+		filepath.Join(dir, "auto-queuer.yaml"),
+		jukebox.Options{SkipVoting: skipVoting, Quota: quota, History: historydb},
+	)
+	r := chi.NewRouter()
+	InitRouter(r, jb, accounts)
+	return r, pl
+}
+
+// request performs a request against the API and decodes the JSON response
+// into recv, if it is not nil.
+func request(t *testing.T, handler http.Handler, req *http.Request, recv interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if recv != nil {
+		if err := json.NewDecoder(rec.Body).Decode(recv); err != nil {
+			t.Fatalf("could not decode response to %s %s: %v", req.Method, req.URL, err)
+		}
+	}
+	return rec.Code
+}
+
+func jsonRequest(t *testing.T, method, target string, body interface{}) *http.Request {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(method, target, bytes.NewReader(data))
+}
@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/rand"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -51,7 +53,9 @@ func (api *API) filterSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	filter, err := filter.UnmarshalJSON(data.Filter)
-	if api.mapError(w, r, err) {
+	if err != nil {
+		// The filter in the request body is invalid.
+		respondError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
@@ -63,6 +67,53 @@ func (api *API) filterSet(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("{}"))
 }
 
+func (api *API) playerFilterPreview(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Filter json.RawMessage `json:"filter"`
+		Sample *int            `json:"sample"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+	sampleSize := 10
+	if data.Sample != nil {
+		sampleSize = *data.Sample
+	}
+	if sampleSize < 0 || sampleSize > 100 {
+		respondError(w, r, http.StatusBadRequest, fmt.Errorf("sample size must be between 0 and 100"))
+		return
+	}
+	filter, err := filter.UnmarshalJSON(data.Filter)
+	if err != nil {
+		// The filter in the request body is invalid.
+		respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := api.jukebox.PreviewFilter(r.Context(), chi.URLParam(r, "playerName"), filter)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	rand.Shuffle(len(results), func(i, j int) {
+		results[i], results[j] = results[j], results[i]
+	})
+	if len(results) < sampleSize {
+		sampleSize = len(results)
+	}
+	sample := make([]interface{}, sampleSize)
+	for i, res := range results[:sampleSize] {
+		sample[i] = map[string]interface{}{
+			"matches": jsonMatches(&res.Track, res.Matches),
+			"track":   jsonTrack(&res.Track),
+		}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":  len(results),
+		"tracks": sample,
+	})
+}
+
 func (api *API) filterEvents(w http.ResponseWriter, r *http.Request) {
 	es, err := eventsource.Begin(w, r)
 	if api.mapError(w, r, err) {
@@ -94,6 +145,13 @@ func (api *API) filterEvents(w http.ResponseWriter, r *http.Request) {
 			"player": playerName,
 			"filter": filterName,
 		})
+		if status, err := api.jukebox.PlayerAutoQueuerStatus(r.Context(), playerName); err == nil && status != nil {
+			es.EventJSON("autoqueuer-status", map[string]interface{}{
+				"player": playerName,
+				"filter": filterName,
+				"status": jsonAutoQueuerStatus(*status),
+			})
+		}
 	}
 
 	for {
@@ -118,6 +176,17 @@ func (api *API) filterEvents(w http.ResponseWriter, r *http.Request) {
 					"player": t.PlayerName,
 					"filter": t.FilterName,
 				})
+			case jukebox.PlayerAutoQueuerStatusEvent:
+				es.EventJSON("autoqueuer-status", map[string]interface{}{
+					"player": t.PlayerName,
+					"filter": t.FilterName,
+					"status": jsonAutoQueuerStatus(t.Status),
+				})
+			case jukebox.PlayerAutoQueuerScheduleEvent:
+				es.EventJSON("schedule", map[string]interface{}{
+					"player":   t.PlayerName,
+					"schedule": t.Schedule,
+				})
 			default:
 				slog.Debug("Unmapped jukebox event", "event", event)
 			}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"trollibox/src/jukebox"
+)
+
+func TestFilterPreview(t *testing.T) {
+	handler, _ := newTestAPI(t, jukebox.SkipVoting{}, jukebox.Quota{}, nil)
+
+	var result struct {
+		Count  int `json:"count"`
+		Tracks []struct {
+			Track struct {
+				URI    string `json:"uri"`
+				Artist string `json:"artist"`
+			} `json:"track"`
+		} `json:"tracks"`
+	}
+	req := jsonRequest(t, "POST", "/player/demo/tracks/preview", map[string]interface{}{
+		"filter": map[string]interface{}{
+			"type":  "ruled",
+			"rules": []interface{}{map[string]interface{}{"attribute": "artist", "operation": "equals", "value": "Foo"}},
+		},
+		"sample": 1,
+	})
+	if status := request(t, handler, req, &result); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if result.Count != 2 || len(result.Tracks) != 1 || result.Tracks[0].Track.Artist != "Foo" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestFilterPreviewErrors(t *testing.T) {
+	handler, _ := newTestAPI(t, jukebox.SkipVoting{}, jukebox.Quota{}, nil)
+
+	validFilter := map[string]interface{}{"type": "ruled", "rules": []interface{}{}}
+	tests := []struct {
+		name   string
+		player string
+		body   interface{}
+		status int
+	}{
+		{"unknown type", "demo", map[string]interface{}{"filter": map[string]interface{}{"type": "nope"}}, http.StatusBadRequest},
+		{"malformed", "demo", map[string]interface{}{"filter": map[string]interface{}{"type": "ruled", "rules": "nope"}}, http.StatusBadRequest},
+		{"invalid rule", "demo", map[string]interface{}{"filter": map[string]interface{}{
+			"type":  "ruled",
+			"rules": []interface{}{map[string]interface{}{"operation": "equals", "value": "Foo"}},
+		}}, http.StatusBadRequest},
+		{"sample size", "demo", map[string]interface{}{"filter": validFilter, "sample": 1000}, http.StatusBadRequest},
+		{"unknown player", "nope", map[string]interface{}{"filter": validFilter}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result struct {
+				Error string `json:"error"`
+			}
+			req := jsonRequest(t, "POST", "/player/"+test.player+"/tracks/preview", test.body)
+			if status := request(t, handler, req, &result); status != test.status {
+				t.Fatalf("unexpected status: %d != %d (%s)", test.status, status, result.Error)
+			}
+			if result.Error == "" {
+				t.Fatalf("expected an error message")
+			}
+		})
+	}
+}
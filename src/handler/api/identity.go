@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"trollibox/src/identity"
+)
+
+func (api *API) identityGet(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(jsonIdentity(identity.FromContext(r.Context())))
+}
+
+// identitySet stores a nickname in a cookie so subsequent requests are made
+// under that name.
+func (api *API) identitySet(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Name string `json:"name"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+	name, err := api.accounts.ValidateNickname(data.Name)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	identity.SetCookie(w, name)
+	_ = json.NewEncoder(w).Encode(jsonIdentity(identity.Identity{Name: name}))
+}
+
+func (api *API) identityRemove(w http.ResponseWriter, r *http.Request) {
+	identity.ClearCookie(w)
+	_, _ = w.Write([]byte("{}"))
+}
+
+func jsonIdentity(id identity.Identity) interface{} {
+	return map[string]interface{}{
+		"name":    id.Name,
+		"account": id.Account,
+		"admin":   id.Admin,
+	}
+}
@@ -5,17 +5,23 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"trollibox/src/filter"
+	"trollibox/src/history"
+	"trollibox/src/identity"
 	"trollibox/src/jukebox"
 	"trollibox/src/library"
 	"trollibox/src/player"
+	"trollibox/src/snapcast"
 	"trollibox/src/util/eventsource"
 )
 
@@ -28,9 +34,12 @@ type rawJsonTrack struct {
 	AlbumArtist string `json:"albumartist,omitempty"`
 	AlbumTrack  string `json:"albumtrack,omitempty"`
 	AlbumDisc   string `json:"albumdisc,omitempty"`
+	Date        string `json:"date,omitempty"`
 	Duration    int    `json:"duration"`
+	ModTime     int64  `json:"modtime,omitempty"`
 
-	QueuedBy string `json:"queuedby,omitempty"`
+	QueuedBy  string `json:"queuedby,omitempty"`
+	Requester string `json:"requester,omitempty"`
 }
 
 func jsonTrack(tr *library.Track) *rawJsonTrack {
@@ -46,7 +55,9 @@ func jsonTrack(tr *library.Track) *rawJsonTrack {
 		AlbumArtist: tr.AlbumArtist,
 		AlbumTrack:  tr.AlbumTrack,
 		AlbumDisc:   tr.AlbumDisc,
+		Date:        tr.Date,
 		Duration:    int(tr.Duration / time.Second),
+		ModTime:     tr.Attr("modtime").(int64),
 	}
 }
 
@@ -55,10 +66,52 @@ func jsonMetaTrack(tr *player.MetaTrack) *rawJsonTrack {
 	if jt == nil {
 		return nil
 	}
-	jt.QueuedBy = tr.QueuedBy
+	jt.QueuedBy, jt.Requester = jsonQueuedBy(*tr)
 	return jt
 }
 
+// jsonQueuedBy splits the QueuedBy value of a track into its kind, "user" or
+// "system", and the name of the user that queued it.
+func jsonQueuedBy(tr player.MetaTrack) (string, string) {
+	if tr.IsQueuedByUser() {
+		return player.QueuedByUser, tr.Requester()
+	}
+	return tr.QueuedBy, ""
+}
+
+// jsonMatches converts the byte offsets of search matches into offsets in
+// UTF-16 code units, which is how strings are indexed by the browser.
+func jsonMatches(tr *library.Track, matches map[string][]filter.SearchMatch) map[string][]filter.SearchMatch {
+	utf16Offset := func(s string, offset int) int {
+		n := 0
+		for _, r := range s[:offset] {
+			if r >= 0x10000 {
+				n += 2
+			} else {
+				n++
+			}
+		}
+		return n
+	}
+
+	out := make(map[string][]filter.SearchMatch, len(matches))
+	for property, mm := range matches {
+		value, ok := tr.Attr(property).(string)
+		if !ok {
+			out[property] = mm
+			continue
+		}
+		out[property] = make([]filter.SearchMatch, len(mm))
+		for i, m := range mm {
+			out[property][i] = filter.SearchMatch{
+				Start: utf16Offset(value, m.Start),
+				End:   utf16Offset(value, m.End),
+			}
+		}
+	}
+	return out
+}
+
 func jsonTracks(inList []library.Track) []interface{} {
 	outList := make([]interface{}, len(inList))
 	for i, tr := range inList {
@@ -77,15 +130,13 @@ func jsonPlaylistTracks(tracks []player.MetaTrack) ([]interface{}, error) {
 
 // API contains the state that is accessible over the Trollibox REST API.
 type API struct {
-	jukebox *jukebox.Jukebox
+	jukebox  *jukebox.Jukebox
+	accounts identity.Accounts
 }
 
 // Deprecated, use setCurrent instead.
 func (api *API) playerNext(w http.ResponseWriter, r *http.Request) {
-	if err := api.jukebox.SetPlayerTrackIndex(r.Context(), chi.URLParam(r, "playerName"), 1, true); api.mapError(w, r, err) {
-		return
-	}
-	_, _ = w.Write([]byte("{}"))
+	api.skipTrack(w, r, chi.URLParam(r, "playerName"))
 }
 
 func (api *API) playerSetCurrent(w http.ResponseWriter, r *http.Request) {
@@ -97,12 +148,59 @@ func (api *API) playerSetCurrent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := api.jukebox.SetPlayerTrackIndex(r.Context(), chi.URLParam(r, "playerName"), data.Current, data.Relative); api.mapError(w, r, err) {
+	playerName := chi.URLParam(r, "playerName")
+	next := data.Relative && data.Current == 1
+	if !data.Relative && api.jukebox.SkipVotingEnabled() {
+		// Moving to the next track by its index counts as a vote too.
+		status, err := api.jukebox.PlayerStatus(r.Context(), playerName)
+		if api.mapError(w, r, err) {
+			return
+		}
+		next = status.TrackIndex >= 0 && data.Current == status.TrackIndex+1
+	}
+	if next {
+		api.skipTrack(w, r, playerName)
+		return
+	}
+	if err := api.jukebox.SetPlayerTrackIndex(r.Context(), playerName, data.Current, data.Relative); api.mapError(w, r, err) {
 		return
 	}
 	_, _ = w.Write([]byte("{}"))
 }
 
+// skipTrack skips to the next track. If skip voting is enabled, a vote is cast
+// instead, unless the user is an administrator.
+func (api *API) skipTrack(w http.ResponseWriter, r *http.Request, playerName string) {
+	if !api.jukebox.SkipVotingEnabled() || identity.FromContext(r.Context()).Admin {
+		if err := api.jukebox.SetPlayerTrackIndex(r.Context(), playerName, 1, true); api.mapError(w, r, err) {
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+		return
+	}
+
+	votes, err := api.jukebox.VoteSkipPlayerTrack(r.Context(), playerName, listenerName(r))
+	if api.mapError(w, r, err) {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(jsonSkipVotes(votes))
+}
+
+// listenerName identifies the user for the purpose of voting. Nicknames can
+// be changed at will, so only the names of accounts are used. Other users are
+// told apart by their address.
+func listenerName(r *http.Request) string {
+	return identity.FromContext(r.Context()).Key()
+}
+
+func jsonSkipVotes(votes jukebox.SkipVotes) interface{} {
+	return map[string]interface{}{
+		"votes":    votes.Votes,
+		"required": votes.Required,
+		"skipped":  votes.Skipped,
+	}
+}
+
 func (api *API) playerSetTime(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Time int `json:"time"`
@@ -217,10 +315,12 @@ func (api *API) playlistInsert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	id := identity.FromContext(r.Context())
 	tracks := make([]player.MetaTrack, len(data.Tracks))
 	for i, uri := range data.Tracks {
 		tracks[i].URI = uri
-		tracks[i].QueuedBy = "user"
+		tracks[i].QueuedBy = player.QueuedByUserNamed(id.Name)
+		tracks[i].RequesterKey = id.Key()
 	}
 	if err := api.jukebox.PlayerPlaylistInsertAt(r.Context(), playerName, data.At, data.Pos, tracks); api.mapError(w, r, err) {
 		return
@@ -238,11 +338,7 @@ func (api *API) playlistMove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	plist, err := api.jukebox.PlayerPlaylist(r.Context(), playerName)
-	if api.mapError(w, r, err) {
-		return
-	}
-	if err := plist.Move(r.Context(), data.From, data.To); api.mapError(w, r, err) {
+	if err := api.jukebox.PlayerPlaylistMove(r.Context(), playerName, data.From, data.To); api.mapError(w, r, err) {
 		return
 	}
 
@@ -258,11 +354,7 @@ func (api *API) playlistRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	plist, err := api.jukebox.PlayerPlaylist(r.Context(), playerName)
-	if api.mapError(w, r, err) {
-		return
-	}
-	if err := plist.Remove(r.Context(), data.Positions...); api.mapError(w, r, err) {
+	if err := api.jukebox.PlayerPlaylistRemove(r.Context(), playerName, data.Positions...); api.mapError(w, r, err) {
 		return
 	}
 
@@ -297,6 +389,54 @@ func (api *API) playerTrackArt(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, path.Base(uri), art.ModTime, bytes.NewReader(art.ImageData))
 }
 
+func (api *API) playerHistory(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+
+	offset, limit := 0, 50
+	if v := r.FormValue("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondError(w, r, http.StatusBadRequest, fmt.Errorf("invalid offset: %q", v))
+			return
+		}
+		offset = n
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 500 {
+			respondError(w, r, http.StatusBadRequest, fmt.Errorf("the limit must be between 0 and 500"))
+			return
+		}
+		limit = n
+	}
+
+	entries, total, err := api.jukebox.PlayerHistory(r.Context(), playerName, offset, limit)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	mappedEntries := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		mappedEntries[i] = jsonHistoryEntry(entry)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"history": mappedEntries,
+	})
+}
+
+func jsonHistoryEntry(entry history.Entry) interface{} {
+	queuedBy, requester := jsonQueuedBy(player.MetaTrack{QueuedBy: entry.QueuedBy})
+	return map[string]interface{}{
+		"uri":       entry.URI,
+		"started":   entry.Started.Unix(),
+		"played":    int(entry.Played / time.Second),
+		"queuedby":  queuedBy,
+		"requester": requester,
+	}
+}
+
 func (api *API) playerSetAutoQueuer(w http.ResponseWriter, r *http.Request) {
 	playerName := chi.URLParam(r, "playerName")
 	var data struct {
@@ -314,10 +454,157 @@ func (api *API) playerSetAutoQueuer(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("{}"))
 }
 
+func (api *API) playerGetAutoQueuerStatus(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	status, err := api.jukebox.PlayerAutoQueuerStatus(r.Context(), playerName)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	var mappedStatus interface{}
+	if status != nil {
+		mappedStatus = jsonAutoQueuerStatus(*status)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": mappedStatus,
+	})
+}
+
+func jsonAutoQueuerStatus(status jukebox.AutoQueuerStatus) interface{} {
+	mapped := map[string]interface{}{
+		"state":     status.State,
+		"remaining": status.Remaining,
+		"retries":   status.Retries,
+		"error":     nil,
+		"retryat":   nil,
+	}
+	if status.LastError != nil {
+		mapped["error"] = status.LastError.Error()
+	}
+	if !status.RetryAt.IsZero() {
+		mapped["retryat"] = status.RetryAt.Unix()
+	}
+	return mapped
+}
+
+func (api *API) playerGetAutoQueuerRepeat(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	windows, err := api.jukebox.PlayerAutoQueuerRepeatWindows(r.Context(), playerName)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"track":  int(windows.Track / time.Second),
+		"artist": windows.Artist,
+	})
+}
+
+func (api *API) playerSetAutoQueuerRepeat(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	var data struct {
+		Track  int `json:"track"`
+		Artist int `json:"artist"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+
+	windows := jukebox.RepeatWindows{
+		Track:  time.Duration(data.Track) * time.Second,
+		Artist: data.Artist,
+	}
+	err := api.jukebox.SetPlayerAutoQueuerRepeatWindows(r.Context(), playerName, windows)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_, _ = w.Write([]byte("{}"))
+}
+
+func (api *API) playerGetAutoQueuerLookahead(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	lookahead, err := api.jukebox.PlayerAutoQueuerLookahead(r.Context(), playerName)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"tracks": lookahead,
+	})
+}
+
+func (api *API) playerSetAutoQueuerLookahead(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	var data struct {
+		Tracks int `json:"tracks"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+
+	err := api.jukebox.SetPlayerAutoQueuerLookahead(r.Context(), playerName, data.Tracks)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_, _ = w.Write([]byte("{}"))
+}
+
+func (api *API) playerGetAutoQueuerSchedule(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	sched, err := api.jukebox.PlayerAutoQueuerSchedule(r.Context(), playerName)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"schedule": sched,
+	})
+}
+
+func (api *API) playerSetAutoQueuerSchedule(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	var data struct {
+		Schedule jukebox.Schedule `json:"schedule"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+
+	err := api.jukebox.SetPlayerAutoQueuerSchedule(r.Context(), playerName, &data.Schedule)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_, _ = w.Write([]byte("{}"))
+}
+
+func (api *API) playerRemoveAutoQueuerSchedule(w http.ResponseWriter, r *http.Request) {
+	playerName := chi.URLParam(r, "playerName")
+	err := api.jukebox.SetPlayerAutoQueuerSchedule(r.Context(), playerName, nil)
+	if api.mapError(w, r, err) {
+		return
+	}
+
+	_, _ = w.Write([]byte("{}"))
+}
+
 func (api *API) playerTrackSearch(w http.ResponseWriter, r *http.Request) {
 	playerName := chi.URLParam(r, "playerName")
 	untaggedFields := strings.Split(r.FormValue("untagged"), ",")
-	results, err := api.jukebox.SearchTracks(r.Context(), playerName, r.FormValue("query"), untaggedFields)
+
+	var results []filter.SearchResult
+	var err error
+	switch mode := r.FormValue("mode"); mode {
+	case "", "keyed":
+		results, err = api.jukebox.SearchTracks(r.Context(), playerName, r.FormValue("query"), untaggedFields)
+	case "fuzzy":
+		results, err = api.jukebox.FuzzySearchTracks(r.Context(), playerName, r.FormValue("query"), untaggedFields)
+	default:
+		respondError(w, r, http.StatusBadRequest, fmt.Errorf("unknown search mode: %q", mode))
+		return
+	}
 	if api.mapError(w, r, err) {
 		return
 	}
@@ -325,7 +612,8 @@ func (api *API) playerTrackSearch(w http.ResponseWriter, r *http.Request) {
 	mappedResults := make([]interface{}, len(results))
 	for i, w := range results {
 		mappedResults[i] = map[string]interface{}{
-			"matches": w.Matches,
+			"matches": jsonMatches(&w.Track, w.Matches),
+			"score":   w.Score,
 			"track":   jsonTrack(&w.Track),
 		}
 	}
@@ -347,6 +635,12 @@ func (api *API) playerEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	listener := emitter.Listen(r.Context())
+	// Stays nil, and thus blocks forever, if the history is not recorded.
+	var historyListener <-chan interface{}
+	if historydb := api.jukebox.HistoryDB(); historydb != nil {
+		historyListener = historydb.Listen(r.Context())
+	}
+	jukeboxListener := api.jukebox.Listen(r.Context())
 
 	plist, err := api.jukebox.PlayerPlaylist(r.Context(), playerName)
 	if err != nil {
@@ -372,9 +666,64 @@ func (api *API) playerEvents(w http.ResponseWriter, r *http.Request) {
 	es.EventJSON("playlist", map[string]interface{}{"index": status.TrackIndex, "tracks": playlistTracks, "time": status.Time / time.Second})
 	es.EventJSON("state", map[string]interface{}{"state": status.PlayState})
 	es.EventJSON("volume", map[string]interface{}{"volume": status.Volume})
+	if api.jukebox.SkipVotingEnabled() {
+		defer api.jukebox.AddPlayerListener(playerName, listenerName(r))()
+		votes, err := api.jukebox.PlayerSkipVotes(r.Context(), playerName)
+		if err != nil {
+			slog.Error("Could not get skip votes", "error", err)
+			return
+		}
+		es.EventJSON("skipvotes", jsonSkipVotes(votes))
+	}
+	// Stays nil, and thus blocks forever, if Snapcast is not configured.
+	var snapcastListener <-chan interface{}
+	// The last known Snapcast state, which tells which clients play the
+	// stream of the player.
+	var snapcastState *jukebox.PlayerSnapcast
+	if api.jukebox.SnapcastEnabled() {
+		snapcastListener = api.jukebox.SnapcastEvents().Listen(r.Context())
+		state, err := api.jukebox.PlayerSnapcast(r.Context(), playerName)
+		if err != nil {
+			slog.Error("Could not get Snapcast status", "error", err)
+			return
+		}
+		snapcastState = state
+		es.EventJSON("snapcast", jsonSnapcast(state))
+	}
+
+	for {
+		var event interface{}
+		var ok bool
+		select {
+		case event, ok = <-listener:
+		case event, ok = <-historyListener:
+		case event, ok = <-jukeboxListener:
+		case event, ok = <-snapcastListener:
+		}
+		if !ok {
+			return
+		}
 
-	for event := range listener {
 		switch t := event.(type) {
+		case history.AddEvent:
+			if t.Entry.Player == playerName {
+				es.EventJSON("history", jsonHistoryEntry(t.Entry))
+			}
+		case jukebox.PlayerSkipVotesEvent:
+			if t.PlayerName == playerName {
+				es.EventJSON("skipvotes", jsonSkipVotes(t.SkipVotes))
+			}
+		case jukebox.PlayerAutoQueuerEvent:
+			if t.PlayerName == playerName {
+				es.EventJSON("autoqueuer", map[string]interface{}{"filter": t.FilterName})
+			}
+		case jukebox.PlayerAutoQueuerStatusEvent:
+			if t.PlayerName == playerName {
+				es.EventJSON("autoqueuer-status", map[string]interface{}{
+					"filter": t.FilterName,
+					"status": jsonAutoQueuerStatus(t.Status),
+				})
+			}
 		case player.PlaylistEvent:
 			tracks, err := plist.Tracks(r.Context())
 			if err != nil {
@@ -400,6 +749,18 @@ func (api *API) playerEvents(w http.ResponseWriter, r *http.Request) {
 			es.EventJSON("volume", map[string]interface{}{"volume": t.Volume})
 		case library.UpdateEvent:
 			es.EventJSON("library", "")
+		case snapcast.ClientVolumeEvent:
+			if snapcastState.PlaysStream(t.ClientID) {
+				es.EventJSON("snapcast-volume", jsonSnapcastVolume(t))
+			}
+		case snapcast.UpdateEvent:
+			state, err := api.jukebox.PlayerSnapcast(r.Context(), playerName)
+			if err != nil {
+				slog.Error("Could not get Snapcast status", "error", err)
+				return
+			}
+			snapcastState = state
+			es.EventJSON("snapcast", jsonSnapcast(state))
 		default:
 			slog.Debug("Unmapped filter db event", "event", event)
 		}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"trollibox/src/identity"
+	"trollibox/src/jukebox"
+)
+
+func TestSetCurrentSkipVoting(t *testing.T) {
+	accounts := identity.Accounts{{Name: "admin", Password: "hunter2", Admin: true}}
+	handler, pl := newTestAPI(t, jukebox.SkipVoting{Votes: 2}, jukebox.Quota{}, accounts)
+
+	req := jsonRequest(t, "PUT", "/player/demo/playlist", map[string]interface{}{
+		"at":     "End",
+		"tracks": []string{"virtual://a.mp3", "virtual://b.mp3", "virtual://c.mp3", "virtual://d.mp3"},
+	})
+	if status := request(t, handler, req, nil); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	currentIndex := func() int {
+		t.Helper()
+		status, err := pl.Status(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.TrackIndex
+	}
+	// setCurrent moves to a track as the user at the address.
+	setCurrent := func(body map[string]interface{}, addr, nickname string, recv interface{}) int {
+		t.Helper()
+		req := jsonRequest(t, "POST", "/player/demo/current", body)
+		req.RemoteAddr = addr
+		if nickname == "admin" {
+			req.SetBasicAuth("admin", "hunter2")
+		} else if nickname != "" {
+			req.Header.Set(identity.Header, nickname)
+		}
+		return request(t, handler, req, recv)
+	}
+	if index := currentIndex(); index != 0 {
+		t.Fatalf("playback did not start: %d", index)
+	}
+
+	// Skipping further than the next track requires no vote, but is
+	// forbidden.
+	for _, body := range []map[string]interface{}{
+		{"relative": true, "current": 2},
+		{"current": 2},
+	} {
+		if status := setCurrent(body, "192.0.2.1:1234", "alice", nil); status != http.StatusForbidden {
+			t.Fatalf("%v: unexpected status: %d", body, status)
+		}
+	}
+	// Removing the current track is a skip too.
+	req = jsonRequest(t, "DELETE", "/player/demo/playlist", map[string]interface{}{"positions": []int{0}})
+	if status := request(t, handler, req, nil); status != http.StatusForbidden {
+		t.Fatalf("unexpected status removing the current track: %d", status)
+	}
+	// So are moving the current track past the next ones and seeking ahead.
+	req = jsonRequest(t, "PATCH", "/player/demo/playlist", map[string]interface{}{"from": 0, "to": 3})
+	if status := request(t, handler, req, nil); status != http.StatusForbidden {
+		t.Fatalf("unexpected status moving the current track: %d", status)
+	}
+	req = jsonRequest(t, "POST", "/player/demo/time", map[string]interface{}{"time": 59})
+	if status := request(t, handler, req, nil); status != http.StatusForbidden {
+		t.Fatalf("unexpected status seeking ahead: %d", status)
+	}
+	if index := currentIndex(); index != 0 {
+		t.Fatalf("track was skipped: %d", index)
+	}
+	// Reordering the upcoming tracks is allowed.
+	req = jsonRequest(t, "PATCH", "/player/demo/playlist", map[string]interface{}{"from": 3, "to": 1})
+	if status := request(t, handler, req, nil); status != http.StatusOK {
+		t.Fatalf("unexpected status moving an upcoming track: %d", status)
+	}
+	req = jsonRequest(t, "PATCH", "/player/demo/playlist", map[string]interface{}{"from": 1, "to": 3})
+	if status := request(t, handler, req, nil); status != http.StatusOK {
+		t.Fatalf("unexpected status moving an upcoming track: %d", status)
+	}
+
+	// Moving to the next track casts a vote, also by its absolute index.
+	// Changing the nickname does not grant another vote.
+	var votes struct {
+		Votes    int  `json:"votes"`
+		Required int  `json:"required"`
+		Skipped  bool `json:"skipped"`
+	}
+	if status := setCurrent(map[string]interface{}{"current": 1}, "192.0.2.1:1234", "alice", &votes); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if status := setCurrent(map[string]interface{}{"relative": true, "current": 1}, "192.0.2.1:5678", "bob", &votes); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if votes.Votes != 1 || votes.Required != 2 || votes.Skipped || currentIndex() != 0 {
+		t.Fatalf("unexpected votes: %+v", votes)
+	}
+	if status := setCurrent(map[string]interface{}{"relative": true, "current": 1}, "192.0.2.2:1234", "", &votes); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if !votes.Skipped || currentIndex() != 1 {
+		t.Fatalf("track was not skipped: %+v", votes)
+	}
+
+	// Going back is allowed.
+	if status := setCurrent(map[string]interface{}{"relative": true, "current": -1}, "192.0.2.1:1234", "alice", nil); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if index := currentIndex(); index != 0 {
+		t.Fatalf("unexpected index: %d", index)
+	}
+
+	// Administrators skip without voting.
+	if status := setCurrent(map[string]interface{}{"current": 3}, "192.0.2.1:1234", "admin", nil); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if index := currentIndex(); index != 3 {
+		t.Fatalf("unexpected index: %d", index)
+	}
+}
+
+func TestPlaylistInsertQuota(t *testing.T) {
+	handler, _ := newTestAPI(t, jukebox.SkipVoting{}, jukebox.Quota{MaxPending: 1}, nil)
+
+	insert := func(uri, addr, nickname string) int {
+		t.Helper()
+		req := jsonRequest(t, "PUT", "/player/demo/playlist", map[string]interface{}{
+			"at":     "End",
+			"tracks": []string{uri},
+		})
+		req.RemoteAddr = addr
+		req.Header.Set(identity.Header, nickname)
+		return request(t, handler, req, nil)
+	}
+	if status := insert("virtual://a.mp3", "192.0.2.1:1234", "alice"); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	// Picking another nickname does not grant a new quota.
+	if status := insert("virtual://b.mp3", "192.0.2.1:5678", "bob"); status != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status after changing nickname: %d", status)
+	}
+	if status := insert("virtual://b.mp3", "192.0.2.2:1234", "bob"); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+}
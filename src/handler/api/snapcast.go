@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"trollibox/src/jukebox"
+	"trollibox/src/snapcast"
+)
+
+func (api *API) playerGetSnapcast(w http.ResponseWriter, r *http.Request) {
+	state, err := api.jukebox.PlayerSnapcast(r.Context(), chi.URLParam(r, "playerName"))
+	if api.mapError(w, r, err) {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(jsonSnapcast(state))
+}
+
+func (api *API) playerSetSnapcastClientVolume(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Volume float32 `json:"volume"`
+		Muted  bool    `json:"muted"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+
+	err := api.jukebox.SetSnapcastClientVolume(r.Context(), chi.URLParam(r, "clientID"), int(data.Volume*100), data.Muted)
+	if api.mapError(w, r, err) {
+		return
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+// playerSetSnapcastClientStream moves a client to another stream. The client
+// is moved to the stream of the player if no stream is specified.
+func (api *API) playerSetSnapcastClientStream(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Stream string `json:"stream"`
+	}
+	if receiveJSONForm(w, r, &data) {
+		return
+	}
+
+	err := api.jukebox.SetSnapcastClientStream(r.Context(), chi.URLParam(r, "playerName"), chi.URLParam(r, "clientID"), data.Stream)
+	if api.mapError(w, r, err) {
+		return
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+func jsonSnapcast(state *jukebox.PlayerSnapcast) interface{} {
+	clients := make([]interface{}, len(state.Clients))
+	for i, client := range state.Clients {
+		clients[i] = map[string]interface{}{
+			"id":        client.ID,
+			"name":      client.Name,
+			"host":      client.Host,
+			"connected": client.Connected,
+			"volume":    float32(client.Volume) / 100.0,
+			"muted":     client.Muted,
+			"group":     client.GroupID,
+			"stream":    client.StreamID,
+		}
+	}
+	streams := make([]interface{}, len(state.Streams))
+	for i, stream := range state.Streams {
+		streams[i] = map[string]interface{}{
+			"id":     stream.ID,
+			"status": stream.Status,
+		}
+	}
+	return map[string]interface{}{
+		"stream":  state.Stream,
+		"streams": streams,
+		"clients": clients,
+	}
+}
+
+func jsonSnapcastVolume(event snapcast.ClientVolumeEvent) interface{} {
+	return map[string]interface{}{
+		"client": event.ClientID,
+		"volume": float32(event.Volume) / 100.0,
+		"muted":  event.Muted,
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	"trollibox/src/handler/api"
 	"trollibox/src/handler/webui"
+	"trollibox/src/identity"
 	"trollibox/src/jukebox"
 	"trollibox/src/util"
 )
@@ -32,15 +33,17 @@ type webUI struct {
 	colorConfig    ColorConfig
 	urlRoot        string
 	jukebox        *jukebox.Jukebox
+	accounts       identity.Accounts
 }
 
-func New(build, version string, colorConfig ColorConfig, urlRoot string, jukebox *jukebox.Jukebox) chi.Router {
+func New(build, version string, colorConfig ColorConfig, urlRoot string, jukebox *jukebox.Jukebox, accounts identity.Accounts) chi.Router {
 	web := webUI{
 		build:       build,
 		version:     version,
 		colorConfig: colorConfig,
 		urlRoot:     urlRoot,
 		jukebox:     jukebox,
+		accounts:    accounts,
 	}
 
 	service := chi.NewRouter()
@@ -54,7 +57,7 @@ func New(build, version string, colorConfig ColorConfig, urlRoot string, jukebox
 	service.Get("/player/{player}", web.browserPage)
 	service.Get("/player/{player}/{view}", web.browserPage)
 	service.Route("/data", func(r chi.Router) {
-		api.InitRouter(r, web.jukebox)
+		api.InitRouter(r, web.jukebox, web.accounts)
 	})
 
 	return service
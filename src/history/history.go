@@ -0,0 +1,253 @@
+// Package history keeps a persistent record of the tracks that have been
+// played by players.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+// An Entry records a single track that was played by a player.
+type Entry struct {
+	Player string `json:"player"`
+	URI    string `json:"uri"`
+	// The moment playback of the track was started.
+	Started time.Time `json:"started"`
+	// How long the track was actually played, pauses excluded.
+	Played time.Duration `json:"played"`
+	// Who queued the track, see player.MetaTrack.
+	QueuedBy string `json:"queuedby"`
+}
+
+// DefaultMaxEntries is the number of entries that is kept per player if no
+// maximum is configured.
+const DefaultMaxEntries = 10000
+
+// Retention limits how much history is kept. Older entries are removed from
+// memory as well as from disk.
+type Retention struct {
+	// The maximum number of entries per player. DefaultMaxEntries is used if
+	// it is zero.
+	MaxEntries int `yaml:"max_entries"`
+	// The maximum age of entries. Zero keeps entries regardless of their age.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (ret Retention) maxEntries() int {
+	if ret.MaxEntries <= 0 {
+		return DefaultMaxEntries
+	}
+	return ret.MaxEntries
+}
+
+// An AddEvent is emitted after an entry was added to the history.
+type AddEvent struct {
+	Entry Entry
+}
+
+// DB stores the history of each player in a separate file in a directory.
+// Entries are appended to the file as lines of JSON.
+type DB struct {
+	util.Emitter
+
+	directory string
+	retention Retention
+
+	lock    sync.Mutex
+	entries map[string][]Entry
+	// The number of lines in the file of each player, which includes entries
+	// that have since been removed.
+	lines map[string]int
+}
+
+// NewDB creates a new history database that stores its files in the specified
+// directory and keeps entries according to the retention.
+//
+// The directory is recursively created if it does not exists. An error is
+// returned if directory creation fails.
+func NewDB(directory string, retention Retention) (*DB, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	return &DB{
+		directory: directory,
+		retention: retention,
+		entries:   map[string][]Entry{},
+		lines:     map[string]int{},
+	}, nil
+}
+
+// Add appends an entry to the history of the entry's player.
+func (db *DB) Add(entry Entry) error {
+	if !player.ValidListName.MatchString(entry.Player) {
+		return fmt.Errorf("invalid player name: %q", entry.Player)
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	entries, err := db.load(entry.Player)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(db.filename(entry.Player), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, err := fd.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	db.entries[entry.Player] = append(entries, entry)
+	db.lines[entry.Player]++
+	db.prune(entry.Player, time.Now())
+	db.Emit(AddEvent{Entry: entry})
+	return nil
+}
+
+// Entries returns at most limit entries from the history of a player,
+// starting at offset. The most recently played track comes first. A negative
+// limit returns all entries after the offset.
+//
+// The total number of entries in the player's history is returned as well.
+func (db *DB) Entries(playerName string, offset, limit int) ([]Entry, int, error) {
+	if !player.ValidListName.MatchString(playerName) {
+		return nil, 0, fmt.Errorf("invalid player name: %q", playerName)
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, err := db.load(playerName); err != nil {
+		return nil, 0, err
+	}
+	db.prune(playerName, time.Now())
+	entries := db.entries[playerName]
+
+	total := len(entries)
+	if offset < 0 || offset >= total {
+		return []Entry{}, total, nil
+	}
+	n := total - offset
+	if limit >= 0 && limit < n {
+		n = limit
+	}
+	page := make([]Entry, n)
+	for i := range page {
+		page[i] = entries[total-1-offset-i]
+	}
+	return page, total, nil
+}
+
+func (db *DB) filename(playerName string) string {
+	return path.Join(db.directory, playerName+".jsonl")
+}
+
+// load returns the entries of a player, reading them from disk the first time
+// they are requested. The caller must hold the lock.
+func (db *DB) load(playerName string) ([]Entry, error) {
+	if entries, ok := db.entries[playerName]; ok {
+		return entries, nil
+	}
+
+	fd, err := os.Open(db.filename(playerName))
+	if errors.Is(err, os.ErrNotExist) {
+		db.entries[playerName] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var entries []Entry
+	lines := 0
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		lines++
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Skipping malformed history entry", "player", playerName, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	db.entries[playerName] = entries
+	db.lines[playerName] = lines
+	db.prune(playerName, time.Now())
+	return db.entries[playerName], nil
+}
+
+// prune removes the entries of a player that exceed the retention. The file
+// is rewritten once enough of its lines are stale, so it does not have to be
+// rewritten for every entry that is added. The caller must hold the lock.
+func (db *DB) prune(playerName string, now time.Time) {
+	entries := db.entries[playerName]
+	start := 0
+	if n := len(entries) - db.retention.maxEntries(); n > 0 {
+		start = n
+	}
+	if db.retention.MaxAge > 0 {
+		cutoff := now.Add(-db.retention.MaxAge)
+		for start < len(entries) && entries[start].Started.Before(cutoff) {
+			start++
+		}
+	}
+	if start > 0 {
+		entries = append([]Entry(nil), entries[start:]...)
+		db.entries[playerName] = entries
+	}
+
+	if stale := db.lines[playerName] - len(entries); stale > 0 && stale >= len(entries)/4 {
+		if err := db.rewrite(playerName); err != nil {
+			slog.Error("Could not remove old history entries", "player", playerName, "error", err)
+		}
+	}
+}
+
+// rewrite replaces the file of a player with the entries that are kept in
+// memory. The caller must hold the lock.
+func (db *DB) rewrite(playerName string) error {
+	tmpFile := db.filename(playerName) + ".tmp"
+	fd, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	for _, entry := range db.entries[playerName] {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		_, _ = w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, db.filename(playerName)); err != nil {
+		return err
+	}
+	db.lines[playerName] = len(db.entries[playerName])
+	return nil
+}
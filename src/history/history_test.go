@@ -0,0 +1,234 @@
+package history
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+	"trollibox/src/player/virtual"
+)
+
+func TestDBEntries(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 0).UTC()
+	for i, uri := range []string{"a", "b", "c"} {
+		entry := Entry{Player: "pl", URI: uri, Started: start.Add(time.Duration(i) * time.Minute), Played: time.Minute, QueuedBy: "user"}
+		if err := db.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Add(Entry{Player: "other", URI: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add(Entry{Player: "../evil", URI: "e"}); err == nil {
+		t.Fatal("expected an error for an invalid player name")
+	}
+
+	uris := func(entries []Entry) []string {
+		out := make([]string, len(entries))
+		for i, e := range entries {
+			out[i] = e.URI
+		}
+		return out
+	}
+
+	// Reopen the database to check that the entries were persisted.
+	db, err = NewDB(dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		offset, limit int
+		expect        []string
+	}{
+		{0, -1, []string{"c", "b", "a"}},
+		{0, 2, []string{"c", "b"}},
+		{1, 1, []string{"b"}},
+		{2, 10, []string{"a"}},
+		{3, 10, []string{}},
+	}
+	for _, c := range cases {
+		entries, total, err := db.Entries("pl", c.offset, c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 {
+			t.Fatalf("unexpected total: %d", total)
+		}
+		if !reflect.DeepEqual(uris(entries), c.expect) {
+			t.Fatalf("offset=%d limit=%d: expected %v, got %v", c.offset, c.limit, c.expect, uris(entries))
+		}
+	}
+
+	entries, _, err := db.Entries("pl", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Entry{Player: "pl", URI: "c", Started: start.Add(2 * time.Minute), Played: time.Minute, QueuedBy: "user"}
+	if !entries[0].Started.Equal(expect.Started) {
+		t.Fatalf("unexpected start: %v", entries[0].Started)
+	}
+	entries[0].Started = expect.Started
+	if entries[0] != expect {
+		t.Fatalf("unexpected entry: %#v", entries[0])
+	}
+
+	if _, total, err := db.Entries("nobody", 0, 10); err != nil || total != 0 {
+		t.Fatalf("unexpected result for an empty history: %v, %v", total, err)
+	}
+}
+
+func TestDBRetention(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir, Retention{MaxEntries: 8, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	// An entry that is too old to be kept.
+	if err := db.Add(Entry{Player: "pl", URI: "old", Started: now.Add(-2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		entry := Entry{Player: "pl", URI: fmt.Sprintf("%d", i), Started: now.Add(time.Duration(i-20) * time.Minute)}
+		if err := db.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := func() int {
+		fd, err := os.Open(db.filename("pl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		n := 0
+		for scanner := bufio.NewScanner(fd); scanner.Scan(); {
+			n++
+		}
+		return n
+	}
+	if n := lines(); n < 8 || n > 10 {
+		t.Fatalf("unexpected number of lines in the file: %d", n)
+	}
+
+	// Reopen the database to check that only the most recent entries are
+	// loaded.
+	db, err = NewDB(dir, Retention{MaxEntries: 8, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, total, err := db.Entries("pl", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 8 || entries[0].URI != "19" || entries[7].URI != "12" {
+		t.Fatalf("unexpected entries: %d %v", total, entries)
+	}
+
+	// Entries expire while the database is open.
+	db.lock.Lock()
+	db.prune("pl", now.Add(time.Hour-5*time.Minute))
+	db.lock.Unlock()
+	if _, total, err := db.Entries("pl", 0, -1); err != nil || total != 5 {
+		t.Fatalf("unexpected total after expiry: %d, %v", total, err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	trackA := &player.MetaTrack{Track: library.Track{URI: "a"}, QueuedBy: "user"}
+	trackB := &player.MetaTrack{Track: library.Track{URI: "b"}, QueuedBy: "system"}
+	start := time.Unix(1700000000, 0)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+
+	rec := recorder{playerName: "pl"}
+	steps := []struct {
+		now      time.Time
+		state    player.PlayState
+		index    int
+		position int
+		track    *player.MetaTrack
+		expect   *Entry
+	}{
+		{at(0), player.PlayStateStopped, -1, 0, nil, nil},
+		{at(10), player.PlayStatePlaying, 0, 0, trackA, nil},
+		{at(40), player.PlayStatePaused, 0, 30, trackA, nil},
+		{at(100), player.PlayStatePlaying, 0, 30, trackA, nil},
+		// A track before the current one is removed.
+		{at(102), player.PlayStatePlaying, 1, 32, trackA, nil},
+		// A track is inserted before the current one.
+		{at(104), player.PlayStatePlaying, 2, 34, trackA, nil},
+		// Skip to the next track.
+		{at(110), player.PlayStatePlaying, 3, 0, trackB, &Entry{Player: "pl", URI: "a", Started: at(10), Played: 40 * time.Second, QueuedBy: "user"}},
+		// The same track played again.
+		{at(130), player.PlayStatePlaying, 0, 0, trackB, &Entry{Player: "pl", URI: "b", Started: at(110), Played: 20 * time.Second, QueuedBy: "system"}},
+		{at(135), player.PlayStateStopped, -1, 0, nil, &Entry{Player: "pl", URI: "b", Started: at(130), Played: 5 * time.Second, QueuedBy: "system"}},
+		{at(140), player.PlayStateStopped, -1, 0, nil, nil},
+	}
+	for i, step := range steps {
+		entry := rec.observe(step.now, step.state, step.index, time.Duration(step.position)*time.Second, step.track)
+		if !reflect.DeepEqual(entry, step.expect) {
+			t.Fatalf("step %d: expected %#v, got %#v", i, step.expect, entry)
+		}
+	}
+}
+
+func TestRecordRemoveEarlierTrack(t *testing.T) {
+	db, err := NewDB(t.TempDir(), Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []library.Track{
+		{URI: "virtual://a.mp3", Duration: time.Minute},
+		{URI: "virtual://b.mp3", Duration: time.Minute},
+		{URI: "virtual://c.mp3", Duration: time.Minute},
+	}
+	pl := virtual.New(virtual.NewLibrary(tracks...))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = Record(ctx, db, "pl", pl) }()
+
+	// step performs an operation and gives the recorder time to observe
+	// it.
+	step := func(op func() error) {
+		t.Helper()
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	metaTracks := make([]player.MetaTrack, len(tracks))
+	for i, track := range tracks {
+		metaTracks[i] = player.MetaTrack{Track: track, QueuedBy: "user"}
+	}
+	step(func() error { return pl.Playlist().Insert(ctx, -1, metaTracks...) })
+	step(func() error { return pl.SetTrackIndex(ctx, 1) })
+	// Remove the first track while the second one is playing.
+	step(func() error { return pl.Playlist().Remove(ctx, 0) })
+	step(func() error { return pl.SetTrackIndex(ctx, 1) })
+
+	entries, _, err := db.Entries("pl", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uris []string
+	for _, entry := range entries {
+		uris = append(uris, entry.URI)
+	}
+	// Newest first.
+	if expect := []string{"virtual://b.mp3", "virtual://a.mp3"}; !reflect.DeepEqual(uris, expect) {
+		t.Fatalf("unexpected entries: %v", uris)
+	}
+}
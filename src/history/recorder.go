@@ -0,0 +1,128 @@
+package history
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"trollibox/src/player"
+)
+
+// Record listens to the events of a player and adds an entry to the database
+// every time the player stops playing a track, either because another track
+// is played or because playback was stopped.
+//
+// The track that is playing when recording ends is not recorded. Record
+// blocks until the context is cancelled or the player's status can not
+// be retrieved.
+func Record(ctx context.Context, db *DB, playerName string, pl player.Player) error {
+	rec := recorder{playerName: playerName}
+
+	update := func() error {
+		status, err := pl.Status(ctx)
+		if err != nil {
+			return err
+		}
+		var track *player.MetaTrack
+		if status.PlayState != player.PlayStateStopped && status.TrackIndex >= 0 {
+			tracks, err := pl.Playlist().Tracks(ctx)
+			if err != nil {
+				return err
+			}
+			if status.TrackIndex < len(tracks) {
+				track = &tracks[status.TrackIndex]
+			}
+		}
+		if entry := rec.observe(time.Now(), status.PlayState, status.TrackIndex, status.Time, track); entry != nil {
+			if err := db.Add(*entry); err != nil {
+				slog.Error("Unable to record history", "player", playerName, "error", err)
+			}
+		}
+		return nil
+	}
+
+	events := pl.Events().Listen(ctx)
+	if err := update(); err != nil {
+		return err
+	}
+	for event := range events {
+		switch event.(type) {
+		case player.PlaylistEvent, player.PlayStateEvent:
+			if err := update(); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// A recorder follows the playback of a single player.
+type recorder struct {
+	playerName string
+
+	// The entry of the track that is currently loaded, nil if none.
+	current *Entry
+	// The position in the playlist and the time into the current track when
+	// it was last observed.
+	index      int
+	position   time.Duration
+	observedAt time.Time
+	// The moment playback was last resumed, zero while not playing.
+	playingSince time.Time
+}
+
+// observe updates the recorder with the current state of the player. If a
+// track was finished as a result, its entry is returned.
+//
+// The index of the current track changes when tracks before it are added,
+// removed or moved, so a track is followed by its URI. Only if the same track
+// is found at another index and its position is behind, it is considered to
+// be played again.
+func (rec *recorder) observe(now time.Time, state player.PlayState, index int, position time.Duration, track *player.MetaTrack) *Entry {
+	var finished *Entry
+	if rec.current != nil {
+		expected := rec.position
+		if !rec.playingSince.IsZero() {
+			expected += now.Sub(rec.observedAt)
+		}
+		replayed := index != rec.index && position+time.Second < expected
+		if track == nil || state == player.PlayStateStopped || track.URI != rec.current.URI || replayed {
+			finished = rec.finish(now)
+		}
+	}
+
+	if rec.current == nil && track != nil && state != player.PlayStateStopped {
+		rec.current = &Entry{
+			Player:   rec.playerName,
+			URI:      track.URI,
+			Started:  now,
+			QueuedBy: track.QueuedBy,
+		}
+	}
+	if rec.current != nil {
+		rec.index, rec.position, rec.observedAt = index, position, now
+	}
+
+	if rec.current != nil {
+		if state == player.PlayStatePlaying && rec.playingSince.IsZero() {
+			rec.playingSince = now
+		} else if state != player.PlayStatePlaying && !rec.playingSince.IsZero() {
+			rec.current.Played += now.Sub(rec.playingSince)
+			rec.playingSince = time.Time{}
+		}
+	}
+	return finished
+}
+
+// finish completes the entry of the current track, if any.
+func (rec *recorder) finish(now time.Time) *Entry {
+	entry := rec.current
+	if entry == nil {
+		return nil
+	}
+	if !rec.playingSince.IsZero() {
+		entry.Played += now.Sub(rec.playingSince)
+	}
+	rec.current, rec.playingSince = nil, time.Time{}
+	return entry
+}
@@ -0,0 +1,175 @@
+// Package identity determines who is making a request to Trollibox.
+//
+// Users identify themselves with a nickname that is sent in a header or a
+// cookie. Nicknames are not verified, they just make it possible to tell users
+// apart by name. Where users must not be able to pose as someone else, such as
+// for votes and quotas, unverified users are told apart by their address
+// instead, see Identity.Key. Optionally, accounts with a password may be configured which are
+// verified using HTTP basic authentication. The names of accounts can not be
+// used as nicknames.
+package identity
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Header is the name of the HTTP header that holds a nickname.
+	Header = "X-Trollibox-User"
+	// Cookie is the name of the cookie that holds a nickname.
+	Cookie = "trollibox-user"
+
+	maxNameLength = 32
+)
+
+var (
+	// ErrInvalidName is returned for nicknames that are empty, too long or
+	// contain control characters.
+	ErrInvalidName = errors.New("invalid name")
+	// ErrUnauthorized is returned when invalid account credentials are
+	// given.
+	ErrUnauthorized = errors.New("invalid username or password")
+)
+
+// An Identity describes who made a request. The zero value is an anonymous
+// user.
+type Identity struct {
+	// The nickname or account name, empty if anonymous.
+	Name string
+	// Whether the name belongs to a verified account.
+	Account bool
+	// Whether the account has administrative privileges.
+	Admin bool
+	// The network address the request was made from, without the port.
+	Address string
+}
+
+// Key identifies the user in a way that can not be changed at will: verified
+// accounts are identified by their name, other users by their address.
+func (id Identity) Key() string {
+	if id.Account {
+		return "account:" + strings.ToLower(id.Name)
+	}
+	return "address:" + id.Address
+}
+
+// An Account is a configured user that identifies with a password.
+type Account struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Admin    bool   `yaml:"admin"`
+}
+
+// Accounts is the set of configured accounts.
+type Accounts []Account
+
+// Identify determines the identity of the user making a request.
+//
+// ErrUnauthorized is returned if the request carries credentials that do not
+// match any account. Invalid nicknames and nicknames of accounts are ignored.
+func (accounts Accounts) Identify(r *http.Request) (Identity, error) {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		account, ok := accounts.lookup(username)
+		if !ok || subtle.ConstantTimeCompare([]byte(account.Password), []byte(password)) != 1 {
+			return Identity{}, ErrUnauthorized
+		}
+		return Identity{Name: account.Name, Account: true, Admin: account.Admin, Address: address}, nil
+	}
+
+	name := r.Header.Get(Header)
+	if name == "" {
+		if cookie, err := r.Cookie(Cookie); err == nil {
+			name, _ = url.QueryUnescape(cookie.Value)
+		}
+	}
+	name, err = accounts.ValidateNickname(name)
+	if err != nil {
+		return Identity{Address: address}, nil
+	}
+	return Identity{Name: name, Address: address}, nil
+}
+
+// ValidateNickname checks whether the name may be used as a nickname and
+// returns it with surrounding whitespace removed.
+func (accounts Accounts) ValidateNickname(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return "", ErrInvalidName
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", ErrInvalidName
+		}
+	}
+	if _, ok := accounts.lookup(name); ok {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+func (accounts Accounts) lookup(name string) (Account, bool) {
+	for _, account := range accounts {
+		if strings.EqualFold(account.Name, name) {
+			return account, true
+		}
+	}
+	return Account{}, false
+}
+
+// Middleware attaches the identity of the user to the context of each
+// request. Requests with invalid credentials are rejected.
+func (accounts Accounts) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := accounts.Identify(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Trollibox"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// SetCookie instructs the client to identify with the nickname in subsequent
+// requests.
+func SetCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     Cookie,
+		Value:    url.QueryEscape(name),
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearCookie removes the nickname cookie from the client.
+func ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: Cookie, Path: "/", MaxAge: -1})
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that carries the identity.
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by the context. The anonymous
+// identity is returned if there is none.
+func FromContext(ctx context.Context) Identity {
+	id, _ := ctx.Value(contextKey{}).(Identity)
+	return id
+}
@@ -0,0 +1,114 @@
+package identity
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+	accounts := Accounts{
+		{Name: "admin", Password: "hunter2", Admin: true},
+		{Name: "dj", Password: "beats"},
+	}
+	// The address of requests created by httptest.
+	const addr = "192.0.2.1"
+
+	tt := []struct {
+		name    string
+		prepare func(r *http.Request)
+		expect  Identity
+		err     error
+	}{
+		{"anonymous", func(r *http.Request) {}, Identity{Address: addr}, nil},
+		{"header", func(r *http.Request) { r.Header.Set(Header, " alice ") }, Identity{Name: "alice", Address: addr}, nil},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: Cookie, Value: "bob"}) }, Identity{Name: "bob", Address: addr}, nil},
+		{"header before cookie", func(r *http.Request) {
+			r.Header.Set(Header, "alice")
+			r.AddCookie(&http.Cookie{Name: Cookie, Value: "bob"})
+		}, Identity{Name: "alice", Address: addr}, nil},
+		{"too long", func(r *http.Request) { r.Header.Set(Header, strings.Repeat("a", 33)) }, Identity{Address: addr}, nil},
+		{"account name as nickname", func(r *http.Request) { r.Header.Set(Header, "Admin") }, Identity{Address: addr}, nil},
+		{"account", func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, Identity{Name: "admin", Account: true, Admin: true, Address: addr}, nil},
+		{"account case insensitive", func(r *http.Request) { r.SetBasicAuth("DJ", "beats") }, Identity{Name: "dj", Account: true, Address: addr}, nil},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "hunter3") }, Identity{}, ErrUnauthorized},
+		{"unknown account", func(r *http.Request) { r.SetBasicAuth("alice", "") }, Identity{}, ErrUnauthorized},
+	}
+	for _, tc := range tt {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		tc.prepare(r)
+		id, err := accounts.Identify(r)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if id != tc.expect {
+			t.Fatalf("%s: expected %#v, got %#v", tc.name, tc.expect, id)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	accounts := Accounts{{Name: "admin", Password: "hunter2"}}
+	var got Identity
+	handler := accounts.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(Header, "alice")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got.Name != "alice" {
+		t.Fatalf("unexpected result: %d, %#v", w.Code, got)
+	}
+
+	// Names survive the round trip through a cookie.
+	w = httptest.NewRecorder()
+	SetCookie(w, "Zoë, the DJ")
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got.Name != "Zoë, the DJ" {
+		t.Fatalf("unexpected name from cookie: %q", got.Name)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("admin", "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestKey(t *testing.T) {
+	accounts := Accounts{{Name: "dj", Password: "beats"}}
+	identify := func(prepare func(r *http.Request)) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		prepare(r)
+		id, err := accounts.Identify(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id.Key()
+	}
+
+	anonymous := identify(func(r *http.Request) {})
+	if key := identify(func(r *http.Request) { r.Header.Set(Header, "alice") }); key != anonymous {
+		t.Fatalf("nicknames should not change the key: %q != %q", key, anonymous)
+	}
+	if key := identify(func(r *http.Request) { r.RemoteAddr = "192.0.2.2:1234" }); key == anonymous {
+		t.Fatalf("addresses should change the key: %q", key)
+	}
+	account := identify(func(r *http.Request) { r.SetBasicAuth("dj", "beats") })
+	if key := identify(func(r *http.Request) {
+		r.SetBasicAuth("DJ", "beats")
+		r.RemoteAddr = "192.0.2.2:1234"
+	}); key != account || key == anonymous {
+		t.Fatalf("accounts should be identified by name: %q, %q", key, account)
+	}
+}
@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies lists the reverse proxies, as IP addresses or CIDR networks,
+// of which the X-Forwarded-For header is trusted.
+//
+// Users without an account are told apart by their address. Behind a reverse
+// proxy, all requests come from the address of the proxy, so the address of
+// the user must be taken from the header the proxy adds instead.
+type TrustedProxies []string
+
+// Validate checks whether all entries are IP addresses or CIDR networks.
+func (proxies TrustedProxies) Validate() error {
+	for _, proxy := range proxies {
+		if _, ok := parseNetwork(proxy); !ok {
+			return fmt.Errorf("invalid trusted proxy: %q", proxy)
+		}
+	}
+	return nil
+}
+
+func (proxies TrustedProxies) contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if network, ok := parseNetwork(proxy); ok && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetwork(s string) (*net.IPNet, bool) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+// Middleware replaces the remote address of requests made through a trusted
+// proxy with the address of the client. The client is the last address in
+// the X-Forwarded-For header that is not a trusted proxy itself, addresses
+// before it could have been made up by the client.
+func (proxies TrustedProxies) Middleware(next http.Handler) http.Handler {
+	if len(proxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !proxies.contains(host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !proxies.contains(hop) {
+				break
+			}
+		}
+		r2 := r.Clone(r.Context())
+		r2.RemoteAddr = net.JoinHostPort(host, port)
+		next.ServeHTTP(w, r2)
+	})
+}
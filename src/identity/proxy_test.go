@@ -0,0 +1,50 @@
+package identity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies := TrustedProxies{"192.0.2.1", "10.0.0.0/8", "::1"}
+	if err := proxies.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (TrustedProxies{"proxy.example.com"}).Validate(); err == nil {
+		t.Fatal("expected an error for a host name")
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		expectAddress string
+	}{
+		{"direct", "198.51.100.1:1234", nil, "198.51.100.1"},
+		{"untrusted proxy", "198.51.100.1:1234", []string{"203.0.113.1"}, "198.51.100.1"},
+		{"trusted proxy", "192.0.2.1:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"trusted network", "10.1.2.3:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"ipv6 proxy", "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"spoofed hop", "192.0.2.1:1234", []string{"203.0.113.9, 203.0.113.1"}, "203.0.113.1"},
+		{"chained proxies", "192.0.2.1:1234", []string{"203.0.113.1, 10.0.0.1"}, "203.0.113.1"},
+		{"multiple headers", "192.0.2.1:1234", []string{"203.0.113.9", "203.0.113.1"}, "203.0.113.1"},
+		{"no header", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"invalid hop", "192.0.2.1:1234", []string{"nonsense"}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		var got Identity
+		handler := proxies.Middleware(Accounts{}.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = FromContext(r.Context())
+		})))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got.Address != test.expectAddress {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expectAddress, got.Address)
+		}
+	}
+}
@@ -2,7 +2,12 @@ package jukebox
 
 import (
 	"context"
+	"log/slog"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"trollibox/src/filter"
 	"trollibox/src/library"
@@ -12,41 +17,250 @@ import (
 type autoQueuerQueue struct {
 	tracks []library.Track
 	index  int
+	// The cumulative weights of the tracks. Nil if all tracks are equally
+	// likely to be picked, in which case the shuffled tracks are cycled
+	// through.
+	cumWeights []float64
 }
 
 func newQueue(ctx context.Context, pl player.Player, ft filter.Filter) (*autoQueuerQueue, error) {
-	tracks, err := pl.Library().Tracks(ctx)
-	if err != nil {
-		return nil, err
-	}
-	results, err := filter.Tracks(ctx, ft, tracks)
+	results, err := filter.LibraryTracks(ctx, ft, pl.Library())
 	if err != nil {
 		return nil, err
 	}
 
+	rand.Shuffle(len(results), func(i, j int) {
+		results[i], results[j] = results[j], results[i]
+	})
 	shuffledTracks := make([]library.Track, len(results))
+	cumWeights := make([]float64, len(results))
+	weighted := false
 	for i, t := range results {
 		shuffledTracks[i] = t.Track
+		cumWeights[i] = t.RandomWeight()
+		if cumWeights[i] != cumWeights[0] {
+			weighted = true
+		}
+		if i > 0 {
+			cumWeights[i] += cumWeights[i-1]
+		}
+	}
+	if !weighted {
+		cumWeights = nil
 	}
-	rand.Shuffle(len(shuffledTracks), func(i, j int) {
-		shuffledTracks[i], shuffledTracks[j] = shuffledTracks[j], shuffledTracks[i]
-	})
 
-	return &autoQueuerQueue{tracks: shuffledTracks, index: 0}, nil
+	return &autoQueuerQueue{tracks: shuffledTracks, index: 0, cumWeights: cumWeights}, nil
 }
 
-func (q *autoQueuerQueue) nextTrack() (player.MetaTrack, bool) {
+// nextTrack returns the next track in the queue that is accepted by the
+// repeat windows. If no track is accepted, the artist window is ignored and
+// then the track window, so the queue never runs dry because of them.
+//
+// If the tracks are weighted, tracks are drawn at random proportionally to
+// their weight instead.
+func (q *autoQueuerQueue) nextTrack(now time.Time, repeat *repeatState) (player.MetaTrack, bool) {
 	if len(q.tracks) == 0 {
 		return player.MetaTrack{}, false
 	}
+	for _, accept := range []func(library.Track) bool{
+		func(t library.Track) bool { return repeat.acceptTrack(now, t) && repeat.acceptArtist(t) },
+		func(t library.Track) bool { return repeat.acceptTrack(now, t) },
+	} {
+		for i := range q.tracks {
+			j := (q.index + i) % len(q.tracks)
+			if q.cumWeights != nil {
+				j = q.draw()
+			}
+			if accept(q.tracks[j]) {
+				return q.take(j), true
+			}
+		}
+	}
+	if q.cumWeights != nil {
+		return q.take(q.draw()), true
+	}
+	return q.take(q.index), true
+}
+
+// draw picks the position of a random track proportionally to its weight.
+func (q *autoQueuerQueue) draw() int {
+	total := q.cumWeights[len(q.cumWeights)-1]
+	r := rand.Float64() * total
+	return sort.Search(len(q.cumWeights), func(i int) bool {
+		return q.cumWeights[i] > r
+	})
+}
+
+// take returns the track at the position. Unweighted queues move the track to
+// the current position in the cycle and advance it.
+func (q *autoQueuerQueue) take(pos int) player.MetaTrack {
+	if q.cumWeights != nil {
+		return player.MetaTrack{Track: q.tracks[pos], QueuedBy: player.QueuedBySystem}
+	}
+	q.tracks[q.index], q.tracks[pos] = q.tracks[pos], q.tracks[q.index]
+	return q.pop()
+}
+
+func (q *autoQueuerQueue) pop() player.MetaTrack {
 	track := q.tracks[q.index]
 	q.index = (q.index + 1) % len(q.tracks)
-	return player.MetaTrack{Track: track, QueuedBy: "system"}, true
+	return player.MetaTrack{Track: track, QueuedBy: player.QueuedBySystem}
+}
+
+// RepeatWindows limit how soon the auto-queuer may queue the same track or
+// artist again. The zero value does not limit anything.
+type RepeatWindows struct {
+	// The minimum amount of time between two plays of the same track.
+	Track time.Duration `yaml:"track,omitempty"`
+	// The minimum number of tracks queued between two tracks of the same
+	// artist.
+	Artist int `yaml:"artist,omitempty"`
+}
+
+type recentTrack struct {
+	URI    string    `yaml:"uri"`
+	Artist string    `yaml:"artist,omitempty"`
+	Queued time.Time `yaml:"queued"`
+}
+
+// repeatState holds the repeat windows of a player along with the tracks that
+// were recently queued by its auto-queuer. It outlives the auto-queuer so
+// changing the filter does not reset it.
+type repeatState struct {
+	lock    sync.Mutex
+	windows RepeatWindows
+	// Oldest first.
+	recent []recentTrack
+}
+
+func (rs *repeatState) acceptTrack(now time.Time, track library.Track) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.windows.Track <= 0 {
+		return true
+	}
+	for _, r := range rs.recent {
+		if r.URI == track.URI && now.Sub(r.Queued) < rs.windows.Track {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs *repeatState) acceptArtist(track library.Track) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	artist := strings.ToLower(track.Artist)
+	if rs.windows.Artist <= 0 || artist == "" {
+		return true
+	}
+	for i := len(rs.recent) - 1; i >= 0 && i >= len(rs.recent)-rs.windows.Artist; i-- {
+		if strings.ToLower(rs.recent[i].Artist) == artist {
+			return false
+		}
+	}
+	return true
+}
+
+// add records a queued track and forgets the tracks that have fallen out of
+// both windows.
+func (rs *repeatState) add(now time.Time, track library.Track) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.recent = append(rs.recent, recentTrack{URI: track.URI, Artist: track.Artist, Queued: now})
+
+	keep := 0
+	for i, r := range rs.recent {
+		inArtistWindow := i >= len(rs.recent)-rs.windows.Artist
+		inTrackWindow := now.Sub(r.Queued) < rs.windows.Track
+		if inArtistWindow || inTrackWindow {
+			break
+		}
+		keep = i + 1
+	}
+	rs.recent = append([]recentTrack(nil), rs.recent[keep:]...)
+}
+
+func (rs *repeatState) setWindows(windows RepeatWindows) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.windows = windows
+}
+
+// clone returns a copy that can be used to draw multiple tracks before any of
+// them has been queued.
+func (rs *repeatState) clone() *repeatState {
+	windows, recent := rs.snapshot()
+	return &repeatState{windows: windows, recent: recent}
+}
+
+func (rs *repeatState) snapshot() (RepeatWindows, []recentTrack) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.windows, append([]recentTrack(nil), rs.recent...)
+}
+
+const (
+	// The delay before the first retry of a failed operation, which is
+	// doubled on every subsequent attempt.
+	autoQueuerBackoff = time.Second
+	// The number of retries after which the auto-queuer gives up.
+	autoQueuerMaxRetries = 8
+)
+
+// AutoQueuerState describes what an auto-queuer is doing.
+type AutoQueuerState string
+
+const (
+	// AutoQueuerRunning is the state of an auto-queuer that is working
+	// normally.
+	AutoQueuerRunning = AutoQueuerState("running")
+	// AutoQueuerBackingOff is the state of an auto-queuer that encountered an
+	// error and waits before retrying.
+	AutoQueuerBackingOff = AutoQueuerState("backing-off")
+	// AutoQueuerExhausted is the state of an auto-queuer that stopped because
+	// no tracks pass its filter.
+	AutoQueuerExhausted = AutoQueuerState("exhausted")
+	// AutoQueuerFailed is the state of an auto-queuer that stopped after too
+	// many errors.
+	AutoQueuerFailed = AutoQueuerState("failed")
+)
+
+// AutoQueuerStatus reports on the state of the auto-queuer of a player.
+type AutoQueuerStatus struct {
+	State AutoQueuerState
+	// The number of tracks that remain before the shuffled queue starts over.
+	// Queues of weighted tracks never run out, so all tracks remain.
+	Remaining int
+	// The most recent error, which is retained after recovering from it.
+	LastError error
+	// The number of consecutive failed attempts.
+	Retries int
+	// When the next attempt is made while backing off.
+	RetryAt time.Time
 }
 
 type autoQueuer struct {
 	queue      *autoQueuerQueue
 	filterName string
+	repeat     *repeatState
+	// The number of tracks queued by the system to keep after the current
+	// track. If zero, a track is only queued when the playlist has ended.
+	lookahead int
+	// Called after a track was queued.
+	onQueue func()
+	// Called after the status has changed.
+	onStatus func(AutoQueuerStatus)
+
+	// The position and URI of a track that was queued while the playlist had
+	// ended but of which playback could not be started yet. Retries only
+	// start playback instead of queueing another track. The position is -1 if
+	// there is no such track.
+	startAt  int
+	startURI string
+
+	statusLock    sync.Mutex
+	currentStatus AutoQueuerStatus
 
 	cancel chan struct{}
 	err    chan error
@@ -62,7 +276,7 @@ func (aq *autoQueuer) stop() {
 // Sending a value over the returned channel interrupts the operation.
 // Receiving from the channel blocks until no more tracks are available from
 // the iterator or an error is encountered.
-func autoQueue(pl player.Player, filterdb *filter.DB, filterName string) (*autoQueuer, error) {
+func autoQueue(pl player.Player, filterdb *filter.DB, filterName string, lookahead int, repeat *repeatState, onQueue func(), onStatus func(AutoQueuerStatus)) (*autoQueuer, error) {
 	ft, err := filterdb.Get(filterName)
 	if err != nil {
 		return nil, err
@@ -76,9 +290,15 @@ func autoQueue(pl player.Player, filterdb *filter.DB, filterName string) (*autoQ
 	aq := &autoQueuer{
 		filterName: filterName,
 		queue:      queue,
+		repeat:     repeat,
+		lookahead:  lookahead,
+		onQueue:    onQueue,
+		onStatus:   onStatus,
+		startAt:    -1,
 		cancel:     make(chan struct{}),
 		err:        make(chan error, 1),
 	}
+	aq.currentStatus = AutoQueuerStatus{State: AutoQueuerRunning, Remaining: len(queue.tracks)}
 
 	go func() {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -86,17 +306,34 @@ func autoQueue(pl player.Player, filterdb *filter.DB, filterName string) (*autoQ
 		defer close(aq.err)
 		playerEvents := pl.Events().Listen(ctx)
 		filterDBEvents := filterdb.Events().Listen(ctx)
-	outer:
+
+		// The filter may have changed, so the tracks that are already queued
+		// by the system are replaced.
+		if aq.run(func() (bool, error) {
+			if aq.lookahead > 0 {
+				return aq.fill(ctx, pl, true)
+			}
+			return false, nil
+		}) {
+			return
+		}
+
 		for {
+			var stop bool
 			select {
 			case event := <-filterDBEvents:
 				if uev, ok := event.(filter.UpdateEvent); ok && uev.Name == filterName {
-					queue, err := newQueue(ctx, pl, uev.Filter)
-					if err != nil {
-						aq.err <- err
-						return
-					}
-					aq.queue = queue
+					stop = aq.run(func() (bool, error) {
+						queue, err := newQueue(ctx, pl, uev.Filter)
+						if err != nil {
+							return false, err
+						}
+						aq.queue = queue
+						if aq.lookahead > 0 {
+							return aq.fill(ctx, pl, true)
+						}
+						return false, nil
+					})
 				}
 			case event := <-playerEvents:
 				_, okA := event.(player.PlayStateEvent)
@@ -104,43 +341,264 @@ func autoQueue(pl player.Player, filterdb *filter.DB, filterName string) (*autoQ
 				if !okA && !okB {
 					continue
 				}
-
-				plist := pl.Playlist()
-				status, err := pl.Status(ctx)
-				if err != nil {
-					aq.err <- err
-					return
-				}
-				if status.PlayState != player.PlayStateStopped && status.TrackIndex != -1 {
-					continue
-				}
-
-				metaTrack, ok := aq.queue.nextTrack()
-				if !ok {
-					break outer
-				}
-				if err := plist.Insert(ctx, -1, metaTrack); err != nil {
-					aq.err <- err
-					return
-				}
-				plistLen, err := plist.Len(ctx)
-				if err != nil {
-					aq.err <- err
-					return
-				}
-				if err := pl.SetState(ctx, player.PlayStatePlaying); err != nil {
-					aq.err <- err
-					return
-				}
-				if err := pl.SetTrackIndex(ctx, plistLen-1); err != nil {
-					aq.err <- err
-					return
-				}
+				stop = aq.run(func() (bool, error) {
+					if aq.lookahead > 0 {
+						return aq.fill(ctx, pl, false)
+					}
+					return aq.queueNext(ctx, pl)
+				})
 
 			case <-aq.cancel:
-				break outer
+				return
+			}
+			if stop {
+				return
 			}
 		}
 	}()
 	return aq, nil
 }
+
+// run performs an operation of the auto-queuer, retrying it with an
+// exponential backoff if it fails. The operation returns true if the queue has
+// run out of tracks.
+//
+// True is returned if the auto-queuer should stop, either because the queue
+// is exhausted, the operation failed too many times or the auto-queuer was
+// stopped.
+func (aq *autoQueuer) run(op func() (bool, error)) bool {
+	for attempt := 1; ; attempt++ {
+		done, err := op()
+		if err == nil {
+			if done {
+				aq.setStatus(AutoQueuerExhausted, nil, time.Time{})
+				return true
+			}
+			aq.setStatus(AutoQueuerRunning, nil, time.Time{})
+			return false
+		}
+		if attempt > autoQueuerMaxRetries {
+			aq.setStatus(AutoQueuerFailed, err, time.Time{})
+			aq.err <- err
+			return true
+		}
+
+		delay := autoQueuerBackoff << (attempt - 1)
+		slog.Warn("Auto queuer error, retrying", "error", err, "filter", aq.filterName, "delay", delay)
+		aq.setStatus(AutoQueuerBackingOff, err, time.Now().Add(delay))
+		select {
+		case <-time.After(delay):
+		case <-aq.cancel:
+			return true
+		}
+	}
+}
+
+func (aq *autoQueuer) setStatus(state AutoQueuerState, err error, retryAt time.Time) {
+	remaining := len(aq.queue.tracks)
+	if aq.queue.cumWeights == nil {
+		remaining -= aq.queue.index
+	}
+
+	aq.statusLock.Lock()
+	prev := aq.currentStatus
+	aq.currentStatus.State = state
+	aq.currentStatus.Remaining = remaining
+	aq.currentStatus.RetryAt = retryAt
+	if err != nil {
+		aq.currentStatus.LastError = err
+		aq.currentStatus.Retries++
+	} else if state != AutoQueuerFailed {
+		aq.currentStatus.Retries = 0
+	}
+	cur := aq.currentStatus
+	changed := err != nil || cur.State != prev.State || cur.Remaining != prev.Remaining || cur.Retries != prev.Retries
+	aq.statusLock.Unlock()
+
+	if changed && aq.onStatus != nil {
+		aq.onStatus(cur)
+	}
+}
+
+// status returns a snapshot of the status of the auto-queuer.
+func (aq *autoQueuer) status() AutoQueuerStatus {
+	aq.statusLock.Lock()
+	defer aq.statusLock.Unlock()
+	return aq.currentStatus
+}
+
+// startPlayback starts playback of the track that was queued to resume the
+// playlist, see startAt. Nothing is done if there is no such track or if the
+// track was removed in the meantime.
+func (aq *autoQueuer) startPlayback(ctx context.Context, pl player.Player) error {
+	if aq.startAt < 0 {
+		return nil
+	}
+	tracks, err := pl.Playlist().Tracks(ctx)
+	if err != nil {
+		return err
+	}
+	if aq.startAt >= len(tracks) || tracks[aq.startAt].URI != aq.startURI {
+		aq.startAt = -1
+		return nil
+	}
+	if err := pl.SetState(ctx, player.PlayStatePlaying); err != nil {
+		return err
+	}
+	if err := pl.SetTrackIndex(ctx, aq.startAt); err != nil {
+		return err
+	}
+	aq.startAt = -1
+	return nil
+}
+
+// queueNext appends a track to the playlist and plays it if the playlist has
+// ended. True is returned if the queue has run out of tracks.
+//
+// If playback could not be started after the track was queued, a retry only
+// starts playback.
+func (aq *autoQueuer) queueNext(ctx context.Context, pl player.Player) (bool, error) {
+	if err := aq.startPlayback(ctx, pl); err != nil {
+		return false, err
+	}
+	plist := pl.Playlist()
+	status, err := pl.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+	if status.PlayState != player.PlayStateStopped && status.TrackIndex != -1 {
+		return false, nil
+	}
+
+	plistLen, err := plist.Len(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	metaTrack, ok := aq.queue.nextTrack(now, aq.repeat)
+	if !ok {
+		return true, nil
+	}
+	if err := plist.Insert(ctx, -1, metaTrack); err != nil {
+		return false, err
+	}
+	aq.repeat.add(now, metaTrack.Track)
+	aq.onQueue()
+	aq.startAt, aq.startURI = plistLen, metaTrack.URI
+	return false, aq.startPlayback(ctx, pl)
+}
+
+// fill keeps the lookahead number of tracks that are queued by the system
+// after the current track. Tracks queued by users after these are moved in
+// front of them by moving the system's tracks to the end of the playlist. If
+// replace is set, the system's tracks are replaced by new ones.
+//
+// If the playlist has ended, playback is resumed with the next track. True is
+// returned if the queue has run out of tracks.
+//
+// The operation can be retried after it failed: the tracks to remove and queue
+// are determined from the current playlist and if only starting playback
+// failed, only that is retried.
+func (aq *autoQueuer) fill(ctx context.Context, pl player.Player, replace bool) (bool, error) {
+	if err := aq.startPlayback(ctx, pl); err != nil {
+		return false, err
+	}
+	plist := pl.Playlist()
+	status, err := pl.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+	tracks, err := plist.Tracks(ctx)
+	if err != nil {
+		return false, err
+	}
+	ended := status.PlayState == player.PlayStateStopped || status.TrackIndex == -1
+	current := status.TrackIndex
+	if current == -1 || current >= len(tracks) {
+		current = len(tracks) - 1
+	}
+
+	lastUserTrack := -1
+	for i := current + 1; i < len(tracks); i++ {
+		if tracks[i].QueuedBy != player.QueuedBySystem {
+			lastUserTrack = i
+		}
+	}
+	var remove []int
+	var requeue []player.MetaTrack
+	numSystem := 0
+	for i := current + 1; i < len(tracks); i++ {
+		if tracks[i].QueuedBy != player.QueuedBySystem {
+			continue
+		}
+		if replace {
+			remove = append(remove, i)
+			continue
+		}
+		if i < lastUserTrack {
+			remove = append(remove, i)
+			requeue = append(requeue, tracks[i])
+		}
+		numSystem++
+	}
+
+	// When the playlist has ended, the first track that is added will be
+	// played, so it does not count towards the lookahead.
+	target := aq.lookahead
+	if ended {
+		target++
+	}
+	insert := requeue
+	now := time.Now()
+	pending := aq.repeat.clone()
+	for ; numSystem < target; numSystem++ {
+		metaTrack, ok := aq.queue.nextTrack(now, pending)
+		if !ok {
+			break
+		}
+		pending.add(now, metaTrack.Track)
+		insert = append(insert, metaTrack)
+	}
+
+	if len(remove) > 0 {
+		if err := plist.Remove(ctx, remove...); err != nil {
+			return false, err
+		}
+	}
+	if len(insert) > 0 {
+		if err := plist.Insert(ctx, -1, insert...); err != nil {
+			return false, err
+		}
+		for _, track := range insert[len(requeue):] {
+			aq.repeat.add(now, track.Track)
+		}
+		if len(insert) > len(requeue) {
+			aq.onQueue()
+		}
+	}
+
+	if ended {
+		// The track to resume with is the first track after the current one
+		// that was not removed, or else the first queued track.
+		removed := map[int]bool{}
+		for _, i := range remove {
+			removed[i] = true
+		}
+		next := -1
+		for i := current + 1; i < len(tracks); i++ {
+			if !removed[i] {
+				next = i
+				break
+			}
+		}
+		if next != -1 {
+			aq.startAt, aq.startURI = current+1, tracks[next].URI
+		} else if len(insert) > 0 {
+			aq.startAt, aq.startURI = current+1, insert[0].URI
+		}
+		if err := aq.startPlayback(ctx, pl); err != nil {
+			return false, err
+		}
+	}
+	return len(aq.queue.tracks) == 0, nil
+}
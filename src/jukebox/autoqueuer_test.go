@@ -0,0 +1,150 @@
+package jukebox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+	"trollibox/src/player/virtual"
+)
+
+// flakyPlayer fails a number of operations before passing them on to a
+// virtual player.
+type flakyPlayer struct {
+	*virtual.Player
+	failInsert        int
+	failSetTrackIndex int
+}
+
+var errFlaky = errors.New("flaky")
+
+func (pl *flakyPlayer) SetTrackIndex(ctx context.Context, trackIndex int) error {
+	if pl.failSetTrackIndex > 0 {
+		pl.failSetTrackIndex--
+		return errFlaky
+	}
+	return pl.Player.SetTrackIndex(ctx, trackIndex)
+}
+
+func (pl *flakyPlayer) Playlist() player.Playlist[player.MetaTrack] {
+	return flakyPlaylist{Playlist: pl.Player.Playlist(), player: pl}
+}
+
+type flakyPlaylist struct {
+	player.Playlist[player.MetaTrack]
+	player *flakyPlayer
+}
+
+func (plist flakyPlaylist) Insert(ctx context.Context, pos int, tracks ...player.MetaTrack) error {
+	if plist.player.failInsert > 0 {
+		plist.player.failInsert--
+		return errFlaky
+	}
+	return plist.Playlist.Insert(ctx, pos, tracks...)
+}
+
+// endedPlayer returns a player of which the playlist has ended after playing
+// a single track.
+func endedPlayer(t *testing.T) (*flakyPlayer, []library.Track) {
+	t.Helper()
+	ctx := context.Background()
+	tracks := []library.Track{
+		{URI: "virtual://a.mp3", Artist: "A", Duration: 50 * time.Millisecond},
+		{URI: "virtual://b.mp3", Artist: "B", Duration: time.Minute},
+		{URI: "virtual://c.mp3", Artist: "C", Duration: time.Minute},
+	}
+	pl := &flakyPlayer{Player: virtual.New(virtual.NewLibrary(tracks...))}
+	if err := pl.Playlist().Insert(ctx, -1, player.MetaTrack{Track: tracks[0], QueuedBy: player.QueuedByUser}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		status, err := pl.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.TrackIndex == -1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return pl, tracks
+}
+
+func testAutoQueuer(tracks []library.Track, lookahead int, queued *int) *autoQueuer {
+	return &autoQueuer{
+		queue:     &autoQueuerQueue{tracks: append([]library.Track(nil), tracks...)},
+		repeat:    &repeatState{windows: RepeatWindows{Track: time.Hour}},
+		lookahead: lookahead,
+		onQueue:   func() { *queued++ },
+		startAt:   -1,
+	}
+}
+
+func TestAutoQueuerRetryStart(t *testing.T) {
+	for _, lookahead := range []int{0, 1} {
+		ctx := context.Background()
+		pl, tracks := endedPlayer(t)
+		queued := 0
+		aq := testAutoQueuer(tracks[1:], lookahead, &queued)
+		op := func() (bool, error) {
+			if lookahead > 0 {
+				return aq.fill(ctx, pl, false)
+			}
+			return aq.queueNext(ctx, pl)
+		}
+
+		pl.failSetTrackIndex = 2
+		for i := 0; i < 2; i++ {
+			if _, err := op(); !errors.Is(err, errFlaky) {
+				t.Fatalf("lookahead %d: expected a failure, got %v", lookahead, err)
+			}
+		}
+		if _, err := op(); err != nil {
+			t.Fatal(err)
+		}
+
+		plistTracks, err := pl.Playlist().Tracks(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plistTracks) != 2+lookahead {
+			t.Fatalf("lookahead %d: retries queued more tracks: %v", lookahead, plistTracks)
+		}
+		status, err := pl.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.TrackIndex != 1 || status.PlayState != player.PlayStatePlaying {
+			t.Fatalf("lookahead %d: unexpected status: %+v", lookahead, status)
+		}
+		if _, recent := aq.repeat.snapshot(); queued != 1 || len(recent) != 1+lookahead {
+			t.Fatalf("lookahead %d: unexpected bookkeeping: %d %v", lookahead, queued, recent)
+		}
+	}
+}
+
+func TestAutoQueuerFailedInsert(t *testing.T) {
+	for _, lookahead := range []int{0, 1} {
+		ctx := context.Background()
+		pl, tracks := endedPlayer(t)
+		queued := 0
+		aq := testAutoQueuer(tracks[1:], lookahead, &queued)
+
+		pl.failInsert = 1
+		var err error
+		if lookahead > 0 {
+			_, err = aq.fill(ctx, pl, false)
+		} else {
+			_, err = aq.queueNext(ctx, pl)
+		}
+		if !errors.Is(err, errFlaky) {
+			t.Fatalf("lookahead %d: expected a failure, got %v", lookahead, err)
+		}
+		if _, recent := aq.repeat.snapshot(); queued != 0 || len(recent) != 0 {
+			t.Fatalf("lookahead %d: a failed insert was recorded: %d %v", lookahead, queued, recent)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package jukebox
+
+import (
+	"context"
+
+	"trollibox/src/player"
+)
+
+// fairInsertPosition determines where a track queued by the requester should
+// be inserted so the upcoming tracks of all requesters are interleaved
+// round-robin: the nth upcoming track of every requester is played before the
+// n+1th track of any requester.
+//
+// Only tracks queued by users after the current track are taken into account,
+// tracks queued by the system are left in place. Requesters are told apart by
+// requesterKey.
+func fairInsertPosition(tracks []player.MetaTrack, current int, requester string) int {
+	// The new track is in the round after the upcoming tracks of the
+	// requester.
+	round := 1
+	for i := current + 1; i < len(tracks); i++ {
+		if tracks[i].IsQueuedByUser() && requesterKey(tracks[i]) == requester {
+			round++
+		}
+	}
+
+	pos := current + 1
+	seen := map[string]int{}
+	for i := current + 1; i < len(tracks); i++ {
+		if !tracks[i].IsQueuedByUser() {
+			continue
+		}
+		key := requesterKey(tracks[i])
+		seen[key]++
+		if seen[key] <= round {
+			pos = i + 1
+		}
+	}
+	return pos
+}
+
+// requesterKey identifies the user that queued a track. Tracks that were
+// queued without Trollibox knowing who requested them are attributed to the
+// name in QueuedBy.
+func requesterKey(track player.MetaTrack) string {
+	if track.RequesterKey != "" {
+		return track.RequesterKey
+	}
+	return track.QueuedBy
+}
+
+// fairInsert inserts tracks that were queued by users in a fair manner, see
+// fairInsertPosition.
+func fairInsert(ctx context.Context, pl player.Player, tracks []player.MetaTrack) error {
+	for _, track := range tracks {
+		status, err := pl.Status(ctx)
+		if err != nil {
+			return err
+		}
+		plistTracks, err := pl.Playlist().Tracks(ctx)
+		if err != nil {
+			return err
+		}
+		// If the playlist has ended, there are no upcoming tracks.
+		current := status.TrackIndex
+		if current == -1 || current >= len(plistTracks) {
+			current = len(plistTracks) - 1
+		}
+		pos := fairInsertPosition(plistTracks, current, requesterKey(track))
+		if pos >= len(plistTracks) {
+			pos = -1
+		}
+		if err := pl.Playlist().Insert(ctx, pos, track); err != nil {
+			return err
+		}
+	}
+	return nil
+}
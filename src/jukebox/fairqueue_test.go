@@ -0,0 +1,41 @@
+package jukebox
+
+import (
+	"testing"
+
+	"trollibox/src/player"
+)
+
+func TestFairInsertPosition(t *testing.T) {
+	queued := func(name, key string) player.MetaTrack {
+		return player.MetaTrack{QueuedBy: player.QueuedByUserNamed(name), RequesterKey: key}
+	}
+	system := player.MetaTrack{QueuedBy: player.QueuedBySystem}
+	alice := queued("alice", "address:192.0.2.1")
+	bob := queued("bob", "address:192.0.2.2")
+	// Alice's address, but a different nickname.
+	mallory := queued("mallory", "address:192.0.2.1")
+	external := player.MetaTrack{QueuedBy: player.QueuedByUser}
+
+	tests := []struct {
+		name      string
+		tracks    []player.MetaTrack
+		current   int
+		requester player.MetaTrack
+		expect    int
+	}{
+		{"empty", nil, -1, alice, 0},
+		{"after current", []player.MetaTrack{alice, bob}, 0, bob, 2},
+		{"interleave", []player.MetaTrack{system, alice, alice, alice}, 0, bob, 2},
+		{"second round", []player.MetaTrack{system, alice, bob, alice, alice}, 0, bob, 4},
+		{"system tracks stay", []player.MetaTrack{system, alice, system, alice}, 0, bob, 2},
+		{"changed nickname", []player.MetaTrack{system, alice, bob, alice}, 0, mallory, 4},
+		{"unknown requesters", []player.MetaTrack{system, external, external}, 0, alice, 2},
+	}
+	for _, test := range tests {
+		pos := fairInsertPosition(test.tracks, test.current, requesterKey(test.requester))
+		if pos != test.expect {
+			t.Errorf("%s: expected position %d, got %d", test.name, test.expect, pos)
+		}
+	}
+}
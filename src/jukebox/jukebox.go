@@ -13,10 +13,13 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"trollibox/src/filter"
+	"trollibox/src/filter/fuzzy"
 	"trollibox/src/filter/keyed"
+	"trollibox/src/history"
 	"trollibox/src/library"
 	"trollibox/src/library/stream"
 	"trollibox/src/player"
+	"trollibox/src/snapcast"
 	"trollibox/src/util"
 )
 
@@ -26,6 +29,10 @@ var (
 	ErrPlayerUnavailable = player.ErrUnavailable
 
 	ErrPlayerNotFound = player.ErrPlayerNotFound
+
+	// ErrInvalidArgument is returned when a value passed to the jukebox is
+	// out of range.
+	ErrInvalidArgument = errors.New("invalid argument")
 )
 
 type PlayerAutoQueuerEvent struct {
@@ -33,6 +40,14 @@ type PlayerAutoQueuerEvent struct {
 	FilterName string
 }
 
+// A PlayerAutoQueuerStatusEvent is emitted after the status of the
+// auto-queuer of a player has changed.
+type PlayerAutoQueuerStatusEvent struct {
+	PlayerName string
+	FilterName string
+	Status     AutoQueuerStatus
+}
+
 // Jukebox augments one or more players with with filters, streams and other
 // functionality.
 type Jukebox struct {
@@ -41,30 +56,111 @@ type Jukebox struct {
 	players       player.List
 	filterdb      *filter.DB
 	streamdb      *stream.DB
+	historydb     *history.DB
 	defaultPlayer string
+	// If set, tracks appended by users are interleaved round-robin between the
+	// users that queued them.
+	fairQueue  bool
+	skipVoting SkipVoting
+
+	quota       Quota
+	quotaStates sync.Map // map[string]*quotaState
 
 	autoQueuers         sync.Map // map[string]*autoQueuer
+	autoQueuerLock      sync.Mutex
+	repeatStates        sync.Map // map[string]*repeatState
+	lookaheads          sync.Map // map[string]int
 	autoQueuerStateFile string
+	autoQueuerStateLock sync.Mutex
+
+	schedules    map[string]*playerSchedule
+	scheduleLock sync.Mutex
+
+	skipVotes sync.Map // map[string]*skipVoteState
+
+	// Optional, controls the speakers that are fed by the players.
+	snapcast *snapcast.Server
 }
 
-func NewJukebox(players player.List, filterdb *filter.DB, streamdb *stream.DB, defaultPlayer, autoQueuerStateFile string) *Jukebox {
+// playerAutoQueuerState is the state of the auto-queuer of a player as it is
+// stored in the state file.
+type playerAutoQueuerState struct {
+	Filter    string        `yaml:"filter,omitempty"`
+	Lookahead int           `yaml:"lookahead,omitempty"`
+	Repeat    RepeatWindows `yaml:"repeat,omitempty"`
+	Recent    []recentTrack `yaml:"recent,omitempty"`
+	Schedule  *Schedule     `yaml:"schedule,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface. Older versions
+// only stored the name of the filter.
+func (state *playerAutoQueuerState) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&state.Filter)
+	}
+	type plain playerAutoQueuerState
+	return value.Decode((*plain)(state))
+}
+
+// Options configures the optional features of a Jukebox. The zero value
+// disables all of them.
+type Options struct {
+	// If set, tracks appended by users are interleaved round-robin between
+	// the users that queued them.
+	FairQueue  bool
+	SkipVoting SkipVoting
+	Quota      Quota
+	// Controls the speakers that are fed by the players.
+	Snapcast *snapcast.Server
+	// Records the tracks that were played by the players.
+	History *history.DB
+}
+
+func NewJukebox(players player.List, filterdb *filter.DB, streamdb *stream.DB, defaultPlayer, autoQueuerStateFile string, opts Options) *Jukebox {
 	jb := &Jukebox{
 		players:             players,
 		filterdb:            filterdb,
 		streamdb:            streamdb,
+		historydb:           opts.History,
 		defaultPlayer:       defaultPlayer,
+		fairQueue:           opts.FairQueue,
+		skipVoting:          opts.SkipVoting,
+		quota:               opts.Quota,
 		autoQueuerStateFile: autoQueuerStateFile,
+		schedules:           map[string]*playerSchedule{},
+		snapcast:            opts.Snapcast,
 	}
 
 	if b, err := os.ReadFile(autoQueuerStateFile); err == nil {
-		var autoQueuerState map[string]string
+		var autoQueuerState map[string]playerAutoQueuerState
 		if err := yaml.Unmarshal(b, &autoQueuerState); err == nil {
-			for player, filter := range autoQueuerState {
-				_ = jb.SetPlayerAutoQueuerFilter(context.Background(), player, filter)
+			for player, state := range autoQueuerState {
+				jb.repeatStates.Store(player, &repeatState{windows: state.Repeat, recent: state.Recent})
+				if state.Lookahead > 0 {
+					jb.lookaheads.Store(player, state.Lookahead)
+				}
+				if state.Schedule != nil {
+					jb.schedules[player] = &playerSchedule{
+						schedule: *state.Schedule,
+						applied:  state.Schedule.FilterAt(time.Now()),
+					}
+				}
+			}
+			for player, state := range autoQueuerState {
+				if state.Filter != "" {
+					_ = jb.SetPlayerAutoQueuerFilter(context.Background(), player, state.Filter)
+				}
 			}
+		} else {
+			slog.Warn("Unable to load auto queuer state", "file", autoQueuerStateFile, "error", err)
 		}
 	}
 
+	if jb.historydb != nil {
+		go jb.recordHistory()
+	}
+	go jb.runSchedules()
+
 	return jb
 }
 
@@ -101,26 +197,51 @@ func (jb *Jukebox) PlayerStatus(ctx context.Context, playerName string) (*player
 	return pl.Status(ctx)
 }
 
+// SetPlayerTrackIndex changes the current track of a player. The index is
+// relative to the current track if relative is set.
+//
+// If skip voting is enabled, users that are not administrators can only go
+// back or start playback of an ended playlist. ErrSkipVoteRequired is returned
+// for other tracks, which must be skipped using VoteSkipPlayerTrack.
 func (jb *Jukebox) SetPlayerTrackIndex(ctx context.Context, playerName string, index int, relative bool) error {
 	pl, err := jb.players.PlayerByName(playerName)
 	if err != nil {
 		return err
 	}
-	if relative {
+	if relative || jb.mustVote(ctx) {
 		status, err := pl.Status(ctx)
 		if err != nil {
 			return err
 		}
-		index += status.TrackIndex
+		if relative {
+			index += status.TrackIndex
+		}
+		if jb.mustVote(ctx) && status.TrackIndex >= 0 && index > status.TrackIndex {
+			return ErrSkipVoteRequired
+		}
 	}
 	return pl.SetTrackIndex(ctx, index)
 }
 
+// SetPlayerTime seeks to an offset in the current track of a player.
+//
+// If skip voting is enabled, users that are not administrators can only seek
+// back, as seeking ahead skips a part of the track. ErrSkipVoteRequired is
+// returned otherwise.
 func (jb *Jukebox) SetPlayerTime(ctx context.Context, playerName string, t time.Duration) error {
 	pl, err := jb.players.PlayerByName(playerName)
 	if err != nil {
 		return err
 	}
+	if jb.mustVote(ctx) {
+		status, err := pl.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if t > status.Time {
+			return ErrSkipVoteRequired
+		}
+	}
 	return pl.SetTime(ctx, t)
 }
 
@@ -170,22 +291,51 @@ func (jb *Jukebox) SearchTracks(ctx context.Context, playerName, query string, u
 	if err != nil {
 		return nil, err
 	}
-	pl, err := jb.players.PlayerByName(playerName)
+	results, err := jb.filterPlayerTracks(ctx, playerName, compiledQuery)
 	if err != nil {
 		return nil, err
 	}
-	tracks, err := pl.Library().Tracks(ctx)
+	sort.Sort(filter.ByNumMatches(results))
+	return results, nil
+}
+
+// FuzzySearchTracks searches the specified fields of the tracks in the
+// player's library for the words in the query, tolerating spelling mistakes.
+// The results are sorted by relevance.
+func (jb *Jukebox) FuzzySearchTracks(ctx context.Context, playerName, query string, fields []string) ([]filter.SearchResult, error) {
+	compiledQuery, err := fuzzy.CompileQuery(query, fields)
 	if err != nil {
 		return nil, err
 	}
-	results, err := filter.Tracks(ctx, compiledQuery, tracks)
+	results, err := jb.filterPlayerTracks(ctx, playerName, compiledQuery)
 	if err != nil {
 		return nil, err
 	}
-	sort.Sort(filter.ByNumMatches(results))
+	sort.Stable(filter.ByScore(results))
 	return results, nil
 }
 
+// PreviewFilter applies the filter to the tracks in the player's library
+// without storing the filter.
+//
+// Filters referring to other filters are resolved using the filter database.
+func (jb *Jukebox) PreviewFilter(ctx context.Context, playerName string, ft filter.Filter) ([]filter.SearchResult, error) {
+	if rf, ok := ft.(filter.ReferencingFilter); ok {
+		if err := rf.Resolve(jb.filterdb); err != nil {
+			return nil, err
+		}
+	}
+	return jb.filterPlayerTracks(ctx, playerName, ft)
+}
+
+func (jb *Jukebox) filterPlayerTracks(ctx context.Context, playerName string, ft filter.Filter) ([]filter.SearchResult, error) {
+	pl, err := jb.players.PlayerByName(playerName)
+	if err != nil {
+		return nil, err
+	}
+	return filter.LibraryTracks(ctx, ft, pl.Library())
+}
+
 func (jb *Jukebox) PlayerPlaylist(ctx context.Context, playerName string) (player.Playlist[player.MetaTrack], error) {
 	pl, err := jb.players.PlayerByName(playerName)
 	if err != nil {
@@ -195,12 +345,81 @@ func (jb *Jukebox) PlayerPlaylist(ctx context.Context, playerName string) (playe
 	return playerPlaylist{libraries: libs, Playlist: pl.Playlist()}, nil
 }
 
+// PlayerPlaylistRemove removes the tracks at the positions from the playlist
+// of a player.
+//
+// If skip voting is enabled, users that are not administrators can not remove
+// the current track and ErrSkipVoteRequired is returned instead.
+func (jb *Jukebox) PlayerPlaylistRemove(ctx context.Context, playerName string, positions ...int) error {
+	pl, err := jb.players.PlayerByName(playerName)
+	if err != nil {
+		return err
+	}
+	if jb.mustVote(ctx) {
+		status, err := pl.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, pos := range positions {
+			if pos == status.TrackIndex {
+				return ErrSkipVoteRequired
+			}
+		}
+	}
+	return pl.Playlist().Remove(ctx, positions...)
+}
+
+// PlayerPlaylistMove moves the track at position from to position to in the
+// playlist of a player.
+//
+// If skip voting is enabled, users that are not administrators can not move
+// the current track ahead, which skips the tracks it is moved past, and
+// ErrSkipVoteRequired is returned instead.
+func (jb *Jukebox) PlayerPlaylistMove(ctx context.Context, playerName string, from, to int) error {
+	pl, err := jb.players.PlayerByName(playerName)
+	if err != nil {
+		return err
+	}
+	if jb.mustVote(ctx) {
+		status, err := pl.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if from == status.TrackIndex && to > from {
+			return ErrSkipVoteRequired
+		}
+	}
+	return pl.Playlist().Move(ctx, from, to)
+}
+
+// PlayerPlaylistInsertAt inserts tracks into the playlist of a player. The
+// tracks are inserted after the current track if at is "Next", appended if at
+// is "End" and inserted at pos otherwise.
+//
+// If the jukebox is in fair queue mode, tracks appended by users are
+// interleaved with the upcoming tracks of other users instead.
 func (jb *Jukebox) PlayerPlaylistInsertAt(ctx context.Context, playerName, at string, pos int, tracks []player.MetaTrack) error {
 	pl, err := jb.players.PlayerByName(playerName)
 	if err != nil {
 		return err
 	}
 
+	// Checking the quota and inserting must not be interleaved with other
+	// insertions into the same playlist.
+	state := jb.quotaState(playerName)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if err := jb.checkQuota(ctx, pl, state, tracks); err != nil {
+		return err
+	}
+	if err := jb.insertAt(ctx, pl, at, pos, tracks); err != nil {
+		return err
+	}
+	jb.recordQueued(state, tracks)
+	return nil
+}
+
+func (jb *Jukebox) insertAt(ctx context.Context, pl player.Player, at string, pos int, tracks []player.MetaTrack) error {
 	switch at {
 	case "Next":
 		status, err := pl.Status(ctx)
@@ -209,6 +428,9 @@ func (jb *Jukebox) PlayerPlaylistInsertAt(ctx context.Context, playerName, at st
 		}
 		pos = status.TrackIndex + 1
 	case "End":
+		if jb.fairQueue {
+			return fairInsert(ctx, pl, tracks)
+		}
 		pos = -1
 	default:
 	}
@@ -226,6 +448,15 @@ func (jb *Jukebox) PlayerAutoQueuerFilters(ctx context.Context) map[string]strin
 }
 
 func (jb *Jukebox) SetPlayerAutoQueuerFilter(ctx context.Context, playerName, filterName string) error {
+	jb.autoQueuerLock.Lock()
+	defer jb.autoQueuerLock.Unlock()
+	return jb.setPlayerAutoQueuerFilter(ctx, playerName, filterName)
+}
+
+// setPlayerAutoQueuerFilter replaces the auto-queuer of a player. The
+// auto-queuer lock must be held so concurrent callers do not both start an
+// auto-queuer.
+func (jb *Jukebox) setPlayerAutoQueuerFilter(ctx context.Context, playerName, filterName string) error {
 	pl, err := jb.players.PlayerByName(playerName)
 	if err != nil {
 		return err
@@ -242,7 +473,12 @@ func (jb *Jukebox) SetPlayerAutoQueuerFilter(ctx context.Context, playerName, fi
 		return nil
 	}
 
-	aq, err := autoQueue(pl, jb.filterdb, filterName)
+	lookahead, _ := jb.lookaheads.Load(playerName)
+	lookaheadTracks, _ := lookahead.(int)
+	onStatus := func(status AutoQueuerStatus) {
+		jb.Emit(PlayerAutoQueuerStatusEvent{PlayerName: playerName, FilterName: filterName, Status: status})
+	}
+	aq, err := autoQueue(pl, jb.filterdb, filterName, lookaheadTracks, jb.repeatState(playerName), jb.saveAutoQueuerState, onStatus)
 	if err != nil {
 		return err
 	}
@@ -250,6 +486,14 @@ func (jb *Jukebox) SetPlayerAutoQueuerFilter(ctx context.Context, playerName, fi
 		if err := <-aq.err; err != nil {
 			slog.Error("Auto queuer error", "error", err, "player", playerName)
 		}
+		// The auto-queuer has stopped by itself because it failed or ran
+		// out of tracks, so it is no longer active.
+		jb.autoQueuerLock.Lock()
+		defer jb.autoQueuerLock.Unlock()
+		if jb.autoQueuers.CompareAndDelete(playerName, aq) {
+			jb.saveAutoQueuerState()
+			jb.Emit(PlayerAutoQueuerEvent{PlayerName: playerName, FilterName: ""})
+		}
 	}()
 	jb.autoQueuers.Store(playerName, aq)
 	jb.saveAutoQueuerState()
@@ -259,6 +503,91 @@ func (jb *Jukebox) SetPlayerAutoQueuerFilter(ctx context.Context, playerName, fi
 	return nil
 }
 
+// PlayerAutoQueuerStatus returns the status of the auto-queuer of a player.
+// Nil is returned if the player has no auto-queuer.
+//
+// Auto-queuers that are exhausted or failed are removed, so their final status
+// is only reported by a PlayerAutoQueuerStatusEvent, which is followed by a
+// PlayerAutoQueuerEvent without filter.
+func (jb *Jukebox) PlayerAutoQueuerStatus(ctx context.Context, playerName string) (*AutoQueuerStatus, error) {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return nil, err
+	}
+	aq, ok := jb.autoQueuers.Load(playerName)
+	if !ok {
+		return nil, nil
+	}
+	status := aq.(*autoQueuer).status()
+	return &status, nil
+}
+
+// PlayerAutoQueuerRepeatWindows returns the repeat windows that are used by
+// the auto-queuer of a player.
+func (jb *Jukebox) PlayerAutoQueuerRepeatWindows(ctx context.Context, playerName string) (RepeatWindows, error) {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return RepeatWindows{}, err
+	}
+	windows, _ := jb.repeatState(playerName).snapshot()
+	return windows, nil
+}
+
+// SetPlayerAutoQueuerRepeatWindows sets how soon the auto-queuer of a player
+// may queue the same track or a track of the same artist again.
+func (jb *Jukebox) SetPlayerAutoQueuerRepeatWindows(ctx context.Context, playerName string, windows RepeatWindows) error {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return err
+	}
+	if windows.Track < 0 || windows.Artist < 0 {
+		return fmt.Errorf("%w: repeat windows can not be negative", ErrInvalidArgument)
+	}
+	jb.repeatState(playerName).setWindows(windows)
+	jb.saveAutoQueuerState()
+	return nil
+}
+
+// PlayerAutoQueuerLookahead returns the number of tracks the auto-queuer of
+// a player keeps queued after the current track.
+func (jb *Jukebox) PlayerAutoQueuerLookahead(ctx context.Context, playerName string) (int, error) {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return 0, err
+	}
+	lookahead, _ := jb.lookaheads.Load(playerName)
+	n, _ := lookahead.(int)
+	return n, nil
+}
+
+// SetPlayerAutoQueuerLookahead sets the number of tracks the auto-queuer of a
+// player keeps queued after the current track. If zero, a track is only queued
+// when the playlist has ended.
+//
+// A running auto-queuer is restarted to apply the change.
+func (jb *Jukebox) SetPlayerAutoQueuerLookahead(ctx context.Context, playerName string, lookahead int) error {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return err
+	}
+	if lookahead < 0 || lookahead > 100 {
+		return fmt.Errorf("%w: the lookahead must be between 0 and 100", ErrInvalidArgument)
+	}
+	if lookahead == 0 {
+		jb.lookaheads.Delete(playerName)
+	} else {
+		jb.lookaheads.Store(playerName, lookahead)
+	}
+
+	jb.autoQueuerLock.Lock()
+	defer jb.autoQueuerLock.Unlock()
+	if aq, ok := jb.autoQueuers.Load(playerName); ok {
+		return jb.setPlayerAutoQueuerFilter(ctx, playerName, aq.(*autoQueuer).filterName)
+	}
+	jb.saveAutoQueuerState()
+	return nil
+}
+
+func (jb *Jukebox) repeatState(playerName string) *repeatState {
+	rs, _ := jb.repeatStates.LoadOrStore(playerName, &repeatState{})
+	return rs.(*repeatState)
+}
+
 func (jb *Jukebox) PlayerEvents(ctx context.Context, playerName string) (*util.Emitter, error) {
 	pl, err := jb.players.PlayerByName(playerName)
 	if err != nil {
@@ -267,6 +596,19 @@ func (jb *Jukebox) PlayerEvents(ctx context.Context, playerName string) (*util.E
 	return pl.Events(), nil
 }
 
+// PlayerHistory returns the tracks that were played by a player, most recent
+// first, along with the total number of tracks in the history. The history is
+// empty if it is not recorded.
+func (jb *Jukebox) PlayerHistory(ctx context.Context, playerName string, offset, limit int) ([]history.Entry, int, error) {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return nil, 0, err
+	}
+	if jb.historydb == nil {
+		return nil, 0, nil
+	}
+	return jb.historydb.Entries(playerName, offset, limit)
+}
+
 func (jb *Jukebox) FilterDB() *filter.DB {
 	return jb.filterdb
 }
@@ -275,8 +617,77 @@ func (jb *Jukebox) StreamDB() *stream.DB {
 	return jb.streamdb
 }
 
+// HistoryDB returns the history database, nil if the history is not recorded.
+func (jb *Jukebox) HistoryDB() *history.DB {
+	return jb.historydb
+}
+
+// recordHistory records the history of all players. Players that appear later
+// on or that fail are picked up when the list of players is checked again.
+func (jb *Jukebox) recordHistory() {
+	var lock sync.Mutex
+	recording := map[string]bool{}
+	for {
+		names, err := jb.players.PlayerNames()
+		if err != nil {
+			slog.Warn("Unable to list players for history", "error", err)
+		}
+		for _, name := range names {
+			lock.Lock()
+			if recording[name] {
+				lock.Unlock()
+				continue
+			}
+			pl, err := jb.players.PlayerByName(name)
+			if err != nil {
+				lock.Unlock()
+				continue
+			}
+			recording[name] = true
+			lock.Unlock()
+
+			go func(name string) {
+				err := history.Record(context.Background(), jb.historydb, name, pl)
+				slog.Warn("Stopped recording history", "player", name, "error", err)
+				lock.Lock()
+				delete(recording, name)
+				lock.Unlock()
+			}(name)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
 func (jb *Jukebox) saveAutoQueuerState() {
-	state := jb.PlayerAutoQueuerFilters(context.Background())
+	jb.autoQueuerStateLock.Lock()
+	defer jb.autoQueuerStateLock.Unlock()
+
+	state := map[string]playerAutoQueuerState{}
+	jb.repeatStates.Range(func(k, v interface{}) bool {
+		windows, recent := v.(*repeatState).snapshot()
+		state[k.(string)] = playerAutoQueuerState{Repeat: windows, Recent: recent}
+		return true
+	})
+	jb.lookaheads.Range(func(k, v interface{}) bool {
+		s := state[k.(string)]
+		s.Lookahead = v.(int)
+		state[k.(string)] = s
+		return true
+	})
+	jb.scheduleLock.Lock()
+	for playerName, ps := range jb.schedules {
+		s := state[playerName]
+		sched := ps.schedule
+		s.Schedule = &sched
+		state[playerName] = s
+	}
+	jb.scheduleLock.Unlock()
+	for playerName, filterName := range jb.PlayerAutoQueuerFilters(context.Background()) {
+		s := state[playerName]
+		s.Filter = filterName
+		state[playerName] = s
+	}
+
 	b, err := yaml.Marshal(state)
 	if err != nil {
 		slog.Warn("Unable to marshal auto queuer state", "error", err)
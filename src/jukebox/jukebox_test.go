@@ -0,0 +1,78 @@
+package jukebox
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"trollibox/src/filter"
+	"trollibox/src/filter/ruled"
+	"trollibox/src/history"
+	"trollibox/src/library"
+	"trollibox/src/library/stream"
+	"trollibox/src/player"
+	"trollibox/src/player/virtual"
+)
+
+// newTestPlayer creates a virtual player with two tracks in its library.
+func newTestPlayer() *virtual.Player {
+	return virtual.New(virtual.NewLibrary(
+		library.Track{URI: "virtual://a.mp3", Artist: "Foo", Duration: time.Minute},
+		library.Track{URI: "virtual://b.mp3", Artist: "Bar", Duration: time.Minute},
+	))
+}
+
+// newTestJukebox creates a jukebox with a single player named "demo".
+func newTestJukebox(t *testing.T, pl player.Player, skipVoting SkipVoting) *Jukebox {
+	t.Helper()
+	dir := t.TempDir()
+	filterdb, err := filter.NewDB(filepath.Join(dir, "filters"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamdb, err := stream.NewDB(filepath.Join(dir, "streams"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	historydb, err := history.NewDB(filepath.Join(dir, "history"), history.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{SkipVoting: skipVoting, History: historydb}
+	return NewJukebox(player.SimpleList{"demo": pl}, filterdb, streamdb, "", filepath.Join(dir, "auto-queuer.yaml"), opts)
+}
+
+func TestExhaustedAutoQueuerIsRemoved(t *testing.T) {
+	ctx := context.Background()
+	pl := newTestPlayer()
+	jb := newTestJukebox(t, pl, SkipVoting{})
+	ft, err := ruled.BuildFilter([]ruled.Rule{{Attribute: "artist", Operation: "equals", Value: "Nobody"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jb.FilterDB().Set("nothing", ft); err != nil {
+		t.Fatal(err)
+	}
+	if err := jb.SetPlayerAutoQueuerFilter(ctx, "demo", "nothing"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The auto-queuer runs out of tracks as soon as it tries to queue one.
+	listener := jb.Listen(ctx)
+	pl.Emit(player.PlayStateEvent{State: player.PlayStateStopped})
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-listener:
+			if ev, ok := event.(PlayerAutoQueuerEvent); ok && ev.PlayerName == "demo" && ev.FilterName == "" {
+				if filters := jb.PlayerAutoQueuerFilters(ctx); len(filters) != 0 {
+					t.Fatalf("the auto-queuer is still active: %v", filters)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("the auto-queuer was not removed")
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package jukebox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"trollibox/src/identity"
+	"trollibox/src/library"
+	"trollibox/src/player"
+)
+
+// A Quota limits how many tracks users may queue. Tracks are counted per
+// requester, which are told apart by their account or else their address, see
+// identity.Identity.Key, so changing nicknames does not grant a new quota.
+// Zero values disable the respective limit.
+type Quota struct {
+	// The maximum number of upcoming tracks per requester.
+	MaxPending int `yaml:"max_pending"`
+	// The maximum total duration of the upcoming tracks per requester.
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// The time a requester has to wait between queueing tracks.
+	Cooldown time.Duration `yaml:"cooldown"`
+	// Reject tracks that are already in the upcoming part of the playlist.
+	RejectDuplicates bool `yaml:"reject_duplicates"`
+}
+
+func (quota Quota) enabled() bool {
+	return quota.MaxPending > 0 || quota.MaxDuration > 0 || quota.Cooldown > 0 || quota.RejectDuplicates
+}
+
+// QuotaReason is the quota that a QuotaError was caused by.
+type QuotaReason string
+
+const (
+	QuotaPending   QuotaReason = "pending"
+	QuotaDuration  QuotaReason = "duration"
+	QuotaCooldown  QuotaReason = "cooldown"
+	QuotaDuplicate QuotaReason = "duplicate"
+)
+
+// A QuotaError is returned when queueing tracks would violate a quota.
+type QuotaError struct {
+	Reason QuotaReason `json:"reason"`
+	// The limit that would be exceeded, a number of tracks or seconds.
+	Limit int `json:"limit,omitempty"`
+	// The number of seconds to wait before tracks may be queued again.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// The URI of the track that is already queued.
+	URI string `json:"uri,omitempty"`
+}
+
+func (err *QuotaError) Error() string {
+	switch err.Reason {
+	case QuotaPending:
+		return fmt.Sprintf("at most %d upcoming tracks may be queued per user", err.Limit)
+	case QuotaDuration:
+		return fmt.Sprintf("at most %v of upcoming tracks may be queued per user", time.Duration(err.Limit)*time.Second)
+	case QuotaCooldown:
+		return fmt.Sprintf("tracks may be queued again in %v", time.Duration(err.RetryAfter)*time.Second)
+	case QuotaDuplicate:
+		return fmt.Sprintf("track is already queued: %s", err.URI)
+	default:
+		return fmt.Sprintf("quota exceeded: %s", err.Reason)
+	}
+}
+
+// check returns a QuotaError if the requester, see requesterKey, may not
+// queue the tracks. The upcoming tracks start at the track that is currently
+// playing.
+func (quota Quota) check(now time.Time, upcoming []player.MetaTrack, requester string, tracks []library.Track, lastQueued time.Time) error {
+	if wait := lastQueued.Add(quota.Cooldown).Sub(now); quota.Cooldown > 0 && wait > 0 {
+		return &QuotaError{Reason: QuotaCooldown, RetryAfter: int((wait + time.Second - 1) / time.Second)}
+	}
+
+	if quota.RejectDuplicates {
+		queued := map[string]bool{}
+		for _, track := range upcoming {
+			queued[track.URI] = true
+		}
+		for _, track := range tracks {
+			if queued[track.URI] {
+				return &QuotaError{Reason: QuotaDuplicate, URI: track.URI}
+			}
+			queued[track.URI] = true
+		}
+	}
+
+	pending := len(tracks)
+	var duration time.Duration
+	for _, track := range tracks {
+		duration += track.Duration
+	}
+	for _, track := range upcoming {
+		if track.IsQueuedByUser() && requesterKey(track) == requester {
+			pending++
+			duration += track.Duration
+		}
+	}
+	if quota.MaxPending > 0 && pending > quota.MaxPending {
+		return &QuotaError{Reason: QuotaPending, Limit: quota.MaxPending}
+	}
+	if quota.MaxDuration > 0 && duration > quota.MaxDuration {
+		return &QuotaError{Reason: QuotaDuration, Limit: int(quota.MaxDuration / time.Second)}
+	}
+	return nil
+}
+
+// quotaState tracks when requesters last queued tracks on a player.
+type quotaState struct {
+	lock       sync.Mutex
+	lastQueued map[string]time.Time
+}
+
+func (jb *Jukebox) quotaState(playerName string) *quotaState {
+	state, _ := jb.quotaStates.LoadOrStore(playerName, &quotaState{lastQueued: map[string]time.Time{}})
+	return state.(*quotaState)
+}
+
+// checkQuota returns a QuotaError if the tracks may not be queued. Tracks
+// queued by the system and by administrators are not subject to quotas.
+//
+// The lock of the quota state must be held.
+func (jb *Jukebox) checkQuota(ctx context.Context, pl player.Player, state *quotaState, tracks []player.MetaTrack) error {
+	if !jb.quota.enabled() || identity.FromContext(ctx).Admin {
+		return nil
+	}
+
+	byRequester := map[string][]string{}
+	for _, track := range tracks {
+		if track.IsQueuedByUser() {
+			key := requesterKey(track)
+			byRequester[key] = append(byRequester[key], track.URI)
+		}
+	}
+	if len(byRequester) == 0 {
+		return nil
+	}
+
+	status, err := pl.Status(ctx)
+	if err != nil {
+		return err
+	}
+	libs := []library.Library{pl.Library(), jb.streamdb}
+	playlist, err := playerPlaylist{libraries: libs, Playlist: pl.Playlist()}.Tracks(ctx)
+	if err != nil {
+		return err
+	}
+	var upcoming []player.MetaTrack
+	if status.TrackIndex >= 0 && status.TrackIndex < len(playlist) {
+		upcoming = playlist[status.TrackIndex:]
+	}
+
+	now := time.Now()
+	for requester, uris := range byRequester {
+		newTracks, err := library.AllTrackInfo(ctx, libs, uris...)
+		if err != nil {
+			return err
+		}
+		// Tracks that are not found in any library are still counted.
+		for i, uri := range uris {
+			newTracks[i].URI = uri
+		}
+		if err := jb.quota.check(now, upcoming, requester, newTracks, state.lastQueued[requester]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordQueued starts the cooldown of the requesters of the tracks.
+//
+// The lock of the quota state must be held.
+func (jb *Jukebox) recordQueued(state *quotaState, tracks []player.MetaTrack) {
+	if jb.quota.Cooldown <= 0 {
+		return
+	}
+	now := time.Now()
+	for requester, t := range state.lastQueued {
+		if now.Sub(t) >= jb.quota.Cooldown {
+			delete(state.lastQueued, requester)
+		}
+	}
+	for _, track := range tracks {
+		if track.IsQueuedByUser() {
+			state.lastQueued[requesterKey(track)] = now
+		}
+	}
+}
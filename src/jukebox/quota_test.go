@@ -0,0 +1,70 @@
+package jukebox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+)
+
+func TestQuotaCheck(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	track := func(uri string, duration time.Duration) library.Track {
+		return library.Track{URI: uri, Duration: duration}
+	}
+	queued := func(uri, key string) player.MetaTrack {
+		return player.MetaTrack{
+			Track:        track(uri, 3*time.Minute),
+			QueuedBy:     player.QueuedByUserNamed("someone"),
+			RequesterKey: key,
+		}
+	}
+	const alice = "address:192.0.2.1"
+	upcoming := []player.MetaTrack{
+		queued("a", alice),
+		queued("b", alice),
+		queued("c", "address:192.0.2.2"),
+		{Track: track("d", 3*time.Minute), QueuedBy: player.QueuedBySystem},
+	}
+
+	tests := []struct {
+		name       string
+		quota      Quota
+		upcoming   []player.MetaTrack
+		tracks     []library.Track
+		lastQueued time.Time
+		expect     *QuotaError
+	}{
+		{"no limits", Quota{}, upcoming, []library.Track{track("a", time.Hour)}, now, nil},
+		{"pending below", Quota{MaxPending: 3}, upcoming, []library.Track{track("e", 0)}, time.Time{}, nil},
+		{"pending above", Quota{MaxPending: 3}, upcoming, []library.Track{track("e", 0), track("f", 0)}, time.Time{}, &QuotaError{Reason: QuotaPending, Limit: 3}},
+		{"pending others", Quota{MaxPending: 1}, upcoming[2:], []library.Track{track("e", 0)}, time.Time{}, nil},
+		{"duration at limit", Quota{MaxDuration: 10 * time.Minute}, upcoming, []library.Track{track("e", 4*time.Minute)}, time.Time{}, nil},
+		{"duration above", Quota{MaxDuration: 10 * time.Minute}, upcoming, []library.Track{track("e", 4*time.Minute+time.Second)}, time.Time{}, &QuotaError{Reason: QuotaDuration, Limit: 600}},
+		{"cooldown", Quota{Cooldown: time.Minute}, nil, []library.Track{track("e", 0)}, now.Add(-30 * time.Second), &QuotaError{Reason: QuotaCooldown, RetryAfter: 30}},
+		{"cooldown rounds up", Quota{Cooldown: time.Minute}, nil, []library.Track{track("e", 0)}, now.Add(-1500 * time.Millisecond), &QuotaError{Reason: QuotaCooldown, RetryAfter: 59}},
+		{"cooldown passed", Quota{Cooldown: time.Minute}, nil, []library.Track{track("e", 0)}, now.Add(-time.Minute), nil},
+		{"never queued", Quota{Cooldown: time.Minute}, nil, []library.Track{track("e", 0)}, time.Time{}, nil},
+		{"duplicate upcoming", Quota{RejectDuplicates: true}, upcoming, []library.Track{track("e", 0), track("d", 0)}, time.Time{}, &QuotaError{Reason: QuotaDuplicate, URI: "d"}},
+		{"duplicate in request", Quota{RejectDuplicates: true}, upcoming, []library.Track{track("e", 0), track("e", 0)}, time.Time{}, &QuotaError{Reason: QuotaDuplicate, URI: "e"}},
+		{"duplicates allowed", Quota{}, upcoming, []library.Track{track("a", 0)}, time.Time{}, nil},
+		{"cooldown first", Quota{MaxPending: 1, Cooldown: time.Minute}, upcoming, []library.Track{track("e", 0)}, now, &QuotaError{Reason: QuotaCooldown, RetryAfter: 60}},
+	}
+	for _, test := range tests {
+		err := test.quota.check(now, test.upcoming, alice, test.tracks, test.lastQueued)
+		if test.expect == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		var quotaErr *QuotaError
+		if !errors.As(err, &quotaErr) {
+			t.Errorf("%s: expected a QuotaError, got %v", test.name, err)
+		} else if *quotaErr != *test.expect {
+			t.Errorf("%s: expected %+v, got %+v", test.name, *test.expect, *quotaErr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package jukebox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// A PlayerAutoQueuerScheduleEvent is emitted after the schedule of a player
+// was changed. The schedule is nil if it was removed.
+type PlayerAutoQueuerScheduleEvent struct {
+	PlayerName string
+	Schedule   *Schedule
+}
+
+// A Schedule switches the filter of the auto-queuer of a player depending on
+// the time of day and day of the week.
+type Schedule struct {
+	// The filter that is used outside of the windows of all entries. If empty,
+	// the auto-queuer is disabled.
+	Default string `yaml:"default,omitempty" json:"default"`
+	// If the windows of entries overlap, the first entry is used.
+	Entries []ScheduleEntry `yaml:"entries" json:"entries"`
+}
+
+// A ScheduleEntry selects a filter during a window of time.
+type ScheduleEntry struct {
+	// The days of the week on which the window starts, every day if empty.
+	Weekdays []time.Weekday `yaml:"weekdays,omitempty" json:"weekdays"`
+	// The start and end of the window in local time, formatted like "15:04".
+	// If the end is not after the start, the window lasts until the end on
+	// the next day.
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+	// The name of the filter to use.
+	Filter string `yaml:"filter" json:"filter"`
+}
+
+// FilterAt returns the name of the filter that is scheduled at the specified
+// moment.
+func (sched *Schedule) FilterAt(t time.Time) string {
+	for _, entry := range sched.Entries {
+		if entry.contains(t) {
+			return entry.Filter
+		}
+	}
+	return sched.Default
+}
+
+func (sched *Schedule) validate() error {
+	for i, entry := range sched.Entries {
+		if _, err := parseClock(entry.Start); err != nil {
+			return fmt.Errorf("%w: entry %d: %v", ErrInvalidArgument, i, err)
+		}
+		if _, err := parseClock(entry.End); err != nil {
+			return fmt.Errorf("%w: entry %d: %v", ErrInvalidArgument, i, err)
+		}
+		if entry.Filter == "" {
+			return fmt.Errorf("%w: entry %d: no filter set", ErrInvalidArgument, i)
+		}
+		for _, day := range entry.Weekdays {
+			if day < time.Sunday || day > time.Saturday {
+				return fmt.Errorf("%w: entry %d: invalid weekday: %d", ErrInvalidArgument, i, day)
+			}
+		}
+	}
+	return nil
+}
+
+// filters returns the names of all filters used by the schedule.
+func (sched *Schedule) filters() []string {
+	var names []string
+	if sched.Default != "" {
+		names = append(names, sched.Default)
+	}
+	for _, entry := range sched.Entries {
+		names = append(names, entry.Filter)
+	}
+	return names
+}
+
+func (entry ScheduleEntry) contains(t time.Time) bool {
+	start, _ := parseClock(entry.Start)
+	end, _ := parseClock(entry.End)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if start < end {
+		return minute >= start && minute < end && entry.onDay(day)
+	}
+	return minute >= start && entry.onDay(day) || minute < end && entry.onDay((day+6)%7)
+}
+
+func (entry ScheduleEntry) onDay(day time.Weekday) bool {
+	if len(entry.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range entry.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses a time of day into the number of minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+type playerSchedule struct {
+	schedule Schedule
+	// The filter that was last selected by the schedule. The filter is only
+	// switched when this changes, so manually selected filters remain in
+	// effect until the next boundary.
+	applied string
+	// Set if the scheduled filter should be applied regardless.
+	pending bool
+}
+
+// PlayerAutoQueuerSchedule returns the schedule of a player or nil if the
+// player has no schedule.
+func (jb *Jukebox) PlayerAutoQueuerSchedule(ctx context.Context, playerName string) (*Schedule, error) {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return nil, err
+	}
+	jb.scheduleLock.Lock()
+	defer jb.scheduleLock.Unlock()
+	ps, ok := jb.schedules[playerName]
+	if !ok {
+		return nil, nil
+	}
+	sched := ps.schedule
+	return &sched, nil
+}
+
+// SetPlayerAutoQueuerSchedule sets the schedule of a player and immediately
+// switches to the filter that is scheduled at this moment. A nil schedule
+// removes the schedule, leaving the current filter in place.
+func (jb *Jukebox) SetPlayerAutoQueuerSchedule(ctx context.Context, playerName string, sched *Schedule) error {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return err
+	}
+	if sched != nil {
+		if err := sched.validate(); err != nil {
+			return err
+		}
+		for _, name := range sched.filters() {
+			if _, err := jb.filterdb.Get(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	jb.scheduleLock.Lock()
+	if sched == nil {
+		delete(jb.schedules, playerName)
+	} else {
+		jb.schedules[playerName] = &playerSchedule{schedule: *sched, pending: true}
+	}
+	jb.scheduleLock.Unlock()
+
+	jb.saveAutoQueuerState()
+	jb.Emit(PlayerAutoQueuerScheduleEvent{PlayerName: playerName, Schedule: sched})
+	jb.applySchedules(time.Now())
+	return nil
+}
+
+// applySchedules switches the filters of players of which the scheduled filter
+// has changed.
+func (jb *Jukebox) applySchedules(now time.Time) {
+	switches := map[string]string{}
+	jb.scheduleLock.Lock()
+	for playerName, ps := range jb.schedules {
+		if filterName := ps.schedule.FilterAt(now); ps.pending || filterName != ps.applied {
+			ps.applied, ps.pending = filterName, false
+			switches[playerName] = filterName
+		}
+	}
+	jb.scheduleLock.Unlock()
+
+	for playerName, filterName := range switches {
+		slog.Info("Switching auto queuer filter by schedule", "player", playerName, "filter", filterName)
+		if err := jb.SetPlayerAutoQueuerFilter(context.Background(), playerName, filterName); err != nil {
+			slog.Error("Unable to switch auto queuer filter by schedule", "player", playerName, "filter", filterName, "error", err)
+		}
+	}
+}
+
+// runSchedules applies the schedules at the start of every minute.
+func (jb *Jukebox) runSchedules() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		jb.applySchedules(time.Now())
+	}
+}
@@ -0,0 +1,86 @@
+package jukebox
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleFilterAt(t *testing.T) {
+	sched := Schedule{
+		Default: "default",
+		Entries: []ScheduleEntry{
+			{Start: "09:00", End: "12:00", Weekdays: []time.Weekday{time.Monday}, Filter: "morning"},
+			// Past midnight, starting on Fridays.
+			{Start: "22:00", End: "02:00", Weekdays: []time.Weekday{time.Friday}, Filter: "night"},
+			// Overlaps with the first entry, which takes precedence.
+			{Start: "11:00", End: "13:00", Filter: "lunch"},
+			// Lasts a full day.
+			{Start: "18:00", End: "18:00", Weekdays: []time.Weekday{time.Wednesday}, Filter: "wednesday"},
+		},
+	}
+	// 2024-01-01 is a Monday.
+	at := func(day time.Weekday, hour, minute int) time.Time {
+		return time.Date(2024, 1, 1+int(day-time.Monday+7)%7, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		t      time.Time
+		expect string
+	}{
+		{"before start", at(time.Monday, 8, 59), "default"},
+		{"at start", at(time.Monday, 9, 0), "morning"},
+		{"before end", at(time.Monday, 11, 59), "morning"},
+		{"at end", at(time.Monday, 12, 0), "lunch"},
+		{"other weekday", at(time.Tuesday, 9, 30), "default"},
+		{"every day", at(time.Tuesday, 11, 30), "lunch"},
+		{"after every day", at(time.Tuesday, 13, 0), "default"},
+		{"past midnight start", at(time.Friday, 22, 0), "night"},
+		{"past midnight next day", at(time.Saturday, 1, 59), "night"},
+		{"past midnight end", at(time.Saturday, 2, 0), "default"},
+		{"past midnight previous weekday", at(time.Friday, 1, 0), "default"},
+		{"past midnight other weekday", at(time.Thursday, 23, 0), "default"},
+		{"full day start", at(time.Wednesday, 18, 0), "wednesday"},
+		{"full day next day", at(time.Thursday, 17, 59), "wednesday"},
+		{"full day end", at(time.Thursday, 18, 0), "default"},
+		{"full day before start", at(time.Wednesday, 17, 59), "default"},
+	}
+	for _, test := range tests {
+		if filter := sched.FilterAt(test.t); filter != test.expect {
+			t.Errorf("%s (%v): expected %q, got %q", test.name, test.t, test.expect, filter)
+		}
+	}
+
+	if filter := (&Schedule{}).FilterAt(at(time.Monday, 12, 0)); filter != "" {
+		t.Errorf("expected no filter for an empty schedule, got %q", filter)
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ScheduleEntry
+		valid bool
+	}{
+		{"valid", ScheduleEntry{Start: "09:00", End: "17:30", Filter: "f"}, true},
+		{"weekdays", ScheduleEntry{Start: "09:00", End: "17:30", Weekdays: []time.Weekday{time.Sunday, time.Saturday}, Filter: "f"}, true},
+		{"start equals end", ScheduleEntry{Start: "09:00", End: "09:00", Filter: "f"}, true},
+		{"empty start", ScheduleEntry{End: "17:30", Filter: "f"}, false},
+		{"no minutes", ScheduleEntry{Start: "9", End: "17:30", Filter: "f"}, false},
+		{"hour out of range", ScheduleEntry{Start: "09:00", End: "24:00", Filter: "f"}, false},
+		{"minute out of range", ScheduleEntry{Start: "09:60", End: "17:30", Filter: "f"}, false},
+		{"seconds", ScheduleEntry{Start: "09:00:00", End: "17:30", Filter: "f"}, false},
+		{"no filter", ScheduleEntry{Start: "09:00", End: "17:30"}, false},
+		{"invalid weekday", ScheduleEntry{Start: "09:00", End: "17:30", Weekdays: []time.Weekday{7}, Filter: "f"}, false},
+	}
+	for _, test := range tests {
+		sched := Schedule{Entries: []ScheduleEntry{test.entry}}
+		err := sched.validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%s: expected ErrInvalidArgument, got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package jukebox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"trollibox/src/identity"
+	"trollibox/src/player"
+)
+
+// ErrSkipVoteRequired is returned when a user that is not an administrator
+// skips tracks other than by vote while skip voting is enabled.
+var ErrSkipVoteRequired = errors.New("skipping tracks requires a vote")
+
+// SkipVoting configures skipping tracks by vote. If neither Votes nor Fraction
+// is set, tracks are skipped right away.
+type SkipVoting struct {
+	// The number of votes required to skip a track.
+	Votes int `yaml:"votes"`
+	// The fraction of active listeners that must vote to skip a track. Only
+	// used if Votes is not set.
+	Fraction float64 `yaml:"fraction"`
+}
+
+// Enabled reports whether skipping requires votes.
+func (sv SkipVoting) Enabled() bool {
+	return sv.Votes > 0 || sv.Fraction > 0
+}
+
+// required returns the number of votes required to skip a track.
+func (sv SkipVoting) required(listeners int) int {
+	if sv.Votes > 0 {
+		return sv.Votes
+	}
+	n := int(math.Ceil(sv.Fraction * float64(listeners)))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// SkipVotes is the tally of the votes to skip the current track of a player.
+type SkipVotes struct {
+	Votes    int
+	Required int
+	// Set if the vote caused the track to be skipped.
+	Skipped bool
+}
+
+// A PlayerSkipVotesEvent is emitted after the votes to skip the current track
+// of a player, or the number of votes required, have changed.
+type PlayerSkipVotesEvent struct {
+	PlayerName string
+	SkipVotes
+}
+
+type skipVoteState struct {
+	lock sync.Mutex
+	// The position and URI of the track that is being voted on.
+	index int
+	uri   string
+	votes map[string]bool
+	// Stops watching for playlist changes.
+	cancel context.CancelFunc
+	// The number of connections per listener.
+	listeners map[string]int
+}
+
+// tally must be called with the lock held.
+func (state *skipVoteState) tally(voting SkipVoting) SkipVotes {
+	active := len(state.listeners)
+	for voter := range state.votes {
+		if _, ok := state.listeners[voter]; !ok {
+			active++
+		}
+	}
+	return SkipVotes{Votes: len(state.votes), Required: voting.required(active)}
+}
+
+// reset must be called with the lock held.
+func (state *skipVoteState) reset() {
+	if state.cancel != nil {
+		state.cancel()
+		state.cancel = nil
+	}
+	state.votes = nil
+}
+
+func (jb *Jukebox) skipVoteState(playerName string) *skipVoteState {
+	state, _ := jb.skipVotes.LoadOrStore(playerName, &skipVoteState{listeners: map[string]int{}})
+	return state.(*skipVoteState)
+}
+
+// SkipVotingEnabled reports whether tracks are skipped by vote.
+func (jb *Jukebox) SkipVotingEnabled() bool {
+	return jb.skipVoting.Enabled()
+}
+
+// mustVote reports whether the user may only skip tracks by vote.
+func (jb *Jukebox) mustVote(ctx context.Context) bool {
+	return jb.skipVoting.Enabled() && !identity.FromContext(ctx).Admin
+}
+
+// PlayerSkipVotes returns the votes to skip the current track of a player.
+func (jb *Jukebox) PlayerSkipVotes(ctx context.Context, playerName string) (SkipVotes, error) {
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return SkipVotes{}, err
+	}
+	state := jb.skipVoteState(playerName)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.tally(jb.skipVoting), nil
+}
+
+// VoteSkipPlayerTrack registers a vote of the voter to skip the current track
+// of a player. The track is skipped once enough votes have been cast. Votes
+// are reset when the playlist changes or another track starts playing.
+func (jb *Jukebox) VoteSkipPlayerTrack(ctx context.Context, playerName, voter string) (SkipVotes, error) {
+	pl, err := jb.players.PlayerByName(playerName)
+	if err != nil {
+		return SkipVotes{}, err
+	}
+	status, err := pl.Status(ctx)
+	if err != nil {
+		return SkipVotes{}, err
+	}
+	tracks, err := pl.Playlist().Tracks(ctx)
+	if err != nil {
+		return SkipVotes{}, err
+	}
+	if status.TrackIndex < 0 || status.TrackIndex >= len(tracks) {
+		return SkipVotes{}, fmt.Errorf("%w: no track is playing", ErrInvalidArgument)
+	}
+	index, uri := status.TrackIndex, tracks[status.TrackIndex].URI
+
+	state := jb.skipVoteState(playerName)
+	state.lock.Lock()
+	if state.votes == nil || state.index != index || state.uri != uri {
+		state.reset()
+		state.index, state.uri = index, uri
+		state.votes = map[string]bool{}
+		var watchCtx context.Context
+		watchCtx, state.cancel = context.WithCancel(context.Background())
+		go jb.watchSkipVotes(watchCtx, playerName, pl, pl.Events().Listen(watchCtx), state)
+	}
+	state.votes[voter] = true
+	votes := state.tally(jb.skipVoting)
+	if votes.Votes >= votes.Required {
+		state.reset()
+		votes.Skipped = true
+	}
+	state.lock.Unlock()
+
+	if votes.Skipped {
+		if err := pl.SetTrackIndex(ctx, index+1); err != nil {
+			return SkipVotes{}, err
+		}
+		jb.Emit(PlayerSkipVotesEvent{PlayerName: playerName, SkipVotes: SkipVotes{Required: votes.Required}})
+	} else {
+		jb.Emit(PlayerSkipVotesEvent{PlayerName: playerName, SkipVotes: votes})
+	}
+	return votes, nil
+}
+
+// watchSkipVotes resets the votes of a player when its playlist changes or
+// it moves on to another track.
+func (jb *Jukebox) watchSkipVotes(ctx context.Context, playerName string, pl player.Player, events <-chan interface{}, state *skipVoteState) {
+	for event := range events {
+		switch event.(type) {
+		case player.PlaylistEvent:
+		case player.PlayStateEvent:
+			if !jb.currentTrackChanged(ctx, pl, state) {
+				continue
+			}
+		default:
+			continue
+		}
+		state.lock.Lock()
+		if ctx.Err() != nil {
+			// The votes were reset in the meantime.
+			state.lock.Unlock()
+			return
+		}
+		state.reset()
+		votes := state.tally(jb.skipVoting)
+		state.lock.Unlock()
+		jb.Emit(PlayerSkipVotesEvent{PlayerName: playerName, SkipVotes: votes})
+		return
+	}
+}
+
+// currentTrackChanged reports whether the player is no longer playing the
+// track that is being voted on.
+func (jb *Jukebox) currentTrackChanged(ctx context.Context, pl player.Player, state *skipVoteState) bool {
+	status, err := pl.Status(ctx)
+	if err != nil {
+		return false
+	}
+	tracks, err := pl.Playlist().Tracks(ctx)
+	if err != nil {
+		return false
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return status.TrackIndex != state.index || status.TrackIndex >= len(tracks) || tracks[status.TrackIndex].URI != state.uri
+}
+
+// AddPlayerListener registers an active listener of a player, which affects
+// the number of votes required to skip a track. The returned function must be
+// called once the listener is no longer active.
+func (jb *Jukebox) AddPlayerListener(playerName, listener string) func() {
+	state := jb.skipVoteState(playerName)
+	state.lock.Lock()
+	state.listeners[listener]++
+	votes := state.tally(jb.skipVoting)
+	state.lock.Unlock()
+	jb.Emit(PlayerSkipVotesEvent{PlayerName: playerName, SkipVotes: votes})
+
+	return func() {
+		state.lock.Lock()
+		if state.listeners[listener]--; state.listeners[listener] <= 0 {
+			delete(state.listeners, listener)
+		}
+		votes := state.tally(jb.skipVoting)
+		state.lock.Unlock()
+		jb.Emit(PlayerSkipVotesEvent{PlayerName: playerName, SkipVotes: votes})
+	}
+}
@@ -0,0 +1,71 @@
+package jukebox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"trollibox/src/player"
+	"trollibox/src/player/virtual"
+	"trollibox/src/util"
+)
+
+// playStatePlayer only reports changes of the play state, like players that
+// do not emit a PlaylistEvent when moving on to the next track.
+type playStatePlayer struct {
+	*virtual.Player
+	events util.Emitter
+}
+
+func (pl *playStatePlayer) Events() *util.Emitter {
+	return &pl.events
+}
+
+func TestSkipVotesResetOnNextTrack(t *testing.T) {
+	ctx := context.Background()
+	pl := &playStatePlayer{Player: newTestPlayer()}
+	jb := newTestJukebox(t, pl, SkipVoting{Votes: 2})
+	tracks, err := pl.Library().Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range tracks {
+		if err := pl.Playlist().Insert(ctx, -1, player.MetaTrack{Track: track, QueuedBy: player.QueuedBySystem}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pl.SetTrackIndex(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expectVotes := func(expect int) {
+		t.Helper()
+		var votes SkipVotes
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if votes, err = jb.PlayerSkipVotes(ctx, "demo"); err != nil {
+				t.Fatal(err)
+			}
+			if votes.Votes == expect {
+				return
+			}
+		}
+		t.Fatalf("expected %d votes, got %+v", expect, votes)
+	}
+	if _, err := jb.VoteSkipPlayerTrack(ctx, "demo", "address:192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pausing does not change the track.
+	if err := pl.SetState(ctx, player.PlayStatePaused); err != nil {
+		t.Fatal(err)
+	}
+	pl.events.Emit(player.PlayStateEvent{State: player.PlayStatePaused})
+	time.Sleep(50 * time.Millisecond)
+	expectVotes(1)
+
+	if err := pl.SetTrackIndex(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	pl.events.Emit(player.PlayStateEvent{State: player.PlayStatePlaying})
+	expectVotes(0)
+}
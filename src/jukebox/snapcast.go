@@ -0,0 +1,81 @@
+package jukebox
+
+import (
+	"context"
+	"errors"
+
+	"trollibox/src/snapcast"
+	"trollibox/src/util"
+)
+
+// ErrSnapcastNotConfigured is returned from the Snapcast functions when no
+// Snapserver is configured.
+var ErrSnapcastNotConfigured = errors.New("snapcast is not configured")
+
+// PlayerSnapcast is the state of the Snapcast clients as seen from a player.
+type PlayerSnapcast struct {
+	// The ID of the stream that is fed by the player.
+	Stream string
+	snapcast.Status
+}
+
+// PlaysStream reports whether the client plays the stream of the player.
+func (state *PlayerSnapcast) PlaysStream(clientID string) bool {
+	for _, client := range state.Clients {
+		if client.ID == clientID {
+			return client.StreamID == state.Stream
+		}
+	}
+	return false
+}
+
+// SnapcastEnabled reports whether a Snapserver is configured.
+func (jb *Jukebox) SnapcastEnabled() bool {
+	return jb.snapcast != nil
+}
+
+// SnapcastEvents returns the emitter of the events of the Snapserver. Must
+// only be called if Snapcast is enabled.
+func (jb *Jukebox) SnapcastEvents() *util.Emitter {
+	return jb.snapcast.Events()
+}
+
+// PlayerSnapcast returns the stream that is fed by a player along with all
+// Snapcast clients, so clients playing other streams can be moved to it.
+func (jb *Jukebox) PlayerSnapcast(ctx context.Context, playerName string) (*PlayerSnapcast, error) {
+	if jb.snapcast == nil {
+		return nil, ErrSnapcastNotConfigured
+	}
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return nil, err
+	}
+	status, err := jb.snapcast.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PlayerSnapcast{Stream: jb.snapcast.PlayerStream(playerName), Status: *status}, nil
+}
+
+// SetSnapcastClientVolume sets the volume of a Snapcast client. The volume is
+// clamped to the range 0 to 100.
+func (jb *Jukebox) SetSnapcastClientVolume(ctx context.Context, clientID string, vol int, muted bool) error {
+	if jb.snapcast == nil {
+		return ErrSnapcastNotConfigured
+	}
+	return jb.snapcast.SetClientVolume(ctx, clientID, vol, muted)
+}
+
+// SetSnapcastClientStream moves a Snapcast client to the specified stream. If
+// the stream is empty, the client is moved to the stream of the player.
+func (jb *Jukebox) SetSnapcastClientStream(ctx context.Context, playerName, clientID, streamID string) error {
+	if jb.snapcast == nil {
+		return ErrSnapcastNotConfigured
+	}
+	if _, err := jb.players.PlayerByName(playerName); err != nil {
+		return err
+	}
+	if streamID == "" {
+		streamID = jb.snapcast.PlayerStream(playerName)
+	}
+	return jb.snapcast.SetClientStream(ctx, clientID, streamID)
+}
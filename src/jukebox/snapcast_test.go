@@ -0,0 +1,25 @@
+package jukebox
+
+import (
+	"testing"
+
+	"trollibox/src/snapcast"
+)
+
+func TestPlayerSnapcastPlaysStream(t *testing.T) {
+	state := PlayerSnapcast{
+		Stream: "space",
+		Status: snapcast.Status{
+			Clients: []snapcast.Client{
+				{ID: "c1", GroupID: "g1", StreamID: "space"},
+				{ID: "c2", GroupID: "g1", StreamID: "space"},
+				{ID: "c3", GroupID: "g2", StreamID: "radio"},
+			},
+		},
+	}
+	for clientID, expect := range map[string]bool{"c1": true, "c2": true, "c3": false, "unknown": false} {
+		if plays := state.PlaysStream(clientID); plays != expect {
+			t.Errorf("%s: expected %v, got %v", clientID, expect, plays)
+		}
+	}
+}
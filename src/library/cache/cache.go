@@ -18,10 +18,11 @@ type Cache struct {
 	library.Library
 	util.Emitter
 
-	lock   sync.RWMutex
-	tracks []library.Track
-	index  map[string]*library.Track
-	err    error
+	lock       sync.RWMutex
+	tracks     []library.Track
+	index      map[string]*library.Track
+	trackIndex *library.Index
+	err        error
 }
 
 // NewCache wraps the specified library and caches it's contents.
@@ -81,6 +82,25 @@ func (cache *Cache) TrackInfo(ctx context.Context, uris ...string) ([]library.Tr
 	return results, nil
 }
 
+// TrackIndex implements the library.IndexedLibrary interface.
+//
+// The index is rebuilt each time the underlying library is updated.
+func (cache *Cache) TrackIndex(ctx context.Context) (*library.Index, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	if cache.tracks == nil {
+		cache.lock.RUnlock()
+		cache.lock.Lock()
+		if cache.tracks == nil {
+			cache.reloadTracks(ctx)
+		}
+		cache.lock.Unlock()
+		cache.lock.RLock()
+	}
+	return cache.trackIndex, cache.err
+}
+
 // Events implements the util.Eventer interface.
 func (cache *Cache) Events() *util.Emitter {
 	return &cache.Emitter
@@ -112,14 +132,16 @@ func (cache *Cache) reloadTracks(ctx context.Context) {
 	tracks, err := cache.Library.Tracks(ctx)
 	if err != nil {
 		cache.err = err
-		cache.tracks, cache.index = nil, nil
+		cache.tracks, cache.index, cache.trackIndex = nil, nil, nil
 		return
 	}
+	cache.err = nil
 
 	cache.tracks, cache.index = tracks, map[string]*library.Track{}
 	for i, track := range cache.tracks {
 		cache.index[track.URI] = &cache.tracks[i]
 	}
+	cache.trackIndex = library.NewIndex(cache.tracks)
 
 	slog.Info("Done reloading tracks", "cache", cache)
 }
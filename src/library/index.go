@@ -0,0 +1,170 @@
+package library
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// An Index is an inverted index of the words in the string attributes of a
+// list of tracks. It is used to quickly find the tracks which could match a
+// search query.
+//
+// Words are sequences of letters and digits and are stored case folded, see
+// FoldString.
+type Index struct {
+	tracks []Track
+	attrs  map[string]*attrIndex
+}
+
+type attrIndex struct {
+	// Maps each word to the sorted positions of the tracks it appears in.
+	postings map[string][]int
+	// All words in sorted order.
+	vocabulary []string
+}
+
+// NewIndex indexes the string attributes of the specified tracks.
+func NewIndex(tracks []Track) *Index {
+	idx := &Index{tracks: tracks, attrs: map[string]*attrIndex{}}
+	for _, attr := range TrackAttrs {
+		if _, ok := (&Track{}).Attr(attr).(string); !ok {
+			continue
+		}
+		ai := &attrIndex{postings: map[string][]int{}}
+		for i := range tracks {
+			for _, word := range IndexWords(tracks[i].Attr(attr).(string)) {
+				p := ai.postings[word]
+				if len(p) > 0 && p[len(p)-1] == i {
+					continue
+				}
+				ai.postings[word] = append(p, i)
+			}
+		}
+		ai.vocabulary = make([]string, 0, len(ai.postings))
+		for word := range ai.postings {
+			ai.vocabulary = append(ai.vocabulary, word)
+		}
+		sort.Strings(ai.vocabulary)
+		idx.attrs[attr] = ai
+	}
+	return idx
+}
+
+// Tracks returns the indexed tracks. The positions returned by the lookup
+// functions refer to this list.
+func (idx *Index) Tracks() []Track {
+	return idx.tracks
+}
+
+// Indexed reports whether the named attribute is indexed.
+func (idx *Index) Indexed(attr string) bool {
+	_, ok := idx.attrs[attr]
+	return ok
+}
+
+// Lookup returns the sorted positions of the tracks that contain the word in
+// the named attribute. The word must be folded.
+func (idx *Index) Lookup(attr, word string) []int {
+	ai, ok := idx.attrs[attr]
+	if !ok {
+		return nil
+	}
+	return ai.postings[word]
+}
+
+// LookupFunc returns the sorted positions of the tracks that contain a word in
+// the named attribute for which the match function returns true.
+func (idx *Index) LookupFunc(attr string, match func(word string) bool) []int {
+	ai, ok := idx.attrs[attr]
+	if !ok {
+		return nil
+	}
+	var lists [][]int
+	for _, word := range ai.vocabulary {
+		if match(word) {
+			lists = append(lists, ai.postings[word])
+		}
+	}
+	return UnionPositions(lists...)
+}
+
+// IsWordRune reports whether the character is part of the words that are
+// indexed.
+func IsWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// IndexWords splits s into the folded words that would be indexed for it.
+func IndexWords(s string) []string {
+	return strings.FieldsFunc(FoldString(s), func(r rune) bool {
+		return !IsWordRune(r)
+	})
+}
+
+// FoldString maps every character of s to a canonical lower case character
+// that is the same for all characters that are equal under Unicode case
+// folding.
+func FoldString(s string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return unicode.ToLower(min)
+	}, s)
+}
+
+// UnionPositions merges sorted lists of positions into a single sorted list
+// without duplicates.
+func UnionPositions(lists ...[]int) []int {
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+	var n int
+	for _, l := range lists {
+		n += len(l)
+	}
+	union := make([]int, 0, n)
+	for _, l := range lists {
+		union = append(union, l...)
+	}
+	sort.Ints(union)
+	out := union[:0]
+	for i, p := range union {
+		if i == 0 || p != union[i-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// IntersectPositions returns the positions that are present in all of the
+// sorted lists.
+func IntersectPositions(lists ...[]int) []int {
+	if len(lists) == 0 {
+		return nil
+	}
+	result := lists[0]
+	for _, l := range lists[1:] {
+		next := make([]int, 0, len(result))
+		for i, j := 0, 0; i < len(result) && j < len(l); {
+			switch {
+			case result[i] < l[j]:
+				i++
+			case result[i] > l[j]:
+				j++
+			default:
+				next = append(next, result[i])
+				i, j = i+1, j+1
+			}
+		}
+		result = next
+	}
+	return result
+}
@@ -0,0 +1,64 @@
+package library
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIndexWords(t *testing.T) {
+	testcases := []struct {
+		input  string
+		expect []string
+	}{
+		{"", []string{}},
+		{"The Beatles", []string{"the", "beatles"}},
+		{"AC/DC - T.N.T.", []string{"ac", "dc", "t", "n", "t"}},
+		{"Sigur Rós", []string{"sigur", "rós"}},
+		{"ΣΊΣΥΦΟΣ", IndexWords("σίσυφος")},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.input, func(t *testing.T) {
+			if words := IndexWords(tt.input); !reflect.DeepEqual(words, tt.expect) {
+				t.Fatalf("Unexpected words: exp %q, got %q", tt.expect, words)
+			}
+		})
+	}
+}
+
+func TestIndexLookup(t *testing.T) {
+	index := NewIndex([]Track{
+		{URI: "a", Artist: "The Beatles", Title: "Help!"},
+		{URI: "b", Artist: "The Rolling Stones", Title: "Paint It Black"},
+		{URI: "c", Artist: "Beat Happening", Title: "Indian Summer"},
+	})
+
+	if !index.Indexed("artist") || index.Indexed("duration") {
+		t.Fatalf("Unexpected indexed attributes")
+	}
+	if p := index.Lookup("artist", "the"); !reflect.DeepEqual(p, []int{0, 1}) {
+		t.Fatalf("Unexpected positions: %v", p)
+	}
+	if p := index.Lookup("artist", "The"); p != nil {
+		t.Fatalf("Unexpected positions for unfolded word: %v", p)
+	}
+	if p := index.Lookup("title", "the"); p != nil {
+		t.Fatalf("Unexpected positions: %v", p)
+	}
+	p := index.LookupFunc("artist", func(word string) bool { return strings.HasPrefix(word, "beat") })
+	if !reflect.DeepEqual(p, []int{0, 2}) {
+		t.Fatalf("Unexpected positions: %v", p)
+	}
+}
+
+func TestPositionSets(t *testing.T) {
+	if u := UnionPositions([]int{1, 3, 5}, []int{2, 3}, nil); !reflect.DeepEqual(u, []int{1, 2, 3, 5}) {
+		t.Fatalf("Unexpected union: %v", u)
+	}
+	if i := IntersectPositions([]int{1, 3, 5}, []int{2, 3, 5}, []int{3, 4, 5}); !reflect.DeepEqual(i, []int{3, 5}) {
+		t.Fatalf("Unexpected intersection: %v", i)
+	}
+	if i := IntersectPositions([]int{1, 3}, nil); len(i) != 0 {
+		t.Fatalf("Unexpected intersection: %v", i)
+	}
+}
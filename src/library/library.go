@@ -87,3 +87,11 @@ func AllTrackInfo(ctx context.Context, libs []Library, uris ...string) ([]Track,
 	}
 	return tracks, nil
 }
+
+// An IndexedLibrary is a Library that maintains an index of its tracks.
+type IndexedLibrary interface {
+	Library
+
+	// Returns an index of all tracks currently in the library.
+	TrackIndex(ctx context.Context) (*Index, error)
+}
@@ -3,6 +3,7 @@ package library
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,7 +14,30 @@ var (
 	interpFilename              = regexp.MustCompile(`^.*\/(.+)\.\w+$`)
 )
 
+// TrackAttrs lists the names of all attributes that are accepted by
+// Track.Attr.
+var TrackAttrs = []string{
+	"uri",
+	"artist",
+	"title",
+	"genre",
+	"album",
+	"albumartist",
+	"albumtrack",
+	"albumdisc",
+	"date",
+	"year",
+	"duration",
+	"modtime",
+}
+
 // Track holds all information associated with a single piece of music.
+//
+// The Date is the release date as found in the track's tags, which is usually
+// either a year or a date formatted as YYYY-MM-DD. The ModTime is the time at
+// which the track was last modified, which is a good indicator of when it was
+// added to the library. It is left out of the JSON encoding, the API sends it
+// as a Unix timestamp which is omitted if the time is unknown.
 type Track struct {
 	URI         string        `json:"uri"`
 	Artist      string        `json:"artist,omitempty"`
@@ -23,6 +47,7 @@ type Track struct {
 	AlbumArtist string        `json:"albumartist,omitempty"`
 	AlbumTrack  string        `json:"albumtrack,omitempty"`
 	AlbumDisc   string        `json:"albumdisc,omitempty"`
+	Date        string        `json:"date,omitempty"`
 	Duration    time.Duration `json:"duration"`
 	ModTime     time.Time     `json:"-"`
 }
@@ -42,7 +67,10 @@ func (t Track) GetURI() string {
 //	"albumartist"
 //	"albumtrack"
 //	"albumdisc"
-//	"duration"
+//	"date"
+//	"year"      the year of the date as an int64, 0 if unknown
+//	"duration"  in seconds as an int64
+//	"modtime"   as an int64 unix timestamp, 0 if unknown
 func (track *Track) Attr(attr string) interface{} {
 	switch attr {
 	case "uri":
@@ -61,12 +89,34 @@ func (track *Track) Attr(attr string) interface{} {
 		return track.AlbumTrack
 	case "albumdisc":
 		return track.AlbumDisc
+	case "date":
+		return track.Date
+	case "year":
+		return int64(track.Year())
 	case "duration":
 		return int64(track.Duration / time.Second)
+	case "modtime":
+		if track.ModTime.IsZero() {
+			return int64(0)
+		}
+		return track.ModTime.Unix()
 	}
 	return nil
 }
 
+// Year returns the year of the track's date or 0 if it is unknown.
+func (track *Track) Year() int {
+	n := 0
+	for n < len(track.Date) && n < 4 && '0' <= track.Date[n] && track.Date[n] <= '9' {
+		n++
+	}
+	if n != 4 {
+		return 0
+	}
+	year, _ := strconv.Atoi(track.Date[:n])
+	return year
+}
+
 func (track Track) String() string {
 	return fmt.Sprintf("%s - %s (%v)", track.Artist, track.Title, track.Duration)
 }
@@ -1,7 +1,10 @@
 package library
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInterpolateMissingFields(t *testing.T) {
@@ -60,3 +63,46 @@ func TestInterpolateMissingFields(t *testing.T) {
 		t.Fatalf("Unexpected artist and title: %q - %q", track.Artist, track.Title)
 	}
 }
+
+func TestYear(t *testing.T) {
+	testcases := []struct {
+		date string
+		year int
+	}{
+		{"", 0},
+		{"1994", 1994},
+		{"1994-03-01", 1994},
+		{"1994/03", 1994},
+		{"94", 0},
+		{"unknown", 0},
+	}
+	for _, tt := range testcases {
+		track := Track{Date: tt.date}
+		if year := track.Year(); year != tt.year {
+			t.Fatalf("Unexpected year for %q: exp %d, got %d", tt.date, tt.year, year)
+		}
+		if year := track.Attr("year"); year != int64(tt.year) {
+			t.Fatalf("Unexpected year attribute for %q: %v", tt.date, year)
+		}
+	}
+}
+
+func TestModTimeAttr(t *testing.T) {
+	if ts := (&Track{}).Attr("modtime"); ts != int64(0) {
+		t.Fatalf("Unexpected timestamp for an unknown modification time: %v", ts)
+	}
+	track := Track{ModTime: time.Unix(1700000000, 0)}
+	if ts := track.Attr("modtime"); ts != int64(1700000000) {
+		t.Fatalf("Unexpected timestamp: %v", ts)
+	}
+}
+
+func TestModTimeJSON(t *testing.T) {
+	data, err := json.Marshal(Track{URI: "foo://bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "modtime") {
+		t.Fatalf("Unexpected modification time in JSON: %s", data)
+	}
+}
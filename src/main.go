@@ -15,14 +15,22 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"trollibox/src/filter"
+	_ "trollibox/src/filter/composed"
 	_ "trollibox/src/filter/keyed"
 	"trollibox/src/filter/ruled"
 	"trollibox/src/handler/web"
+	"trollibox/src/history"
+	"trollibox/src/identity"
 	"trollibox/src/jukebox"
 	"trollibox/src/library/stream"
 	"trollibox/src/player"
+	"trollibox/src/player/kodi"
+	"trollibox/src/player/mopidy"
 	"trollibox/src/player/mpd"
+	"trollibox/src/player/mpris"
 	"trollibox/src/player/slimserver"
+	"trollibox/src/player/virtual"
+	"trollibox/src/snapcast"
 )
 
 const confFile = "config.yaml"
@@ -41,6 +49,16 @@ type config struct {
 
 	AutoQueue     bool   `yaml:"autoqueue"`
 	DefaultPlayer string `yaml:"default_player"`
+	FairQueue     bool   `yaml:"fair_queue"`
+
+	History history.Retention `yaml:"history"`
+
+	SkipVoting jukebox.SkipVoting `yaml:"skip_voting"`
+	Quota      jukebox.Quota      `yaml:"quota"`
+
+	Accounts identity.Accounts `yaml:"accounts"`
+
+	TrustedProxies identity.TrustedProxies `yaml:"trusted_proxies"`
 
 	Colors web.ColorConfig `yaml:"colors"`
 	MPD    []struct {
@@ -50,6 +68,20 @@ type config struct {
 		Password *string `yaml:"password"`
 	} `yaml:"mpd"`
 
+	Mopidy []struct {
+		Name string `yaml:"name"`
+		URL  string `yaml:"url"`
+	} `yaml:"mopidy"`
+
+	Kodi []struct {
+		Name     string  `yaml:"name"`
+		Network  string  `yaml:"network"`
+		Address  string  `yaml:"address"`
+		WebURL   string  `yaml:"weburl"`
+		Username *string `yaml:"username"`
+		Password *string `yaml:"password"`
+	} `yaml:"kodi"`
+
 	SlimServer *struct {
 		Network  string  `yaml:"network"`
 		Address  string  `yaml:"address"`
@@ -57,15 +89,43 @@ type config struct {
 		Password *string `yaml:"password"`
 		WebURL   string  `yaml:"weburl"`
 	} `yaml:"slimserver"`
+
+	Virtual []struct {
+		Name            string        `yaml:"name"`
+		Library         string        `yaml:"library"`
+		DefaultDuration time.Duration `yaml:"default_duration"`
+	} `yaml:"virtual"`
+
+	MPRIS *struct {
+		Bus string `yaml:"bus"`
+	} `yaml:"mpris"`
+
+	Snapcast *struct {
+		Network string            `yaml:"network"`
+		Address string            `yaml:"address"`
+		Streams map[string]string `yaml:"streams"`
+	} `yaml:"snapcast"`
 }
 
 func (conf *config) Validate() (errs []error) {
 	if conf.Address == "" {
 		errs = append(errs, fmt.Errorf("config: `bind` is required"))
 	}
-	if len(conf.MPD) == 0 && conf.SlimServer == nil {
+	if len(conf.MPD) == 0 && len(conf.Mopidy) == 0 && len(conf.Kodi) == 0 && conf.SlimServer == nil && conf.MPRIS == nil && len(conf.Virtual) == 0 {
 		errs = append(errs, fmt.Errorf("config: no media servers configured"))
 	}
+	if conf.SkipVoting.Votes < 0 || conf.SkipVoting.Fraction < 0 || conf.SkipVoting.Fraction > 1 {
+		errs = append(errs, fmt.Errorf("config: `skip_voting` is out of range"))
+	}
+	if conf.History.MaxEntries < 0 || conf.History.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("config: `history` limits can not be negative"))
+	}
+	if conf.Quota.MaxPending < 0 || conf.Quota.MaxDuration < 0 || conf.Quota.Cooldown < 0 {
+		errs = append(errs, fmt.Errorf("config: `quota` limits can not be negative"))
+	}
+	if err := conf.TrustedProxies.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("config: `trusted_proxies`: %w", err))
+	}
 	return
 }
 
@@ -141,6 +201,11 @@ func main() {
 		}
 	}
 
+	historydb, err := history.NewDB(path.Join(storeDir, "history"), config.History)
+	if err != nil {
+		log.Fatalf("Unable to create history database: %v", err)
+	}
+
 	players, err := connectToPlayers(config)
 	if err != nil {
 		log.Fatal(err)
@@ -155,15 +220,31 @@ func main() {
 		}
 	}
 
+	var snapServer *snapcast.Server
+	if config.Snapcast != nil {
+		snapServer, err = snapcast.Connect(config.Snapcast.Network, config.Snapcast.Address, config.Snapcast.Streams)
+		if err != nil {
+			log.Fatalf("Unable to connect to Snapcast: %v", err)
+		}
+		slog.Info("Connected to Snapcast", "address", config.Snapcast.Address)
+	}
+
 	jukebox := jukebox.NewJukebox(
 		players,
 		filterdb,
 		streamdb,
 		config.DefaultPlayer,
 		path.Join(storeDir, "auto-queuer.yaml"),
+		jukebox.Options{
+			FairQueue:  config.FairQueue,
+			SkipVoting: config.SkipVoting,
+			Quota:      config.Quota,
+			Snapcast:   snapServer,
+			History:    historydb,
+		},
 	)
 
-	service := web.New(build, version, config.Colors, config.URLRoot, jukebox)
+	service := web.New(build, version, config.Colors, config.URLRoot, jukebox, config.Accounts)
 
 	if build == "debug" {
 		service.Get("/debug/pprof/*", pprof.Index)
@@ -171,7 +252,7 @@ func main() {
 	slog.Info("Now accepting HTTP connections", "addr", config.Address)
 	server := &http.Server{
 		Addr:           config.Address,
-		Handler:        service,
+		Handler:        config.TrustedProxies.Middleware(service),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -180,20 +261,59 @@ func main() {
 }
 
 func connectToPlayers(config *config) (player.List, error) {
-	mpdPlayers := player.SimpleList{}
+	simplePlayers := player.SimpleList{}
 	for _, mpdConf := range config.MPD {
 		mpdPlayer, err := mpd.Connect(mpdConf.Network, mpdConf.Address, mpdConf.Password)
 		if err != nil {
 			return nil, fmt.Errorf("unable to connect to MPD: %v", err)
 		}
-		if _, ok := mpdPlayers[mpdConf.Name]; ok {
+		if _, ok := simplePlayers[mpdConf.Name]; ok {
 			return nil, fmt.Errorf("duplicate player name: %q", mpdConf.Name)
 		}
-		if err := mpdPlayers.Set(mpdConf.Name, mpdPlayer); err != nil {
+		if err := simplePlayers.Set(mpdConf.Name, mpdPlayer); err != nil {
+			return nil, err
+		}
+	}
+	for _, mopidyConf := range config.Mopidy {
+		mopidyPlayer, err := mopidy.Connect(mopidyConf.URL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Mopidy: %v", err)
+		}
+		if _, ok := simplePlayers[mopidyConf.Name]; ok {
+			return nil, fmt.Errorf("duplicate player name: %q", mopidyConf.Name)
+		}
+		if err := simplePlayers.Set(mopidyConf.Name, mopidyPlayer); err != nil {
 			return nil, err
 		}
 	}
 
+	for _, kodiConf := range config.Kodi {
+		kodiPlayer, err := kodi.Connect(kodiConf.Network, kodiConf.Address, kodiConf.WebURL, kodiConf.Username, kodiConf.Password)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Kodi: %v", err)
+		}
+		if _, ok := simplePlayers[kodiConf.Name]; ok {
+			return nil, fmt.Errorf("duplicate player name: %q", kodiConf.Name)
+		}
+		if err := simplePlayers.Set(kodiConf.Name, kodiPlayer); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, virtualConf := range config.Virtual {
+		lib, err := virtual.LoadLibrary(virtualConf.Library, virtualConf.DefaultDuration)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load virtual player library: %v", err)
+		}
+		if _, ok := simplePlayers[virtualConf.Name]; ok {
+			return nil, fmt.Errorf("duplicate player name: %q", virtualConf.Name)
+		}
+		if err := simplePlayers.Set(virtualConf.Name, virtual.New(lib)); err != nil {
+			return nil, err
+		}
+	}
+
+	lists := player.MultiList{simplePlayers}
 	if config.SlimServer != nil {
 		slimServ, err := slimserver.Connect(
 			config.SlimServer.Network,
@@ -205,8 +325,18 @@ func connectToPlayers(config *config) (player.List, error) {
 		if err != nil {
 			return nil, fmt.Errorf("unable to connect to SlimServer: %v", err)
 		}
-		return player.MultiList{mpdPlayers, slimServ}, nil
+		lists = append(lists, slimServ)
+	}
+	if config.MPRIS != nil {
+		bus, err := mpris.Connect(config.MPRIS.Bus)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to MPRIS players: %v", err)
+		}
+		lists = append(lists, bus)
 	}
 
-	return mpdPlayers, nil
+	if len(lists) == 1 {
+		return simplePlayers, nil
+	}
+	return lists, nil
 }
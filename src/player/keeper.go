@@ -36,7 +36,7 @@ func (kpr *PlaylistMetaKeeper) update(ctx context.Context) error {
 			if source != nil && source.QueuedBy != "" {
 				target.QueuedBy = source.QueuedBy
 			} else {
-				target.QueuedBy = "user"
+				target.QueuedBy = QueuedByUser
 			}
 		}
 	}
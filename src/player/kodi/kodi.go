@@ -0,0 +1,555 @@
+// Package kodi implements a player backend for Kodi using its JSON-RPC API
+// over TCP. Track art is retrieved from the image proxy of Kodi's web server.
+package kodi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/library/cache"
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+const (
+	uriSchema = "kodi://"
+
+	// The ID of the playlist that holds music.
+	audioPlaylistID = 0
+	// The ID of the player that plays music. Video and pictures are shown by
+	// other players.
+	audioPlayerID = 0
+)
+
+// The properties of songs that are requested from Kodi.
+var songProperties = []string{
+	"title", "artist", "albumartist", "album", "genre", "duration", "track",
+	"disc", "year", "file", "dateadded",
+}
+
+// The types of items played by Kodi that are not audio.
+var nonAudioItemTypes = map[string]bool{
+	"movie":      true,
+	"episode":    true,
+	"musicvideo": true,
+	"picture":    true,
+}
+
+// kodiNotification is a notification as received from Kodi.
+type kodiNotification struct {
+	Method string
+	Params string
+}
+
+type kodiSong struct {
+	File        string   `json:"file"`
+	Label       string   `json:"label"`
+	Title       string   `json:"title"`
+	Artist      []string `json:"artist"`
+	AlbumArtist []string `json:"albumartist"`
+	Album       string   `json:"album"`
+	Genre       []string `json:"genre"`
+	Duration    int      `json:"duration"`
+	Track       int      `json:"track"`
+	Disc        int      `json:"disc"`
+	Year        int      `json:"year"`
+	DateAdded   string   `json:"dateadded"`
+}
+
+type kodiTime struct {
+	Hours        int `json:"hours"`
+	Minutes      int `json:"minutes"`
+	Seconds      int `json:"seconds"`
+	Milliseconds int `json:"milliseconds"`
+}
+
+func (t kodiTime) duration() time.Duration {
+	return time.Duration(t.Hours)*time.Hour +
+		time.Duration(t.Minutes)*time.Minute +
+		time.Duration(t.Seconds)*time.Second +
+		time.Duration(t.Milliseconds)*time.Millisecond
+}
+
+func kodiTimeOf(d time.Duration) kodiTime {
+	return kodiTime{
+		Hours:        int(d / time.Hour),
+		Minutes:      int(d / time.Minute % 60),
+		Seconds:      int(d / time.Second % 60),
+		Milliseconds: int(d / time.Millisecond % 1000),
+	}
+}
+
+type kodiActivePlayer struct {
+	PlayerID int    `json:"playerid"`
+	Type     string `json:"type"`
+}
+
+// Player handles the connection to a single Kodi instance.
+type Player struct {
+	util.Emitter
+
+	address string
+	rpc     rpcClient
+
+	webURL     *url.URL
+	httpClient *http.Client
+
+	cachedLibrary *cache.Cache
+	playlist      player.PlaylistMetaKeeper
+}
+
+// Connect connects to the TCP JSON-RPC interface of Kodi, which listens on
+// port 9090 by default. The web URL is the root of Kodi's web server and is
+// used to retrieve track art, it may be empty. The username and password are
+// those of the web server.
+func Connect(network, address, webURL string, username, password *string) (*Player, error) {
+	pl := &Player{
+		Emitter:    util.Emitter{Release: time.Millisecond * 100},
+		address:    address,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if webURL != "" {
+		u, err := url.Parse(strings.TrimSuffix(webURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid Kodi web URL: %v", err)
+		}
+		if username != nil {
+			passwd := ""
+			if password != nil {
+				passwd = *password
+			}
+			u.User = url.UserPassword(*username, passwd)
+		}
+		pl.webURL = u
+	}
+	pl.playlist.Playlist = kodiPlaylist{player: pl}
+
+	pl.rpc = rpcClient{
+		network: network,
+		address: address,
+		onNotification: func(method string, params json.RawMessage) {
+			pl.Emit(kodiNotification{Method: method, Params: string(params)})
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialRPC(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	pl.rpc.conn = conn
+	go pl.rpc.run(conn)
+
+	// Test the connection.
+	if err := pl.rpc.call(ctx, "JSONRPC.Ping", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pl.cachedLibrary = cache.NewCache(pl)
+	go pl.mainLoop()
+	return pl, nil
+}
+
+func (pl *Player) mainLoop() {
+	ctx := context.Background()
+	for event := range pl.Listen(ctx) {
+		notification, ok := event.(kodiNotification)
+		if !ok {
+			continue
+		}
+		var params struct {
+			Data struct {
+				Item struct {
+					Type string `json:"type"`
+				} `json:"item"`
+				Player struct {
+					PlayerID *int     `json:"playerid"`
+					Time     kodiTime `json:"time"`
+				} `json:"player"`
+				PlaylistID *int `json:"playlistid"`
+				Volume     int  `json:"volume"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal([]byte(notification.Params), &params)
+
+		if strings.HasPrefix(notification.Method, "Player.") {
+			// Ignore video and pictures. Not all notifications carry
+			// the player, so the type of the item may tell too. Items
+			// of unknown type may be audio streams.
+			if id := params.Data.Player.PlayerID; id != nil && *id != audioPlayerID {
+				continue
+			}
+			if nonAudioItemTypes[params.Data.Item.Type] {
+				continue
+			}
+		}
+
+		switch notification.Method {
+		case "Player.OnPlay", "Player.OnResume", "Player.OnAVStart":
+			pl.Emit(player.PlayStateEvent{State: player.PlayStatePlaying})
+			pl.emitPlaylistEvent(ctx)
+		case "Player.OnPause":
+			pl.Emit(player.PlayStateEvent{State: player.PlayStatePaused})
+		case "Player.OnStop":
+			pl.Emit(player.PlayStateEvent{State: player.PlayStateStopped})
+			pl.emitPlaylistEvent(ctx)
+		case "Player.OnSeek":
+			pl.Emit(player.TimeEvent{Time: params.Data.Player.Time.duration()})
+		case "Playlist.OnAdd", "Playlist.OnRemove", "Playlist.OnClear":
+			if params.Data.PlaylistID != nil && *params.Data.PlaylistID == audioPlaylistID {
+				pl.emitPlaylistEvent(ctx)
+			}
+		case "Application.OnVolumeChanged":
+			pl.Emit(player.VolumeEvent{Volume: params.Data.Volume})
+		case "AudioLibrary.OnScanFinished", "AudioLibrary.OnCleanFinished":
+			pl.Emit(library.UpdateEvent{})
+		}
+	}
+}
+
+func (pl *Player) emitPlaylistEvent(ctx context.Context) {
+	status, err := pl.Status(ctx)
+	if err != nil {
+		slog.Error("Could not get Kodi status", "error", err)
+		return
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: status.TrackIndex})
+}
+
+// audioPlayer returns the ID of the active audio player, or -1 if nothing is
+// being played.
+func (pl *Player) audioPlayer(ctx context.Context) (int, error) {
+	var players []kodiActivePlayer
+	if err := pl.rpc.call(ctx, "Player.GetActivePlayers", nil, &players); err != nil {
+		return -1, err
+	}
+	for _, p := range players {
+		if p.Type == "audio" {
+			return p.PlayerID, nil
+		}
+	}
+	return -1, nil
+}
+
+// Library implements the player.Player interface.
+func (pl *Player) Library() library.Library {
+	return pl.cachedLibrary
+}
+
+// Tracks implements the library.Library interface.
+func (pl *Player) Tracks(ctx context.Context) ([]library.Track, error) {
+	var result struct {
+		Songs []kodiSong `json:"songs"`
+	}
+	params := map[string]interface{}{"properties": songProperties}
+	if err := pl.rpc.call(ctx, "AudioLibrary.GetSongs", params, &result); err != nil {
+		return nil, err
+	}
+	tracks := make([]library.Track, len(result.Songs))
+	for i, song := range result.Songs {
+		tracks[i] = trackFromKodiSong(song)
+	}
+	return tracks, nil
+}
+
+// TrackInfo implements the library.Library interface.
+func (pl *Player) TrackInfo(ctx context.Context, uris ...string) ([]library.Track, error) {
+	tracks := make([]library.Track, len(uris))
+	for i, uri := range uris {
+		// The information of HTTP streams is provided by the stream database.
+		if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+			continue
+		}
+		var result struct {
+			FileDetails kodiSong `json:"filedetails"`
+		}
+		params := map[string]interface{}{
+			"file":       uriToKodi(uri),
+			"media":      "music",
+			"properties": songProperties,
+		}
+		if err := pl.rpc.call(ctx, "Files.GetFileDetails", params, &result); err != nil {
+			var rpcErr *RPCError
+			if errors.As(err, &rpcErr) {
+				// The file does not exist.
+				continue
+			}
+			return nil, err
+		}
+		tracks[i] = trackFromKodiSong(result.FileDetails)
+	}
+	return tracks, nil
+}
+
+// TrackArt implements the library.Library interface.
+func (pl *Player) TrackArt(ctx context.Context, uri string) (*library.Art, error) {
+	if pl.webURL == nil {
+		return nil, library.ErrNoArt
+	}
+	var result struct {
+		FileDetails struct {
+			Thumbnail string `json:"thumbnail"`
+		} `json:"filedetails"`
+	}
+	params := map[string]interface{}{
+		"file":       uriToKodi(uri),
+		"media":      "music",
+		"properties": []string{"thumbnail"},
+	}
+	if err := pl.rpc.call(ctx, "Files.GetFileDetails", params, &result); err != nil {
+		return nil, err
+	}
+	if result.FileDetails.Thumbnail == "" {
+		return nil, library.ErrNoArt
+	}
+
+	// Kodi serves images through its image proxy.
+	imageURL := pl.webURL.JoinPath("image", url.PathEscape(result.FileDetails.Thumbnail))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pl.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, library.ErrNoArt
+	}
+	imageData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	art := &library.Art{
+		ImageData: imageData,
+		MimeType:  resp.Header.Get("Content-Type"),
+	}
+	if art.MimeType == "" {
+		art.MimeType = http.DetectContentType(imageData)
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		art.ModTime = modTime
+	}
+	return art, nil
+}
+
+// Lists implements the player.Player interface.
+func (pl *Player) Lists(ctx context.Context) (map[string]player.Playlist[library.Track], error) {
+	var result struct {
+		Files []struct {
+			File     string `json:"file"`
+			Label    string `json:"label"`
+			FileType string `json:"filetype"`
+		} `json:"files"`
+	}
+	params := map[string]interface{}{
+		"directory": "special://profile/playlists/music/",
+		"media":     "music",
+	}
+	if err := pl.rpc.call(ctx, "Files.GetDirectory", params, &result); err != nil {
+		return nil, err
+	}
+	playlists := map[string]player.Playlist[library.Track]{}
+	for _, file := range result.Files {
+		playlists[file.Label] = userPlaylist{player: pl, file: file.File}
+	}
+	return playlists, nil
+}
+
+// Status implements the player.Player interface.
+func (pl *Player) Status(ctx context.Context) (*player.Status, error) {
+	var app struct {
+		Volume int `json:"volume"`
+	}
+	if err := pl.rpc.call(ctx, "Application.GetProperties", map[string]interface{}{"properties": []string{"volume"}}, &app); err != nil {
+		return nil, err
+	}
+	status := &player.Status{
+		TrackIndex: -1,
+		PlayState:  player.PlayStateStopped,
+		Volume:     app.Volume,
+	}
+
+	playerID, err := pl.audioPlayer(ctx)
+	if err != nil {
+		return nil, err
+	} else if playerID < 0 {
+		return status, nil
+	}
+	var props struct {
+		Position int      `json:"position"`
+		Time     kodiTime `json:"time"`
+		Speed    int      `json:"speed"`
+	}
+	params := map[string]interface{}{
+		"playerid":   playerID,
+		"properties": []string{"position", "time", "speed"},
+	}
+	if err := pl.rpc.call(ctx, "Player.GetProperties", params, &props); err != nil {
+		return nil, err
+	}
+	status.TrackIndex = props.Position
+	status.Time = props.Time.duration()
+	if props.Speed == 0 {
+		status.PlayState = player.PlayStatePaused
+	} else {
+		status.PlayState = player.PlayStatePlaying
+	}
+	return status, nil
+}
+
+// SetTime implements the player.Player interface.
+func (pl *Player) SetTime(ctx context.Context, offset time.Duration) error {
+	if offset < 0 {
+		return fmt.Errorf("error setting time: negative offset")
+	}
+	playerID, err := pl.audioPlayer(ctx)
+	if err != nil || playerID < 0 {
+		return err
+	}
+	params := map[string]interface{}{
+		"playerid": playerID,
+		"value":    map[string]interface{}{"time": kodiTimeOf(offset)},
+	}
+	if err := pl.rpc.call(ctx, "Player.Seek", params, nil); err != nil {
+		return fmt.Errorf("error setting time: %w", err)
+	}
+	return nil
+}
+
+// SetTrackIndex implements the player.Player interface.
+func (pl *Player) SetTrackIndex(ctx context.Context, trackIndex int) error {
+	if plistLen, err := pl.Playlist().Len(ctx); err != nil {
+		return err
+	} else if trackIndex >= plistLen {
+		return pl.SetState(ctx, player.PlayStateStopped)
+	}
+	return pl.open(ctx, trackIndex)
+}
+
+// open starts playback of the audio playlist at the specified position.
+func (pl *Player) open(ctx context.Context, position int) error {
+	params := map[string]interface{}{
+		"item": map[string]interface{}{"playlistid": audioPlaylistID, "position": position},
+	}
+	return pl.rpc.call(ctx, "Player.Open", params, nil)
+}
+
+// SetState implements the player.Player interface.
+func (pl *Player) SetState(ctx context.Context, state player.PlayState) error {
+	playerID, err := pl.audioPlayer(ctx)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case player.PlayStatePaused:
+		if playerID < 0 {
+			return nil
+		}
+		return pl.rpc.call(ctx, "Player.PlayPause", map[string]interface{}{"playerid": playerID, "play": false}, nil)
+	case player.PlayStatePlaying:
+		if plistLen, err := pl.Playlist().Len(ctx); err != nil {
+			return fmt.Errorf("error getting playlist length: %v", err)
+		} else if plistLen == 0 {
+			pl.Emit(player.PlayStateEvent{State: state})
+			return nil
+		}
+		if playerID < 0 {
+			return pl.open(ctx, 0)
+		}
+		return pl.rpc.call(ctx, "Player.PlayPause", map[string]interface{}{"playerid": playerID, "play": true}, nil)
+	case player.PlayStateStopped:
+		if playerID < 0 {
+			return nil
+		}
+		return pl.rpc.call(ctx, "Player.Stop", map[string]interface{}{"playerid": playerID}, nil)
+	default:
+		return fmt.Errorf("unknown play state %q", state)
+	}
+}
+
+// SetVolume implements the player.Player interface.
+func (pl *Player) SetVolume(ctx context.Context, vol int) error {
+	if vol > 100 {
+		vol = 100
+	} else if vol < 0 {
+		vol = 0
+	}
+	return pl.rpc.call(ctx, "Application.SetVolume", map[string]interface{}{"volume": vol}, nil)
+}
+
+// Playlist implements the player.Player interface.
+func (pl *Player) Playlist() player.Playlist[player.MetaTrack] {
+	return &pl.playlist
+}
+
+// Events implements the player.Player interface.
+func (pl *Player) Events() *util.Emitter {
+	return &pl.Emitter
+}
+
+func (pl *Player) String() string {
+	return fmt.Sprintf("Kodi{%s}", pl.address)
+}
+
+func trackFromKodiSong(song kodiSong) library.Track {
+	track := library.Track{
+		URI:         kodiToURI(song.File),
+		Title:       song.Title,
+		Artist:      strings.Join(song.Artist, ", "),
+		AlbumArtist: strings.Join(song.AlbumArtist, ", "),
+		Album:       song.Album,
+		Genre:       strings.Join(song.Genre, ", "),
+		Duration:    time.Duration(song.Duration) * time.Second,
+	}
+	if track.Title == "" {
+		track.Title = song.Label
+	}
+	if song.Track > 0 {
+		track.AlbumTrack = strconv.Itoa(song.Track)
+	}
+	if song.Disc > 0 {
+		track.AlbumDisc = strconv.Itoa(song.Disc)
+	}
+	if song.Year > 0 {
+		track.Date = strconv.Itoa(song.Year)
+	}
+	if song.DateAdded != "" {
+		if modTime, err := time.ParseInLocation("2006-01-02 15:04:05", song.DateAdded, time.Local); err == nil {
+			track.ModTime = modTime
+		}
+	}
+	library.InterpolateMissingFields(&track)
+	return track
+}
+
+func uriToKodi(uri string) string {
+	return strings.TrimPrefix(uri, uriSchema)
+}
+
+func kodiToURI(file string) string {
+	if !strings.Contains(file, "://") {
+		return uriSchema + file
+	}
+	return file
+}
+
+// sortedDescending returns a copy of the positions sorted from high to low.
+func sortedDescending(positions []int) []int {
+	sorted := append([]int{}, positions...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	return sorted
+}
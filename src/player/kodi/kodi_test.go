@@ -0,0 +1,453 @@
+package kodi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+)
+
+const favouritesFile = "special://profile/playlists/music/Favourites.m3u"
+
+type fakeFile struct {
+	kodiSong
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// fakeKodi implements the parts of the TCP JSON-RPC API of Kodi that are used
+// by the player.
+type fakeKodi struct {
+	lock     sync.Mutex
+	library  []fakeFile
+	playlist []kodiSong
+	current  int
+	active   bool
+	speed    int
+	time     kodiTime
+	volume   int
+	conns    map[*json.Encoder]struct{}
+}
+
+func newFakeKodi(t *testing.T) net.Listener {
+	fake := &fakeKodi{
+		current: -1,
+		conns:   map[*json.Encoder]struct{}{},
+	}
+	fake.library = []fakeFile{
+		{kodiSong: kodiSong{File: "/music/a.mp3", Title: "Track A", Artist: []string{"Artist A"}, Duration: 180, Track: 1}, Thumbnail: "image://music@/music/a.mp3/"},
+		{kodiSong: kodiSong{File: "/music/b.mp3", Title: "Track B", Artist: []string{"Artist B", "Artist C"}, Album: "Album", Year: 2001, Duration: 200}},
+		{kodiSong: kodiSong{File: "/music/c.mp3", Title: "Track C", Duration: 220}},
+		{kodiSong: kodiSong{File: "/music/d.mp3", Title: "Track D", Duration: 240}},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return listener
+}
+
+func (fake *fakeKodi) serve(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	fake.lock.Lock()
+	fake.conns[encoder] = struct{}{}
+	fake.lock.Unlock()
+	defer func() {
+		fake.lock.Lock()
+		delete(fake.conns, encoder)
+		fake.lock.Unlock()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var req struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+		fake.handle(encoder, req.ID, req.Method, req.Params)
+	}
+}
+
+func (fake *fakeKodi) handle(encoder *json.Encoder, id int64, method string, rawParams json.RawMessage) {
+	var params struct {
+		File      string `json:"file"`
+		Directory string `json:"directory"`
+		Item      struct {
+			PlaylistID int `json:"playlistid"`
+			Position   int `json:"position"`
+		} `json:"item"`
+		Items []struct {
+			File string `json:"file"`
+		} `json:"-"`
+		Position  *int `json:"position"`
+		Position1 int  `json:"position1"`
+		Position2 int  `json:"position2"`
+		Play      bool `json:"play"`
+		Value     struct {
+			Time kodiTime `json:"time"`
+		} `json:"value"`
+		Volume int `json:"volume"`
+	}
+	if len(rawParams) > 0 {
+		_ = json.Unmarshal(rawParams, &params)
+		var items struct {
+			Item []struct {
+				File string `json:"file"`
+			} `json:"item"`
+		}
+		if json.Unmarshal(rawParams, &items) == nil {
+			params.Items = items.Item
+		}
+	}
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	type notification struct {
+		method string
+		data   map[string]interface{}
+	}
+	var notifications []notification
+	notify := func(method string, data map[string]interface{}) {
+		notifications = append(notifications, notification{method: method, data: data})
+	}
+	findSong := func(file string) (fakeFile, bool) {
+		for _, song := range fake.library {
+			if song.File == file {
+				return song, true
+			}
+		}
+		return fakeFile{}, false
+	}
+	play := func(index int) {
+		fake.current, fake.active, fake.speed, fake.time = index, true, 1, kodiTime{}
+		notify("Player.OnPlay", map[string]interface{}{"item": map[string]interface{}{"type": "song"}, "player": map[string]interface{}{"playerid": 0, "speed": 1}})
+	}
+
+	var result interface{}
+	var rpcErr *RPCError
+	switch method {
+	case "JSONRPC.Ping":
+		result = "pong"
+	case "AudioLibrary.GetSongs":
+		songs := make([]kodiSong, len(fake.library))
+		for i, song := range fake.library {
+			songs[i] = song.kodiSong
+		}
+		result = map[string]interface{}{"songs": songs}
+	case "Files.GetFileDetails":
+		if song, ok := findSong(params.File); ok {
+			result = map[string]interface{}{"filedetails": song}
+		} else {
+			rpcErr = &RPCError{Code: -32602, Message: "Invalid params."}
+		}
+	case "Files.GetDirectory":
+		switch params.Directory {
+		case "special://profile/playlists/music/":
+			result = map[string]interface{}{"files": []map[string]string{
+				{"file": favouritesFile, "label": "Favourites", "filetype": "file"},
+			}}
+		case favouritesFile:
+			b, _ := findSong("/music/b.mp3")
+			d, _ := findSong("/music/d.mp3")
+			result = map[string]interface{}{"files": []kodiSong{b.kodiSong, d.kodiSong}}
+		default:
+			rpcErr = &RPCError{Code: -32602, Message: "Invalid params."}
+		}
+	case "Player.GetActivePlayers":
+		players := []kodiActivePlayer{}
+		if fake.active {
+			players = append(players, kodiActivePlayer{PlayerID: 0, Type: "audio"})
+		}
+		result = players
+	case "Player.GetProperties":
+		result = map[string]interface{}{"position": fake.current, "time": fake.time, "speed": fake.speed}
+	case "Player.Open":
+		if params.Item.Position < 0 || params.Item.Position >= len(fake.playlist) {
+			rpcErr = &RPCError{Code: -32602, Message: "Invalid params."}
+			break
+		}
+		play(params.Item.Position)
+		result = "OK"
+	case "Player.PlayPause":
+		if params.Play && fake.speed == 0 {
+			fake.speed = 1
+			notify("Player.OnResume", map[string]interface{}{})
+		} else if !params.Play && fake.speed != 0 {
+			fake.speed = 0
+			notify("Player.OnPause", map[string]interface{}{})
+		}
+		result = map[string]interface{}{"speed": fake.speed}
+	case "Player.Stop":
+		fake.active, fake.speed, fake.current, fake.time = false, 0, -1, kodiTime{}
+		notify("Player.OnStop", map[string]interface{}{"item": map[string]interface{}{"type": "song"}, "end": false})
+		result = "OK"
+	case "Player.Seek":
+		fake.time = params.Value.Time
+		notify("Player.OnSeek", map[string]interface{}{"player": map[string]interface{}{"playerid": 0, "time": fake.time}})
+		result = map[string]interface{}{"time": fake.time}
+	case "Application.GetProperties":
+		result = map[string]interface{}{"volume": fake.volume}
+	case "Application.SetVolume":
+		fake.volume = params.Volume
+		notify("Application.OnVolumeChanged", map[string]interface{}{"volume": fake.volume, "muted": false})
+		result = fake.volume
+	case "Playlist.Add", "Playlist.Insert":
+		pos := len(fake.playlist)
+		if method == "Playlist.Insert" && params.Position != nil && *params.Position < pos {
+			pos = *params.Position
+		}
+		var added []kodiSong
+		for _, item := range params.Items {
+			if song, ok := findSong(item.File); ok {
+				added = append(added, song.kodiSong)
+			}
+		}
+		fake.playlist = append(fake.playlist[:pos], append(added, fake.playlist[pos:]...)...)
+		if fake.current >= pos {
+			fake.current += len(added)
+		}
+		for i := range added {
+			notify("Playlist.OnAdd", map[string]interface{}{"playlistid": 0, "position": pos + i})
+		}
+		result = "OK"
+	case "Playlist.Remove":
+		pos := *params.Position
+		if pos == fake.current && fake.active {
+			// Kodi does not allow removal of the item that is being played.
+			rpcErr = &RPCError{Code: -32100, Message: "Failed to execute method."}
+			break
+		}
+		fake.playlist = append(fake.playlist[:pos], fake.playlist[pos+1:]...)
+		if fake.current > pos {
+			fake.current--
+		}
+		notify("Playlist.OnRemove", map[string]interface{}{"playlistid": 0, "position": pos})
+		result = "OK"
+	case "Playlist.Swap":
+		a, b := params.Position1, params.Position2
+		fake.playlist[a], fake.playlist[b] = fake.playlist[b], fake.playlist[a]
+		if fake.current == a {
+			fake.current = b
+		} else if fake.current == b {
+			fake.current = a
+		}
+		result = "OK"
+	case "Playlist.GetItems":
+		result = map[string]interface{}{"items": fake.playlist}
+	case "Playlist.GetProperties":
+		result = map[string]interface{}{"size": len(fake.playlist)}
+	default:
+		rpcErr = &RPCError{Code: -32601, Message: "Method not found."}
+	}
+
+	_ = encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result, "error": rpcErr})
+	for _, n := range notifications {
+		message := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  n.method,
+			"params":  map[string]interface{}{"data": n.data, "sender": "xbmc"},
+		}
+		for conn := range fake.conns {
+			_ = conn.Encode(message)
+		}
+	}
+}
+
+func newFakeWebServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, passwd, ok := r.BasicAuth(); !ok || user != "kodi" || passwd != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/image/image://music@/music/a.mp3/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte("jpeg"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func connectForTesting(t *testing.T) *Player {
+	listener := newFakeKodi(t)
+	web := newFakeWebServer(t)
+	username, password := "kodi", "secret"
+	pl, err := Connect("tcp", listener.Addr().String(), web.URL, &username, &password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pl
+}
+
+func TestPlayerImplementation(t *testing.T) {
+	player.TestPlayerImplementation(t, connectForTesting(t))
+}
+
+func TestPlaylistImplementation(t *testing.T) {
+	pl := connectForTesting(t)
+	tracks, err := pl.Tracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaTracks := make([]player.MetaTrack, 3)
+	for i, t := range tracks[:len(metaTracks)] {
+		metaTracks[i].Track = t
+		metaTracks[i].QueuedBy = "system"
+	}
+
+	player.TestPlaylistImplementation[player.MetaTrack](t, pl.Playlist(), metaTracks)
+}
+
+func TestRemovePlaying(t *testing.T) {
+	ctx := context.Background()
+	pl := connectForTesting(t)
+	tracks, err := pl.Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plist := pl.playlist.Playlist
+	if err := plist.Insert(ctx, -1, tracks...); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.SetTrackIndex(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := plist.Remove(ctx, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	status, err := pl.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.PlayState != player.PlayStatePlaying || status.TrackIndex != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	remaining, err := plist.Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 || remaining[0].URI != tracks[2].URI {
+		t.Fatalf("unexpected tracks: %v", remaining)
+	}
+}
+
+func TestIgnoreVideoNotifications(t *testing.T) {
+	pl := connectForTesting(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := pl.Events().Listen(ctx)
+
+	pl.Emit(kodiNotification{Method: "Player.OnPlay", Params: `{"data":{"item":{"type":"movie"},"player":{"playerid":1,"speed":1}}}`})
+	pl.Emit(kodiNotification{Method: "Player.OnPause", Params: `{"data":{"item":{"type":"unknown"},"player":{"playerid":1,"speed":0}}}`})
+	pl.Emit(kodiNotification{Method: "Player.OnStop", Params: `{"data":{"item":{"type":"episode"},"end":true}}`})
+	pl.Emit(kodiNotification{Method: "Player.OnSeek", Params: `{"data":{"item":{"type":"picture"},"player":{"playerid":2}}}`})
+	// Emitted last, so any event for the notifications above comes first.
+	pl.Emit(kodiNotification{Method: "Player.OnPause", Params: `{"data":{"item":{"type":"song"},"player":{"playerid":0,"speed":0}}}`})
+	for {
+		select {
+		case event := <-events:
+			switch event := event.(type) {
+			case player.PlayStateEvent:
+				if event.State != player.PlayStatePaused {
+					t.Fatalf("unexpected event for a video notification: %#v", event)
+				}
+				return
+			case player.PlaylistEvent, player.TimeEvent:
+				t.Fatalf("unexpected event for a video notification: %#v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the audio notification was not handled")
+		}
+	}
+}
+
+func TestTrackInfo(t *testing.T) {
+	ctx := context.Background()
+	pl := connectForTesting(t)
+	tracks, err := pl.TrackInfo(ctx, "kodi:///music/b.mp3", "kodi:///music/unknown.mp3", "http://example.com/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []library.Track{
+		{
+			URI:      "kodi:///music/b.mp3",
+			Artist:   "Artist B, Artist C",
+			Title:    "Track B",
+			Album:    "Album",
+			Date:     "2001",
+			Duration: 200 * time.Second,
+		},
+		{},
+		{},
+	}
+	if !reflect.DeepEqual(tracks, expect) {
+		t.Fatalf("unexpected tracks:\n%#v\n%#v", expect, tracks)
+	}
+
+	art, err := pl.TrackArt(ctx, "kodi:///music/a.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(art.ImageData) != "jpeg" || art.MimeType != "image/jpeg" {
+		t.Fatalf("unexpected art: %#v", art)
+	}
+	if _, err := pl.TrackArt(ctx, "kodi:///music/b.mp3"); err != library.ErrNoArt {
+		t.Fatalf("expected ErrNoArt, got %v", err)
+	}
+}
+
+func TestLists(t *testing.T) {
+	ctx := context.Background()
+	pl := connectForTesting(t)
+	lists, err := pl.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, ok := lists["Favourites"]
+	if !ok {
+		t.Fatalf("playlist not found: %v", lists)
+	}
+	tracks, err := list.Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 || tracks[0].URI != "kodi:///music/b.mp3" || tracks[1].URI != "kodi:///music/d.mp3" {
+		t.Fatalf("unexpected tracks: %v", tracks)
+	}
+}
+
+func TestRPCError(t *testing.T) {
+	pl := connectForTesting(t)
+	err := pl.rpc.call(context.Background(), "Nonexistent.Method", nil, nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package kodi
+
+import (
+	"context"
+	"fmt"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+)
+
+type kodiPlaylist struct {
+	player *Player
+}
+
+func (plist kodiPlaylist) Insert(ctx context.Context, pos int, tracks ...library.Track) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+	length, err := plist.Len(ctx)
+	if err != nil {
+		return err
+	}
+
+	items := make([]map[string]string, len(tracks))
+	for i, track := range tracks {
+		items[i] = map[string]string{"file": uriToKodi(track.URI)}
+	}
+	params := map[string]interface{}{"playlistid": audioPlaylistID, "item": items}
+	method := "Playlist.Add"
+	if pos != -1 {
+		params["position"] = pos
+		method = "Playlist.Insert"
+	}
+	if err := plist.player.rpc.call(ctx, method, params, nil); err != nil {
+		return err
+	}
+
+	if length == 0 {
+		// Play the first track if the playlist was empty, just like the MPD
+		// backend does.
+		return plist.player.open(ctx, 0)
+	}
+	return nil
+}
+
+func (plist kodiPlaylist) Move(ctx context.Context, fromPos, toPos int) error {
+	// Kodi is only able to swap items, so the item is moved by swapping it
+	// with each of its neighbours in the direction of the destination.
+	step := 1
+	if toPos < fromPos {
+		step = -1
+	}
+	for pos := fromPos; pos != toPos; pos += step {
+		params := map[string]interface{}{
+			"playlistid": audioPlaylistID,
+			"position1":  pos,
+			"position2":  pos + step,
+		}
+		if err := plist.player.rpc.call(ctx, "Playlist.Swap", params, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (plist kodiPlaylist) Remove(ctx context.Context, positions ...int) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	status, err := plist.player.Status(ctx)
+	if err != nil {
+		return err
+	}
+	length, err := plist.Len(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Kodi refuses to remove the item that is currently being played. Stop
+	// playback first and resume at the next remaining track afterwards.
+	removeCurrent := false
+	removedBefore := 0
+	for _, pos := range positions {
+		if pos == status.TrackIndex {
+			removeCurrent = true
+		} else if pos < status.TrackIndex {
+			removedBefore++
+		}
+	}
+	if removeCurrent {
+		if err := plist.player.SetState(ctx, player.PlayStateStopped); err != nil {
+			return err
+		}
+	}
+
+	removed := 0
+	prev := -1
+	for _, pos := range sortedDescending(positions) {
+		if pos < 0 || pos >= length || pos == prev {
+			continue
+		}
+		prev = pos
+		params := map[string]interface{}{"playlistid": audioPlaylistID, "position": pos}
+		if err := plist.player.rpc.call(ctx, "Playlist.Remove", params, nil); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if removeCurrent && status.PlayState == player.PlayStatePlaying {
+		if next := status.TrackIndex - removedBefore; next < length-removed {
+			return plist.player.open(ctx, next)
+		}
+	}
+	return nil
+}
+
+func (plist kodiPlaylist) Tracks(ctx context.Context) ([]library.Track, error) {
+	var result struct {
+		Items []kodiSong `json:"items"`
+	}
+	params := map[string]interface{}{"playlistid": audioPlaylistID, "properties": songProperties}
+	if err := plist.player.rpc.call(ctx, "Playlist.GetItems", params, &result); err != nil {
+		return nil, err
+	}
+	tracks := make([]library.Track, len(result.Items))
+	for i, item := range result.Items {
+		tracks[i] = trackFromKodiSong(item)
+	}
+	return tracks, nil
+}
+
+func (plist kodiPlaylist) Len(ctx context.Context) (int, error) {
+	var result struct {
+		Size int `json:"size"`
+	}
+	params := map[string]interface{}{"playlistid": audioPlaylistID, "properties": []string{"size"}}
+	if err := plist.player.rpc.call(ctx, "Playlist.GetProperties", params, &result); err != nil {
+		return -1, err
+	}
+	return result.Size, nil
+}
+
+// userPlaylist is a playlist file that is stored by Kodi.
+type userPlaylist struct {
+	player *Player
+	file   string
+}
+
+func (plist userPlaylist) Insert(ctx context.Context, pos int, tracks ...library.Track) error {
+	return fmt.Errorf("UNIMPLEMENTED")
+}
+
+func (plist userPlaylist) Move(ctx context.Context, fromPos, toPos int) error {
+	return fmt.Errorf("UNIMPLEMENTED")
+}
+
+func (plist userPlaylist) Remove(ctx context.Context, positions ...int) error {
+	return fmt.Errorf("UNIMPLEMENTED")
+}
+
+func (plist userPlaylist) Tracks(ctx context.Context) ([]library.Track, error) {
+	var result struct {
+		Files []kodiSong `json:"files"`
+	}
+	params := map[string]interface{}{
+		"directory":  plist.file,
+		"media":      "music",
+		"properties": songProperties,
+	}
+	if err := plist.player.rpc.call(ctx, "Files.GetDirectory", params, &result); err != nil {
+		return nil, err
+	}
+	tracks := make([]library.Track, len(result.Files))
+	for i, file := range result.Files {
+		tracks[i] = trackFromKodiSong(file)
+	}
+	return tracks, nil
+}
+
+func (plist userPlaylist) Len(ctx context.Context) (int, error) {
+	tracks, err := plist.Tracks(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return len(tracks), nil
+}
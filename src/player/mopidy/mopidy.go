@@ -0,0 +1,527 @@
+// Package mopidy implements a player backend for Mopidy using its HTTP
+// JSON-RPC API. Events are received over Mopidy's WebSocket.
+package mopidy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"trollibox/src/library"
+	"trollibox/src/library/cache"
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+const (
+	// The maximum number of URIs to look up with a single call.
+	lookupBatchSize = 200
+	// The maximum size of a message received over the WebSocket.
+	wsMaxMessageSize = 16 << 20
+	// Only tracks of Mopidy-Local are part of the library. Other backends,
+	// such as streaming services, may have catalogs that are too large to
+	// browse.
+	libraryURIPrefix = "local:"
+	// The maximum depth of directories in the library that are browsed.
+	maxBrowseDepth = 16
+)
+
+type mopidyArtist struct {
+	Name string `json:"name"`
+}
+
+type mopidyAlbum struct {
+	Name    string         `json:"name"`
+	Artists []mopidyArtist `json:"artists"`
+	Date    string         `json:"date"`
+}
+
+type mopidyTrack struct {
+	URI          string         `json:"uri"`
+	Name         string         `json:"name"`
+	Artists      []mopidyArtist `json:"artists"`
+	Album        *mopidyAlbum   `json:"album"`
+	Genre        string         `json:"genre"`
+	Date         string         `json:"date"`
+	Length       int64          `json:"length"`
+	TrackNo      int            `json:"track_no"`
+	DiscNo       int            `json:"disc_no"`
+	LastModified int64          `json:"last_modified"`
+}
+
+type mopidyTlTrack struct {
+	TLID  int         `json:"tlid"`
+	Track mopidyTrack `json:"track"`
+}
+
+type mopidyRef struct {
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+type mopidyImage struct {
+	URI   string `json:"uri"`
+	Width int    `json:"width"`
+}
+
+type mopidyEvent struct {
+	Event        string `json:"event"`
+	NewState     string `json:"new_state"`
+	TimePosition int64  `json:"time_position"`
+	Volume       int    `json:"volume"`
+}
+
+var playStates = map[string]player.PlayState{
+	"playing": player.PlayStatePlaying,
+	"paused":  player.PlayStatePaused,
+	"stopped": player.PlayStateStopped,
+}
+
+// Player handles the connection to a single Mopidy instance.
+type Player struct {
+	util.Emitter
+
+	baseURL string
+	rpc     rpcClient
+
+	cachedLibrary *cache.Cache
+	playlist      player.PlaylistMetaKeeper
+}
+
+// Connect connects to Mopidy. The URL is the root of Mopidy's HTTP server,
+// e.g. http://127.0.0.1:6680/.
+func Connect(baseURL string) (*Player, error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("invalid Mopidy URL: %q", baseURL)
+	}
+
+	pl := &Player{
+		Emitter: util.Emitter{Release: time.Millisecond * 100},
+		baseURL: baseURL,
+		rpc: rpcClient{
+			url:    baseURL + "/mopidy/rpc",
+			client: &http.Client{Timeout: 30 * time.Second},
+		},
+	}
+	pl.playlist.Playlist = mopidyPlaylist{player: pl}
+	pl.cachedLibrary = cache.NewCache(pl)
+
+	// Test the connection.
+	if err := pl.rpc.call(context.Background(), "core.get_version", nil, nil); err != nil {
+		return nil, err
+	}
+
+	go pl.eventLoop()
+	return pl, nil
+}
+
+func (pl *Player) eventLoop() {
+	// http:// becomes ws:// and https:// becomes wss://.
+	wsURL := "ws" + strings.TrimPrefix(pl.baseURL, "http") + "/mopidy/ws"
+	for {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			slog.Debug("Could not connect to the Mopidy websocket", "error", err)
+			// Limit the number of reconnection attempts to one per second.
+			time.Sleep(time.Second)
+			continue
+		}
+		ws.SetReadLimit(wsMaxMessageSize)
+		// Events may have been missed while disconnected.
+		pl.emitStatus(context.Background())
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				slog.Debug("Mopidy websocket closed", "error", err)
+				break
+			}
+			pl.handleEvent(message)
+		}
+		ws.Close()
+	}
+}
+
+func (pl *Player) handleEvent(message []byte) {
+	var event mopidyEvent
+	if err := json.Unmarshal(message, &event); err != nil || event.Event == "" {
+		// Not an event, or a message we do not understand.
+		return
+	}
+	ctx := context.Background()
+
+	switch event.Event {
+	case "playback_state_changed":
+		pl.Emit(player.PlayStateEvent{State: playStates[event.NewState]})
+		pl.emitPlaylistEvent(ctx)
+	case "tracklist_changed", "track_playback_started", "stream_title_changed":
+		pl.emitPlaylistEvent(ctx)
+	case "seeked":
+		pl.Emit(player.TimeEvent{Time: time.Duration(event.TimePosition) * time.Millisecond})
+	case "volume_changed":
+		pl.Emit(player.VolumeEvent{Volume: event.Volume})
+	case "playlists_loaded", "playlist_changed", "playlist_deleted":
+		pl.Emit(player.ListEvent{})
+	}
+}
+
+// emitStatus emits the events that describe the current status.
+func (pl *Player) emitStatus(ctx context.Context) {
+	status, err := pl.Status(ctx)
+	if err != nil {
+		slog.Error("Could not get Mopidy status", "error", err)
+		return
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: status.TrackIndex})
+	pl.Emit(player.PlayStateEvent{State: status.PlayState})
+	pl.Emit(player.VolumeEvent{Volume: status.Volume})
+}
+
+func (pl *Player) emitPlaylistEvent(ctx context.Context) {
+	index, err := pl.trackIndex(ctx)
+	if err != nil {
+		slog.Error("Could not get Mopidy tracklist index", "error", err)
+		return
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: index})
+}
+
+func (pl *Player) trackIndex(ctx context.Context) (int, error) {
+	var index *int
+	if err := pl.rpc.call(ctx, "core.tracklist.index", nil, &index); err != nil {
+		return -1, err
+	}
+	if index == nil {
+		return -1, nil
+	}
+	return *index, nil
+}
+
+// Library implements the player.Player interface.
+func (pl *Player) Library() library.Library {
+	return pl.cachedLibrary
+}
+
+// Tracks implements the library.Library interface.
+//
+// Only the tracks of Mopidy-Local are returned, see libraryURIPrefix. Tracks
+// of other backends can still be queued by their URI.
+func (pl *Player) Tracks(ctx context.Context) ([]library.Track, error) {
+	uris, err := pl.browseTracks(ctx, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	found, err := pl.lookup(ctx, uris)
+	if err != nil {
+		return nil, err
+	}
+	// Drop the tracks that could not be looked up.
+	tracks := found[:0]
+	for _, track := range found {
+		if track.URI != "" {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, nil
+}
+
+// browseTracks returns the URIs of all tracks in a directory and its
+// subdirectories up to maxBrowseDepth. A nil URI denotes the root directory.
+// Only directories and tracks of the local backend are included.
+func (pl *Player) browseTracks(ctx context.Context, uri *string, depth int) ([]string, error) {
+	var refs []mopidyRef
+	if err := pl.rpc.call(ctx, "core.library.browse", map[string]interface{}{"uri": uri}, &refs); err != nil {
+		return nil, err
+	}
+	var uris []string
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.URI, libraryURIPrefix) {
+			continue
+		}
+		switch ref.Type {
+		case "track":
+			uris = append(uris, ref.URI)
+		case "directory":
+			if depth >= maxBrowseDepth {
+				slog.Warn("Not browsing deeply nested Mopidy directory", "uri", ref.URI)
+				continue
+			}
+			dirURI := ref.URI
+			sub, err := pl.browseTracks(ctx, &dirURI, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			uris = append(uris, sub...)
+		}
+	}
+	return uris, nil
+}
+
+// lookup retrieves the tracks for the URIs. A zero track is returned for URIs
+// that Mopidy does not know about.
+func (pl *Player) lookup(ctx context.Context, uris []string) ([]library.Track, error) {
+	tracks := make([]library.Track, len(uris))
+	for start := 0; start < len(uris); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(uris) {
+			end = len(uris)
+		}
+		var result map[string][]mopidyTrack
+		if err := pl.rpc.call(ctx, "core.library.lookup", map[string]interface{}{"uris": uris[start:end]}, &result); err != nil {
+			return nil, err
+		}
+		for i, uri := range uris[start:end] {
+			if mt, ok := result[uri]; ok && len(mt) > 0 {
+				tracks[start+i] = trackFromMopidy(mt[0])
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// TrackInfo implements the library.Library interface.
+func (pl *Player) TrackInfo(ctx context.Context, uris ...string) ([]library.Track, error) {
+	// Looking up HTTP streams makes Mopidy fetch them, which may take a long
+	// time. Their information is provided by the stream database instead.
+	lookup := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+			lookup = append(lookup, uri)
+		}
+	}
+	found, err := pl.lookup(ctx, lookup)
+	if err != nil {
+		return nil, err
+	}
+	byURI := make(map[string]library.Track, len(found))
+	for i, uri := range lookup {
+		byURI[uri] = found[i]
+	}
+	tracks := make([]library.Track, len(uris))
+	for i, uri := range uris {
+		tracks[i] = byURI[uri]
+	}
+	return tracks, nil
+}
+
+// TrackArt implements the library.Library interface.
+func (pl *Player) TrackArt(ctx context.Context, uri string) (*library.Art, error) {
+	var images map[string][]mopidyImage
+	if err := pl.rpc.call(ctx, "core.library.get_images", map[string]interface{}{"uris": []string{uri}}, &images); err != nil {
+		return nil, err
+	}
+	var best *mopidyImage
+	for i, image := range images[uri] {
+		if best == nil || image.Width > best.Width {
+			best = &images[uri][i]
+		}
+	}
+	if best == nil {
+		return nil, library.ErrNoArt
+	}
+
+	// Images of local files are served by Mopidy under a relative URL.
+	base, err := url.Parse(pl.baseURL + "/")
+	if err != nil {
+		return nil, err
+	}
+	imageURL, err := base.Parse(best.URI)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pl.rpc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, library.ErrNoArt
+	}
+	imageData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	art := &library.Art{
+		ImageData: imageData,
+		MimeType:  resp.Header.Get("Content-Type"),
+	}
+	if art.MimeType == "" {
+		art.MimeType = http.DetectContentType(imageData)
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		art.ModTime = modTime
+	}
+	return art, nil
+}
+
+// Lists implements the player.Player interface.
+func (pl *Player) Lists(ctx context.Context) (map[string]player.Playlist[library.Track], error) {
+	var refs []mopidyRef
+	if err := pl.rpc.call(ctx, "core.playlists.as_list", nil, &refs); err != nil {
+		return nil, err
+	}
+	playlists := map[string]player.Playlist[library.Track]{}
+	for _, ref := range refs {
+		playlists[ref.Name] = userPlaylist{player: pl, uri: ref.URI}
+	}
+	return playlists, nil
+}
+
+// Status implements the player.Player interface.
+func (pl *Player) Status(ctx context.Context) (*player.Status, error) {
+	var state string
+	if err := pl.rpc.call(ctx, "core.playback.get_state", nil, &state); err != nil {
+		return nil, err
+	}
+	var timePosition int64
+	if err := pl.rpc.call(ctx, "core.playback.get_time_position", nil, &timePosition); err != nil {
+		return nil, err
+	}
+	index, err := pl.trackIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The volume is null if Mopidy has no mixer.
+	var volume *int
+	if err := pl.rpc.call(ctx, "core.mixer.get_volume", nil, &volume); err != nil {
+		return nil, err
+	}
+
+	status := &player.Status{
+		TrackIndex: index,
+		Time:       time.Duration(timePosition) * time.Millisecond,
+		PlayState:  playStates[state],
+	}
+	if volume != nil {
+		status.Volume = *volume
+	}
+	return status, nil
+}
+
+// SetTime implements the player.Player interface.
+func (pl *Player) SetTime(ctx context.Context, offset time.Duration) error {
+	if offset < 0 {
+		return fmt.Errorf("error setting time: negative offset")
+	}
+	params := map[string]interface{}{"time_position": offset.Milliseconds()}
+	if err := pl.rpc.call(ctx, "core.playback.seek", params, nil); err != nil {
+		return fmt.Errorf("error setting time: %w", err)
+	}
+	return nil
+}
+
+// SetTrackIndex implements the player.Player interface.
+func (pl *Player) SetTrackIndex(ctx context.Context, trackIndex int) error {
+	var tlTracks []mopidyTlTrack
+	if err := pl.rpc.call(ctx, "core.tracklist.get_tl_tracks", nil, &tlTracks); err != nil {
+		return err
+	}
+	if trackIndex >= len(tlTracks) {
+		return pl.SetState(ctx, player.PlayStateStopped)
+	} else if trackIndex < 0 {
+		return fmt.Errorf("invalid track index: %d", trackIndex)
+	}
+	return pl.rpc.call(ctx, "core.playback.play", map[string]interface{}{"tlid": tlTracks[trackIndex].TLID}, nil)
+}
+
+// SetState implements the player.Player interface.
+func (pl *Player) SetState(ctx context.Context, state player.PlayState) error {
+	switch state {
+	case player.PlayStatePaused:
+		return pl.rpc.call(ctx, "core.playback.pause", nil, nil)
+	case player.PlayStatePlaying:
+		if plistLen, err := pl.Playlist().Len(ctx); err != nil {
+			return fmt.Errorf("error getting playlist length: %v", err)
+		} else if plistLen == 0 {
+			pl.Emit(player.PlayStateEvent{State: state})
+			return nil
+		}
+		var current string
+		if err := pl.rpc.call(ctx, "core.playback.get_state", nil, &current); err != nil {
+			return err
+		}
+		if current == "paused" {
+			return pl.rpc.call(ctx, "core.playback.resume", nil, nil)
+		}
+		return pl.rpc.call(ctx, "core.playback.play", nil, nil)
+	case player.PlayStateStopped:
+		return pl.rpc.call(ctx, "core.playback.stop", nil, nil)
+	default:
+		return fmt.Errorf("unknown play state %q", state)
+	}
+}
+
+// SetVolume implements the player.Player interface.
+func (pl *Player) SetVolume(ctx context.Context, vol int) error {
+	if vol > 100 {
+		vol = 100
+	} else if vol < 0 {
+		vol = 0
+	}
+	return pl.rpc.call(ctx, "core.mixer.set_volume", map[string]interface{}{"volume": vol}, nil)
+}
+
+// Playlist implements the player.Player interface.
+func (pl *Player) Playlist() player.Playlist[player.MetaTrack] {
+	return &pl.playlist
+}
+
+// Events implements the player.Player interface.
+func (pl *Player) Events() *util.Emitter {
+	return &pl.Emitter
+}
+
+func (pl *Player) String() string {
+	return fmt.Sprintf("Mopidy{%s}", pl.baseURL)
+}
+
+func trackFromMopidy(mt mopidyTrack) library.Track {
+	track := library.Track{
+		URI:      mt.URI,
+		Title:    mt.Name,
+		Artist:   joinArtists(mt.Artists),
+		Genre:    mt.Genre,
+		Date:     mt.Date,
+		Duration: time.Duration(mt.Length) * time.Millisecond,
+	}
+	if mt.Album != nil {
+		track.Album = mt.Album.Name
+		track.AlbumArtist = joinArtists(mt.Album.Artists)
+		if track.Date == "" {
+			track.Date = mt.Album.Date
+		}
+	}
+	if mt.TrackNo > 0 {
+		track.AlbumTrack = strconv.Itoa(mt.TrackNo)
+	}
+	if mt.DiscNo > 0 {
+		track.AlbumDisc = strconv.Itoa(mt.DiscNo)
+	}
+	if mt.LastModified > 0 {
+		track.ModTime = time.UnixMilli(mt.LastModified)
+	}
+	library.InterpolateMissingFields(&track)
+	return track
+}
+
+func joinArtists(artists []mopidyArtist) string {
+	names := make([]string, len(artists))
+	for i, artist := range artists {
+		names[i] = artist.Name
+	}
+	return strings.Join(names, ", ")
+}
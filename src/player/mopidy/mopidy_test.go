@@ -0,0 +1,498 @@
+package mopidy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+)
+
+// fakeMopidy implements the parts of the JSON-RPC and WebSocket API of Mopidy
+// that are used by the player.
+type fakeMopidy struct {
+	lock      sync.Mutex
+	library   []mopidyTrack
+	tracklist []mopidyTlTrack
+	nextTLID  int
+	current   int
+	state     string
+	position  int64
+	volume    int
+	clients   map[chan []byte]struct{}
+}
+
+func newFakeMopidy(t *testing.T) (*fakeMopidy, *httptest.Server) {
+	fake := &fakeMopidy{
+		current: -1,
+		state:   "stopped",
+		clients: map[chan []byte]struct{}{},
+	}
+	fake.library = []mopidyTrack{
+		{URI: "local:track:a.mp3", Name: "Track A", Artists: []mopidyArtist{{Name: "Artist A"}}, Length: 180000, TrackNo: 1},
+		{URI: "local:track:b.mp3", Name: "Track B", Artists: []mopidyArtist{{Name: "Artist B"}, {Name: "Artist C"}}, Album: &mopidyAlbum{Name: "Album", Date: "2001"}, Length: 200000},
+		{URI: "local:track:c.mp3", Name: "Track C", Length: 220000},
+		{URI: "local:track:d.mp3", Name: "Track D", Length: 240000},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mopidy/rpc", fake.serveRPC)
+	mux.HandleFunc("/mopidy/ws", fake.serveWebSocket)
+	mux.HandleFunc("/local/cover.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (fake *fakeMopidy) serveRPC(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     int64           `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var params struct {
+		URI        *string  `json:"uri"`
+		URIs       []string `json:"uris"`
+		AtPosition *int     `json:"at_position"`
+		TLID       *int     `json:"tlid"`
+		Start      int      `json:"start"`
+		End        int      `json:"end"`
+		ToPosition int      `json:"to_position"`
+		Criteria   struct {
+			TLID []int `json:"tlid"`
+		} `json:"criteria"`
+		TimePosition int64 `json:"time_position"`
+		Volume       int   `json:"volume"`
+	}
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	fake.lock.Lock()
+	var events []map[string]interface{}
+	setState := func(state string) {
+		if fake.state != state {
+			events = append(events, map[string]interface{}{"event": "playback_state_changed", "old_state": fake.state, "new_state": state})
+			fake.state = state
+		}
+	}
+	play := func(index int) {
+		fake.current, fake.position = index, 0
+		setState("playing")
+		events = append(events, map[string]interface{}{"event": "track_playback_started", "tl_track": fake.tracklist[index]})
+	}
+
+	var result interface{}
+	var rpcErr *RPCError
+	switch req.Method {
+	case "core.get_version":
+		result = "3.4.2"
+	case "core.library.browse":
+		refs := []mopidyRef{}
+		if params.URI == nil {
+			refs = append(refs, mopidyRef{Type: "directory", URI: "local:directory", Name: "Local media"})
+			refs = append(refs, mopidyRef{Type: "directory", URI: "spotify:directory", Name: "Spotify"})
+		} else if *params.URI == "local:directory" {
+			for _, track := range fake.library {
+				refs = append(refs, mopidyRef{Type: "track", URI: track.URI, Name: track.Name})
+			}
+			// A track that can not be looked up.
+			refs = append(refs, mopidyRef{Type: "track", URI: "local:track:missing.mp3", Name: "Missing"})
+			refs = append(refs, mopidyRef{Type: "directory", URI: "local:directory:loop", Name: "Loop"})
+		} else if *params.URI == "local:directory:loop" {
+			// A directory that contains itself.
+			refs = append(refs, mopidyRef{Type: "directory", URI: "local:directory:loop", Name: "Loop"})
+		} else if *params.URI == "spotify:directory" {
+			refs = append(refs, mopidyRef{Type: "track", URI: "spotify:track:a", Name: "Remote track"})
+		}
+		result = refs
+	case "core.library.lookup":
+		found := map[string][]mopidyTrack{}
+		for _, uri := range params.URIs {
+			found[uri] = []mopidyTrack{}
+			for _, track := range fake.library {
+				if track.URI == uri {
+					found[uri] = append(found[uri], track)
+				}
+			}
+		}
+		result = found
+	case "core.library.get_images":
+		images := map[string][]mopidyImage{}
+		for _, uri := range params.URIs {
+			images[uri] = []mopidyImage{}
+			if uri == "local:track:a.mp3" {
+				images[uri] = []mopidyImage{{URI: "/local/thumb.png", Width: 10}, {URI: "/local/cover.png", Width: 500}}
+			}
+		}
+		result = images
+	case "core.playlists.as_list":
+		result = []mopidyRef{{Type: "playlist", URI: "m3u:favourites.m3u8", Name: "Favourites"}}
+	case "core.playlists.get_items":
+		result = []mopidyRef{{Type: "track", URI: "local:track:b.mp3"}, {Type: "track", URI: "local:track:d.mp3"}}
+	case "core.tracklist.index":
+		if fake.current >= 0 {
+			result = fake.current
+		}
+	case "core.tracklist.get_tl_tracks":
+		result = fake.tracklist
+	case "core.tracklist.get_tracks":
+		tracks := make([]mopidyTrack, len(fake.tracklist))
+		for i, tlTrack := range fake.tracklist {
+			tracks[i] = tlTrack.Track
+		}
+		result = tracks
+	case "core.tracklist.get_length":
+		result = len(fake.tracklist)
+	case "core.tracklist.add":
+		pos := len(fake.tracklist)
+		if params.AtPosition != nil && *params.AtPosition < pos {
+			pos = *params.AtPosition
+		}
+		var added []mopidyTlTrack
+		for _, uri := range params.URIs {
+			for _, track := range fake.library {
+				if track.URI == uri {
+					fake.nextTLID++
+					added = append(added, mopidyTlTrack{TLID: fake.nextTLID, Track: track})
+				}
+			}
+		}
+		fake.tracklist = append(fake.tracklist[:pos], append(added, fake.tracklist[pos:]...)...)
+		if fake.current >= pos {
+			fake.current += len(added)
+		}
+		events = append(events, map[string]interface{}{"event": "tracklist_changed"})
+		result = added
+	case "core.tracklist.move":
+		var current *mopidyTlTrack
+		if fake.current >= 0 {
+			current = &fake.tracklist[fake.current]
+		}
+		currentTLID := -1
+		if current != nil {
+			currentTLID = current.TLID
+		}
+		moved := append([]mopidyTlTrack{}, fake.tracklist[params.Start:params.End]...)
+		rest := append(append([]mopidyTlTrack{}, fake.tracklist[:params.Start]...), fake.tracklist[params.End:]...)
+		fake.tracklist = append(rest[:params.ToPosition], append(moved, rest[params.ToPosition:]...)...)
+		for i, tlTrack := range fake.tracklist {
+			if tlTrack.TLID == currentTLID {
+				fake.current = i
+			}
+		}
+		events = append(events, map[string]interface{}{"event": "tracklist_changed"})
+	case "core.tracklist.remove":
+		remove := map[int]bool{}
+		for _, tlid := range params.Criteria.TLID {
+			remove[tlid] = true
+		}
+		var kept, removed []mopidyTlTrack
+		current := -1
+		for i, tlTrack := range fake.tracklist {
+			if remove[tlTrack.TLID] {
+				removed = append(removed, tlTrack)
+				if i == fake.current {
+					setState("stopped")
+				}
+				continue
+			}
+			if i == fake.current {
+				current = len(kept)
+			}
+			kept = append(kept, tlTrack)
+		}
+		fake.tracklist, fake.current = kept, current
+		events = append(events, map[string]interface{}{"event": "tracklist_changed"})
+		result = removed
+	case "core.playback.get_state":
+		result = fake.state
+	case "core.playback.get_time_position":
+		result = fake.position
+	case "core.playback.play":
+		index := -1
+		if params.TLID != nil {
+			for i, tlTrack := range fake.tracklist {
+				if tlTrack.TLID == *params.TLID {
+					index = i
+				}
+			}
+		} else if fake.current >= 0 {
+			index = fake.current
+		} else if len(fake.tracklist) > 0 {
+			index = 0
+		}
+		if index >= 0 {
+			play(index)
+		}
+	case "core.playback.pause":
+		setState("paused")
+	case "core.playback.resume":
+		if fake.state == "paused" {
+			setState("playing")
+		}
+	case "core.playback.stop":
+		fake.position = 0
+		setState("stopped")
+	case "core.playback.seek":
+		result = fake.state != "stopped"
+		if fake.state != "stopped" {
+			fake.position = params.TimePosition
+			events = append(events, map[string]interface{}{"event": "seeked", "time_position": fake.position})
+		}
+	case "core.mixer.get_volume":
+		result = fake.volume
+	case "core.mixer.set_volume":
+		fake.volume = params.Volume
+		events = append(events, map[string]interface{}{"event": "volume_changed", "volume": fake.volume})
+		result = true
+	default:
+		rpcErr = &RPCError{Code: -32601, Message: "Method not found"}
+	}
+
+	response, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result, "error": rpcErr})
+	for _, event := range events {
+		message, _ := json.Marshal(event)
+		for client := range fake.clients {
+			client <- message
+		}
+	}
+	fake.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(response)
+}
+
+func (fake *fakeMopidy) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	messages := make(chan []byte, 64)
+	fake.lock.Lock()
+	fake.clients[messages] = struct{}{}
+	fake.lock.Unlock()
+	defer fake.disconnect(messages)
+
+	closed := make(chan struct{})
+	go func() {
+		// Handle control frames until the client disconnects.
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				break
+			}
+		}
+		close(closed)
+	}()
+
+	// Send a ping to check that control frames are handled.
+	_ = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// disconnect closes the websocket connection of a client.
+func (fake *fakeMopidy) disconnect(client chan []byte) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if _, ok := fake.clients[client]; ok {
+		delete(fake.clients, client)
+		close(client)
+	}
+}
+
+func connectForTesting(t *testing.T) *Player {
+	_, pl := connectToFake(t)
+	return pl
+}
+
+func connectToFake(t *testing.T) (*fakeMopidy, *Player) {
+	fake, server := newFakeMopidy(t)
+	pl, err := Connect(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the event stream to be connected.
+	deadline := time.Now().Add(time.Second)
+	ctx := context.Background()
+	for {
+		l := pl.Events().Listen(ctx)
+		if err := pl.SetVolume(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-l:
+			return fake, pl
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the event stream was not connected")
+		}
+	}
+}
+
+func TestPlayerImplementation(t *testing.T) {
+	player.TestPlayerImplementation(t, connectForTesting(t))
+}
+
+func TestPlaylistImplementation(t *testing.T) {
+	pl := connectForTesting(t)
+	tracks, err := pl.Tracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaTracks := make([]player.MetaTrack, 3)
+	for i, t := range tracks[:len(metaTracks)] {
+		metaTracks[i].Track = t
+		metaTracks[i].QueuedBy = "system"
+	}
+
+	player.TestPlaylistImplementation[player.MetaTrack](t, pl.Playlist(), metaTracks)
+}
+
+func TestTracks(t *testing.T) {
+	pl := connectForTesting(t)
+	tracks, err := pl.Tracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only local tracks are browsed and looping directories are not
+	// followed forever.
+	var uris []string
+	for _, track := range tracks {
+		uris = append(uris, track.URI)
+	}
+	expect := []string{"local:track:a.mp3", "local:track:b.mp3", "local:track:c.mp3", "local:track:d.mp3"}
+	if !reflect.DeepEqual(uris, expect) {
+		t.Fatalf("unexpected tracks: %v", uris)
+	}
+}
+
+func TestTrackInfo(t *testing.T) {
+	ctx := context.Background()
+	pl := connectForTesting(t)
+	tracks, err := pl.TrackInfo(ctx, "local:track:b.mp3", "local:track:unknown.mp3", "http://example.com/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []library.Track{
+		{
+			URI:      "local:track:b.mp3",
+			Artist:   "Artist B, Artist C",
+			Title:    "Track B",
+			Album:    "Album",
+			Date:     "2001",
+			Duration: 200 * time.Second,
+		},
+		{},
+		{},
+	}
+	if !reflect.DeepEqual(tracks, expect) {
+		t.Fatalf("unexpected tracks:\n%#v\n%#v", expect, tracks)
+	}
+
+	art, err := pl.TrackArt(ctx, "local:track:a.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(art.ImageData) != "png" || art.MimeType != "image/png" {
+		t.Fatalf("unexpected art: %#v", art)
+	}
+	if _, err := pl.TrackArt(ctx, "local:track:b.mp3"); err != library.ErrNoArt {
+		t.Fatalf("expected ErrNoArt, got %v", err)
+	}
+}
+
+func TestLists(t *testing.T) {
+	ctx := context.Background()
+	pl := connectForTesting(t)
+	lists, err := pl.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, ok := lists["Favourites"]
+	if !ok {
+		t.Fatalf("playlist not found: %v", lists)
+	}
+	tracks, err := list.Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 || tracks[0].URI != "local:track:b.mp3" || tracks[1].URI != "local:track:d.mp3" {
+		t.Fatalf("unexpected tracks: %v", tracks)
+	}
+}
+
+func TestRPCError(t *testing.T) {
+	pl := connectForTesting(t)
+	err := pl.rpc.call(context.Background(), "core.nonexistent", nil, nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ctx := context.Background()
+	fake, pl := connectToFake(t)
+	l := pl.Events().Listen(ctx)
+
+	// Changes are missed while disconnected.
+	fake.lock.Lock()
+	fake.volume = 42
+	clients := make([]chan []byte, 0, len(fake.clients))
+	for client := range fake.clients {
+		clients = append(clients, client)
+	}
+	fake.lock.Unlock()
+	for _, client := range clients {
+		fake.disconnect(client)
+	}
+
+	expect := map[interface{}]bool{
+		player.PlaylistEvent{TrackIndex: -1}:                  true,
+		player.PlayStateEvent{State: player.PlayStateStopped}: true,
+		player.VolumeEvent{Volume: 42}:                        true,
+	}
+	timeout := time.After(5 * time.Second)
+	for len(expect) > 0 {
+		select {
+		case event := <-l:
+			delete(expect, event)
+		case <-timeout:
+			t.Fatalf("events not emitted after reconnecting: %v", expect)
+		}
+	}
+}
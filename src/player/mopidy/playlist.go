@@ -0,0 +1,132 @@
+package mopidy
+
+import (
+	"context"
+	"fmt"
+
+	"trollibox/src/library"
+)
+
+type mopidyPlaylist struct {
+	player *Player
+}
+
+func (plist mopidyPlaylist) Insert(ctx context.Context, pos int, tracks ...library.Track) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+	length, err := plist.Len(ctx)
+	if err != nil {
+		return err
+	}
+
+	uris := make([]string, len(tracks))
+	for i, track := range tracks {
+		uris[i] = track.URI
+	}
+	params := map[string]interface{}{"uris": uris}
+	if pos != -1 {
+		params["at_position"] = pos
+	}
+	var added []mopidyTlTrack
+	if err := plist.player.rpc.call(ctx, "core.tracklist.add", params, &added); err != nil {
+		return err
+	}
+	if len(added) != len(uris) {
+		return fmt.Errorf("mopidy: only %d of %d tracks could be added", len(added), len(uris))
+	}
+
+	if length == 0 {
+		// Play the first track if the playlist was empty, just like the MPD
+		// backend does.
+		return plist.player.rpc.call(ctx, "core.playback.play", nil, nil)
+	}
+	return nil
+}
+
+func (plist mopidyPlaylist) Move(ctx context.Context, fromPos, toPos int) error {
+	params := map[string]interface{}{"start": fromPos, "end": fromPos + 1, "to_position": toPos}
+	return plist.player.rpc.call(ctx, "core.tracklist.move", params, nil)
+}
+
+func (plist mopidyPlaylist) Remove(ctx context.Context, positions ...int) error {
+	var tlTracks []mopidyTlTrack
+	if err := plist.player.rpc.call(ctx, "core.tracklist.get_tl_tracks", nil, &tlTracks); err != nil {
+		return err
+	}
+	tlids := make([]int, 0, len(positions))
+	for _, pos := range positions {
+		if pos >= 0 && pos < len(tlTracks) {
+			tlids = append(tlids, tlTracks[pos].TLID)
+		}
+	}
+	if len(tlids) == 0 {
+		return nil
+	}
+	params := map[string]interface{}{"criteria": map[string]interface{}{"tlid": tlids}}
+	return plist.player.rpc.call(ctx, "core.tracklist.remove", params, nil)
+}
+
+func (plist mopidyPlaylist) Tracks(ctx context.Context) ([]library.Track, error) {
+	var mtracks []mopidyTrack
+	if err := plist.player.rpc.call(ctx, "core.tracklist.get_tracks", nil, &mtracks); err != nil {
+		return nil, err
+	}
+	tracks := make([]library.Track, len(mtracks))
+	for i, mt := range mtracks {
+		tracks[i] = trackFromMopidy(mt)
+	}
+	return tracks, nil
+}
+
+func (plist mopidyPlaylist) Len(ctx context.Context) (int, error) {
+	var length int
+	if err := plist.player.rpc.call(ctx, "core.tracklist.get_length", nil, &length); err != nil {
+		return -1, err
+	}
+	return length, nil
+}
+
+// userPlaylist is a playlist that is stored by Mopidy.
+type userPlaylist struct {
+	player *Player
+	uri    string
+}
+
+func (plist userPlaylist) Insert(ctx context.Context, pos int, tracks ...library.Track) error {
+	return fmt.Errorf("UNIMPLEMENTED")
+}
+
+func (plist userPlaylist) Move(ctx context.Context, fromPos, toPos int) error {
+	return fmt.Errorf("UNIMPLEMENTED")
+}
+
+func (plist userPlaylist) Remove(ctx context.Context, positions ...int) error {
+	return fmt.Errorf("UNIMPLEMENTED")
+}
+
+func (plist userPlaylist) items(ctx context.Context) ([]mopidyRef, error) {
+	var refs []mopidyRef
+	err := plist.player.rpc.call(ctx, "core.playlists.get_items", map[string]interface{}{"uri": plist.uri}, &refs)
+	return refs, err
+}
+
+func (plist userPlaylist) Tracks(ctx context.Context) ([]library.Track, error) {
+	refs, err := plist.items(ctx)
+	if err != nil {
+		return nil, err
+	}
+	uris := make([]string, len(refs))
+	for i, ref := range refs {
+		uris[i] = ref.URI
+	}
+	return plist.player.lookup(ctx, uris)
+}
+
+func (plist userPlaylist) Len(ctx context.Context) (int, error) {
+	refs, err := plist.items(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return len(refs), nil
+}
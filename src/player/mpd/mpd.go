@@ -630,6 +630,7 @@ func trackFromMpdSong(mpdc *mpd.Client, song mpd.Attrs, track *library.Track) er
 	track.AlbumArtist = song["albumartist"]
 	track.AlbumDisc = song["disc"]
 	track.AlbumTrack = song["track"]
+	track.Date = song["date"]
 	modTime, err := time.Parse(time.RFC3339, song["last-modified"])
 	if err != nil {
 		slog.Warn("Could not parse song time", "error", err, "song", song)
@@ -0,0 +1,219 @@
+// Package mpris implements a player backend for desktop media players that
+// can be remote controlled over D-Bus using the MPRIS2 specification.
+//
+// Every application that owns a name below org.mpris.MediaPlayer2 on the
+// configured bus is exposed as a player.
+package mpris
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+const (
+	busNamePrefix = "org.mpris.MediaPlayer2."
+	objectPath    = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+
+	rootInterface      = "org.mpris.MediaPlayer2"
+	playerInterface    = "org.mpris.MediaPlayer2.Player"
+	trackListInterface = "org.mpris.MediaPlayer2.TrackList"
+	propsInterface     = "org.freedesktop.DBus.Properties"
+	dbusInterface      = "org.freedesktop.DBus"
+
+	// noTrack is the track ID that is used by MPRIS to refer to no track at
+	// all.
+	noTrack = dbus.ObjectPath("/org/mpris/MediaPlayer2/TrackList/NoTrack")
+)
+
+var invalidNameChars = regexp.MustCompile(`\W`)
+
+// Bus handles the connection to a D-Bus message bus and discovers the MPRIS
+// media players on it.
+type Bus struct {
+	conn *dbus.Conn
+
+	lock sync.Mutex
+	// Players are reused so events can be emitted for players that have been
+	// looked up before.
+	players map[string]*Player
+	// Signals are sent from the unique name of a connection, this maps them
+	// to the well-known names of the players.
+	owners map[string]string
+}
+
+// Connect connects to a D-Bus message bus. The address is either "session",
+// "system" or a D-Bus server address like "unix:path=/run/user/1000/bus".
+func Connect(address string) (*Bus, error) {
+	// Signals must be handled in order so the last emitted state is the one
+	// that sticks.
+	handler := dbus.WithSignalHandler(dbus.NewSequentialSignalHandler())
+	var conn *dbus.Conn
+	var err error
+	switch address {
+	case "", "session":
+		conn, err = dbus.ConnectSessionBus(handler)
+	case "system":
+		conn, err = dbus.ConnectSystemBus(handler)
+	default:
+		conn, err = dbus.Connect(address, handler)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to D-Bus: %v", err)
+	}
+
+	if err := conn.AddMatchSignal(dbus.WithMatchObjectPath(objectPath)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchInterface(dbusInterface),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg0Namespace(strings.TrimSuffix(busNamePrefix, ".")),
+	); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	bus := &Bus{
+		conn:    conn,
+		players: map[string]*Player{},
+		owners:  map[string]string{},
+	}
+	signals := make(chan *dbus.Signal, 64)
+	conn.Signal(signals)
+	go bus.signalLoop(signals)
+	return bus, nil
+}
+
+// Close closes the connection to the message bus.
+func (bus *Bus) Close() error {
+	return bus.conn.Close()
+}
+
+func (bus *Bus) signalLoop(signals <-chan *dbus.Signal) {
+	for signal := range signals {
+		if signal.Name == dbusInterface+".NameOwnerChanged" {
+			var name, oldOwner, newOwner string
+			if err := dbus.Store(signal.Body, &name, &oldOwner, &newOwner); err != nil {
+				continue
+			}
+			bus.lock.Lock()
+			delete(bus.owners, oldOwner)
+			if _, ok := bus.players[name]; ok && newOwner != "" {
+				bus.owners[newOwner] = name
+			}
+			bus.lock.Unlock()
+			continue
+		}
+
+		bus.lock.Lock()
+		pl, ok := bus.players[bus.owners[signal.Sender]]
+		bus.lock.Unlock()
+		if ok {
+			pl.handleSignal(signal)
+		}
+	}
+}
+
+// busNames maps the names of the players to their bus names.
+func (bus *Bus) busNames() (map[string]string, error) {
+	var names []string
+	if err := bus.conn.BusObject().Call(dbusInterface+".ListNames", 0).Store(&names); err != nil {
+		return nil, fmt.Errorf("error listing D-Bus names: %v / %w", err, player.ErrUnavailable)
+	}
+	busNames := map[string]string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, busNamePrefix) {
+			continue
+		}
+		// Names like org.mpris.MediaPlayer2.vlc.instance1234 contain
+		// characters that are not allowed in player names.
+		busNames[invalidNameChars.ReplaceAllString(strings.TrimPrefix(name, busNamePrefix), "_")] = name
+	}
+	return busNames, nil
+}
+
+// PlayerNames implements the player.List interface.
+func (bus *Bus) PlayerNames() ([]string, error) {
+	busNames, err := bus.busNames()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(busNames))
+	for name := range busNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PlayerByName implements the player.List interface.
+func (bus *Bus) PlayerByName(name string) (player.Player, error) {
+	busNames, err := bus.busNames()
+	if err != nil {
+		return nil, err
+	}
+	busName, ok := busNames[name]
+	if !ok {
+		return nil, fmt.Errorf("%w, no MPRIS player with name %q", player.ErrPlayerNotFound, name)
+	}
+
+	var owner string
+	if err := bus.conn.BusObject().Call(dbusInterface+".GetNameOwner", 0, busName).Store(&owner); err != nil {
+		return nil, fmt.Errorf("%w, %v", player.ErrPlayerNotFound, err)
+	}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.owners[owner] = busName
+	if pl, ok := bus.players[busName]; ok {
+		return pl, nil
+	}
+	pl := &Player{
+		Emitter: util.Emitter{Release: time.Millisecond * 100},
+		busName: busName,
+		object:  bus.conn.Object(busName, objectPath),
+	}
+	pl.playlist.Playlist = mprisPlaylist{player: pl}
+	bus.players[busName] = pl
+	return pl, nil
+}
+
+func (bus *Bus) String() string {
+	names, err := bus.PlayerNames()
+	if err != nil {
+		return fmt.Sprintf("MPRIS{err=%v}", err)
+	}
+	return fmt.Sprintf("MPRIS{names=[%s]}", strings.Join(names, ", "))
+}
+
+// wrapError marks errors that are caused by the player having disappeared
+// from the bus as player.ErrUnavailable.
+func wrapError(busName string, err error) error {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) {
+		switch dbusErr.Name {
+		case "org.freedesktop.DBus.Error.ServiceUnknown", "org.freedesktop.DBus.Error.NameHasNoOwner", "org.freedesktop.DBus.Error.NoReply":
+			return fmt.Errorf("error connecting to %s: %v / %w", busName, err, player.ErrUnavailable)
+		}
+	}
+	if errors.Is(err, dbus.ErrClosed) {
+		return fmt.Errorf("error connecting to %s: %v / %w", busName, err, player.ErrUnavailable)
+	}
+	return err
+}
+
+func logSignalError(busName string, err error) {
+	slog.Debug("Could not handle MPRIS signal", "player", busName, "error", err)
+}
@@ -0,0 +1,440 @@
+package mpris
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+)
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus starts a private dbus-daemon and returns its address.
+func startBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not available")
+	}
+	dir := t.TempDir()
+	confFile := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(confFile, []byte(fmt.Sprintf(busConfig, dir)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+confFile, "--print-address", "--nofork")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(address)
+}
+
+type fakeTrack struct {
+	id  dbus.ObjectPath
+	uri string
+}
+
+// fakeMpris implements the parts of the MPRIS Player and TrackList interfaces
+// that are used by the player.
+type fakeMpris struct {
+	conn  *dbus.Conn
+	props *prop.Properties
+
+	lock     sync.Mutex
+	library  map[string]map[string]dbus.Variant
+	tracks   []fakeTrack
+	nextID   int
+	current  int
+	status   string
+	position int64
+}
+
+// fakeTrackList is exported separately because the method sets of both
+// interfaces are distinct.
+type fakeTrackList struct {
+	*fakeMpris
+}
+
+func newFakeMpris(t *testing.T, address, name string, hasTrackList bool) *fakeMpris {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fake := &fakeMpris{
+		conn:    conn,
+		library: map[string]map[string]dbus.Variant{},
+		current: -1,
+		status:  "Stopped",
+	}
+	for i, title := range []string{"Track A", "Track B", "Track C", "Track D"} {
+		uri := fmt.Sprintf("file:///music/%c.mp3", 'a'+i)
+		fake.library[uri] = map[string]dbus.Variant{
+			"xesam:url":         dbus.MakeVariant(uri),
+			"xesam:title":       dbus.MakeVariant(title),
+			"xesam:artist":      dbus.MakeVariant([]string{"Artist"}),
+			"xesam:trackNumber": dbus.MakeVariant(int32(i + 1)),
+			"mpris:length":      dbus.MakeVariant(int64(180_000_000)),
+		}
+	}
+	// The library of an MPRIS player consists of the tracks in its tracklist,
+	// so start with some tracks.
+	for _, uri := range []string{"file:///music/a.mp3", "file:///music/b.mp3", "file:///music/c.mp3", "file:///music/d.mp3"} {
+		fake.tracks = append(fake.tracks, fake.newTrack(uri))
+	}
+	if !hasTrackList {
+		fake.tracks = fake.tracks[:1]
+		fake.current = 0
+	}
+
+	if err := conn.Export(fake, objectPath, playerInterface); err != nil {
+		t.Fatal(err)
+	}
+	if hasTrackList {
+		if err := conn.Export(fakeTrackList{fake}, objectPath, trackListInterface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.props, err = prop.Export(conn, objectPath, prop.Map{
+		rootInterface: {
+			"Identity":     {Value: name, Emit: prop.EmitConst},
+			"HasTrackList": {Value: hasTrackList, Emit: prop.EmitConst},
+		},
+		playerInterface: {
+			"PlaybackStatus": {Value: fake.status, Emit: prop.EmitTrue},
+			"Metadata":       {Value: fake.metadata(), Emit: prop.EmitTrue},
+			"Position":       {Value: int64(0), Emit: prop.EmitFalse},
+			"Volume":         {Value: float64(1), Writable: true, Emit: prop.EmitTrue},
+		},
+		trackListInterface: {
+			"Tracks":        {Value: fake.trackIDs(), Emit: prop.EmitInvalidates},
+			"CanEditTracks": {Value: true, Emit: prop.EmitConst},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.RequestName(busNamePrefix+name, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func (fake *fakeMpris) newTrack(uri string) fakeTrack {
+	fake.nextID++
+	return fakeTrack{id: dbus.ObjectPath(fmt.Sprintf("/org/trollibox/track/%d", fake.nextID)), uri: uri}
+}
+
+func (fake *fakeMpris) trackIDs() []dbus.ObjectPath {
+	ids := make([]dbus.ObjectPath, len(fake.tracks))
+	for i, track := range fake.tracks {
+		ids[i] = track.id
+	}
+	return ids
+}
+
+func (fake *fakeMpris) trackMetadata(track fakeTrack) map[string]dbus.Variant {
+	metadata := map[string]dbus.Variant{"mpris:trackid": dbus.MakeVariant(track.id)}
+	for k, v := range fake.library[track.uri] {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+func (fake *fakeMpris) metadata() map[string]dbus.Variant {
+	if fake.current < 0 {
+		return map[string]dbus.Variant{"mpris:trackid": dbus.MakeVariant(noTrack)}
+	}
+	return fake.trackMetadata(fake.tracks[fake.current])
+}
+
+// update publishes the state of the fake. Must be called with the lock held.
+func (fake *fakeMpris) update() {
+	fake.props.SetMust(playerInterface, "PlaybackStatus", fake.status)
+	fake.props.SetMust(playerInterface, "Metadata", fake.metadata())
+	fake.props.SetMust(playerInterface, "Position", fake.position)
+	fake.props.SetMust(trackListInterface, "Tracks", fake.trackIDs())
+}
+
+func (fake *fakeMpris) Play() *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if fake.current < 0 && len(fake.tracks) > 0 {
+		fake.current = 0
+	}
+	if fake.current >= 0 {
+		fake.status = "Playing"
+	}
+	fake.update()
+	return nil
+}
+
+func (fake *fakeMpris) Pause() *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if fake.status == "Playing" {
+		fake.status = "Paused"
+	}
+	fake.update()
+	return nil
+}
+
+func (fake *fakeMpris) Stop() *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.status, fake.position = "Stopped", 0
+	fake.update()
+	return nil
+}
+
+func (fake *fakeMpris) SetPosition(id dbus.ObjectPath, position int64) *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if fake.current < 0 || fake.tracks[fake.current].id != id {
+		return nil
+	}
+	fake.position = position
+	fake.update()
+	_ = fake.conn.Emit(objectPath, playerInterface+".Seeked", position)
+	return nil
+}
+
+func (fake fakeTrackList) AddTrack(uri string, after dbus.ObjectPath, setAsCurrent bool) *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	pos := 0
+	if after != noTrack {
+		pos = -1
+		for i, track := range fake.tracks {
+			if track.id == after {
+				pos = i + 1
+			}
+		}
+		if pos < 0 {
+			return dbus.MakeFailedError(fmt.Errorf("no such track: %s", after))
+		}
+	}
+	track := fake.newTrack(uri)
+	fake.tracks = append(fake.tracks[:pos], append([]fakeTrack{track}, fake.tracks[pos:]...)...)
+	if fake.current >= pos {
+		fake.current++
+	}
+	fake.update()
+	return nil
+}
+
+func (fake fakeTrackList) RemoveTrack(id dbus.ObjectPath) *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for i, track := range fake.tracks {
+		if track.id != id {
+			continue
+		}
+		fake.tracks = append(fake.tracks[:i], fake.tracks[i+1:]...)
+		if fake.current == i {
+			fake.current, fake.status, fake.position = -1, "Stopped", 0
+		} else if fake.current > i {
+			fake.current--
+		}
+		break
+	}
+	fake.update()
+	return nil
+}
+
+func (fake fakeTrackList) GoTo(id dbus.ObjectPath) *dbus.Error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for i, track := range fake.tracks {
+		if track.id == id {
+			fake.current, fake.position = i, 0
+		}
+	}
+	fake.update()
+	return nil
+}
+
+func (fake fakeTrackList) GetTracksMetadata(ids []dbus.ObjectPath) ([]map[string]dbus.Variant, *dbus.Error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	metadata := []map[string]dbus.Variant{}
+	for _, id := range ids {
+		for _, track := range fake.tracks {
+			if track.id == id {
+				metadata = append(metadata, fake.trackMetadata(track))
+			}
+		}
+	}
+	return metadata, nil
+}
+
+func connectForTesting(t *testing.T, address string) *Bus {
+	bus, err := Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bus.Close() })
+	return bus
+}
+
+func playerForTesting(t *testing.T) (*Player, *fakeMpris) {
+	address := startBus(t)
+	fake := newFakeMpris(t, address, "fake", true)
+	pl, err := connectForTesting(t, address).PlayerByName("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pl.(*Player), fake
+}
+
+func TestPlayerNames(t *testing.T) {
+	address := startBus(t)
+	newFakeMpris(t, address, "fake", true)
+	newFakeMpris(t, address, "simple.instance42", false)
+	bus := connectForTesting(t, address)
+
+	names, err := bus.PlayerNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"fake", "simple_instance42"}; !reflect.DeepEqual(names, expect) {
+		t.Fatalf("unexpected names: %v != %v", expect, names)
+	}
+	if _, err := bus.PlayerByName("simple_instance42"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bus.PlayerByName("nonexistent"); !errors.Is(err, player.ErrPlayerNotFound) {
+		t.Fatalf("expected ErrPlayerNotFound, got %v", err)
+	}
+}
+
+func TestPlayerImplementation(t *testing.T) {
+	pl, _ := playerForTesting(t)
+	player.TestPlayerImplementation(t, pl)
+}
+
+func TestPlaylistImplementation(t *testing.T) {
+	pl, _ := playerForTesting(t)
+	tracks, err := pl.Tracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaTracks := make([]player.MetaTrack, 3)
+	for i, t := range tracks[:len(metaTracks)] {
+		metaTracks[i].Track = t
+		metaTracks[i].QueuedBy = "system"
+	}
+
+	player.TestPlaylistImplementation[player.MetaTrack](t, pl.Playlist(), metaTracks)
+}
+
+func TestWithoutTrackList(t *testing.T) {
+	ctx := context.Background()
+	address := startBus(t)
+	newFakeMpris(t, address, "simple", false)
+	pl, err := connectForTesting(t, address).PlayerByName("simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := pl.Playlist().Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].URI != "file:///music/a.mp3" {
+		t.Fatalf("unexpected tracks: %v", tracks)
+	}
+	if err := pl.Playlist().Insert(ctx, -1, tracks[0]); err == nil {
+		t.Fatal("expected an error when inserting without a tracklist")
+	}
+
+	if err := pl.SetTrackIndex(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	status, err := pl.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TrackIndex != 0 || status.PlayState != player.PlayStatePlaying {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestTrackInfo(t *testing.T) {
+	ctx := context.Background()
+	pl, fake := playerForTesting(t)
+
+	artFile := filepath.Join(t.TempDir(), "cover.png")
+	if err := os.WriteFile(artFile, []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fake.lock.Lock()
+	fake.library["file:///music/a.mp3"]["mpris:artUrl"] = dbus.MakeVariant("file://" + artFile)
+	fake.lock.Unlock()
+
+	tracks, err := pl.TrackInfo(ctx, "file:///music/b.mp3", "file:///music/unknown.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []library.Track{
+		{
+			URI:        "file:///music/b.mp3",
+			Artist:     "Artist",
+			Title:      "Track B",
+			AlbumTrack: "2",
+			Duration:   3 * time.Minute,
+		},
+		{},
+	}
+	if !reflect.DeepEqual(tracks, expect) {
+		t.Fatalf("unexpected tracks:\n%#v\n%#v", expect, tracks)
+	}
+
+	art, err := pl.TrackArt(ctx, "file:///music/a.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(art.ImageData) != "png" || art.MimeType != "image/png" {
+		t.Fatalf("unexpected art: %#v", art)
+	}
+	if _, err := pl.TrackArt(ctx, "file:///music/b.mp3"); err != library.ErrNoArt {
+		t.Fatalf("expected ErrNoArt, got %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+package mpris
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+// Player is a single MPRIS media player.
+//
+// MPRIS does not provide access to the library of a player, so the library of
+// a Player consists of the tracks in its tracklist.
+type Player struct {
+	util.Emitter
+
+	busName string
+	object  dbus.BusObject
+
+	playlist player.PlaylistMetaKeeper
+}
+
+func (pl *Player) call(ctx context.Context, method string, args ...interface{}) *dbus.Call {
+	call := pl.object.CallWithContext(ctx, method, 0, args...)
+	call.Err = wrapError(pl.busName, call.Err)
+	return call
+}
+
+// properties gets all properties of the specified interface.
+func (pl *Player) properties(ctx context.Context, iface string) (map[string]dbus.Variant, error) {
+	var props map[string]dbus.Variant
+	if err := pl.call(ctx, propsInterface+".GetAll", iface).Store(&props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func (pl *Player) property(ctx context.Context, iface, name string, value interface{}) error {
+	var variant dbus.Variant
+	if err := pl.call(ctx, propsInterface+".Get", iface, name).Store(&variant); err != nil {
+		return err
+	}
+	return variant.Store(value)
+}
+
+// hasTrackList reports whether the player implements the TrackList interface.
+func (pl *Player) hasTrackList(ctx context.Context) (bool, error) {
+	var hasTrackList bool
+	if err := pl.property(ctx, rootInterface, "HasTrackList", &hasTrackList); err != nil {
+		return false, err
+	}
+	return hasTrackList, nil
+}
+
+// trackIDs returns the IDs of the tracks in the tracklist.
+func (pl *Player) trackIDs(ctx context.Context) ([]dbus.ObjectPath, error) {
+	var ids []dbus.ObjectPath
+	if err := pl.property(ctx, trackListInterface, "Tracks", &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (pl *Player) handleSignal(signal *dbus.Signal) {
+	ctx := context.Background()
+	switch signal.Name {
+	case propsInterface + ".PropertiesChanged":
+		var iface string
+		var changed map[string]dbus.Variant
+		var invalidated []string
+		if err := dbus.Store(signal.Body, &iface, &changed, &invalidated); err != nil {
+			logSignalError(pl.busName, err)
+			return
+		}
+		for _, name := range invalidated {
+			changed[name] = dbus.Variant{}
+		}
+		switch iface {
+		case playerInterface:
+			if v, ok := changed["PlaybackStatus"]; ok {
+				if status, ok := v.Value().(string); ok {
+					pl.Emit(player.PlayStateEvent{State: playStateFromMpris(status)})
+				}
+			}
+			if v, ok := changed["Volume"]; ok {
+				if volume, ok := v.Value().(float64); ok {
+					pl.Emit(player.VolumeEvent{Volume: volumeFromMpris(volume)})
+				}
+			}
+			_, metadataChanged := changed["Metadata"]
+			_, statusChanged := changed["PlaybackStatus"]
+			if metadataChanged || statusChanged {
+				pl.emitPlaylistEvent(ctx)
+			}
+		case trackListInterface:
+			if _, ok := changed["Tracks"]; ok {
+				pl.emitPlaylistEvent(ctx)
+			}
+		}
+	case playerInterface + ".Seeked":
+		var position int64
+		if err := dbus.Store(signal.Body, &position); err != nil {
+			logSignalError(pl.busName, err)
+			return
+		}
+		pl.Emit(player.TimeEvent{Time: time.Duration(position) * time.Microsecond})
+	case trackListInterface + ".TrackListReplaced",
+		trackListInterface + ".TrackAdded",
+		trackListInterface + ".TrackRemoved",
+		trackListInterface + ".TrackMetadataChanged":
+		pl.emitPlaylistEvent(ctx)
+	}
+}
+
+func (pl *Player) emitPlaylistEvent(ctx context.Context) {
+	status, err := pl.Status(ctx)
+	if err != nil {
+		logSignalError(pl.busName, err)
+		return
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: status.TrackIndex})
+}
+
+// Library implements the player.Player interface.
+func (pl *Player) Library() library.Library {
+	return pl
+}
+
+// Tracks implements the library.Library interface.
+func (pl *Player) Tracks(ctx context.Context) ([]library.Track, error) {
+	_, metadata, err := pl.playlistMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]library.Track, 0, len(metadata))
+	for _, m := range metadata {
+		if track := trackFromMetadata(m); track.URI != "" {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, nil
+}
+
+// TrackInfo implements the library.Library interface.
+func (pl *Player) TrackInfo(ctx context.Context, uris ...string) ([]library.Track, error) {
+	known, err := pl.Tracks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byURI := make(map[string]library.Track, len(known))
+	for _, track := range known {
+		byURI[track.URI] = track
+	}
+	tracks := make([]library.Track, len(uris))
+	for i, uri := range uris {
+		tracks[i] = byURI[uri]
+	}
+	return tracks, nil
+}
+
+// TrackArt implements the library.Library interface.
+func (pl *Player) TrackArt(ctx context.Context, uri string) (*library.Art, error) {
+	_, metadata, err := pl.playlistMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var artURL string
+	for _, m := range metadata {
+		if variantString(m["xesam:url"]) == uri {
+			artURL = variantString(m["mpris:artUrl"])
+			break
+		}
+	}
+	if artURL == "" {
+		return nil, library.ErrNoArt
+	}
+	u, err := url.Parse(artURL)
+	if err != nil {
+		return nil, library.ErrNoArt
+	}
+
+	switch u.Scheme {
+	case "file":
+		imageData, err := os.ReadFile(u.Path)
+		if err != nil {
+			return nil, library.ErrNoArt
+		}
+		art := &library.Art{ImageData: imageData}
+		if art.MimeType = mime.TypeByExtension(filepath.Ext(u.Path)); art.MimeType == "" {
+			art.MimeType = http.DetectContentType(imageData)
+		}
+		if info, err := os.Stat(u.Path); err == nil {
+			art.ModTime = info.ModTime()
+		}
+		return art, nil
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, artURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, library.ErrNoArt
+		}
+		imageData, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		art := &library.Art{ImageData: imageData, MimeType: resp.Header.Get("Content-Type")}
+		if art.MimeType == "" {
+			art.MimeType = http.DetectContentType(imageData)
+		}
+		return art, nil
+	default:
+		return nil, library.ErrNoArt
+	}
+}
+
+// Lists implements the player.Player interface.
+//
+// The Playlists interface of MPRIS only allows playlists to be activated, it
+// does not expose their contents. So no lists are returned.
+func (pl *Player) Lists(ctx context.Context) (map[string]player.Playlist[library.Track], error) {
+	return map[string]player.Playlist[library.Track]{}, nil
+}
+
+// Status implements the player.Player interface.
+func (pl *Player) Status(ctx context.Context) (*player.Status, error) {
+	props, err := pl.properties(ctx, playerInterface)
+	if err != nil {
+		return nil, err
+	}
+	status := &player.Status{
+		TrackIndex: -1,
+		PlayState:  playStateFromMpris(variantString(props["PlaybackStatus"])),
+	}
+	if volume, ok := props["Volume"].Value().(float64); ok {
+		status.Volume = volumeFromMpris(volume)
+	}
+	if status.PlayState != player.PlayStateStopped {
+		status.Time = time.Duration(variantInt(props["Position"])) * time.Microsecond
+	}
+
+	var metadata map[string]dbus.Variant
+	_ = props["Metadata"].Store(&metadata)
+	current, _ := metadata["mpris:trackid"].Value().(dbus.ObjectPath)
+
+	hasTrackList, err := pl.hasTrackList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !hasTrackList {
+		if current != "" && current != noTrack && status.PlayState != player.PlayStateStopped {
+			status.TrackIndex = 0
+		}
+		return status, nil
+	}
+	ids, err := pl.trackIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		if id == current {
+			status.TrackIndex = i
+			break
+		}
+	}
+	return status, nil
+}
+
+// SetTime implements the player.Player interface.
+func (pl *Player) SetTime(ctx context.Context, offset time.Duration) error {
+	var metadata map[string]dbus.Variant
+	if err := pl.property(ctx, playerInterface, "Metadata", &metadata); err != nil {
+		return err
+	}
+	trackID, _ := metadata["mpris:trackid"].Value().(dbus.ObjectPath)
+	if trackID == "" || trackID == noTrack {
+		return nil
+	}
+	return pl.call(ctx, playerInterface+".SetPosition", trackID, offset.Microseconds()).Err
+}
+
+// SetTrackIndex implements the player.Player interface.
+func (pl *Player) SetTrackIndex(ctx context.Context, trackIndex int) error {
+	hasTrackList, err := pl.hasTrackList(ctx)
+	if err != nil {
+		return err
+	}
+	if !hasTrackList {
+		// Without a tracklist, only the current track is known.
+		if trackIndex == 0 {
+			return pl.SetState(ctx, player.PlayStatePlaying)
+		}
+		return pl.SetState(ctx, player.PlayStateStopped)
+	}
+
+	ids, err := pl.trackIDs(ctx)
+	if err != nil {
+		return err
+	}
+	if trackIndex >= len(ids) {
+		return pl.SetState(ctx, player.PlayStateStopped)
+	}
+	if err := pl.call(ctx, trackListInterface+".GoTo", ids[trackIndex]).Err; err != nil {
+		return err
+	}
+	return pl.call(ctx, playerInterface+".Play").Err
+}
+
+// SetState implements the player.Player interface.
+func (pl *Player) SetState(ctx context.Context, state player.PlayState) error {
+	switch state {
+	case player.PlayStatePaused:
+		return pl.call(ctx, playerInterface+".Pause").Err
+	case player.PlayStatePlaying:
+		if plistLen, err := pl.Playlist().Len(ctx); err != nil {
+			return fmt.Errorf("error getting playlist length: %v", err)
+		} else if plistLen == 0 {
+			pl.Emit(player.PlayStateEvent{State: state})
+			return nil
+		}
+		return pl.call(ctx, playerInterface+".Play").Err
+	case player.PlayStateStopped:
+		return pl.call(ctx, playerInterface+".Stop").Err
+	default:
+		return fmt.Errorf("unknown play state %q", state)
+	}
+}
+
+// SetVolume implements the player.Player interface.
+func (pl *Player) SetVolume(ctx context.Context, vol int) error {
+	if vol > 100 {
+		vol = 100
+	} else if vol < 0 {
+		vol = 0
+	}
+	return pl.call(ctx, propsInterface+".Set", playerInterface, "Volume", dbus.MakeVariant(float64(vol)/100)).Err
+}
+
+// Playlist implements the player.Player interface.
+func (pl *Player) Playlist() player.Playlist[player.MetaTrack] {
+	return &pl.playlist
+}
+
+// Events implements the player.Player interface.
+func (pl *Player) Events() *util.Emitter {
+	return &pl.Emitter
+}
+
+func (pl *Player) String() string {
+	return fmt.Sprintf("MPRIS{%s}", pl.busName)
+}
+
+func playStateFromMpris(status string) player.PlayState {
+	switch status {
+	case "Playing":
+		return player.PlayStatePlaying
+	case "Paused":
+		return player.PlayStatePaused
+	default:
+		return player.PlayStateStopped
+	}
+}
+
+func volumeFromMpris(volume float64) int {
+	return int(math.Round(volume * 100))
+}
+
+func trackFromMetadata(metadata map[string]dbus.Variant) library.Track {
+	track := library.Track{
+		URI:         variantString(metadata["xesam:url"]),
+		Title:       variantString(metadata["xesam:title"]),
+		Artist:      strings.Join(variantStrings(metadata["xesam:artist"]), ", "),
+		AlbumArtist: strings.Join(variantStrings(metadata["xesam:albumArtist"]), ", "),
+		Album:       variantString(metadata["xesam:album"]),
+		Genre:       strings.Join(variantStrings(metadata["xesam:genre"]), ", "),
+		Duration:    time.Duration(variantInt(metadata["mpris:length"])) * time.Microsecond,
+	}
+	if n := variantInt(metadata["xesam:trackNumber"]); n > 0 {
+		track.AlbumTrack = strconv.FormatInt(n, 10)
+	}
+	if n := variantInt(metadata["xesam:discNumber"]); n > 0 {
+		track.AlbumDisc = strconv.FormatInt(n, 10)
+	}
+	if created := variantString(metadata["xesam:contentCreated"]); created != "" {
+		// Dates are formatted as ISO 8601, only the date part is kept.
+		track.Date, _, _ = strings.Cut(created, "T")
+	}
+	if track.URI != "" {
+		library.InterpolateMissingFields(&track)
+	}
+	return track
+}
+
+func variantString(v dbus.Variant) string {
+	switch s := v.Value().(type) {
+	case string:
+		return s
+	case dbus.ObjectPath:
+		return string(s)
+	default:
+		return ""
+	}
+}
+
+func variantStrings(v dbus.Variant) []string {
+	switch s := v.Value().(type) {
+	case []string:
+		return s
+	case string:
+		// Some players send a single string instead of a list.
+		return []string{s}
+	default:
+		return nil
+	}
+}
+
+// variantInt converts any integer variant to an int64. Players are not
+// consistent in the integer types they use.
+func variantInt(v dbus.Variant) int64 {
+	switch n := v.Value().(type) {
+	case int16:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case int64:
+		return n
+	case uint64:
+		return int64(n)
+	case float64:
+		return int64(n)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,175 @@
+package mpris
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+
+	"trollibox/src/library"
+)
+
+// playlistMetadata returns the IDs and metadata of the tracks in the
+// playlist. If the player does not implement the TrackList interface, the
+// playlist consists of just the current track.
+func (pl *Player) playlistMetadata(ctx context.Context) ([]dbus.ObjectPath, []map[string]dbus.Variant, error) {
+	hasTrackList, err := pl.hasTrackList(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasTrackList {
+		var metadata map[string]dbus.Variant
+		if err := pl.property(ctx, playerInterface, "Metadata", &metadata); err != nil {
+			return nil, nil, err
+		}
+		trackID, _ := metadata["mpris:trackid"].Value().(dbus.ObjectPath)
+		if trackID == "" || trackID == noTrack {
+			return nil, nil, nil
+		}
+		return []dbus.ObjectPath{trackID}, []map[string]dbus.Variant{metadata}, nil
+	}
+
+	ids, err := pl.trackIDs(ctx)
+	if err != nil || len(ids) == 0 {
+		return nil, nil, err
+	}
+	var metadata []map[string]dbus.Variant
+	if err := pl.call(ctx, trackListInterface+".GetTracksMetadata", ids).Store(&metadata); err != nil {
+		return nil, nil, err
+	}
+	return ids, metadata, nil
+}
+
+// requireTrackList returns an error if the tracklist of the player can not be
+// edited.
+func (pl *Player) requireTrackList(ctx context.Context) error {
+	hasTrackList, err := pl.hasTrackList(ctx)
+	if err != nil {
+		return err
+	}
+	var canEdit bool
+	if hasTrackList {
+		if err := pl.property(ctx, trackListInterface, "CanEditTracks", &canEdit); err != nil {
+			return err
+		}
+	}
+	if !canEdit {
+		return fmt.Errorf("%s does not support editing its tracklist", pl.busName)
+	}
+	return nil
+}
+
+type mprisPlaylist struct {
+	player *Player
+}
+
+func (plist mprisPlaylist) Insert(ctx context.Context, pos int, tracks ...library.Track) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+	if err := plist.player.requireTrackList(ctx); err != nil {
+		return err
+	}
+	ids, err := plist.player.trackIDs(ctx)
+	if err != nil {
+		return err
+	}
+	wasEmpty := len(ids) == 0
+	if pos == -1 || pos > len(ids) {
+		pos = len(ids)
+	}
+
+	// AddTrack does not return the ID of the new track, so the tracklist is
+	// read again after each addition to find the track to insert after.
+	for i, track := range tracks {
+		after := noTrack
+		if pos+i > 0 {
+			after = ids[pos+i-1]
+		}
+		if err := plist.player.call(ctx, trackListInterface+".AddTrack", track.URI, after, false).Err; err != nil {
+			return err
+		}
+		if ids, err = plist.player.trackIDs(ctx); err != nil {
+			return err
+		}
+	}
+
+	if wasEmpty {
+		// Play the first track if the playlist was empty, just like the MPD
+		// backend does.
+		return plist.player.SetTrackIndex(ctx, 0)
+	}
+	return nil
+}
+
+func (plist mprisPlaylist) Move(ctx context.Context, fromPos, toPos int) error {
+	if fromPos == toPos {
+		return nil
+	}
+	if err := plist.player.requireTrackList(ctx); err != nil {
+		return err
+	}
+	// MPRIS has no way to move tracks, so the track is removed and added
+	// again at its new position.
+	ids, metadata, err := plist.player.playlistMetadata(ctx)
+	if err != nil {
+		return err
+	}
+	if fromPos < 0 || fromPos >= len(ids) || toPos < 0 || toPos >= len(ids) {
+		return fmt.Errorf("move out of range: %d -> %d", fromPos, toPos)
+	}
+	uri := variantString(metadata[fromPos]["xesam:url"])
+	if err := plist.player.call(ctx, trackListInterface+".RemoveTrack", ids[fromPos]).Err; err != nil {
+		return err
+	}
+	if ids, err = plist.player.trackIDs(ctx); err != nil {
+		return err
+	}
+	after := noTrack
+	if toPos > 0 {
+		after = ids[toPos-1]
+	}
+	return plist.player.call(ctx, trackListInterface+".AddTrack", uri, after, false).Err
+}
+
+func (plist mprisPlaylist) Remove(ctx context.Context, positions ...int) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	if err := plist.player.requireTrackList(ctx); err != nil {
+		return err
+	}
+	ids, err := plist.player.trackIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pos := range positions {
+		if pos < 0 || pos >= len(ids) {
+			continue
+		}
+		if err := plist.player.call(ctx, trackListInterface+".RemoveTrack", ids[pos]).Err; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (plist mprisPlaylist) Tracks(ctx context.Context) ([]library.Track, error) {
+	_, metadata, err := plist.player.playlistMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]library.Track, len(metadata))
+	for i, m := range metadata {
+		tracks[i] = trackFromMetadata(m)
+	}
+	return tracks, nil
+}
+
+func (plist mprisPlaylist) Len(ctx context.Context) (int, error) {
+	ids, _, err := plist.player.playlistMetadata(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return len(ids), nil
+}
@@ -2,6 +2,8 @@ package player
 
 import (
 	"context"
+	"strings"
+
 	"trollibox/src/library"
 )
 
@@ -33,12 +35,51 @@ type Playlist[T PlaylistTrack] interface {
 	Len(ctx context.Context) (int, error)
 }
 
+const (
+	// QueuedBySystem is the QueuedBy value of tracks that were queued
+	// automatically.
+	QueuedBySystem = "system"
+	// QueuedByUser is the QueuedBy value of tracks that were queued by an
+	// anonymous user.
+	QueuedByUser = "user"
+)
+
 // MetaTrack is a track that is queued in the playlist of a player.
 //
 // It augments a regular library track with fields that are valid while the track is queued.
 type MetaTrack struct {
 	library.Track
 	// QueuedBy indicates by what entity a track was added.
-	// Can be either "user" or "system".
+	// Can be either "system", "user" or "user:" followed by the name of the
+	// user, see QueuedByUserNamed.
 	QueuedBy string
+	// RequesterKey tells users apart that queued tracks, see
+	// identity.Identity.Key. Unlike the name in QueuedBy, it can not be
+	// chosen freely by the user. It is empty if the track was not queued
+	// through Trollibox by a user.
+	RequesterKey string
+}
+
+// QueuedByUserNamed returns the QueuedBy value of tracks queued by the named
+// user. QueuedByUser is returned if the name is empty.
+func QueuedByUserNamed(name string) string {
+	if name == "" {
+		return QueuedByUser
+	}
+	return QueuedByUser + ":" + name
+}
+
+// IsQueuedByUser reports whether the track was queued by a user, named or
+// not.
+func (mt MetaTrack) IsQueuedByUser() bool {
+	return mt.QueuedBy == QueuedByUser || strings.HasPrefix(mt.QueuedBy, QueuedByUser+":")
+}
+
+// Requester returns the name of the user that queued the track. It is empty
+// if the track was queued by the system or an anonymous user.
+func (mt MetaTrack) Requester() string {
+	if !strings.HasPrefix(mt.QueuedBy, QueuedByUser+":") {
+		return ""
+	}
+	return mt.QueuedBy[len(QueuedByUser)+1:]
 }
@@ -26,3 +26,27 @@ func TestDummyPlaylistImplementation(t *testing.T) {
 	}
 	TestPlaylistImplementation[library.Track](t, &DummyPlaylist{}, tracks)
 }
+
+func TestMetaTrackQueuedBy(t *testing.T) {
+	tt := []struct {
+		queuedBy  string
+		byUser    bool
+		requester string
+	}{
+		{QueuedBySystem, false, ""},
+		{QueuedByUser, true, ""},
+		{QueuedByUserNamed(""), true, ""},
+		{QueuedByUserNamed("alice"), true, "alice"},
+		{QueuedByUserNamed("bob:smith"), true, "bob:smith"},
+		{"username", false, ""},
+	}
+	for _, tc := range tt {
+		mt := MetaTrack{QueuedBy: tc.queuedBy}
+		if mt.IsQueuedByUser() != tc.byUser {
+			t.Fatalf("Unexpected IsQueuedByUser for %q: %v", tc.queuedBy, !tc.byUser)
+		}
+		if mt.Requester() != tc.requester {
+			t.Fatalf("Unexpected requester for %q: %q", tc.queuedBy, mt.Requester())
+		}
+	}
+}
@@ -20,7 +20,7 @@ import (
 	"trollibox/src/util"
 )
 
-const trackTags = "uAglitdc"
+const trackTags = "uAglitdcy"
 
 var eventTranslations = []struct {
 	Exp   *regexp.Regexp
@@ -319,6 +319,10 @@ func setSlimAttr(serv *Server, track *library.Track, key, value string) {
 		track.AlbumTrack = value
 	case "disc":
 		track.AlbumDisc = value
+	case "year":
+		if value != "0" {
+			track.Date = value
+		}
 	case "duration":
 		d, _ := strconv.ParseFloat(value, 64)
 		track.Duration = time.Duration(d) * time.Second
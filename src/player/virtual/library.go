@@ -0,0 +1,224 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/util"
+)
+
+const uriSchema = "virtual://"
+
+// DefaultDuration is the duration of tracks for which no duration is known.
+const DefaultDuration = 3 * time.Minute
+
+// The extensions of files that are considered to be audio.
+var audioExtensions = map[string]bool{
+	".aac":  true,
+	".flac": true,
+	".m4a":  true,
+	".mp3":  true,
+	".ogg":  true,
+	".opus": true,
+	".wav":  true,
+	".wma":  true,
+}
+
+// The names of image files that are used as art for the tracks in the same
+// directory.
+var artFilenames = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png"}
+
+// Library is a fixed set of tracks that is held in memory.
+type Library struct {
+	util.Emitter
+
+	tracks []library.Track
+	// Maps track URIs to the files holding their art.
+	art map[string]string
+}
+
+// NewLibrary creates a library holding the specified tracks.
+func NewLibrary(tracks ...library.Track) *Library {
+	return &Library{tracks: tracks, art: map[string]string{}}
+}
+
+// LoadLibrary loads a library from either a directory or a JSON manifest,
+// depending on what the path points to.
+//
+// The duration is assigned to tracks that have none, which is always the
+// case for tracks loaded from a directory. DefaultDuration is used if it is
+// zero.
+func LoadLibrary(path string, duration time.Duration) (*Library, error) {
+	if duration <= 0 {
+		duration = DefaultDuration
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return loadDirectory(path, duration)
+	}
+	return loadManifest(path, duration)
+}
+
+// loadDirectory creates a track for every audio file in the directory and its
+// subdirectories. The metadata of the tracks is derived from the filenames.
+func loadDirectory(dir string, duration time.Duration) (*Library, error) {
+	lib := NewLibrary()
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !audioExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		track := library.Track{
+			URI:      uriSchema + filepath.ToSlash(rel),
+			Duration: duration,
+			ModTime:  info.ModTime(),
+		}
+		library.InterpolateMissingFields(&track)
+		lib.tracks = append(lib.tracks, track)
+
+		for _, name := range artFilenames {
+			artFile := filepath.Join(filepath.Dir(path), name)
+			if _, err := os.Stat(artFile); err == nil {
+				lib.art[track.URI] = artFile
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading virtual library: %v", err)
+	}
+	return lib, nil
+}
+
+type manifest struct {
+	Tracks []struct {
+		URI         string  `json:"uri"`
+		Title       string  `json:"title"`
+		Artist      string  `json:"artist"`
+		Album       string  `json:"album"`
+		AlbumArtist string  `json:"albumartist"`
+		AlbumTrack  string  `json:"albumtrack"`
+		AlbumDisc   string  `json:"albumdisc"`
+		Genre       string  `json:"genre"`
+		Date        string  `json:"date"`
+		Duration    float64 `json:"duration"` // In seconds.
+		Art         string  `json:"art"`      // Relative to the manifest.
+	} `json:"tracks"`
+}
+
+// loadManifest loads the tracks described in a JSON file.
+func loadManifest(file string, duration time.Duration) (*Library, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var m manifest
+	if err := json.NewDecoder(fd).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error loading virtual library manifest %q: %v", file, err)
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	lib := NewLibrary()
+	for i, mt := range m.Tracks {
+		if mt.URI == "" {
+			return nil, fmt.Errorf("error loading virtual library manifest %q: track %d has no uri", file, i)
+		}
+		track := library.Track{
+			URI:         mt.URI,
+			Title:       mt.Title,
+			Artist:      mt.Artist,
+			Album:       mt.Album,
+			AlbumArtist: mt.AlbumArtist,
+			AlbumTrack:  mt.AlbumTrack,
+			AlbumDisc:   mt.AlbumDisc,
+			Genre:       mt.Genre,
+			Date:        mt.Date,
+			Duration:    time.Duration(mt.Duration * float64(time.Second)),
+			ModTime:     info.ModTime(),
+		}
+		if track.Duration <= 0 {
+			track.Duration = duration
+		}
+		library.InterpolateMissingFields(&track)
+		lib.tracks = append(lib.tracks, track)
+		if mt.Art != "" {
+			lib.art[track.URI] = filepath.Join(filepath.Dir(file), mt.Art)
+		}
+	}
+	return lib, nil
+}
+
+// Tracks implements the library.Library interface.
+func (lib *Library) Tracks(ctx context.Context) ([]library.Track, error) {
+	return append([]library.Track{}, lib.tracks...), nil
+}
+
+// TrackInfo implements the library.Library interface.
+func (lib *Library) TrackInfo(ctx context.Context, uris ...string) ([]library.Track, error) {
+	byURI := make(map[string]library.Track, len(lib.tracks))
+	for _, track := range lib.tracks {
+		byURI[track.URI] = track
+	}
+	tracks := make([]library.Track, len(uris))
+	for i, uri := range uris {
+		tracks[i] = byURI[uri]
+	}
+	return tracks, nil
+}
+
+// TrackArt implements the library.Library interface.
+func (lib *Library) TrackArt(ctx context.Context, uri string) (*library.Art, error) {
+	artFile, ok := lib.art[uri]
+	if !ok {
+		return nil, library.ErrNoArt
+	}
+	imageData, err := os.ReadFile(artFile)
+	if err != nil {
+		return nil, library.ErrNoArt
+	}
+	art := &library.Art{ImageData: imageData}
+	if art.MimeType = mime.TypeByExtension(filepath.Ext(artFile)); art.MimeType == "" {
+		art.MimeType = http.DetectContentType(imageData)
+	}
+	if info, err := os.Stat(artFile); err == nil {
+		art.ModTime = info.ModTime()
+	}
+	return art, nil
+}
+
+// Events implements the library.Library interface.
+func (lib *Library) Events() *util.Emitter {
+	return &lib.Emitter
+}
+
+func (lib *Library) String() string {
+	return fmt.Sprintf("VirtualLibrary{%d tracks}", len(lib.tracks))
+}
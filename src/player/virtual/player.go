@@ -0,0 +1,355 @@
+// Package virtual implements a player that runs inside Trollibox itself. It
+// does not produce any sound, playback is simulated on the wall clock.
+//
+// It is useful for demonstrating the interface and for testing without
+// having to run an actual music player.
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/library/cache"
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+// Player simulates playback of the tracks in its playlist.
+type Player struct {
+	util.Emitter
+
+	lib           *Library
+	cachedLibrary *cache.Cache
+	playlist      player.PlaylistMetaKeeper
+
+	lock   sync.Mutex
+	tracks []library.Track
+	index  int
+	state  player.PlayState
+	volume int
+	// The playback offset at the time playback was last started or seeked.
+	offset time.Duration
+	since  time.Time
+	// The timer that advances to the next track, the generation is used to
+	// ignore timers that were superseded.
+	timer      *time.Timer
+	generation int
+}
+
+// New creates a virtual player that plays tracks from the specified library.
+func New(lib *Library) *Player {
+	pl := &Player{
+		Emitter: util.Emitter{Release: time.Millisecond * 100},
+		lib:     lib,
+		index:   -1,
+		state:   player.PlayStateStopped,
+		volume:  100,
+	}
+	pl.playlist.Playlist = virtualPlaylist{player: pl}
+	pl.cachedLibrary = cache.NewCache(lib)
+	return pl
+}
+
+// elapsed returns the playback offset into the current track. Must be called
+// with the lock held.
+func (pl *Player) elapsed() time.Duration {
+	if pl.state == player.PlayStateStopped {
+		return 0
+	}
+	elapsed := pl.offset
+	if pl.state == player.PlayStatePlaying {
+		elapsed += time.Since(pl.since)
+	}
+	if pl.index >= 0 && pl.index < len(pl.tracks) {
+		if duration := pl.tracks[pl.index].Duration; duration > 0 && elapsed > duration {
+			elapsed = duration
+		}
+	}
+	return elapsed
+}
+
+// schedule arranges for the next track to be played once the current track
+// has finished. Must be called with the lock held after every change to the
+// playback state.
+func (pl *Player) schedule() {
+	pl.generation++
+	if pl.timer != nil {
+		pl.timer.Stop()
+		pl.timer = nil
+	}
+	if pl.state != player.PlayStatePlaying || pl.index < 0 || pl.index >= len(pl.tracks) {
+		return
+	}
+	// Tracks without a duration, like streams, play until they are stopped.
+	duration := pl.tracks[pl.index].Duration
+	if duration <= 0 {
+		return
+	}
+	generation := pl.generation
+	pl.timer = time.AfterFunc(duration-pl.elapsed(), func() {
+		pl.lock.Lock()
+		defer pl.lock.Unlock()
+		if pl.generation == generation {
+			pl.play(pl.index + 1)
+		}
+	})
+}
+
+// play starts playback of the track at the specified index, playback is
+// stopped if the index is beyond the end of the playlist. Must be called with
+// the lock held.
+func (pl *Player) play(index int) {
+	if index >= len(pl.tracks) {
+		pl.stop(true)
+		return
+	}
+	pl.index, pl.offset, pl.since = index, 0, time.Now()
+	pl.state = player.PlayStatePlaying
+	pl.schedule()
+	pl.Emit(player.PlaylistEvent{TrackIndex: pl.index})
+	pl.Emit(player.PlayStateEvent{State: pl.state})
+}
+
+// stop stops playback. If ended is set, the current track is unset as well.
+// Must be called with the lock held.
+func (pl *Player) stop(ended bool) {
+	pl.state, pl.offset = player.PlayStateStopped, 0
+	if ended {
+		pl.index = -1
+		pl.Emit(player.PlaylistEvent{TrackIndex: pl.index})
+	}
+	pl.schedule()
+	pl.Emit(player.PlayStateEvent{State: pl.state})
+}
+
+// Library implements the player.Player interface.
+func (pl *Player) Library() library.Library {
+	return pl.cachedLibrary
+}
+
+// Lists implements the player.Player interface.
+func (pl *Player) Lists(ctx context.Context) (map[string]player.Playlist[library.Track], error) {
+	return map[string]player.Playlist[library.Track]{}, nil
+}
+
+// Status implements the player.Player interface.
+func (pl *Player) Status(ctx context.Context) (*player.Status, error) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return &player.Status{
+		TrackIndex: pl.index,
+		Time:       pl.elapsed(),
+		PlayState:  pl.state,
+		Volume:     pl.volume,
+	}, nil
+}
+
+// SetTime implements the player.Player interface.
+func (pl *Player) SetTime(ctx context.Context, offset time.Duration) error {
+	if offset < 0 {
+		return fmt.Errorf("error setting time: negative offset")
+	}
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	if pl.state == player.PlayStateStopped {
+		return nil
+	}
+	pl.offset, pl.since = offset, time.Now()
+	pl.schedule()
+	pl.Emit(player.TimeEvent{Time: offset})
+	return nil
+}
+
+// SetTrackIndex implements the player.Player interface.
+func (pl *Player) SetTrackIndex(ctx context.Context, trackIndex int) error {
+	if trackIndex < 0 {
+		return fmt.Errorf("negative track index: %d", trackIndex)
+	}
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.play(trackIndex)
+	return nil
+}
+
+// SetState implements the player.Player interface.
+func (pl *Player) SetState(ctx context.Context, state player.PlayState) error {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	switch state {
+	case player.PlayStatePlaying:
+		if len(pl.tracks) == 0 {
+			pl.Emit(player.PlayStateEvent{State: state})
+			return nil
+		}
+		switch pl.state {
+		case player.PlayStatePaused:
+			pl.state, pl.since = player.PlayStatePlaying, time.Now()
+			pl.schedule()
+			pl.Emit(player.PlayStateEvent{State: pl.state})
+		case player.PlayStateStopped:
+			index := pl.index
+			if index < 0 || index >= len(pl.tracks) {
+				index = 0
+			}
+			pl.play(index)
+		}
+	case player.PlayStatePaused:
+		if pl.state == player.PlayStatePlaying {
+			pl.offset = pl.elapsed()
+			pl.state = player.PlayStatePaused
+			pl.schedule()
+			pl.Emit(player.PlayStateEvent{State: pl.state})
+		}
+	case player.PlayStateStopped:
+		pl.stop(false)
+	default:
+		return fmt.Errorf("unknown play state %q", state)
+	}
+	return nil
+}
+
+// SetVolume implements the player.Player interface.
+func (pl *Player) SetVolume(ctx context.Context, vol int) error {
+	if vol > 100 {
+		vol = 100
+	} else if vol < 0 {
+		vol = 0
+	}
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.volume = vol
+	pl.Emit(player.VolumeEvent{Volume: vol})
+	return nil
+}
+
+// Playlist implements the player.Player interface.
+func (pl *Player) Playlist() player.Playlist[player.MetaTrack] {
+	return &pl.playlist
+}
+
+// Events implements the player.Player interface.
+func (pl *Player) Events() *util.Emitter {
+	return &pl.Emitter
+}
+
+func (pl *Player) String() string {
+	return fmt.Sprintf("Virtual{%v}", pl.lib)
+}
+
+type virtualPlaylist struct {
+	player *Player
+}
+
+func (plist virtualPlaylist) Insert(ctx context.Context, pos int, tracks ...library.Track) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+	pl := plist.player
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	if pos == -1 || pos > len(pl.tracks) {
+		pos = len(pl.tracks)
+	} else if pos < 0 {
+		return fmt.Errorf("invalid insert position: %d", pos)
+	}
+	wasEmpty := len(pl.tracks) == 0
+	newTracks := make([]library.Track, 0, len(pl.tracks)+len(tracks))
+	newTracks = append(newTracks, pl.tracks[:pos]...)
+	newTracks = append(newTracks, tracks...)
+	newTracks = append(newTracks, pl.tracks[pos:]...)
+	pl.tracks = newTracks
+	if pl.index >= pos {
+		pl.index += len(tracks)
+	}
+
+	if wasEmpty {
+		// Play the first track if the playlist was empty, just like the MPD
+		// backend does.
+		pl.play(0)
+		return nil
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: pl.index})
+	return nil
+}
+
+func (plist virtualPlaylist) Move(ctx context.Context, fromPos, toPos int) error {
+	pl := plist.player
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	if fromPos < 0 || fromPos >= len(pl.tracks) || toPos < 0 || toPos >= len(pl.tracks) {
+		return fmt.Errorf("move out of range: %d -> %d", fromPos, toPos)
+	}
+
+	track := pl.tracks[fromPos]
+	pl.tracks = append(pl.tracks[:fromPos], pl.tracks[fromPos+1:]...)
+	pl.tracks = append(pl.tracks[:toPos], append([]library.Track{track}, pl.tracks[toPos:]...)...)
+	switch {
+	case pl.index == fromPos:
+		pl.index = toPos
+	case fromPos < pl.index && pl.index <= toPos:
+		pl.index--
+	case toPos <= pl.index && pl.index < fromPos:
+		pl.index++
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: pl.index})
+	return nil
+}
+
+func (plist virtualPlaylist) Remove(ctx context.Context, positions ...int) error {
+	pl := plist.player
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	sorted := append([]int{}, positions...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	removedCurrent := false
+	prev := -1
+	for _, pos := range sorted {
+		if pos < 0 || pos >= len(pl.tracks) || pos == prev {
+			continue
+		}
+		prev = pos
+		pl.tracks = append(pl.tracks[:pos], pl.tracks[pos+1:]...)
+		if pos < pl.index {
+			pl.index--
+		} else if pos == pl.index {
+			removedCurrent = true
+		}
+	}
+
+	if removedCurrent {
+		// Continue with the track that followed the removed one.
+		if pl.state == player.PlayStateStopped {
+			if pl.index >= len(pl.tracks) {
+				pl.index = -1
+			}
+		} else if pl.state == player.PlayStatePlaying {
+			pl.play(pl.index)
+			return nil
+		} else if pl.index < len(pl.tracks) {
+			pl.offset = 0
+		} else {
+			pl.stop(true)
+			return nil
+		}
+	}
+	pl.Emit(player.PlaylistEvent{TrackIndex: pl.index})
+	return nil
+}
+
+func (plist virtualPlaylist) Tracks(ctx context.Context) ([]library.Track, error) {
+	plist.player.lock.Lock()
+	defer plist.player.lock.Unlock()
+	return append([]library.Track{}, plist.player.tracks...), nil
+}
+
+func (plist virtualPlaylist) Len(ctx context.Context) (int, error) {
+	plist.player.lock.Lock()
+	defer plist.player.lock.Unlock()
+	return len(plist.player.tracks), nil
+}
@@ -0,0 +1,191 @@
+package virtual
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"trollibox/src/library"
+	"trollibox/src/player"
+	"trollibox/src/util"
+)
+
+func testLibrary(duration time.Duration) *Library {
+	return NewLibrary(
+		library.Track{URI: "virtual://a.mp3", Title: "Track A", Duration: duration},
+		library.Track{URI: "virtual://b.mp3", Title: "Track B", Duration: duration},
+		library.Track{URI: "virtual://c.mp3", Title: "Track C", Duration: duration},
+		library.Track{URI: "virtual://d.mp3", Title: "Track D", Duration: duration},
+	)
+}
+
+func TestPlayerImplementation(t *testing.T) {
+	player.TestPlayerImplementation(t, New(testLibrary(time.Minute)))
+}
+
+func TestPlaylistImplementation(t *testing.T) {
+	pl := New(testLibrary(time.Minute))
+	tracks, err := pl.Library().Tracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaTracks := make([]player.MetaTrack, 3)
+	for i, t := range tracks[:len(metaTracks)] {
+		metaTracks[i].Track = t
+		metaTracks[i].QueuedBy = "system"
+	}
+
+	player.TestPlaylistImplementation[player.MetaTrack](t, pl.Playlist(), metaTracks)
+}
+
+func TestPlayback(t *testing.T) {
+	ctx := context.Background()
+	lib := testLibrary(200 * time.Millisecond)
+	pl := New(lib)
+
+	util.TestEventEmission(t, pl, player.PlaylistEvent{TrackIndex: 1}, func() {
+		if err := pl.playlist.Playlist.Insert(ctx, -1, lib.tracks[:2]...); err != nil {
+			t.Fatal(err)
+		}
+	})
+	status, err := pl.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TrackIndex != 1 || status.PlayState != player.PlayStatePlaying {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if status.Time < 0 || status.Time > 200*time.Millisecond {
+		t.Fatalf("unexpected time: %v", status.Time)
+	}
+
+	util.TestEventEmission(t, pl, player.PlayStateEvent{State: player.PlayStateStopped}, func() {})
+	status, err = pl.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TrackIndex != -1 || status.PlayState != player.PlayStateStopped {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx := context.Background()
+	lib := testLibrary(200 * time.Millisecond)
+	pl := New(lib)
+	if err := pl.playlist.Playlist.Insert(ctx, -1, lib.tracks...); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.SetState(ctx, player.PlayStatePaused); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	status, err := pl.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TrackIndex != 0 || status.PlayState != player.PlayStatePaused {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	files := map[string]string{
+		"Artist A - Title A.mp3":            "",
+		"album/01 - Artist B - Title B.ogg": "",
+		"album/cover.jpg":                   "jpeg",
+		"notes.txt":                         "",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib, err := LoadLibrary(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := lib.Tracks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("unexpected tracks: %v", tracks)
+	}
+	byURI := map[string]library.Track{}
+	for _, track := range tracks {
+		byURI[track.URI] = track
+	}
+	trackA, ok := byURI["virtual://Artist A - Title A.mp3"]
+	if !ok || trackA.Artist != "Artist A" || trackA.Title != "Title A" || trackA.Duration != DefaultDuration {
+		t.Fatalf("unexpected track: %+v", trackA)
+	}
+
+	art, err := lib.TrackArt(ctx, "virtual://album/01 - Artist B - Title B.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(art.ImageData) != "jpeg" || art.MimeType != "image/jpeg" {
+		t.Fatalf("unexpected art: %#v", art)
+	}
+	if _, err := lib.TrackArt(ctx, trackA.URI); err != library.ErrNoArt {
+		t.Fatalf("expected ErrNoArt, got %v", err)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	manifest := `{"tracks": [
+		{"uri": "demo://one", "title": "One", "artist": "Someone", "duration": 90.5, "art": "one.png"},
+		{"uri": "demo://two", "title": "Two"}
+	]}`
+	if err := os.WriteFile(filepath.Join(dir, "library.json"), []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "one.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := LoadLibrary(filepath.Join(dir, "library.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := lib.TrackInfo(ctx, "demo://one", "demo://two", "demo://three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	durations := []time.Duration{tracks[0].Duration, tracks[1].Duration, tracks[2].Duration}
+	if expect := []time.Duration{90500 * time.Millisecond, time.Minute, 0}; !reflect.DeepEqual(durations, expect) {
+		t.Fatalf("unexpected durations: %v != %v", expect, durations)
+	}
+	if tracks[0].Artist != "Someone" || tracks[1].Title != "Two" || tracks[2].URI != "" {
+		t.Fatalf("unexpected tracks: %+v", tracks)
+	}
+
+	art, err := lib.TrackArt(ctx, "demo://one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(art.ImageData) != "png" || art.MimeType != "image/png" {
+		t.Fatalf("unexpected art: %#v", art)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{"tracks": [{"title": "No URI"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLibrary(filepath.Join(dir, "invalid.json"), 0); err == nil {
+		t.Fatal("expected an error for a track without uri")
+	}
+}
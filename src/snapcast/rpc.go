@@ -0,0 +1,198 @@
+package snapcast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"trollibox/src/player"
+)
+
+// An RPCError is an error returned by the JSON-RPC API of Snapserver.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (err *RPCError) Error() string {
+	return fmt.Sprintf("snapcast: %s (%d)", err.Message, err.Code)
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      int64       `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// rpcMessage is either a response to a request or a notification.
+type rpcMessage struct {
+	ID     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// rpcConn is a JSON-RPC connection to the TCP control interface of
+// Snapserver. Messages are separated by newlines and notifications are sent
+// over the same connection as the responses to requests.
+type rpcConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	lock      sync.Mutex
+	nextID    int64
+	pending   map[int64]chan rpcMessage
+	closedErr error
+}
+
+func dialRPC(ctx context.Context, network, address string) (*rpcConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcConn{conn: conn, pending: map[int64]chan rpcMessage{}}, nil
+}
+
+// readLoop reads messages until the connection is closed and passes all
+// notifications to the handler. Outstanding calls fail once the connection is
+// closed.
+func (rc *rpcConn) readLoop(onNotification func(method string, params json.RawMessage)) error {
+	decoder := json.NewDecoder(rc.conn)
+	var err error
+	for {
+		var msg rpcMessage
+		if err = decoder.Decode(&msg); err != nil {
+			break
+		}
+		if msg.ID == nil {
+			onNotification(msg.Method, msg.Params)
+			continue
+		}
+		rc.lock.Lock()
+		ch, ok := rc.pending[*msg.ID]
+		delete(rc.pending, *msg.ID)
+		rc.lock.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+
+	if err == io.EOF {
+		err = fmt.Errorf("connection closed by Snapserver")
+	}
+	rc.lock.Lock()
+	rc.closedErr = err
+	for id, ch := range rc.pending {
+		close(ch)
+		delete(rc.pending, id)
+	}
+	rc.lock.Unlock()
+	rc.conn.Close()
+	return err
+}
+
+func (rc *rpcConn) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	rc.lock.Lock()
+	if rc.closedErr != nil {
+		rc.lock.Unlock()
+		return fmt.Errorf("error connecting to Snapserver: %v / %w", rc.closedErr, player.ErrUnavailable)
+	}
+	rc.nextID++
+	id := rc.nextID
+	ch := make(chan rpcMessage, 1)
+	rc.pending[id] = ch
+	rc.lock.Unlock()
+
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err == nil {
+		_ = rc.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		rc.writeLock.Lock()
+		_, err = rc.conn.Write(append(body, '\n'))
+		rc.writeLock.Unlock()
+	}
+	if err != nil {
+		rc.lock.Lock()
+		delete(rc.pending, id)
+		rc.lock.Unlock()
+		return err
+	}
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return fmt.Errorf("error connecting to Snapserver: %s: connection closed / %w", method, player.ErrUnavailable)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%s: %w", method, msg.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	case <-ctx.Done():
+		rc.lock.Lock()
+		delete(rc.pending, id)
+		rc.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (rc *rpcConn) Close() error {
+	return rc.conn.Close()
+}
+
+// rpcClient maintains a connection to Snapserver and reconnects when it is
+// lost.
+type rpcClient struct {
+	network, address string
+	onNotification   func(method string, params json.RawMessage)
+	// Called after the connection has been restored.
+	onReconnect func()
+
+	lock sync.Mutex
+	conn *rpcConn
+	err  error
+}
+
+// run keeps the connection to Snapserver open.
+func (client *rpcClient) run(conn *rpcConn) {
+	for {
+		err := conn.readLoop(client.onNotification)
+		slog.Debug("Snapserver connection closed", "address", client.address, "error", err)
+
+		for {
+			// Limit the number of reconnection attempts to one per second.
+			time.Sleep(time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			conn, err = dialRPC(ctx, client.network, client.address)
+			cancel()
+			client.lock.Lock()
+			client.conn, client.err = conn, err
+			client.lock.Unlock()
+			if err == nil {
+				break
+			}
+			slog.Debug("Could not connect to Snapserver", "address", client.address, "error", err)
+		}
+		client.onReconnect()
+	}
+}
+
+func (client *rpcClient) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	client.lock.Lock()
+	conn, err := client.conn, client.err
+	client.lock.Unlock()
+	if conn == nil {
+		return fmt.Errorf("error connecting to Snapserver: %v / %w", err, player.ErrUnavailable)
+	}
+	return conn.call(ctx, method, params, result)
+}
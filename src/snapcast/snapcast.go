@@ -0,0 +1,344 @@
+// Package snapcast implements a client for the control interface of
+// Snapserver, the server of the Snapcast multi-room audio system.
+//
+// Players whose output is fed into Snapcast are attached to a Snapcast stream,
+// the clients that are listening to that stream are the speakers of the
+// player. Their volume can be controlled individually and they can be moved
+// between streams.
+package snapcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"trollibox/src/util"
+)
+
+var (
+	// ErrClientNotFound is returned when a client is not known to Snapserver.
+	ErrClientNotFound = errors.New("snapcast client not found")
+	// ErrStreamNotFound is returned when a stream is not known to Snapserver.
+	ErrStreamNotFound = errors.New("snapcast stream not found")
+)
+
+// A ClientVolumeEvent is emitted when the volume of a client has changed.
+type ClientVolumeEvent struct {
+	ClientID string
+	Volume   int
+	Muted    bool
+}
+
+// An UpdateEvent is emitted when the clients, groups or streams of the server
+// have changed.
+type UpdateEvent struct{}
+
+// A Client is a device that plays audio from one of the streams.
+type Client struct {
+	ID        string
+	Name      string
+	Host      string
+	Connected bool
+	Volume    int
+	Muted     bool
+	// Clients in the same group play the same stream in sync.
+	GroupID  string
+	StreamID string
+}
+
+// A Stream is a source of audio, like the output of an MPD instance.
+type Stream struct {
+	ID     string
+	Status string
+}
+
+// Status is a snapshot of the clients and streams of a server.
+type Status struct {
+	Clients []Client
+	Streams []Stream
+}
+
+type volume struct {
+	Muted   bool `json:"muted"`
+	Percent int  `json:"percent"`
+}
+
+type serverStatus struct {
+	Server struct {
+		Groups []struct {
+			ID       string `json:"id"`
+			StreamID string `json:"stream_id"`
+			Clients  []struct {
+				ID        string `json:"id"`
+				Connected bool   `json:"connected"`
+				Config    struct {
+					Name   string `json:"name"`
+					Volume volume `json:"volume"`
+				} `json:"config"`
+				Host struct {
+					Name string `json:"name"`
+					IP   string `json:"ip"`
+				} `json:"host"`
+			} `json:"clients"`
+		} `json:"groups"`
+		Streams []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"streams"`
+	} `json:"server"`
+}
+
+func (ss *serverStatus) status() *Status {
+	status := &Status{Clients: []Client{}, Streams: []Stream{}}
+	for _, group := range ss.Server.Groups {
+		for _, c := range group.Clients {
+			client := Client{
+				ID:        c.ID,
+				Name:      c.Config.Name,
+				Host:      c.Host.Name,
+				Connected: c.Connected,
+				Volume:    c.Config.Volume.Percent,
+				Muted:     c.Config.Volume.Muted,
+				GroupID:   group.ID,
+				StreamID:  group.StreamID,
+			}
+			if client.Name == "" {
+				client.Name = client.Host
+			}
+			status.Clients = append(status.Clients, client)
+		}
+	}
+	for _, stream := range ss.Server.Streams {
+		status.Streams = append(status.Streams, Stream{ID: stream.ID, Status: stream.Status})
+	}
+	sort.Slice(status.Clients, func(i, j int) bool {
+		return status.Clients[i].Name < status.Clients[j].Name
+	})
+	return status
+}
+
+// Server is a connection to a Snapserver.
+type Server struct {
+	util.Emitter
+
+	address string
+	// Maps player names to stream IDs.
+	streams map[string]string
+
+	rpc rpcClient
+}
+
+// Connect connects to the JSON-RPC TCP interface of a Snapserver, which
+// listens on port 1705 by default.
+//
+// The streams map the names of players to the IDs of the streams they feed.
+// Players that are not listed are assumed to feed the stream with the same
+// name.
+func Connect(network, address string, streams map[string]string) (*Server, error) {
+	server := &Server{
+		Emitter: util.Emitter{Release: time.Millisecond * 100},
+		address: address,
+		streams: streams,
+	}
+	server.rpc = rpcClient{
+		network:        network,
+		address:        address,
+		onNotification: server.handleNotification,
+		onReconnect: func() {
+			// Changes may have been missed while disconnected.
+			server.Emit(UpdateEvent{})
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialRPC(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	server.rpc.conn = conn
+	go server.rpc.run(conn)
+
+	// Test the connection.
+	if err := server.rpc.call(ctx, "Server.GetRPCVersion", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+func (server *Server) handleNotification(method string, params json.RawMessage) {
+	switch method {
+	case "Client.OnVolumeChanged":
+		var p struct {
+			ID     string `json:"id"`
+			Volume volume `json:"volume"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return
+		}
+		server.Emit(ClientVolumeEvent{ClientID: p.ID, Volume: p.Volume.Percent, Muted: p.Volume.Muted})
+	case "Client.OnConnect", "Client.OnDisconnect", "Client.OnNameChanged",
+		"Group.OnMute", "Group.OnStreamChanged", "Group.OnNameChanged",
+		"Server.OnUpdate", "Stream.OnUpdate":
+		server.Emit(UpdateEvent{})
+	}
+}
+
+// PlayerStream returns the ID of the stream that is fed by the named player.
+func (server *Server) PlayerStream(playerName string) string {
+	if stream, ok := server.streams[playerName]; ok {
+		return stream
+	}
+	return playerName
+}
+
+func (server *Server) serverStatus(ctx context.Context) (*serverStatus, error) {
+	var ss serverStatus
+	if err := server.rpc.call(ctx, "Server.GetStatus", nil, &ss); err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+// Status returns the clients and streams of the server.
+func (server *Server) Status(ctx context.Context) (*Status, error) {
+	ss, err := server.serverStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ss.status(), nil
+}
+
+// SetClientVolume sets the volume of a client in the range 0 to 100.
+func (server *Server) SetClientVolume(ctx context.Context, clientID string, vol int, muted bool) error {
+	if vol > 100 {
+		vol = 100
+	} else if vol < 0 {
+		vol = 0
+	}
+	// Snapserver does not tell unknown clients apart from other errors.
+	status, err := server.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := status.client(clientID); !ok {
+		return fmt.Errorf("%w: %q", ErrClientNotFound, clientID)
+	}
+	if err := server.rpc.call(ctx, "Client.SetVolume", map[string]interface{}{
+		"id":     clientID,
+		"volume": volume{Percent: vol, Muted: muted},
+	}, nil); err != nil {
+		return err
+	}
+	// Snapserver only notifies the other connections of the change.
+	server.Emit(ClientVolumeEvent{ClientID: clientID, Volume: vol, Muted: muted})
+	return nil
+}
+
+// SetClientStream makes a client play the specified stream.
+//
+// Snapcast assigns streams to groups of clients rather than to individual
+// clients. The client joins the group that is already playing the stream if
+// there is one, otherwise it is moved to a group of its own.
+func (server *Server) SetClientStream(ctx context.Context, clientID, streamID string) error {
+	if err := server.setClientStream(ctx, clientID, streamID); err != nil {
+		return err
+	}
+	// Snapserver only notifies the other connections of the change.
+	server.Emit(UpdateEvent{})
+	return nil
+}
+
+func (server *Server) setClientStream(ctx context.Context, clientID, streamID string) error {
+	ss, err := server.serverStatus(ctx)
+	if err != nil {
+		return err
+	}
+	status := ss.status()
+	if !status.hasStream(streamID) {
+		return fmt.Errorf("%w: %q", ErrStreamNotFound, streamID)
+	}
+	client, ok := status.client(clientID)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrClientNotFound, clientID)
+	}
+	if client.StreamID == streamID {
+		return nil
+	}
+
+	for _, group := range ss.Server.Groups {
+		if group.StreamID == streamID {
+			clients := status.groupClients(group.ID)
+			return server.rpc.call(ctx, "Group.SetClients", map[string]interface{}{
+				"id":      group.ID,
+				"clients": append(clients, clientID),
+			}, nil)
+		}
+	}
+
+	groupID := client.GroupID
+	if clients := status.groupClients(groupID); len(clients) > 1 {
+		// Clients that are removed from a group are put in a new group.
+		remaining := make([]string, 0, len(clients)-1)
+		for _, id := range clients {
+			if id != clientID {
+				remaining = append(remaining, id)
+			}
+		}
+		var ss serverStatus
+		if err := server.rpc.call(ctx, "Group.SetClients", map[string]interface{}{
+			"id":      groupID,
+			"clients": remaining,
+		}, &ss); err != nil {
+			return err
+		}
+		if client, ok = ss.status().client(clientID); !ok {
+			return fmt.Errorf("%w: %q", ErrClientNotFound, clientID)
+		}
+		groupID = client.GroupID
+	}
+	return server.rpc.call(ctx, "Group.SetStream", map[string]interface{}{
+		"id":        groupID,
+		"stream_id": streamID,
+	}, nil)
+}
+
+// Events returns the emitter of ClientVolumeEvent and UpdateEvent.
+func (server *Server) Events() *util.Emitter {
+	return &server.Emitter
+}
+
+func (server *Server) String() string {
+	return fmt.Sprintf("Snapcast{%s}", server.address)
+}
+
+func (status *Status) client(id string) (Client, bool) {
+	for _, client := range status.Clients {
+		if client.ID == id {
+			return client, true
+		}
+	}
+	return Client{}, false
+}
+
+func (status *Status) groupClients(groupID string) []string {
+	var ids []string
+	for _, client := range status.Clients {
+		if client.GroupID == groupID {
+			ids = append(ids, client.ID)
+		}
+	}
+	return ids
+}
+
+func (status *Status) hasStream(id string) bool {
+	for _, stream := range status.Streams {
+		if stream.ID == id {
+			return true
+		}
+	}
+	return false
+}
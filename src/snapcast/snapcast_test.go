@@ -0,0 +1,363 @@
+package snapcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"trollibox/src/util"
+)
+
+type fakeClient struct {
+	id     string
+	name   string
+	volume volume
+}
+
+type fakeGroup struct {
+	id       string
+	streamID string
+	clients  []fakeClient
+}
+
+// fakeSnapserver implements the parts of the JSON-RPC API of Snapserver that
+// are used by the client.
+type fakeSnapserver struct {
+	lock      sync.Mutex
+	groups    []*fakeGroup
+	streams   []string
+	nextGroup int
+	conns     map[*json.Encoder]struct{}
+}
+
+func newFakeSnapserver(t *testing.T) (*fakeSnapserver, net.Listener) {
+	fake := &fakeSnapserver{
+		groups: []*fakeGroup{
+			{id: "g1", streamID: "space", clients: []fakeClient{
+				{id: "c1", name: "Kitchen", volume: volume{Percent: 50}},
+				{id: "c2", name: "Hallway", volume: volume{Percent: 60}},
+			}},
+			{id: "g2", streamID: "radio", clients: []fakeClient{
+				{id: "c3", name: "Lounge", volume: volume{Percent: 70, Muted: true}},
+			}},
+		},
+		streams:   []string{"space", "radio", "idle"},
+		nextGroup: 3,
+		conns:     map[*json.Encoder]struct{}{},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake, listener
+}
+
+func (fake *fakeSnapserver) serve(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	fake.lock.Lock()
+	fake.conns[encoder] = struct{}{}
+	fake.lock.Unlock()
+	defer func() {
+		fake.lock.Lock()
+		delete(fake.conns, encoder)
+		fake.lock.Unlock()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var req struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+		result, err := fake.handle(req.Method, req.Params)
+		fake.lock.Lock()
+		if err != nil {
+			_ = encoder.Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      req.ID,
+				"error":   map[string]interface{}{"code": -32603, "message": "Internal error", "data": err.Error()},
+			})
+		} else {
+			_ = encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+		}
+		fake.lock.Unlock()
+	}
+}
+
+// notify sends a notification to all connections, like Snapserver does when
+// the state is changed by another control client.
+func (fake *fakeSnapserver) notify(method string, params interface{}) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for encoder := range fake.conns {
+		_ = encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+	}
+}
+
+func (fake *fakeSnapserver) handle(method string, rawParams json.RawMessage) (interface{}, error) {
+	var params struct {
+		ID       string   `json:"id"`
+		Volume   volume   `json:"volume"`
+		Clients  []string `json:"clients"`
+		StreamID string   `json:"stream_id"`
+	}
+	if len(rawParams) > 0 {
+		if err := json.Unmarshal(rawParams, &params); err != nil {
+			return nil, err
+		}
+	}
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	switch method {
+	case "Server.GetRPCVersion":
+		return map[string]int{"major": 2, "minor": 0, "patch": 0}, nil
+	case "Server.GetStatus":
+		return fake.status(), nil
+	case "Client.SetVolume":
+		for _, group := range fake.groups {
+			for i, client := range group.clients {
+				if client.id == params.ID {
+					group.clients[i].volume = params.Volume
+					return map[string]interface{}{"volume": params.Volume}, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("client not found")
+	case "Group.SetStream":
+		group := fake.group(params.ID)
+		if group == nil {
+			return nil, fmt.Errorf("group not found")
+		}
+		group.streamID = params.StreamID
+		return map[string]string{"stream_id": group.streamID}, nil
+	case "Group.SetClients":
+		group := fake.group(params.ID)
+		if group == nil {
+			return nil, fmt.Errorf("group not found")
+		}
+		// Clients that are no longer listed are put in new groups of their
+		// own, listed clients are taken from their current groups.
+		wanted := map[string]bool{}
+		for _, id := range params.Clients {
+			wanted[id] = true
+		}
+		var kept []fakeClient
+		for _, client := range group.clients {
+			if wanted[client.id] {
+				kept = append(kept, client)
+				delete(wanted, client.id)
+				continue
+			}
+			fake.groups = append(fake.groups, &fakeGroup{
+				id:       fmt.Sprintf("g%d", fake.nextGroup),
+				streamID: group.streamID,
+				clients:  []fakeClient{client},
+			})
+			fake.nextGroup++
+		}
+		for _, other := range fake.groups {
+			if other == group {
+				continue
+			}
+			var remaining []fakeClient
+			for _, client := range other.clients {
+				if wanted[client.id] {
+					kept = append(kept, client)
+				} else {
+					remaining = append(remaining, client)
+				}
+			}
+			other.clients = remaining
+		}
+		group.clients = kept
+		var groups []*fakeGroup
+		for _, g := range fake.groups {
+			if len(g.clients) > 0 {
+				groups = append(groups, g)
+			}
+		}
+		fake.groups = groups
+		return fake.status(), nil
+	}
+	return nil, fmt.Errorf("method not found: %s", method)
+}
+
+func (fake *fakeSnapserver) group(id string) *fakeGroup {
+	for _, group := range fake.groups {
+		if group.id == id {
+			return group
+		}
+	}
+	return nil
+}
+
+func (fake *fakeSnapserver) status() interface{} {
+	groups := []interface{}{}
+	for _, group := range fake.groups {
+		clients := []interface{}{}
+		for _, client := range group.clients {
+			clients = append(clients, map[string]interface{}{
+				"id":        client.id,
+				"connected": true,
+				"config":    map[string]interface{}{"name": "", "volume": client.volume},
+				"host":      map[string]interface{}{"name": client.name, "ip": "127.0.0.1"},
+			})
+		}
+		groups = append(groups, map[string]interface{}{
+			"id":        group.id,
+			"muted":     false,
+			"stream_id": group.streamID,
+			"clients":   clients,
+		})
+	}
+	streams := []interface{}{}
+	for _, id := range fake.streams {
+		streams = append(streams, map[string]interface{}{"id": id, "status": "playing"})
+	}
+	return map[string]interface{}{
+		"server": map[string]interface{}{"groups": groups, "streams": streams},
+	}
+}
+
+func testServer(t *testing.T) (*fakeSnapserver, *Server) {
+	fake, listener := newFakeSnapserver(t)
+	server, err := Connect("tcp", listener.Addr().String(), map[string]string{"mpd": "space"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, server
+}
+
+func clientStreams(t *testing.T, server *Server) map[string]string {
+	t.Helper()
+	status, err := server.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := map[string]string{}
+	for _, client := range status.Clients {
+		streams[client.ID] = client.StreamID
+	}
+	return streams
+}
+
+func TestStatus(t *testing.T) {
+	_, server := testServer(t)
+	status, err := server.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Status{
+		Clients: []Client{
+			{ID: "c2", Name: "Hallway", Host: "Hallway", Connected: true, Volume: 60, GroupID: "g1", StreamID: "space"},
+			{ID: "c1", Name: "Kitchen", Host: "Kitchen", Connected: true, Volume: 50, GroupID: "g1", StreamID: "space"},
+			{ID: "c3", Name: "Lounge", Host: "Lounge", Connected: true, Volume: 70, Muted: true, GroupID: "g2", StreamID: "radio"},
+		},
+		Streams: []Stream{{ID: "space", Status: "playing"}, {ID: "radio", Status: "playing"}, {ID: "idle", Status: "playing"}},
+	}
+	if !reflect.DeepEqual(status, expect) {
+		t.Fatalf("unexpected status:\n%+v\n%+v", expect, status)
+	}
+
+	if stream := server.PlayerStream("mpd"); stream != "space" {
+		t.Fatalf("unexpected stream for mapped player: %q", stream)
+	}
+	if stream := server.PlayerStream("radio"); stream != "radio" {
+		t.Fatalf("unexpected stream for unmapped player: %q", stream)
+	}
+}
+
+func TestSetClientVolume(t *testing.T) {
+	ctx := context.Background()
+	_, server := testServer(t)
+
+	util.TestEventEmission(t, server, ClientVolumeEvent{ClientID: "c1", Volume: 100, Muted: true}, func() {
+		if err := server.SetClientVolume(ctx, "c1", 150, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+	status, err := server.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, _ := status.client("c1"); client.Volume != 100 || !client.Muted {
+		t.Fatalf("unexpected client: %+v", client)
+	}
+
+	if err := server.SetClientVolume(ctx, "nope", 10, false); !errors.Is(err, ErrClientNotFound) {
+		t.Fatalf("expected ErrClientNotFound, got %v", err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	fake, server := testServer(t)
+
+	util.TestEventEmission(t, server, ClientVolumeEvent{ClientID: "c3", Volume: 42}, func() {
+		fake.notify("Client.OnVolumeChanged", map[string]interface{}{
+			"id":     "c3",
+			"volume": map[string]interface{}{"percent": 42, "muted": false},
+		})
+	})
+	util.TestEventEmission(t, server, UpdateEvent{}, func() {
+		fake.notify("Group.OnStreamChanged", map[string]interface{}{"id": "g2", "stream_id": "idle"})
+	})
+}
+
+func TestSetClientStream(t *testing.T) {
+	ctx := context.Background()
+	_, server := testServer(t)
+
+	// Join the group that is already playing the stream.
+	util.TestEventEmission(t, server, UpdateEvent{}, func() {
+		if err := server.SetClientStream(ctx, "c3", "space"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if expect, streams := map[string]string{"c1": "space", "c2": "space", "c3": "space"}, clientStreams(t, server); !reflect.DeepEqual(expect, streams) {
+		t.Fatalf("unexpected streams: %v != %v", expect, streams)
+	}
+
+	// Split a client from its group.
+	if err := server.SetClientStream(ctx, "c2", "radio"); err != nil {
+		t.Fatal(err)
+	}
+	if expect, streams := map[string]string{"c1": "space", "c2": "radio", "c3": "space"}, clientStreams(t, server); !reflect.DeepEqual(expect, streams) {
+		t.Fatalf("unexpected streams: %v != %v", expect, streams)
+	}
+
+	// Change the stream of a client that has a group of its own.
+	if err := server.SetClientStream(ctx, "c2", "idle"); err != nil {
+		t.Fatal(err)
+	}
+	if expect, streams := map[string]string{"c1": "space", "c2": "idle", "c3": "space"}, clientStreams(t, server); !reflect.DeepEqual(expect, streams) {
+		t.Fatalf("unexpected streams: %v != %v", expect, streams)
+	}
+
+	if err := server.SetClientStream(ctx, "c1", "nope"); !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("expected ErrStreamNotFound, got %v", err)
+	}
+	if err := server.SetClientStream(ctx, "nope", "space"); !errors.Is(err, ErrClientNotFound) {
+		t.Fatalf("expected ErrClientNotFound, got %v", err)
+	}
+}